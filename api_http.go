@@ -8,6 +8,7 @@ import (
 	"io"
 	"net/http"
 	"strings"
+	"time"
 
 	"github.com/urnetwork/connect"
 )
@@ -100,3 +101,85 @@ func httpProviderLocations(ctx context.Context, apiURL, jwt string) (*findLocati
 	}
 	return &out, nil
 }
+
+// networkClientHTTP is one entry of /network/clients.
+type networkClientHTTP struct {
+	ClientID    string    `json:"client_id"`
+	NetworkID   string    `json:"network_id"`
+	Description string    `json:"description"`
+	DeviceSpec  string    `json:"device_spec"`
+	CreateTime  time.Time `json:"create_time"`
+	AuthTime    time.Time `json:"auth_time"`
+	Connections []struct {
+		ConnectionID   string    `json:"connection_id"`
+		ConnectTime    time.Time `json:"connect_time"`
+		ConnectAddress string    `json:"connect_address"`
+	} `json:"connections"`
+}
+
+type networkClientsHTTPResult struct {
+	Clients []*networkClientHTTP `json:"clients"`
+}
+
+type removeNetworkClientHTTPArgs struct {
+	ClientID string `json:"client_id"`
+}
+
+type removeNetworkClientHTTPResult struct {
+	Error *struct {
+		Message string `json:"message"`
+	} `json:"error,omitempty"`
+}
+
+func httpNetworkClients(ctx context.Context, apiURL, jwt string) (*networkClientsHTTPResult, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimRight(apiURL, "/")+"/network/clients", nil)
+	if err != nil {
+		return nil, err
+	}
+	if strings.TrimSpace(jwt) != "" {
+		req.Header.Set("Authorization", "Bearer "+jwt)
+	}
+	resp, err := defaultHTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		data, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("network-clients http %d: %s", resp.StatusCode, string(data))
+	}
+	var out networkClientsHTTPResult
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+func httpRemoveNetworkClient(ctx context.Context, apiURL, jwt, clientID string) error {
+	b, _ := json.Marshal(removeNetworkClientHTTPArgs{ClientID: clientID})
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimRight(apiURL, "/")+"/network/remove-client", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if strings.TrimSpace(jwt) != "" {
+		req.Header.Set("Authorization", "Bearer "+jwt)
+	}
+	resp, err := defaultHTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		data, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("remove-client http %d: %s", resp.StatusCode, string(data))
+	}
+	var out removeNetworkClientHTTPResult
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil && err != io.EOF {
+		return err
+	}
+	if out.Error != nil {
+		return fmt.Errorf("remove-client error: %s", out.Error.Message)
+	}
+	return nil
+}
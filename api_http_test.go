@@ -41,3 +41,47 @@ func TestHttpFindLocationsAndProviderLocations(t *testing.T) {
 		t.Fatalf("httpProviderLocations error: %v", err)
 	}
 }
+
+func TestHttpNetworkClientsAndRemove(t *testing.T) {
+	var removed string
+	mux := http.NewServeMux()
+	mux.HandleFunc("/network/clients", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			t.Fatalf("expected GET")
+		}
+		_, _ = w.Write([]byte(`{"clients":[{"client_id":"c-1","description":"laptop","device_spec":"linux/amd64"}]}`))
+	})
+	mux.HandleFunc("/network/remove-client", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			t.Fatalf("expected POST")
+		}
+		var args removeNetworkClientHTTPArgs
+		_ = json.NewDecoder(r.Body).Decode(&args)
+		removed = args.ClientID
+		if args.ClientID == "missing" {
+			_, _ = w.Write([]byte(`{"error":{"message":"not found"}}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{}`))
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	ctx := context.Background()
+	res, err := httpNetworkClients(ctx, srv.URL, "token")
+	if err != nil {
+		t.Fatalf("httpNetworkClients error: %v", err)
+	}
+	if len(res.Clients) != 1 || res.Clients[0].ClientID != "c-1" || res.Clients[0].Description != "laptop" {
+		t.Fatalf("unexpected clients: %+v", res.Clients)
+	}
+	if err := httpRemoveNetworkClient(ctx, srv.URL, "token", "c-1"); err != nil {
+		t.Fatalf("httpRemoveNetworkClient error: %v", err)
+	}
+	if removed != "c-1" {
+		t.Fatalf("server saw client_id=%q", removed)
+	}
+	if err := httpRemoveNetworkClient(ctx, srv.URL, "token", "missing"); err == nil {
+		t.Fatalf("expected API error to be surfaced")
+	}
+}
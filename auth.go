@@ -4,6 +4,8 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"os"
+	"runtime"
 	"strings"
 	"time"
 
@@ -27,7 +29,7 @@ func newByAPI(ctx context.Context, apiURL, jwt string) *connect.BringYourApi {
 type Authenticator interface {
 	LoginWithPassword(ctx context.Context, apiURL, userAuth, password string) (*LoginResult, error)
 	VerifyCode(ctx context.Context, apiURL, userAuth, code string) (string, error)
-	MintClientJWT(ctx context.Context, apiURL, byJwt string) (string, error)
+	MintClientJWT(ctx context.Context, apiURL, byJwt, description, deviceSpec string) (string, error)
 }
 
 // apiAuthenticator is the production Authenticator backed by the BringYour connect library.
@@ -41,8 +43,8 @@ func (a *apiAuthenticator) VerifyCode(ctx context.Context, apiURL, userAuth, cod
 	return verifyCode(ctx, apiURL, userAuth, code)
 }
 
-func (a *apiAuthenticator) MintClientJWT(ctx context.Context, apiURL, byJwt string) (string, error) {
-	return mintClientJWT(ctx, apiURL, byJwt)
+func (a *apiAuthenticator) MintClientJWT(ctx context.Context, apiURL, byJwt, description, deviceSpec string) (string, error) {
+	return mintClientJWT(ctx, apiURL, byJwt, description, deviceSpec)
 }
 
 // DefaultAuthenticator is the Authenticator used by all production code paths.
@@ -128,11 +130,19 @@ func verifyCode(ctx context.Context, apiURL, userAuth, code string) (string, err
 }
 
 // mintClientJWT exchanges any BY JWT (network- or client-scoped) for a fresh client-scoped JWT.
-func mintClientJWT(ctx context.Context, apiURL, byJwt string) (string, error) {
+// description and deviceSpec label the new network client; empty values fall back to
+// defaultClientDescription and defaultDeviceSpec so clients are never anonymous.
+func mintClientJWT(ctx context.Context, apiURL, byJwt, description, deviceSpec string) (string, error) {
 	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
 	defer cancel()
+	if strings.TrimSpace(description) == "" {
+		description = defaultClientDescription()
+	}
+	if strings.TrimSpace(deviceSpec) == "" {
+		deviceSpec = defaultDeviceSpec()
+	}
 	api := newByAPI(ctx, apiURL, byJwt)
-	res, err := api.AuthNetworkClientSync(&connect.AuthNetworkClientArgs{Description: "", DeviceSpec: ""})
+	res, err := api.AuthNetworkClientSync(&connect.AuthNetworkClientArgs{Description: description, DeviceSpec: deviceSpec})
 	if err != nil {
 		return "", err
 	}
@@ -144,3 +154,18 @@ func mintClientJWT(ctx context.Context, apiURL, byJwt string) (string, error) {
 	}
 	return res.ByClientJwt, nil
 }
+
+// defaultClientDescription returns the description used for minted clients when none is given,
+// e.g. "urnet-client@laptop".
+func defaultClientDescription() string {
+	if host, err := os.Hostname(); err == nil && strings.TrimSpace(host) != "" {
+		return "urnet-client@" + host
+	}
+	return "urnet-client"
+}
+
+// defaultDeviceSpec returns the device spec used for minted clients when none is given,
+// e.g. "urnet-client 0.1.0 linux/amd64".
+func defaultDeviceSpec() string {
+	return fmt.Sprintf("urnet-client %s %s/%s", Version, runtime.GOOS, runtime.GOARCH)
+}
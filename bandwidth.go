@@ -0,0 +1,343 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/time/rate"
+	"gopkg.in/yaml.v3"
+)
+
+// byteRate is a bandwidth in bytes per second; 0 means unlimited.
+type byteRate float64
+
+// parseByteRate parses a rate such as "10mbit", "512kbit", "2MB" or "1.5MiB" (per
+// second). Bit units end in "bit" or "bps"; byte units end in "B". Prefixes k, m, g are
+// decimal and ki, mi, gi binary. A bare number is bytes per second. "" and "0" mean
+// unlimited.
+func parseByteRate(s string) (byteRate, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	if s == "" {
+		return 0, nil
+	}
+	i := strings.IndexFunc(s, func(r rune) bool { return (r < '0' || r > '9') && r != '.' })
+	num, unit := s, ""
+	if i >= 0 {
+		num, unit = s[:i], strings.TrimSpace(s[i:])
+	}
+	n, err := strconv.ParseFloat(num, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("want a rate such as 10mbit or 2MB")
+	}
+	bits := false
+	switch {
+	case strings.HasSuffix(unit, "bit"):
+		unit, bits = strings.TrimSuffix(unit, "bit"), true
+	case strings.HasSuffix(unit, "bps"):
+		unit, bits = strings.TrimSuffix(unit, "bps"), true
+	case strings.HasSuffix(unit, "b"):
+		unit = strings.TrimSuffix(unit, "b")
+	}
+	mult, ok := map[string]float64{"": 1, "k": 1e3, "m": 1e6, "g": 1e9, "ki": 1 << 10, "mi": 1 << 20, "gi": 1 << 30}[unit]
+	if !ok {
+		return 0, fmt.Errorf("unknown unit in %q; want e.g. kbit, mbit, KB, MB", s)
+	}
+	n *= mult
+	if bits {
+		n /= 8
+	}
+	return byteRate(n), nil
+}
+
+// String formats r in bits per second ("10mbit"), which parseByteRate reads back.
+func (r byteRate) String() string {
+	bits := float64(r) * 8
+	for _, u := range []struct {
+		mult float64
+		name string
+	}{{1e9, "gbit"}, {1e6, "mbit"}, {1e3, "kbit"}} {
+		if bits >= u.mult {
+			return strconv.FormatFloat(bits/u.mult, 'f', -1, 64) + u.name
+		}
+	}
+	return strconv.FormatFloat(bits, 'f', -1, 64) + "bit"
+}
+
+// bandwidthClass limits the clients of one SOCKS source range or user. A CIDR class
+// gives every source address in its ranges its own bucket; a user class gives all of the
+// user's connections one shared bucket.
+type bandwidthClass struct {
+	CIDRs    []*net.IPNet
+	User     string
+	Upload   byteRate
+	Download byteRate
+}
+
+// bandwidthOptions configures SOCKS bandwidth shaping. Every connection draws from the
+// global buckets, the first CIDR class matching its source address, and its user's class.
+type bandwidthOptions struct {
+	Upload   byteRate // all clients together, client to destination
+	Download byteRate // all clients together, destination to client
+	Classes  []*bandwidthClass
+}
+
+func (o bandwidthOptions) enabled() bool {
+	return o.Upload > 0 || o.Download > 0 || len(o.Classes) > 0
+}
+
+// parseBandwidthClasses decodes the `bandwidth:` section of the config file.
+//
+//	bandwidth:
+//	  - cidr: [10.0.0.0/24, 10.0.1.0/24]   # each source address on its own
+//	    download: 10mbit
+//	  - user: alice                        # all of alice's connections together
+//	    upload: 1mbit
+//	    download: 5mbit
+func parseBandwidthClasses(n *yaml.Node) ([]*bandwidthClass, error) {
+	if n.Kind != yaml.SequenceNode {
+		return nil, fmt.Errorf("bandwidth: expected a list (line %d)", n.Line)
+	}
+	var classes []*bandwidthClass
+	for i, item := range n.Content {
+		if err := checkYAMLKeys(item, "cidr", "user", "upload", "download"); err != nil {
+			return nil, fmt.Errorf("bandwidth[%d]: %w", i, err)
+		}
+		var spec struct {
+			CIDR     stringList `yaml:"cidr"`
+			User     string     `yaml:"user"`
+			Upload   string     `yaml:"upload"`
+			Download string     `yaml:"download"`
+		}
+		if err := item.Decode(&spec); err != nil {
+			return nil, fmt.Errorf("bandwidth[%d]: %w", i, err)
+		}
+		c := &bandwidthClass{User: strings.TrimSpace(spec.User)}
+		if (len(spec.CIDR) == 0) == (c.User == "") {
+			return nil, fmt.Errorf("bandwidth[%d] (line %d): set exactly one of cidr and user", i, item.Line)
+		}
+		for _, s := range spec.CIDR {
+			ipn := parseCIDRHost(s)
+			if ipn == nil {
+				return nil, fmt.Errorf("bandwidth[%d] (line %d): invalid cidr %q", i, item.Line, s)
+			}
+			c.CIDRs = append(c.CIDRs, ipn)
+		}
+		var err error
+		if c.Upload, err = parseByteRate(spec.Upload); err != nil {
+			return nil, fmt.Errorf("bandwidth[%d] (line %d): upload: %w", i, item.Line, err)
+		}
+		if c.Download, err = parseByteRate(spec.Download); err != nil {
+			return nil, fmt.Errorf("bandwidth[%d] (line %d): download: %w", i, item.Line, err)
+		}
+		classes = append(classes, c)
+	}
+	return classes, nil
+}
+
+// checkYAMLKeys rejects keys of mapping n outside known.
+func checkYAMLKeys(n *yaml.Node, known ...string) error {
+	if n.Kind != yaml.MappingNode {
+		return fmt.Errorf("expected a mapping (line %d)", n.Line)
+	}
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		k := n.Content[i]
+		if !slices.Contains(known, k.Value) {
+			return fmt.Errorf("unknown key %q (line %d)", k.Value, k.Line)
+		}
+	}
+	return nil
+}
+
+// shaper hands out token buckets to SOCKS connections and measures the traffic through
+// them. A nil *shaper shapes nothing.
+type shaper struct {
+	opts   bandwidthOptions
+	global [2]*rate.Limiter // upload, download; nil when unlimited
+
+	mu      sync.Mutex
+	buckets map[string]*sharedBucket // "ip 10.0.0.5" or "user alice"
+
+	bytes    [2]atomic.Uint64 // upload, download totals
+	rateMu   sync.Mutex
+	lastAt   time.Time
+	lastSeen [2]uint64
+}
+
+const (
+	dirUpload   = 0 // client to destination
+	dirDownload = 1 // destination to client
+)
+
+type sharedBucket struct {
+	lims [2]*rate.Limiter
+	refs int
+}
+
+// newShaper returns a shaper for opts, or nil when opts limits nothing.
+func newShaper(opts bandwidthOptions) *shaper {
+	if !opts.enabled() {
+		return nil
+	}
+	return &shaper{
+		opts:    opts,
+		global:  [2]*rate.Limiter{newLimiter(opts.Upload), newLimiter(opts.Download)},
+		buckets: map[string]*sharedBucket{},
+		lastAt:  time.Now(),
+	}
+}
+
+// newLimiter returns a token bucket for r holding a quarter second of traffic (at least
+// one full-size packet), or nil when r is unlimited.
+func newLimiter(r byteRate) *rate.Limiter {
+	if r <= 0 {
+		return nil
+	}
+	return rate.NewLimiter(rate.Limit(r), max(int(r/4), 1500))
+}
+
+// connShaping is the set of buckets one connection draws from.
+type connShaping struct {
+	s    *shaper
+	lims [2][]*rate.Limiter
+	keys []string
+}
+
+// acquire returns the buckets for a connection from ip authenticated as user ("" when
+// unauthenticated). Call release when the connection ends. It returns nil when s is nil.
+func (s *shaper) acquire(ip net.IP, user string) *connShaping {
+	if s == nil {
+		return nil
+	}
+	cs := &connShaping{s: s}
+	add := func(lims [2]*rate.Limiter) {
+		for d, l := range lims {
+			if l != nil {
+				cs.lims[d] = append(cs.lims[d], l)
+			}
+		}
+	}
+	add(s.global)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	shared := func(key string, c *bandwidthClass) {
+		b := s.buckets[key]
+		if b == nil {
+			b = &sharedBucket{lims: [2]*rate.Limiter{newLimiter(c.Upload), newLimiter(c.Download)}}
+			s.buckets[key] = b
+		}
+		b.refs++
+		cs.keys = append(cs.keys, key)
+		add(b.lims)
+	}
+	matchedCIDR, matchedUser := false, false
+	for _, c := range s.opts.Classes {
+		switch {
+		case len(c.CIDRs) > 0 && !matchedCIDR && cidrsContain(c.CIDRs, ip):
+			matchedCIDR = true
+			shared("ip "+ip.String(), c)
+		case c.User != "" && !matchedUser && c.User == user:
+			matchedUser = true
+			shared("user "+user, c)
+		}
+	}
+	return cs
+}
+
+// cidrsContain reports whether any of cidrs contains ip; a nil ip is in none.
+func cidrsContain(cidrs []*net.IPNet, ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, n := range cidrs {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// release drops the connection's hold on its shared buckets; buckets nobody holds are
+// forgotten.
+func (cs *connShaping) release() {
+	if cs == nil {
+		return
+	}
+	cs.s.mu.Lock()
+	defer cs.s.mu.Unlock()
+	for _, k := range cs.keys {
+		if b := cs.s.buckets[k]; b != nil {
+			if b.refs--; b.refs <= 0 {
+				delete(cs.s.buckets, k)
+			}
+		}
+	}
+}
+
+// wait counts n bytes in direction dir and blocks until every bucket admits them.
+func (cs *connShaping) wait(ctx context.Context, dir, n int) error {
+	if cs == nil {
+		return nil
+	}
+	cs.s.bytes[dir].Add(uint64(n))
+	for _, l := range cs.lims[dir] {
+		for left := n; left > 0; {
+			k := min(left, l.Burst())
+			if err := l.WaitN(ctx, k); err != nil {
+				return err
+			}
+			left -= k
+		}
+	}
+	return nil
+}
+
+// reader shapes reads from r in direction dir.
+func (cs *connShaping) reader(ctx context.Context, r io.Reader, dir int) io.Reader {
+	if cs == nil {
+		return r
+	}
+	return shapedReader{ctx: ctx, r: r, cs: cs, dir: dir}
+}
+
+type shapedReader struct {
+	ctx context.Context
+	r   io.Reader
+	cs  *connShaping
+	dir int
+}
+
+func (r shapedReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if n > 0 {
+		if werr := r.cs.wait(r.ctx, r.dir, n); werr != nil && err == nil {
+			err = werr
+		}
+	}
+	return n, err
+}
+
+// rates returns the upload and download rates since the previous call.
+func (s *shaper) rates() (up, down byteRate) {
+	s.rateMu.Lock()
+	defer s.rateMu.Unlock()
+	now := time.Now()
+	secs := now.Sub(s.lastAt).Seconds()
+	var r [2]byteRate
+	for d := range r {
+		cur := s.bytes[d].Load()
+		if secs > 0 {
+			r[d] = byteRate(float64(cur-s.lastSeen[d]) / secs)
+		}
+		s.lastSeen[d] = cur
+	}
+	s.lastAt = now
+	return r[0], r[1]
+}
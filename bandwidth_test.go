@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/proxy"
+	"gopkg.in/yaml.v3"
+)
+
+func TestParseByteRate(t *testing.T) {
+	for in, want := range map[string]byteRate{
+		"":        0,
+		"0":       0,
+		"1500":    1500,
+		"10mbit":  1.25e6,
+		"512kbps": 64e3,
+		"2MB":     2e6,
+		"1.5MiB":  1.5 * (1 << 20),
+		"1 Gbit":  1.25e8,
+	} {
+		got, err := parseByteRate(in)
+		if err != nil || got != want {
+			t.Errorf("parseByteRate(%q) = %v, %v; want %v", in, float64(got), err, float64(want))
+		}
+	}
+	for _, in := range []string{"fast", "10 furlongs", "-1mbit", "1.2.3"} {
+		if _, err := parseByteRate(in); err == nil {
+			t.Errorf("parseByteRate(%q) succeeded", in)
+		}
+	}
+	for _, s := range []string{"10mbit", "2.5gbit", "800kbit", "100bit"} {
+		r, _ := parseByteRate(s)
+		if r.String() != s {
+			t.Errorf("String() of %s = %s", s, r)
+		}
+	}
+}
+
+func TestParseBandwidthClasses(t *testing.T) {
+	var n yaml.Node
+	src := "- cidr: [10.0.0.0/24]\n  download: 10mbit\n- user: alice\n  upload: 1MB\n"
+	if err := yaml.Unmarshal([]byte(src), &n); err != nil {
+		t.Fatal(err)
+	}
+	classes, err := parseBandwidthClasses(n.Content[0])
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	if len(classes) != 2 || len(classes[0].CIDRs) != 1 || classes[0].Download != 1.25e6 || classes[1].User != "alice" || classes[1].Upload != 1e6 {
+		t.Fatalf("classes = %+v %+v", classes[0], classes[1])
+	}
+
+	for _, bad := range []string{
+		"- download: 1mbit\n",                      // neither cidr nor user
+		"- cidr: 10.0.0.0/8\n  user: bob\n",        // both
+		"- user: bob\n  uplaod: 1mbit\n",           // typo
+		"- cidr: 10.0.0.0/33\n  download: 1mbit\n", // bad CIDR
+		"- user: bob\n  download: lots\n",          // bad rate
+	} {
+		var n yaml.Node
+		if err := yaml.Unmarshal([]byte(bad), &n); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := parseBandwidthClasses(n.Content[0]); err == nil {
+			t.Errorf("accepted %q", bad)
+		}
+	}
+}
+
+func TestShaper_Buckets(t *testing.T) {
+	_, lan, _ := net.ParseCIDR("10.0.0.0/24")
+	sh := newShaper(bandwidthOptions{
+		Download: 1e6,
+		Classes: []*bandwidthClass{
+			{CIDRs: []*net.IPNet{lan}, Download: 1e5},
+			{User: "alice", Upload: 1e4},
+		},
+	})
+	a := sh.acquire(net.ParseIP("10.0.0.1"), "alice")
+	b := sh.acquire(net.ParseIP("10.0.0.2"), "alice")
+	c := sh.acquire(net.ParseIP("192.0.2.1"), "")
+	if len(a.lims[dirDownload]) != 2 || len(a.lims[dirUpload]) != 1 || len(c.lims[dirDownload]) != 1 || len(c.lims[dirUpload]) != 0 {
+		t.Fatalf("bucket counts: a=%d/%d c=%d/%d", len(a.lims[dirUpload]), len(a.lims[dirDownload]), len(c.lims[dirUpload]), len(c.lims[dirDownload]))
+	}
+	if a.lims[dirDownload][1] == b.lims[dirDownload][1] {
+		t.Fatal("source addresses in a CIDR class share a bucket")
+	}
+	if a.lims[dirUpload][0] != b.lims[dirUpload][0] {
+		t.Fatal("a user's connections do not share a bucket")
+	}
+	for _, cs := range []*connShaping{a, b, c} {
+		cs.release()
+	}
+	if len(sh.buckets) != 0 {
+		t.Fatalf("%d buckets left after release", len(sh.buckets))
+	}
+	if newShaper(bandwidthOptions{}) != nil {
+		t.Fatal("shaper without limits")
+	}
+}
+
+func TestSocks5_DownloadLimit(t *testing.T) {
+	const size = 60 << 10
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { _ = ln.Close() })
+	go func() {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer func() { _ = c.Close() }()
+		_, _ = c.Write(make([]byte, size))
+	}()
+	sh := newShaper(bandwidthOptions{Download: 50 << 10})
+	proxyAddr := startTestSocks(t, socksOptions{Shaper: sh})
+
+	start := time.Now()
+	conn := socksConnectTo(t, proxyAddr, ln.Addr().(*net.TCPAddr).Port)
+	if n, err := io.Copy(io.Discard, conn); err != nil || n != size {
+		t.Fatalf("read %d bytes, %v", n, err)
+	}
+	// 60KiB at 50KiB/s with a 12.5KiB burst takes about 0.95s.
+	if d := time.Since(start); d < 700*time.Millisecond {
+		t.Fatalf("download took %s, want it shaped to about 1s", d)
+	}
+	if up, down := sh.rates(); up != 0 || down <= 0 {
+		t.Fatalf("rates up=%s down=%s", up, down)
+	}
+}
+
+func TestSocks5_UserPassAuth(t *testing.T) {
+	port := tcpEcho(t)
+	proxyAddr := startTestSocks(t, socksOptions{Auth: []string{"alice:s3cret", "country:Germany:pw"}})
+	target := net.JoinHostPort("127.0.0.1", strconv.Itoa(port))
+
+	dial := func(auth *proxy.Auth) (net.Conn, error) {
+		d, err := proxy.SOCKS5("tcp", proxyAddr, auth, &net.Dialer{Timeout: 5 * time.Second})
+		if err != nil {
+			t.Fatalf("proxy.SOCKS5: %v", err)
+		}
+		return d.(proxy.ContextDialer).DialContext(context.Background(), "tcp", target)
+	}
+	for _, a := range []*proxy.Auth{{User: "alice", Password: "s3cret"}, {User: "country:Germany", Password: "pw"}} {
+		c, err := dial(a)
+		if err != nil {
+			t.Fatalf("dial as %s: %v", a.User, err)
+		}
+		expectEcho(t, c, "hi "+a.User)
+		_ = c.Close()
+	}
+	if _, err := dial(&proxy.Auth{User: "alice", Password: "wrong"}); err == nil || !strings.Contains(err.Error(), "authentication failed") {
+		t.Fatalf("wrong password: %v", err)
+	}
+	if _, err := dial(nil); err == nil || !strings.Contains(err.Error(), "no acceptable authentication methods") {
+		t.Fatalf("no credentials: %v", err)
+	}
+
+	conn := dialProxy(t, proxyAddr)
+	if _, err := conn.Write(socks4Request(1, net.ParseIP("127.0.0.1"), port, "")); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if rep, _ := readSocks4Reply(t, conn); rep != 91 {
+		t.Fatalf("SOCKS4 with auth configured: reply=%d, want 91", rep)
+	}
+}
+
+func TestParseSocksAuth(t *testing.T) {
+	users, err := parseSocksAuth([]string{"alice:pw", "loc-abc:x"})
+	if err != nil || users["alice"] != "pw" || users["loc-abc"] != "x" {
+		t.Fatalf("users = %v, %v", users, err)
+	}
+	for _, bad := range [][]string{{"alice"}, {":pw"}, {"alice:"}, {"a:1", "a:2"}} {
+		if _, err := parseSocksAuth(bad); err == nil {
+			t.Errorf("accepted %v", bad)
+		}
+	}
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// DefaultBlocklistRefresh is how often blocklist sources are reloaded.
+const DefaultBlocklistRefresh = 24 * time.Hour
+
+// maxBlocklistBytes caps the size of one blocklist source.
+const maxBlocklistBytes = 64 << 20
+
+// blocklistOptions configures newBlocklist.
+type blocklistOptions struct {
+	Sources  []string      // file paths or http(s) URLs
+	Refresh  time.Duration // 0 disables periodic reloads
+	Response string        // "nxdomain" (default) or "zero"
+}
+
+// blocklist answers whether a name is blocked. Sources may be hosts files ("0.0.0.0 name",
+// which block that exact name) or domain lists (one domain per line, which also block
+// subdomains). A source that fails to reload keeps its previous entries.
+type blocklist struct {
+	sources  []string
+	refresh  time.Duration
+	response string
+	client   *http.Client
+
+	mu     sync.RWMutex
+	loaded map[string]*blocklistEntries // by source
+
+	blocked atomic.Uint64
+}
+
+type blocklistEntries struct {
+	exact  map[string]struct{}
+	suffix map[string]struct{}
+}
+
+// newBlocklist returns a blocklist for opts; call load (and run) to fill it.
+func newBlocklist(opts blocklistOptions) *blocklist {
+	response := strings.ToLower(strings.TrimSpace(opts.Response))
+	if response == "" {
+		response = "nxdomain"
+	}
+	return &blocklist{
+		sources:  opts.Sources,
+		refresh:  opts.Refresh,
+		response: response,
+		client:   &http.Client{Timeout: 30 * time.Second},
+		loaded:   map[string]*blocklistEntries{},
+	}
+}
+
+// startBlocklist loads the sources and keeps them refreshed until ctx ends. It returns
+// nil when there are no sources.
+func startBlocklist(ctx context.Context, opts blocklistOptions) *blocklist {
+	if len(opts.Sources) == 0 {
+		return nil
+	}
+	bl := newBlocklist(opts)
+	bl.load(ctx)
+	go bl.run(ctx)
+	return bl
+}
+
+// run reloads the sources every refresh interval until ctx ends.
+func (bl *blocklist) run(ctx context.Context) {
+	if bl.refresh <= 0 {
+		return
+	}
+	t := time.NewTicker(bl.refresh)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			bl.load(ctx)
+		}
+	}
+}
+
+// load (re)reads every source. Failures are logged and leave that source's previous
+// entries in place.
+func (bl *blocklist) load(ctx context.Context) {
+	for _, src := range bl.sources {
+		e, err := bl.fetch(ctx, src)
+		if err != nil {
+			logWarn("blocklist %s: %v\n", src, err)
+			continue
+		}
+		bl.mu.Lock()
+		bl.loaded[src] = e
+		bl.mu.Unlock()
+		logDebug("blocklist %s: %d names, %d domains\n", src, len(e.exact), len(e.suffix))
+	}
+	logInfo("DNS blocklist: %d entries from %d sources\n", bl.size(), len(bl.sources))
+}
+
+func (bl *blocklist) fetch(ctx context.Context, src string) (*blocklistEntries, error) {
+	if !isBlocklistURL(src) {
+		f, err := os.Open(src)
+		if err != nil {
+			return nil, err
+		}
+		defer func() { _ = f.Close() }()
+		return parseBlocklist(io.LimitReader(f, maxBlocklistBytes))
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, src, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := bl.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("HTTP %s", resp.Status)
+	}
+	return parseBlocklist(io.LimitReader(resp.Body, maxBlocklistBytes))
+}
+
+func (bl *blocklist) size() int {
+	bl.mu.RLock()
+	defer bl.mu.RUnlock()
+	n := 0
+	for _, e := range bl.loaded {
+		n += len(e.exact) + len(e.suffix)
+	}
+	return n
+}
+
+// blocks reports whether host is on the blocklist and counts the hit. A nil blocklist
+// blocks nothing.
+func (bl *blocklist) blocks(host string) bool {
+	if bl == nil {
+		return false
+	}
+	h := normalizeHost(host)
+	if h == "" {
+		return false
+	}
+	bl.mu.RLock()
+	defer bl.mu.RUnlock()
+	for _, e := range bl.loaded {
+		if _, ok := e.exact[h]; ok {
+			bl.blocked.Add(1)
+			return true
+		}
+		for d := h; d != ""; {
+			if _, ok := e.suffix[d]; ok {
+				bl.blocked.Add(1)
+				return true
+			}
+			_, d, _ = strings.Cut(d, ".")
+		}
+	}
+	return false
+}
+
+// Blocked returns the number of blocked lookups so far.
+func (bl *blocklist) Blocked() uint64 {
+	if bl == nil {
+		return 0
+	}
+	return bl.blocked.Load()
+}
+
+// answer builds the response to a blocked query: NXDOMAIN, or with the "zero" response
+// 0.0.0.0 / :: for A / AAAA and an empty answer for other types.
+func (bl *blocklist) answer(q *dnsmessage.Message) *dnsmessage.Message {
+	if bl.response != "zero" {
+		return dnsReply(q, dnsmessage.RCodeNameError)
+	}
+	resp := dnsReply(q, dnsmessage.RCodeSuccess)
+	question := q.Questions[0]
+	hdr := dnsmessage.ResourceHeader{Name: question.Name, Type: question.Type, Class: dnsmessage.ClassINET, TTL: 60}
+	switch question.Type {
+	case dnsmessage.TypeA:
+		resp.Answers = []dnsmessage.Resource{{Header: hdr, Body: &dnsmessage.AResource{}}}
+	case dnsmessage.TypeAAAA:
+		resp.Answers = []dnsmessage.Resource{{Header: hdr, Body: &dnsmessage.AAAAResource{}}}
+	}
+	return resp
+}
+
+// hostsFileNames are names found in stock hosts files that must never be blocked.
+var hostsFileNames = map[string]bool{
+	"localhost": true, "localhost.localdomain": true, "local": true, "broadcasthost": true,
+	"ip6-localhost": true, "ip6-loopback": true, "ip6-localnet": true, "ip6-mcastprefix": true,
+	"ip6-allnodes": true, "ip6-allrouters": true, "ip6-allhosts": true, "0.0.0.0": true,
+}
+
+// parseBlocklist reads a hosts-format or domain-list blocklist. Comments start with
+// '#' or '!'. Domain-list entries may be written as "*.name" or "||name^".
+func parseBlocklist(r io.Reader) (*blocklistEntries, error) {
+	e := &blocklistEntries{exact: map[string]struct{}{}, suffix: map[string]struct{}{}}
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64*1024), 1<<20)
+	for sc.Scan() {
+		line := sc.Text()
+		if i := strings.IndexAny(line, "#!"); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		switch {
+		case len(fields) == 0:
+		case net.ParseIP(fields[0]) != nil:
+			for _, name := range fields[1:] {
+				if h := normalizeHost(name); h != "" && !hostsFileNames[h] {
+					e.exact[h] = struct{}{}
+				}
+			}
+		case len(fields) == 1:
+			d := strings.TrimSuffix(strings.TrimPrefix(fields[0], "||"), "^")
+			d = strings.TrimPrefix(d, "*.")
+			if h := normalizeHost(d); h != "" && !strings.ContainsAny(h, "/*?:") {
+				e.suffix[h] = struct{}{}
+			}
+		}
+	}
+	return e, sc.Err()
+}
+
+func isBlocklistURL(src string) bool {
+	return strings.HasPrefix(src, "http://") || strings.HasPrefix(src, "https://")
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func mustParseBlocklist(t *testing.T, text string) *blocklist {
+	t.Helper()
+	e, err := parseBlocklist(strings.NewReader(text))
+	if err != nil {
+		t.Fatalf("parseBlocklist: %v", err)
+	}
+	bl := newBlocklist(blocklistOptions{Sources: []string{"test"}})
+	bl.loaded["test"] = e
+	return bl
+}
+
+func TestBlocklist_Formats(t *testing.T) {
+	bl := mustParseBlocklist(t, `
+# hosts format
+127.0.0.1 localhost
+0.0.0.0 ads.example tracker.example # trailing comment
+::      v6ads.example
+! adblock-style comment
+||malware.example^
+*.wild.example
+plain.example
+`)
+	for host, want := range map[string]bool{
+		"ads.example":         true,
+		"ADS.Example.":        true,
+		"sub.ads.example":     false, // hosts entries are exact
+		"tracker.example":     true,
+		"v6ads.example":       true,
+		"localhost":           false,
+		"malware.example":     true,
+		"cdn.malware.example": true,
+		"wild.example":        true,
+		"a.b.wild.example":    true,
+		"plain.example":       true,
+		"www.plain.example":   true,
+		"notplain.example":    false,
+		"example":             false,
+	} {
+		if got := bl.blocks(host); got != want {
+			t.Errorf("blocks(%q) = %v, want %v", host, got, want)
+		}
+	}
+	if bl.Blocked() != 10 {
+		t.Errorf("Blocked() = %d, want 10", bl.Blocked())
+	}
+	var nilList *blocklist
+	if nilList.blocks("ads.example") || nilList.Blocked() != 0 {
+		t.Error("nil blocklist must block nothing")
+	}
+}
+
+func TestBlocklist_LoadFileAndURLKeepsEntriesOnFailure(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "list.txt")
+	if err := os.WriteFile(path, []byte("file.example\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	var fail atomic.Bool
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if fail.Load() {
+			http.Error(w, "down", http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = w.Write([]byte("0.0.0.0 url.example\n"))
+	}))
+	defer srv.Close()
+
+	bl := newBlocklist(blocklistOptions{Sources: []string{path, srv.URL + "/hosts"}})
+	bl.load(context.Background())
+	if !bl.blocks("x.file.example") || !bl.blocks("url.example") {
+		t.Fatal("expected entries from both sources")
+	}
+
+	fail.Store(true)
+	if err := os.WriteFile(path, []byte("other.example\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	bl.load(context.Background())
+	if bl.blocks("file.example") || !bl.blocks("other.example") {
+		t.Error("file source was not reloaded")
+	}
+	if !bl.blocks("url.example") {
+		t.Error("failed URL source lost its previous entries")
+	}
+}
+
+func TestDNSServer_Blocklist(t *testing.T) {
+	up := &standInDNS{ip: net.ParseIP("10.1.0.1")}
+	upstream := up.serveUDP(t)
+	for _, response := range []string{"nxdomain", "zero"} {
+		bl := mustParseBlocklist(t, "ads.example\n")
+		bl.response = response
+		s := startTestDNSServer(t, dnsServerOptions{
+			Upstreams: []string{upstream},
+			Hosts:     []string{"ok.ads.example=192.168.1.10"},
+			Blocklist: bl,
+		})
+
+		resp := queryDNS(t, "udp", s.Addr(), "x.ads.example", dnsmessage.TypeA)
+		switch response {
+		case "nxdomain":
+			if resp.RCode != dnsmessage.RCodeNameError {
+				t.Errorf("nxdomain: got %s", resp.RCode)
+			}
+		case "zero":
+			if got := answerIP(t, resp); !got.Equal(net.IPv4zero) {
+				t.Errorf("zero: got %s", got)
+			}
+		}
+		if got := answerIP(t, queryDNS(t, "udp", s.Addr(), "ok.ads.example", dnsmessage.TypeA)); got.String() != "192.168.1.10" {
+			t.Errorf("%s: static host was blocked, got %s", response, got)
+		}
+	}
+	if up.queries.Load() != 0 {
+		t.Errorf("blocked or static names reached the upstream %d times", up.queries.Load())
+	}
+}
+
+func TestSocksLookupHost_Blocklist(t *testing.T) {
+	srv := &socksServer{
+		resolver:  mustDNSClient(t, dnsClientOptions{Upstreams: []string{(&standInDNS{ip: net.ParseIP("10.0.0.1")}).serveUDP(t)}}),
+		rules:     newRuleSet(nil, nil, nil),
+		blocklist: mustParseBlocklist(t, "tracker.example\n"),
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if ip, blocked := srv.lookupHost(ctx, "tcp", "pixel.tracker.example", 443, nil); !blocked || ip != nil {
+		t.Errorf("blocked name: ip=%v blocked=%v", ip, blocked)
+	}
+	if ip, blocked := srv.lookupHost(ctx, "tcp", "www.example.com", 443, nil); blocked || !ip.Equal(net.ParseIP("10.0.0.1")) {
+		t.Errorf("allowed name: ip=%v blocked=%v", ip, blocked)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"strings"
+	"time"
 
 	"github.com/docopt/docopt-go"
 )
@@ -20,12 +21,10 @@ func cmdSaveJWT(opts docopt.Opts) error {
 	return nil
 }
 
-func cmdVerify(ctx context.Context, opts docopt.Opts) error {
-	apiURL := getStringOr(opts, "--api_url", DefaultAPIURL)
-	userAuth, _ := opts.String("--user_auth")
+func cmdVerify(ctx context.Context, opts docopt.Opts, cfg VPNConfig) error {
 	code, _ := opts.String("--code")
 
-	byJwt, err := verifyCode(ctx, apiURL, userAuth, code)
+	byJwt, err := verifyCode(ctx, cfg.APIURL, cfg.UserAuth, code)
 	if err != nil {
 		return fmt.Errorf("verify error: %w", err)
 	}
@@ -36,15 +35,13 @@ func cmdVerify(ctx context.Context, opts docopt.Opts) error {
 	return nil
 }
 
-func cmdMintClient(ctx context.Context, opts docopt.Opts) error {
-	apiURL := getStringOr(opts, "--api_url", DefaultAPIURL)
-	jwtOpt, _ := opts.String("--jwt")
-	jwt, err := loadJWT(jwtOpt)
+func cmdMintClient(ctx context.Context, cfg VPNConfig) error {
+	jwt, err := loadJWT(cfg.JWT)
 	if err != nil {
 		return err
 	}
 
-	clientJwt, err := mintClientJWT(ctx, apiURL, jwt)
+	clientJwt, err := mintClientJWT(ctx, cfg.APIURL, jwt, cfg.Description, cfg.DeviceSpec)
 	if err != nil {
 		return err
 	}
@@ -58,3 +55,26 @@ func cmdMintClient(ctx context.Context, opts docopt.Opts) error {
 	}
 	return nil
 }
+
+// cmdLogout revokes the network client behind the stored client JWT and deletes the
+// stored JWT. Network-scoped tokens have no client to revoke and are only deleted.
+func cmdLogout(ctx context.Context, cfg VPNConfig) error {
+	jwt, err := loadJWT("")
+	if err != nil {
+		return err
+	}
+	if id := parseClientID(jwt); id != "" {
+		rCtx, cancel := context.WithTimeout(ctx, 20*time.Second)
+		defer cancel()
+		if err := httpRemoveNetworkClient(rCtx, cfg.APIURL, jwt, id); err != nil {
+			logWarn("revoke client %s failed: %v; deleting local JWT anyway\n", id, err)
+		} else {
+			fmt.Printf("revoked client_id=%s\n", id)
+		}
+	}
+	if err := removeJWT(); err != nil {
+		return fmt.Errorf("delete jwt failed: %w", err)
+	}
+	fmt.Printf("removed %s\n", jwtPath())
+	return nil
+}
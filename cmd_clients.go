@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/docopt/docopt-go"
+)
+
+func cmdClientsList(ctx context.Context, opts docopt.Opts, cfg VPNConfig) error {
+	asJSON, _ := opts.Bool("--json")
+	jwt, err := loadJWT(cfg.JWT)
+	if err != nil {
+		return err
+	}
+
+	qCtx, cancel := context.WithTimeout(ctx, 20*time.Second)
+	defer cancel()
+	res, err := httpNetworkClients(qCtx, cfg.APIURL, jwt)
+	if err != nil {
+		return err
+	}
+
+	if asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(res.Clients)
+	}
+	if len(res.Clients) == 0 {
+		fmt.Println("no clients")
+		return nil
+	}
+	current := parseClientID(jwt)
+	for _, c := range res.Clients {
+		mark := " "
+		if c.ClientID == current {
+			mark = "*"
+		}
+		desc := c.Description
+		if desc == "" {
+			desc = "(no description)"
+		}
+		created := "-"
+		if !c.CreateTime.IsZero() {
+			created = c.CreateTime.UTC().Format(time.RFC3339)
+		}
+		fmt.Printf("%s %s  %-28s spec=%q created=%s connections=%d\n", mark, c.ClientID, desc, c.DeviceSpec, created, len(c.Connections))
+	}
+	return nil
+}
+
+func cmdClientsRemove(ctx context.Context, opts docopt.Opts, cfg VPNConfig) error {
+	clientID := strings.TrimSpace(getStringOr(opts, "<client_id>", ""))
+	if clientID == "" {
+		return fmt.Errorf("<client_id> is required")
+	}
+	jwt, err := loadJWT(cfg.JWT)
+	if err != nil {
+		return err
+	}
+
+	rCtx, cancel := context.WithTimeout(ctx, 20*time.Second)
+	defer cancel()
+	if err := httpRemoveNetworkClient(rCtx, cfg.APIURL, jwt, clientID); err != nil {
+		return err
+	}
+	fmt.Printf("removed client_id=%s\n", clientID)
+	if clientID == parseClientID(jwt) {
+		logWarn("removed the client this JWT belongs to; run 'mint-client' or 'login' again\n")
+	}
+	return nil
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/docopt/docopt-go"
+	"gopkg.in/yaml.v3"
+)
+
+// configShowEntry is one setting in the output of `config show`.
+type configShowEntry struct {
+	Key    string       `json:"key" yaml:"key"`
+	Value  any          `json:"value" yaml:"value"`
+	Source configSource `json:"source" yaml:"source"`
+	Origin string       `json:"origin" yaml:"origin"`
+}
+
+// configShowOutput is the document printed by `config show`.
+type configShowOutput struct {
+	ConfigFile     string            `json:"config_file" yaml:"config_file"`
+	Settings       []configShowEntry `json:"settings" yaml:"settings"`
+	Rules          []string          `json:"rules,omitempty" yaml:"rules,omitempty"`
+	Listeners      []string          `json:"listeners,omitempty" yaml:"listeners,omitempty"`
+	RouteLocations []string          `json:"route_locations,omitempty" yaml:"route_locations,omitempty"`
+}
+
+// cmdConfigShow prints the merged configuration as YAML (default) or JSON together with
+// the layer that supplied each value. Secrets are redacted.
+func cmdConfigShow(opts docopt.Opts, rc *resolvedConfig) error {
+	asJSON, _ := opts.Bool("--json")
+
+	out := buildConfigShow(rc)
+	if asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(out)
+	}
+	enc := yaml.NewEncoder(os.Stdout)
+	enc.SetIndent(2)
+	defer enc.Close()
+	return enc.Encode(out)
+}
+
+// buildConfigShow collects every setting in table order.
+func buildConfigShow(rc *resolvedConfig) configShowOutput {
+	out := configShowOutput{ConfigFile: rc.ConfigPath}
+	for _, s := range configSettings {
+		v := settingValue(s.Target(rc))
+		if s.Secret {
+			if str, _ := v.(string); str != "" {
+				v = "<redacted>"
+			}
+		}
+		out.Settings = append(out.Settings, configShowEntry{
+			Key:    s.Key,
+			Value:  v,
+			Source: rc.Sources[s.Key],
+			Origin: rc.Origins[s.Key],
+		})
+	}
+	for _, r := range rc.VPN.Rules {
+		out.Rules = append(out.Rules, r.String())
+	}
+	for _, l := range rc.VPN.Listeners {
+		out.Listeners = append(out.Listeners, l.String())
+	}
+	for _, r := range rc.VPN.RouteLocations {
+		out.RouteLocations = append(out.RouteLocations, r.String())
+	}
+	return out
+}
+
+// settingValue dereferences a setting target for display. Durations are shown in Go
+// duration syntax so they round-trip through the config file.
+func settingValue(ptr any) any {
+	switch p := ptr.(type) {
+	case *string:
+		return *p
+	case *[]string:
+		if *p == nil {
+			return []string{}
+		}
+		return *p
+	case *bool:
+		return *p
+	case *int:
+		return *p
+	case *time.Duration:
+		return p.String()
+	case *byteRate:
+		return p.String()
+	default:
+		return fmt.Sprint(ptr)
+	}
+}
+
+// cmdConfigValidate reports every problem in the merged configuration and fails when
+// there is at least one.
+func cmdConfigValidate(rc *resolvedConfig) error {
+	errs := validateConfig(rc)
+	if len(errs) == 0 {
+		if rc.ConfigPath != "" {
+			fmt.Printf("%s: ok\n", rc.ConfigPath)
+		} else {
+			fmt.Println("config ok")
+		}
+		return nil
+	}
+	return reportProblems(errs)
+}
+
+// reportProblems prints each configuration problem on its own line and returns an
+// error counting them.
+func reportProblems(errs []error) error {
+	for _, err := range errs {
+		fmt.Fprintf(os.Stderr, "invalid: %v\n", err)
+	}
+	if len(errs) == 1 {
+		return fmt.Errorf("1 problem found")
+	}
+	return fmt.Errorf("%d problems found", len(errs))
+}
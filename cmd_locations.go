@@ -8,11 +8,10 @@ import (
 	"github.com/docopt/docopt-go"
 )
 
-func cmdLocations(ctx context.Context, opts docopt.Opts) error {
-	apiURL := getStringOr(opts, "--api_url", DefaultAPIURL)
+func cmdLocations(ctx context.Context, opts docopt.Opts, cfg VPNConfig) error {
+	apiURL := cfg.APIURL
 	q := getStringOr(opts, "--query", "")
-	jwtOpt, _ := opts.String("--jwt")
-	jwt, err := loadJWT(jwtOpt)
+	jwt, err := loadJWT(cfg.JWT)
 	if err != nil {
 		return err
 	}
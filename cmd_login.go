@@ -2,30 +2,75 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"strings"
 
 	"github.com/docopt/docopt-go"
 )
 
-func cmdLogin(ctx context.Context, opts docopt.Opts) error {
-	apiURL := getStringOr(opts, "--api_url", DefaultAPIURL)
-	userAuth, _ := opts.String("--user_auth")
-	password, _ := opts.String("--password")
+// errVerificationRequired is returned by loginAndVerify when the account needs a
+// verification code and none was given or could be prompted for.
+var errVerificationRequired = errors.New("verification required (re-run with --code=<code> or run 'verify')")
 
-	res, err := loginWithPassword(ctx, apiURL, userAuth, password)
+func cmdLogin(ctx context.Context, opts docopt.Opts, cfg VPNConfig) error {
+	code := strings.TrimSpace(getStringOr(opts, "--code", ""))
+
+	userAuth, password, err := promptCredentials(ctx, cfg.UserAuth, cfg.Password)
 	if err != nil {
-		return fmt.Errorf("login error: %w", err)
+		return err
 	}
-	if res.VerificationRequired {
+	if userAuth == "" || password == "" {
+		return errors.New("--user_auth and --password are required when stdin is not a terminal")
+	}
+
+	res, err := loginAndVerify(ctx, cfg.APIURL, userAuth, password, code)
+	if errors.Is(err, errVerificationRequired) {
 		fmt.Printf("verification required for %s\n", userAuth)
 		return nil
 	}
+	if err != nil {
+		return err
+	}
+	if res.NetworkName != "" {
+		fmt.Printf("saved JWT for network %s -> %s\n", res.NetworkName, jwtPath())
+	} else {
+		fmt.Printf("saved JWT -> %s\n", jwtPath())
+	}
+	return nil
+}
+
+// loginAndVerify logs in with a password and, when the API asks for verification, submits
+// code — prompting for it on the terminal when code is empty. The resulting network JWT is
+// saved before returning. errVerificationRequired is returned when a code is needed but
+// none is available.
+func loginAndVerify(ctx context.Context, apiURL, userAuth, password, code string) (*LoginResult, error) {
+	res, err := DefaultAuthenticator.LoginWithPassword(ctx, apiURL, userAuth, password)
+	if err != nil {
+		return nil, fmt.Errorf("login error: %w", err)
+	}
+	if res.VerificationRequired {
+		if code == "" && promptInteractive() {
+			logInfo("verification code sent to %s\n", userAuth)
+			if code, err = promptLine(ctx, "Verification code: "); err != nil {
+				return nil, err
+			}
+			code = strings.TrimSpace(code)
+		}
+		if code == "" {
+			return nil, errVerificationRequired
+		}
+		byJwt, err := DefaultAuthenticator.VerifyCode(ctx, apiURL, userAuth, code)
+		if err != nil {
+			return nil, fmt.Errorf("verify error: %w", err)
+		}
+		res = &LoginResult{ByJwt: byJwt}
+	}
 	if res.ByJwt == "" {
-		return fmt.Errorf("login succeeded but no by_jwt returned")
+		return nil, errors.New("login succeeded but no by_jwt returned")
 	}
 	if err := saveJWT(res.ByJwt); err != nil {
-		return fmt.Errorf("save jwt failed: %w", err)
+		return nil, fmt.Errorf("save jwt failed: %w", err)
 	}
-	fmt.Printf("saved JWT for network %s -> %s\n", res.NetworkName, jwtPath())
-	return nil
+	return res, nil
 }
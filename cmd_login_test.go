@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+// fakeAuthenticator records calls and returns canned results.
+type fakeAuthenticator struct {
+	login      *LoginResult
+	verifyJwt  string
+	verifyCode string
+}
+
+func (f *fakeAuthenticator) LoginWithPassword(_ context.Context, _, _, _ string) (*LoginResult, error) {
+	return f.login, nil
+}
+
+func (f *fakeAuthenticator) VerifyCode(_ context.Context, _, _, code string) (string, error) {
+	f.verifyCode = code
+	return f.verifyJwt, nil
+}
+
+func (f *fakeAuthenticator) MintClientJWT(_ context.Context, _, _, _, _ string) (string, error) {
+	return "", errors.New("not used")
+}
+
+// withPrompts installs fake auth and terminal input for the duration of the test.
+func withPrompts(t *testing.T, auth Authenticator, interactive bool, input string) {
+	t.Helper()
+	t.Setenv("URNETWORK_HOME", t.TempDir())
+	oldAuth, oldInteractive, oldReader, oldOut := DefaultAuthenticator, promptInteractive, stdinReader, promptOut
+	DefaultAuthenticator = auth
+	promptInteractive = func() bool { return interactive }
+	stdinReader = bufio.NewReader(strings.NewReader(input))
+	promptOut = io.Discard
+	t.Cleanup(func() {
+		DefaultAuthenticator, promptInteractive, stdinReader, promptOut = oldAuth, oldInteractive, oldReader, oldOut
+	})
+}
+
+func TestLoginAndVerify_PromptsForCode(t *testing.T) {
+	fa := &fakeAuthenticator{login: &LoginResult{VerificationRequired: true}, verifyJwt: "network-jwt"}
+	withPrompts(t, fa, true, "123456\n")
+
+	res, err := loginAndVerify(context.Background(), "http://unused", "me@example.com", "pw", "")
+	if err != nil {
+		t.Fatalf("loginAndVerify: %v", err)
+	}
+	if fa.verifyCode != "123456" {
+		t.Fatalf("verify code=%q want 123456", fa.verifyCode)
+	}
+	if res.ByJwt != "network-jwt" {
+		t.Fatalf("by_jwt=%q", res.ByJwt)
+	}
+	if got, _ := loadJWT(""); got != "network-jwt" {
+		t.Fatalf("saved jwt=%q", got)
+	}
+}
+
+func TestLoginAndVerify_NonInteractiveNeedsCode(t *testing.T) {
+	fa := &fakeAuthenticator{login: &LoginResult{VerificationRequired: true}}
+	withPrompts(t, fa, false, "")
+
+	_, err := loginAndVerify(context.Background(), "http://unused", "me@example.com", "pw", "")
+	if !errors.Is(err, errVerificationRequired) {
+		t.Fatalf("err=%v want errVerificationRequired", err)
+	}
+}
+
+func TestLoginAndVerify_NoVerification(t *testing.T) {
+	fa := &fakeAuthenticator{login: &LoginResult{ByJwt: "jwt-1", NetworkName: "net"}}
+	withPrompts(t, fa, true, "")
+
+	res, err := loginAndVerify(context.Background(), "http://unused", "me@example.com", "pw", "")
+	if err != nil {
+		t.Fatalf("loginAndVerify: %v", err)
+	}
+	if res.NetworkName != "net" || fa.verifyCode != "" {
+		t.Fatalf("unexpected result %+v verify=%q", res, fa.verifyCode)
+	}
+}
+
+func TestPromptCredentials(t *testing.T) {
+	withPrompts(t, &fakeAuthenticator{}, true, "me@example.com\nsecret\n")
+	u, p, err := promptCredentials(context.Background(), "", "")
+	if err != nil || u != "me@example.com" || p != "secret" {
+		t.Fatalf("got %q %q %v", u, p, err)
+	}
+
+	withPrompts(t, &fakeAuthenticator{}, false, "ignored\n")
+	u, p, err = promptCredentials(context.Background(), "", "")
+	if err != nil || u != "" || p != "" {
+		t.Fatalf("non-interactive should not prompt: %q %q %v", u, p, err)
+	}
+}
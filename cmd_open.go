@@ -9,11 +9,10 @@ import (
 	"github.com/urnetwork/connect"
 )
 
-func cmdOpen(ctx context.Context, opts docopt.Opts) error {
-	apiURL := getStringOr(opts, "--api_url", DefaultAPIURL)
-	connectURL := getStringOr(opts, "--connect_url", DefaultConnectURL)
-	jwtOpt, _ := opts.String("--jwt")
-	jwt, err := loadJWT(jwtOpt)
+func cmdOpen(ctx context.Context, opts docopt.Opts, cfg VPNConfig) error {
+	apiURL := cfg.APIURL
+	connectURL := cfg.ConnectURL
+	jwt, err := loadJWT(cfg.JWT)
 	if err != nil {
 		return err
 	}
@@ -9,10 +9,9 @@ import (
 	"github.com/urnetwork/connect"
 )
 
-func cmdFindProviders(ctx context.Context, opts docopt.Opts) error {
-	apiURL := getStringOr(opts, "--api_url", DefaultAPIURL)
-	jwtOpt, _ := opts.String("--jwt")
-	jwt, err := loadJWT(jwtOpt)
+func cmdFindProviders(ctx context.Context, opts docopt.Opts, cfg VPNConfig) error {
+	apiURL := cfg.APIURL
+	jwt, err := loadJWT(cfg.JWT)
 	if err != nil {
 		return err
 	}
@@ -27,8 +26,7 @@ func cmdFindProviders(ctx context.Context, opts docopt.Opts) error {
 	qCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
 	defer cancel()
 
-	loc := parseLocationConfig(opts)
-	_, specs := buildProviderSpecs(qCtx, apiURL, jwt, loc)
+	_, specs := buildProviderSpecs(qCtx, apiURL, jwt, cfg.Location)
 
 	api := newByAPI(qCtx, apiURL, jwt)
 
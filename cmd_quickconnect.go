@@ -4,7 +4,6 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"os"
 	"strings"
 	"time"
 
@@ -12,62 +11,38 @@ import (
 )
 
 // cmdQuickConnect performs: optional login+verify → ensure client JWT (with refresh) → start VPN.
-func cmdQuickConnect(ctx context.Context, opts docopt.Opts) error {
-	apiURL := getStringOr(opts, "--api_url", DefaultAPIURL)
-
-	userAuth := strings.TrimSpace(getStringOr(opts, "--user_auth", ""))
-	password := strings.TrimSpace(getStringOr(opts, "--password", ""))
-	if userAuth == "" {
-		userAuth = strings.TrimSpace(os.Getenv("URNETWORK_USERNAME"))
-	}
-	if password == "" {
-		password = strings.TrimSpace(os.Getenv("URNETWORK_PASSWORD"))
-	}
+func cmdQuickConnect(ctx context.Context, opts docopt.Opts, cfg VPNConfig) error {
+	apiURL := cfg.APIURL
+	userAuth := cfg.UserAuth
+	password := cfg.Password
 	codeOpt := strings.TrimSpace(getStringOr(opts, "--code", ""))
-	jwtOpt, _ := opts.String("--jwt")
-	forceJWT, _ := opts.Bool("--force_jwt")
-	renewStr := strings.TrimSpace(getStringOr(opts, "--jwt_renew_interval", ""))
-	var renewInterval time.Duration
-	if renewStr != "" {
-		if d, err := time.ParseDuration(renewStr); err == nil {
-			renewInterval = d
-		} else {
-			logWarn("invalid --jwt_renew_interval=%q; ignoring\n", renewStr)
+	jwtOpt := cfg.JWT
+	forceJWT := cfg.ForceJWT
+	description := cfg.Description
+	deviceSpec := cfg.DeviceSpec
+	renewInterval := cfg.JWTRenewInterval
+
+	// On a terminal, prompt for whatever is missing when credentials were partially given
+	// or there is no JWT to fall back on.
+	if _, jwtErr := loadJWT(jwtOpt); userAuth != "" || password != "" || jwtErr != nil {
+		var err error
+		if userAuth, password, err = promptCredentials(ctx, userAuth, password); err != nil {
+			return err
 		}
 	}
 
-	// 1) Login if credentials provided
+	// 1) Login if credentials provided (verification code is prompted for on a terminal)
 	if userAuth != "" || password != "" {
 		if userAuth == "" || password == "" {
 			return errors.New("--user_auth and --password must be provided together")
 		}
-		loginRes, loginErr := loginWithPassword(ctx, apiURL, userAuth, password)
+		loginRes, loginErr := loginAndVerify(ctx, apiURL, userAuth, password, codeOpt)
 		if loginErr != nil {
-			return fmt.Errorf("login error: %w", loginErr)
+			return loginErr
 		}
-		if loginRes.VerificationRequired {
-			if codeOpt == "" {
-				return errors.New("verification required (re-run with --code=<code> or run 'verify')")
-			}
-			// Verification required + code provided → proceed to verify step below.
-		} else {
-			if loginRes.ByJwt == "" {
-				return errors.New("login succeeded but no by_jwt returned")
-			}
-			if err := saveJWT(loginRes.ByJwt); err != nil {
-				return fmt.Errorf("save jwt failed: %w", err)
-			}
+		if loginRes.NetworkName != "" {
 			logInfo("saved JWT for network %s -> %s\n", loginRes.NetworkName, jwtPath())
-		}
-
-		if codeOpt != "" {
-			byJwt2, verifyErr := verifyCode(ctx, apiURL, userAuth, codeOpt)
-			if verifyErr != nil {
-				return fmt.Errorf("verify error: %w", verifyErr)
-			}
-			if err := saveJWT(byJwt2); err != nil {
-				return fmt.Errorf("save jwt failed: %w", err)
-			}
+		} else {
 			logInfo("verified and saved JWT -> %s\n", jwtPath())
 		}
 	}
@@ -87,15 +62,21 @@ func cmdQuickConnect(ctx context.Context, opts docopt.Opts) error {
 				if retryEvery <= 0 {
 					retryEvery = time.Minute
 				}
+				if userAuth == "" || password == "" {
+					logWarn("existing client JWT appears invalid\n")
+					if userAuth, password, err = promptCredentials(ctx, userAuth, password); err != nil {
+						return err
+					}
+				}
 				for {
 					if userAuth == "" || password == "" {
 						return errors.New("existing client JWT appears invalid; provide --user_auth and --password or a BY token via --jwt to refresh")
 					}
-					loginRes, loginErr := loginWithPassword(ctx, apiURL, userAuth, password)
+					loginRes, loginErr := loginAndVerify(ctx, apiURL, userAuth, password, codeOpt)
 					if loginErr != nil {
-						logWarn("jwt refresh: login failed: %v\n", loginErr)
-					} else if !loginRes.VerificationRequired && loginRes.ByJwt != "" {
-						clientJwt, mintErr := mintClientJWT(ctx, apiURL, loginRes.ByJwt)
+						logWarn("jwt refresh: %v\n", loginErr)
+					} else {
+						clientJwt, mintErr := mintClientJWT(ctx, apiURL, loginRes.ByJwt, description, deviceSpec)
 						if mintErr != nil {
 							logWarn("jwt refresh: mint failed: %v\n", mintErr)
 						} else if saveErr := saveJWT(clientJwt); saveErr != nil {
@@ -114,7 +95,7 @@ func cmdQuickConnect(ctx context.Context, opts docopt.Opts) error {
 				}
 			}
 		} else {
-			clientJwt, mintErr := mintClientJWT(ctx, apiURL, jwt)
+			clientJwt, mintErr := mintClientJWT(ctx, apiURL, jwt, description, deviceSpec)
 			if mintErr != nil {
 				return mintErr
 			}
@@ -143,7 +124,7 @@ func cmdQuickConnect(ctx context.Context, opts docopt.Opts) error {
 						logWarn("jwt renew: no jwt available: %v\n", err)
 						continue
 					}
-					clientJwt, mintErr := mintClientJWT(ctx, apiURL, currentJwt)
+					clientJwt, mintErr := mintClientJWT(ctx, apiURL, currentJwt, description, deviceSpec)
 					if mintErr == nil {
 						if saveErr := saveJWT(clientJwt); saveErr != nil {
 							logWarn("jwt renew: save failed: %v\n", saveErr)
@@ -164,7 +145,7 @@ func cmdQuickConnect(ctx context.Context, opts docopt.Opts) error {
 							logWarn("jwt renew: login requires verification or returned no JWT\n")
 							continue
 						}
-						clientJwt2, mintErr2 := mintClientJWT(ctx, apiURL, loginRes.ByJwt)
+						clientJwt2, mintErr2 := mintClientJWT(ctx, apiURL, loginRes.ByJwt, description, deviceSpec)
 						if mintErr2 != nil {
 							logWarn("jwt renew: mint failed: %v\n", mintErr2)
 							continue
@@ -190,8 +171,8 @@ func cmdQuickConnect(ctx context.Context, opts docopt.Opts) error {
 		close(stopRenew)
 		return fmt.Errorf("no jwt available after setup: %w", err)
 	}
-	vpnCfg := parseVPNConfig(opts, finalJWT)
-	runErr := cmdVpn(ctx, vpnCfg)
+	cfg.JWT = finalJWT
+	runErr := cmdVpn(ctx, cfg)
 	close(stopRenew)
 	return runErr
 }
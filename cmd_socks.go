@@ -3,22 +3,36 @@ package main
 import (
 	"context"
 	"fmt"
-
-	"github.com/docopt/docopt-go"
 )
 
-func cmdSocks(ctx context.Context, opts docopt.Opts) error {
-	cfg := parseSOCKSConfig(opts)
-
+func cmdSocks(ctx context.Context, cfg SOCKSConfig) error {
 	if cfg.ListenAddr == "" {
-		return fmt.Errorf("--listen is required for socks command")
+		return fmt.Errorf("--listen (or URNETWORK_LISTEN / listen in the config file) is required for socks command")
 	}
 
 	// NOTE: extender connection is not yet implemented; the binary logs the target
 	// and runs a plain SOCKS5 proxy. Track as a known gap.
 	logInfo("Extender details: IP=%s Port=%s SNI=%s\n", cfg.ExtenderIP, cfg.ExtenderPort, cfg.ExtenderSNI)
 
-	stopSocks, err := StartSocks5(ctx, cfg.ListenAddr, "", cfg.Debug, cfg.AllowDomains, cfg.ExcludeDomains, nil)
+	stopSocks, err := startSocks(ctx, socksOptions{
+		ListenAddr:     cfg.ListenAddr,
+		Debug:          cfg.Debug,
+		AllowDomains:   cfg.AllowDomains,
+		ExcludeDomains: cfg.ExcludeDomains,
+		DNSServers:     cfg.DNSServers,
+		DNSHosts:       cfg.DNSHosts,
+		Rules:          cfg.Rules,
+		Sniff:          cfg.Sniff,
+		SniffTimeout:   cfg.SniffTimeout,
+		EnableIPv6:     cfg.EnableIPv6,
+		Limits:         cfg.Limits,
+		Auth:           cfg.Auth,
+		Shaper:         newShaper(cfg.Bandwidth),
+		AllowSrc:       cfg.AllowSrc,
+		ProxyFrom:      cfg.ProxyFrom,
+		TLS:            cfg.TLS,
+		Blocklist:      startBlocklist(ctx, cfg.DNSBlocklist),
+	})
 	if err != nil {
 		return fmt.Errorf("failed to start SOCKS5 proxy: %w", err)
 	}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/docopt/docopt-go"
+)
+
+// tokenReport is the output of `token inspect` / `whoami`.
+type tokenReport struct {
+	Source    string  `json:"source"`
+	Remaining string  `json:"remaining,omitempty"`
+	Expired   bool    `json:"expired"`
+	APIValid  bool    `json:"api_valid"`
+	Token     jwtInfo `json:"token"`
+}
+
+// cmdTokenInspect decodes the stored (or --jwt) token, validates it against the API
+// and prints the result as text or JSON.
+func cmdTokenInspect(ctx context.Context, opts docopt.Opts, rc *resolvedConfig) error {
+	asJSON, _ := opts.Bool("--json")
+
+	jwt, err := loadJWT(rc.VPN.JWT)
+	if err != nil {
+		return err
+	}
+	info, err := inspectJWT(jwt)
+	if err != nil {
+		return err
+	}
+
+	rep := tokenReport{Source: jwtPath(), Token: info}
+	if rc.VPN.JWT != "" {
+		rep.Source = rc.Origins["jwt"]
+	}
+	if d, ok := info.Remaining(time.Now()); ok {
+		rep.Remaining = d.Round(time.Second).String()
+		rep.Expired = d <= 0
+	}
+	rep.APIValid = validateClientJWT(ctx, rc.VPN.APIURL, jwt)
+
+	if asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(rep)
+	}
+	printTokenReport(rep)
+	return nil
+}
+
+func printTokenReport(rep tokenReport) {
+	orDash := func(s string) string {
+		if s == "" {
+			return "-"
+		}
+		return s
+	}
+	fmtTime := func(t *time.Time) string {
+		if t == nil {
+			return "-"
+		}
+		return t.Format(time.RFC3339)
+	}
+	fmt.Printf("source:       %s\n", rep.Source)
+	fmt.Printf("token_type:   %s\n", rep.Token.TokenType)
+	fmt.Printf("network_name: %s\n", orDash(rep.Token.NetworkName))
+	fmt.Printf("network_id:   %s\n", orDash(rep.Token.NetworkID))
+	fmt.Printf("user_id:      %s\n", orDash(rep.Token.UserID))
+	fmt.Printf("client_id:    %s\n", orDash(rep.Token.ClientID))
+	fmt.Printf("issued_at:    %s\n", fmtTime(rep.Token.IssuedAt))
+	switch {
+	case rep.Token.ExpiresAt == nil:
+		fmt.Printf("expires_at:   never\n")
+	case rep.Expired:
+		fmt.Printf("expires_at:   %s (expired %s ago)\n", fmtTime(rep.Token.ExpiresAt), strings.TrimPrefix(rep.Remaining, "-"))
+	default:
+		fmt.Printf("expires_at:   %s (in %s)\n", fmtTime(rep.Token.ExpiresAt), rep.Remaining)
+	}
+	fmt.Printf("api_valid:    %t\n", rep.APIValid)
+}
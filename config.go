@@ -1,12 +1,19 @@
 package main
 
 import (
+	"errors"
 	"fmt"
+	"net"
+	neturl "net/url"
 	"os"
+	"runtime"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/docopt/docopt-go"
+	"github.com/urnetwork/connect"
 	"gopkg.in/yaml.v3"
 )
 
@@ -17,7 +24,8 @@ type LocationConfig struct {
 	LocationQuery   string
 }
 
-// VPNConfig holds all configuration for cmdVpn and vpnRunCore.
+// VPNConfig holds all configuration for cmdVpn and vpnRunCore, plus the auth and
+// logging settings shared by every command.
 type VPNConfig struct {
 	APIURL              string
 	ConnectURL          string
@@ -28,19 +36,53 @@ type VPNConfig struct {
 	ExtraRoutes         string
 	ExcludeRoutes       string
 	DNSList             string
+	DNSHosts            []string // static name=ip overrides for SOCKS lookups
+	DNSListen           string   // local DNS forwarder address
+	DNSSplit            []string // domain=server upstreams for the DNS forwarder
+	DNSBlocklist        []string // blocklist files or URLs
+	DNSBlocklistRefresh time.Duration
+	DNSBlockResponse    string // nxdomain or zero
 	DNSService          string
 	DNSBootstrap        string
 	SOCKSListen         string
 	AllowDomains        []string
 	ExcludeDomains      []string
+	Sniff               bool            // sniff TLS SNI / HTTP Host of IP-literal SOCKS requests
+	SniffTimeout        time.Duration   // how long to wait for the first client bytes
+	SOCKSLimits         socksLimits     // SOCKS connection caps, relay timeouts and drain period
+	SOCKSAuth           []string        // user:password entries required by the SOCKS proxy
+	SOCKSAllowSrc       []string        // client sources the SOCKS listener accepts
+	SOCKSAllowLocal     bool            // also accept loopback, link-local and private sources
+	SOCKSAllowlist      []*net.IPNet    // parsed from the two above; nil allows every source
+	SOCKSProxyProtocol  []string        // load balancers that send a PROXY protocol header
+	SOCKSProxyFrom      []*net.IPNet    // parsed from SOCKSProxyProtocol; nil trusts none
+	SOCKSTLS            socksTLSOptions // certificates for socks+tls:// listeners
+	Bandwidth           bandwidthOptions
+	Transparent         string // transparent proxy address; "" disables it
+	TransparentMode     string // redirect or tproxy
+	TransparentNft      bool   // install and remove the nft rules for it
+	Shadowsocks         string // Shadowsocks server address (TCP and UDP); "" disables it
+	ShadowsocksMethod   string // chacha20-ietf-poly1305 or aes-256-gcm
+	ShadowsocksPassword string
 	AllowInboundSrcList string
 	AllowInboundLocal   bool
 	EnableIPv6          bool
 	EnableKillSwitch    bool
 	Debug               bool
 	StatsInterval       time.Duration
+	LogLevel            string
+	LogFile             string
 	JWT                 string
+	ForceJWT            bool
+	JWTRenewInterval    time.Duration
+	UserAuth            string
+	Password            string
+	Description         string
+	DeviceSpec          string
 	Location            LocationConfig
+	Rules               []*routeRule     // ordered SOCKS routing rules from the config file
+	Listeners           []*socksListener // extra SOCKS listeners from the config file
+	RouteLocations      []*routeLocation // TUN destinations with their own exit location
 }
 
 // SOCKSConfig holds all configuration for the standalone socks subcommand.
@@ -50,82 +92,337 @@ type SOCKSConfig struct {
 	ExtenderPort   string
 	ExtenderSNI    string
 	ExtenderSecret string
+	DNSServers     []string
+	DNSHosts       []string
+	DNSBlocklist   blocklistOptions
 	AllowDomains   []string
 	ExcludeDomains []string
+	Rules          []*routeRule
+	Sniff          bool
+	SniffTimeout   time.Duration
+	EnableIPv6     bool
+	Limits         socksLimits
+	Auth           []string
+	Bandwidth      bandwidthOptions
+	AllowSrc       []*net.IPNet
+	ProxyFrom      []*net.IPNet
+	TLS            socksTLSOptions
 	Debug          bool
 }
 
-// parseLocationConfig extracts location-related CLI flags into a LocationConfig.
-func parseLocationConfig(opts docopt.Opts) LocationConfig {
-	return LocationConfig{
-		LocationID:      strings.TrimSpace(getStringOr(opts, "--location_id", "")),
-		LocationGroupID: strings.TrimSpace(getStringOr(opts, "--location_group_id", "")),
-		LocationQuery:   strings.TrimSpace(getStringOr(opts, "--location_query", "")),
+// ---------------------------------------------------------------------------
+// Layered configuration: flag > env (URNETWORK_*) > config file > default
+// ---------------------------------------------------------------------------
+
+// configSource records which layer supplied a setting's effective value.
+type configSource string
+
+const (
+	sourceDefault configSource = "default"
+	sourceFile    configSource = "file"
+	sourceEnv     configSource = "env"
+	sourceFlag    configSource = "flag"
+)
+
+// configSetting describes one setting. Its value is taken from the first layer that
+// provides it: a docopt flag, an environment variable, the config file, then Default.
+type configSetting struct {
+	Key      string   // YAML key; the primary env var is URNETWORK_<KEY>
+	Flags    []string // docopt flags; the first is canonical
+	Env      []string // extra environment variable names accepted after URNETWORK_<KEY>
+	FileKeys []string // extra YAML keys accepted besides Key
+	Default  string
+	Secret   bool                         // redacted by `config show`
+	Target   func(rc *resolvedConfig) any // pointer to the field that receives the value
+}
+
+// envNames returns the environment variables consulted for s, in priority order.
+func (s configSetting) envNames() []string {
+	return append([]string{"URNETWORK_" + strings.ToUpper(s.Key)}, s.Env...)
+}
+
+// configSettings lists every setting the resolver knows about.
+// Duration settings accept Go durations ("30m") or bare integers meaning seconds.
+var configSettings = []configSetting{
+	{Key: "api_url", Flags: []string{"--api_url"}, Default: DefaultAPIURL, Target: func(rc *resolvedConfig) any { return &rc.VPN.APIURL }},
+	{Key: "connect_url", Flags: []string{"--connect_url"}, Default: DefaultConnectURL, Target: func(rc *resolvedConfig) any { return &rc.VPN.ConnectURL }},
+	{Key: "jwt", Flags: []string{"--jwt"}, Secret: true, Target: func(rc *resolvedConfig) any { return &rc.VPN.JWT }},
+	{Key: "user_auth", Flags: []string{"--user_auth"}, Env: []string{"URNETWORK_USERNAME"}, Target: func(rc *resolvedConfig) any { return &rc.VPN.UserAuth }},
+	{Key: "password", Flags: []string{"--password"}, Secret: true, Target: func(rc *resolvedConfig) any { return &rc.VPN.Password }},
+	{Key: "force_jwt", Flags: []string{"--force_jwt"}, Default: "false", Target: func(rc *resolvedConfig) any { return &rc.VPN.ForceJWT }},
+	{Key: "jwt_renew_interval", Flags: []string{"--jwt_renew_interval"}, Default: "0", Target: func(rc *resolvedConfig) any { return &rc.VPN.JWTRenewInterval }},
+	{Key: "description", Flags: []string{"--description"}, Target: func(rc *resolvedConfig) any { return &rc.VPN.Description }},
+	{Key: "device_spec", Flags: []string{"--device_spec"}, Target: func(rc *resolvedConfig) any { return &rc.VPN.DeviceSpec }},
+	{Key: "tun", Flags: []string{"--tun"}, Target: func(rc *resolvedConfig) any { return &rc.VPN.TunName }},
+	{Key: "ip_cidr", Flags: []string{"--ip_cidr"}, Default: "10.255.0.2/24", Target: func(rc *resolvedConfig) any { return &rc.VPN.IPCIDR }},
+	{Key: "mtu", Flags: []string{"--mtu"}, Default: "1420", Target: func(rc *resolvedConfig) any { return &rc.VPN.MTU }},
+	{Key: "default_route", Flags: []string{"--default_route"}, Default: "false", Target: func(rc *resolvedConfig) any { return &rc.VPN.DefaultRoute }},
+	{Key: "route", Flags: []string{"--route"}, Target: func(rc *resolvedConfig) any { return &rc.VPN.ExtraRoutes }},
+	{Key: "exclude_route", Flags: []string{"--exclude_route"}, Target: func(rc *resolvedConfig) any { return &rc.VPN.ExcludeRoutes }},
+	{Key: "dns", Flags: []string{"--dns"}, Target: func(rc *resolvedConfig) any { return &rc.VPN.DNSList }},
+	{Key: "dns_hosts", Flags: []string{"--dns_hosts"}, Target: func(rc *resolvedConfig) any { return &rc.VPN.DNSHosts }},
+	{Key: "dns_listen", Flags: []string{"--dns_listen"}, Target: func(rc *resolvedConfig) any { return &rc.VPN.DNSListen }},
+	{Key: "dns_split", Flags: []string{"--dns_split"}, Target: func(rc *resolvedConfig) any { return &rc.VPN.DNSSplit }},
+	{Key: "dns_blocklist", Flags: []string{"--dns_blocklist"}, Target: func(rc *resolvedConfig) any { return &rc.VPN.DNSBlocklist }},
+	{Key: "dns_blocklist_refresh", Flags: []string{"--dns_blocklist_refresh"}, Default: DefaultBlocklistRefresh.String(), Target: func(rc *resolvedConfig) any { return &rc.VPN.DNSBlocklistRefresh }},
+	{Key: "dns_block_response", Flags: []string{"--dns_block_response"}, Default: "nxdomain", Target: func(rc *resolvedConfig) any { return &rc.VPN.DNSBlockResponse }},
+	{Key: "dns_service", Flags: []string{"--dns_service"}, Target: func(rc *resolvedConfig) any { return &rc.VPN.DNSService }},
+	{Key: "dns_bootstrap", Flags: []string{"--dns_bootstrap"}, Default: "bypass", Target: func(rc *resolvedConfig) any { return &rc.VPN.DNSBootstrap }},
+	{Key: "location_query", Flags: []string{"--location_query"}, Target: func(rc *resolvedConfig) any { return &rc.VPN.Location.LocationQuery }},
+	{Key: "location_id", Flags: []string{"--location_id"}, Target: func(rc *resolvedConfig) any { return &rc.VPN.Location.LocationID }},
+	{Key: "location_group_id", Flags: []string{"--location_group_id"}, Target: func(rc *resolvedConfig) any { return &rc.VPN.Location.LocationGroupID }},
+	{Key: "socks", Flags: []string{"--socks", "--socks_listen"}, Env: []string{"URNETWORK_SOCKS_LISTEN"}, FileKeys: []string{"socks_listen"}, Target: func(rc *resolvedConfig) any { return &rc.VPN.SOCKSListen }},
+	{Key: "domain", Flags: []string{"--domain"}, Target: func(rc *resolvedConfig) any { return &rc.VPN.AllowDomains }},
+	{Key: "exclude_domain", Flags: []string{"--exclude_domain"}, Target: func(rc *resolvedConfig) any { return &rc.VPN.ExcludeDomains }},
+	{Key: "sniff", Flags: []string{"--sniff"}, Default: "false", Target: func(rc *resolvedConfig) any { return &rc.VPN.Sniff }},
+	{Key: "sniff_timeout", Flags: []string{"--sniff_timeout"}, Default: DefaultSniffTimeout.String(), Target: func(rc *resolvedConfig) any { return &rc.VPN.SniffTimeout }},
+	{Key: "socks_max_conns", Flags: []string{"--socks_max_conns"}, Default: strconv.Itoa(DefaultSocksMaxConns), Target: func(rc *resolvedConfig) any { return &rc.VPN.SOCKSLimits.MaxConns }},
+	{Key: "socks_max_conns_per_ip", Flags: []string{"--socks_max_conns_per_ip"}, Default: "0", Target: func(rc *resolvedConfig) any { return &rc.VPN.SOCKSLimits.MaxConnsPerIP }},
+	{Key: "socks_idle_timeout", Flags: []string{"--socks_idle_timeout"}, Default: DefaultSocksIdleTimeout.String(), Target: func(rc *resolvedConfig) any { return &rc.VPN.SOCKSLimits.IdleTimeout }},
+	{Key: "socks_half_close_timeout", Flags: []string{"--socks_half_close_timeout"}, Default: DefaultSocksHalfCloseTimeout.String(), Target: func(rc *resolvedConfig) any { return &rc.VPN.SOCKSLimits.HalfCloseTimeout }},
+	{Key: "socks_drain_timeout", Flags: []string{"--socks_drain_timeout"}, Default: DefaultSocksDrainTimeout.String(), Target: func(rc *resolvedConfig) any { return &rc.VPN.SOCKSLimits.DrainTimeout }},
+	{Key: "socks_auth", Flags: []string{"--socks_auth"}, Secret: true, Target: func(rc *resolvedConfig) any { return &rc.VPN.SOCKSAuth }},
+	{Key: "socks_upload_limit", Flags: []string{"--socks_upload_limit"}, Default: "0", Target: func(rc *resolvedConfig) any { return &rc.VPN.Bandwidth.Upload }},
+	{Key: "socks_download_limit", Flags: []string{"--socks_download_limit"}, Default: "0", Target: func(rc *resolvedConfig) any { return &rc.VPN.Bandwidth.Download }},
+	{Key: "socks_allow_src", Flags: []string{"--socks_allow_src"}, Target: func(rc *resolvedConfig) any { return &rc.VPN.SOCKSAllowSrc }},
+	{Key: "socks_allow_local", Flags: []string{"--socks_allow_local"}, Default: "false", Target: func(rc *resolvedConfig) any { return &rc.VPN.SOCKSAllowLocal }},
+	{Key: "socks_proxy_protocol", Flags: []string{"--socks_proxy_protocol"}, Target: func(rc *resolvedConfig) any { return &rc.VPN.SOCKSProxyProtocol }},
+	{Key: "socks_tls_cert", Flags: []string{"--socks_tls_cert"}, Target: func(rc *resolvedConfig) any { return &rc.VPN.SOCKSTLS.Cert }},
+	{Key: "socks_tls_key", Flags: []string{"--socks_tls_key"}, Target: func(rc *resolvedConfig) any { return &rc.VPN.SOCKSTLS.Key }},
+	{Key: "socks_tls_client_ca", Flags: []string{"--socks_tls_client_ca"}, Target: func(rc *resolvedConfig) any { return &rc.VPN.SOCKSTLS.ClientCA }},
+	{Key: "transparent", Flags: []string{"--transparent"}, Target: func(rc *resolvedConfig) any { return &rc.VPN.Transparent }},
+	{Key: "transparent_mode", Flags: []string{"--transparent_mode"}, Default: transparentRedirect, Target: func(rc *resolvedConfig) any { return &rc.VPN.TransparentMode }},
+	{Key: "transparent_nft", Flags: []string{"--transparent_nft"}, Default: "false", Target: func(rc *resolvedConfig) any { return &rc.VPN.TransparentNft }},
+	{Key: "shadowsocks", Flags: []string{"--shadowsocks"}, Target: func(rc *resolvedConfig) any { return &rc.VPN.Shadowsocks }},
+	{Key: "shadowsocks_method", Flags: []string{"--shadowsocks_method"}, Default: shadowsocksChaCha20, Target: func(rc *resolvedConfig) any { return &rc.VPN.ShadowsocksMethod }},
+	{Key: "shadowsocks_password", Flags: []string{"--shadowsocks_password"}, Secret: true, Target: func(rc *resolvedConfig) any { return &rc.VPN.ShadowsocksPassword }},
+	{Key: "allow_inbound_src", Flags: []string{"--allow_inbound_src"}, Target: func(rc *resolvedConfig) any { return &rc.VPN.AllowInboundSrcList }},
+	{Key: "allow_inbound_local", Flags: []string{"--allow_inbound_local"}, Default: "false", Target: func(rc *resolvedConfig) any { return &rc.VPN.AllowInboundLocal }},
+	{Key: "enable_ipv6", Flags: []string{"--enable_ipv6"}, Default: "false", Target: func(rc *resolvedConfig) any { return &rc.VPN.EnableIPv6 }},
+	{Key: "kill_switch", Flags: []string{"--kill_switch"}, Default: "false", Target: func(rc *resolvedConfig) any { return &rc.VPN.EnableKillSwitch }},
+	{Key: "debug", Flags: []string{"--debug"}, Default: "false", Target: func(rc *resolvedConfig) any { return &rc.VPN.Debug }},
+	{Key: "log_level", Flags: []string{"--log_level"}, Target: func(rc *resolvedConfig) any { return &rc.VPN.LogLevel }},
+	{Key: "log_file", Flags: []string{"--log_file"}, Target: func(rc *resolvedConfig) any { return &rc.VPN.LogFile }},
+	{Key: "stats_interval", Flags: []string{"--stats_interval"}, Default: "5", Target: func(rc *resolvedConfig) any { return &rc.VPN.StatsInterval }},
+	{Key: "listen", Flags: []string{"--listen"}, Target: func(rc *resolvedConfig) any { return &rc.SOCKS.ListenAddr }},
+	{Key: "extender_ip", Flags: []string{"--extender_ip"}, Target: func(rc *resolvedConfig) any { return &rc.SOCKS.ExtenderIP }},
+	{Key: "extender_port", Flags: []string{"--extender_port"}, Target: func(rc *resolvedConfig) any { return &rc.SOCKS.ExtenderPort }},
+	{Key: "extender_sni", Flags: []string{"--extender_sni"}, Target: func(rc *resolvedConfig) any { return &rc.SOCKS.ExtenderSNI }},
+	{Key: "extender_secret", Flags: []string{"--extender_secret"}, Secret: true, Target: func(rc *resolvedConfig) any { return &rc.SOCKS.ExtenderSecret }},
+}
+
+// resolvedConfig is the effective configuration of one invocation together with the
+// provenance of every setting.
+type resolvedConfig struct {
+	VPN        VPNConfig
+	SOCKS      SOCKSConfig
+	ConfigPath string                  // config file in use, "" when none
+	Sources    map[string]configSource // setting key -> layer that supplied it
+	Origins    map[string]string       // setting key -> human-readable origin (flag name, env var, file key)
+	// Problems are the values that could not be parsed; each such setting keeps its
+	// default. validateConfig reports them with the rest.
+	Problems []error
+}
+
+// resolveConfig builds the effective configuration from parsed docopt options, the
+// environment and the config file named by --config or URNETWORK_CONFIG.
+func resolveConfig(opts docopt.Opts) (*resolvedConfig, error) {
+	return resolveConfigWith(opts, os.LookupEnv)
+}
+
+// resolveConfigWith is resolveConfig with an injectable environment lookup for tests.
+// When values do not parse it returns the configuration along with an error joining
+// rc.Problems, so `config validate` can report every one of them.
+func resolveConfigWith(opts docopt.Opts, lookupEnv func(string) (string, bool)) (*resolvedConfig, error) {
+	rc := &resolvedConfig{
+		Sources: map[string]configSource{},
+		Origins: map[string]string{},
+	}
+
+	path := strings.TrimSpace(getStringOr(opts, "--config", ""))
+	if path == "" {
+		if v, ok := lookupEnv("URNETWORK_CONFIG"); ok {
+			path = strings.TrimSpace(v)
+		}
 	}
+	cf, err := loadConfigFile(path)
+	if err != nil {
+		return nil, err
+	}
+	rc.ConfigPath = cf.Path
+
+	for _, s := range configSettings {
+		raw, src, origin := s.Default, sourceDefault, "default"
+		if v, flag, ok := flagValue(opts, s.Flags); ok {
+			raw, src, origin = v, sourceFlag, flag
+		} else if v, name, ok := envValue(lookupEnv, s.envNames()); ok {
+			raw, src, origin = v, sourceEnv, name
+		} else if v, key, ok := cf.value(append([]string{s.Key}, s.FileKeys...)); ok {
+			raw, src, origin = v, sourceFile, fmt.Sprintf("%s: %s", cf.Path, key)
+		}
+		rc.Sources[s.Key] = src
+		rc.Origins[s.Key] = origin
+		if err := assignSetting(s.Target(rc), raw); err != nil {
+			rc.Problems = append(rc.Problems, fmt.Errorf("%s (from %s): %q: %w", s.Key, origin, raw, err))
+			_ = assignSetting(s.Target(rc), s.Default)
+		}
+	}
+
+	// Fail closed: a listener must never start open because its allowlist did not parse.
+	if rc.VPN.SOCKSAllowlist, err = parseSourceAllowlist(rc.VPN.SOCKSAllowSrc, rc.VPN.SOCKSAllowLocal); err != nil {
+		rc.Problems = append(rc.Problems, fmt.Errorf("socks_allow_src (from %s): %w", rc.Origins["socks_allow_src"], err))
+	}
+	if rc.VPN.SOCKSProxyFrom, err = parseSourceAllowlist(rc.VPN.SOCKSProxyProtocol, false); err != nil {
+		rc.Problems = append(rc.Problems, fmt.Errorf("socks_proxy_protocol (from %s): %w", rc.Origins["socks_proxy_protocol"], err))
+	}
+
+	if n, ok := cf.Sections["rules"]; ok {
+		rules, err := parseRouteRules(n)
+		if err != nil {
+			rc.Problems = append(rc.Problems, fmt.Errorf("config file %s: %w", cf.Path, err))
+		}
+		rc.VPN.Rules = rules
+	}
+	if n, ok := cf.Sections["bandwidth"]; ok {
+		classes, err := parseBandwidthClasses(n)
+		if err != nil {
+			rc.Problems = append(rc.Problems, fmt.Errorf("config file %s: %w", cf.Path, err))
+		}
+		rc.VPN.Bandwidth.Classes = classes
+		rc.Origins["bandwidth"] = fmt.Sprintf("%s: bandwidth", cf.Path)
+	}
+	if n, ok := cf.Sections["listeners"]; ok {
+		listeners, err := parseListeners(n)
+		if err != nil {
+			rc.Problems = append(rc.Problems, fmt.Errorf("config file %s: %w", cf.Path, err))
+		}
+		rc.VPN.Listeners = listeners
+	}
+	if n, ok := cf.Sections["route_locations"]; ok {
+		routes, err := parseRouteLocations(n)
+		if err != nil {
+			rc.Problems = append(rc.Problems, fmt.Errorf("config file %s: %w", cf.Path, err))
+		}
+		rc.VPN.RouteLocations = routes
+	}
+
+	// The standalone socks command shares the DNS, routing, sniffing, IPv6, limit, auth,
+	// bandwidth, source allowlist, PROXY protocol, TLS and debug settings.
+	rc.SOCKS.AllowDomains = rc.VPN.AllowDomains
+	rc.SOCKS.ExcludeDomains = rc.VPN.ExcludeDomains
+	rc.SOCKS.Rules = rc.VPN.Rules
+	rc.SOCKS.DNSServers = splitCSV(rc.VPN.DNSList)
+	rc.SOCKS.DNSHosts = rc.VPN.DNSHosts
+	rc.SOCKS.DNSBlocklist = rc.VPN.blocklistOptions()
+	rc.SOCKS.Sniff = rc.VPN.Sniff
+	rc.SOCKS.SniffTimeout = rc.VPN.SniffTimeout
+	rc.SOCKS.EnableIPv6 = rc.VPN.EnableIPv6
+	rc.SOCKS.Limits = rc.VPN.SOCKSLimits
+	rc.SOCKS.Auth = rc.VPN.SOCKSAuth
+	rc.SOCKS.Bandwidth = rc.VPN.Bandwidth
+	rc.SOCKS.AllowSrc = rc.VPN.SOCKSAllowlist
+	rc.SOCKS.ProxyFrom = rc.VPN.SOCKSProxyFrom
+	rc.SOCKS.TLS = rc.VPN.SOCKSTLS
+	rc.SOCKS.Debug = rc.VPN.Debug
+	if len(rc.Problems) > 0 {
+		return rc, errors.Join(rc.Problems...)
+	}
+	return rc, nil
 }
 
-// parseVPNConfig extracts the full VPN configuration from parsed docopt options and a
-// pre-resolved JWT string. This is the only place docopt.Opts is read for VPN settings.
-func parseVPNConfig(opts docopt.Opts, jwt string) VPNConfig {
-	defRoute, _ := opts.Bool("--default_route")
-	dbg, _ := opts.Bool("--debug")
-	allowLocal, _ := opts.Bool("--allow_inbound_local")
-	enableIPv6, _ := opts.Bool("--enable_ipv6")
-	killSwitch, _ := opts.Bool("--kill_switch")
-	socksListen := strings.TrimSpace(getStringOr(opts, "--socks", getStringOr(opts, "--socks_listen", "")))
-	return VPNConfig{
-		APIURL:              getStringOr(opts, "--api_url", DefaultAPIURL),
-		ConnectURL:          getStringOr(opts, "--connect_url", DefaultConnectURL),
-		TunName:             getStringOr(opts, "--tun", ""),
-		IPCIDR:              getStringOr(opts, "--ip_cidr", "10.255.0.2/24"),
-		MTU:                 getIntOr(opts, "--mtu", 1420),
-		DefaultRoute:        defRoute,
-		ExtraRoutes:         getStringOr(opts, "--route", ""),
-		ExcludeRoutes:       getStringOr(opts, "--exclude_route", ""),
-		DNSList:             getStringOr(opts, "--dns", ""),
-		DNSService:          strings.TrimSpace(getStringOr(opts, "--dns_service", "")),
-		DNSBootstrap:        strings.TrimSpace(getStringOr(opts, "--dns_bootstrap", "bypass")),
-		SOCKSListen:         socksListen,
-		AllowDomains:        splitCSV(getStringOr(opts, "--domain", "")),
-		ExcludeDomains:      splitCSV(getStringOr(opts, "--exclude_domain", "")),
-		AllowInboundSrcList: strings.TrimSpace(getStringOr(opts, "--allow_inbound_src", "")),
-		AllowInboundLocal:   allowLocal,
-		EnableIPv6:          enableIPv6,
-		EnableKillSwitch:    killSwitch,
-		Debug:               dbg,
-		StatsInterval:       time.Duration(getIntOr(opts, "--stats_interval", 5)) * time.Second,
-		JWT:                 jwt,
-		Location:            parseLocationConfig(opts),
+// flagValue returns the value of the first flag in flags that was given on the command line.
+// docopt reports absent options as nil (valued) or false (boolean).
+func flagValue(opts docopt.Opts, flags []string) (string, string, bool) {
+	for _, f := range flags {
+		switch v := opts[f].(type) {
+		case string:
+			return v, f, true
+		case bool:
+			if v {
+				return "true", f, true
+			}
+		}
 	}
+	return "", "", false
 }
 
-// parseSOCKSConfig extracts SOCKS proxy configuration from parsed docopt options.
-func parseSOCKSConfig(opts docopt.Opts) SOCKSConfig {
-	dbg, _ := opts.Bool("--debug")
-	listen, _ := opts.String("--listen")
-	extIP, _ := opts.String("--extender_ip")
-	extPort, _ := opts.String("--extender_port")
-	extSNI, _ := opts.String("--extender_sni")
-	extSec, _ := opts.String("--extender_secret")
-	return SOCKSConfig{
-		ListenAddr:     strings.TrimSpace(listen),
-		ExtenderIP:     strings.TrimSpace(extIP),
-		ExtenderPort:   strings.TrimSpace(extPort),
-		ExtenderSNI:    strings.TrimSpace(extSNI),
-		ExtenderSecret: strings.TrimSpace(extSec),
-		AllowDomains:   splitCSV(getStringOr(opts, "--domain", "")),
-		ExcludeDomains: splitCSV(getStringOr(opts, "--exclude_domain", "")),
-		Debug:          dbg,
+// envValue returns the first non-empty environment variable among names.
+func envValue(lookupEnv func(string) (string, bool), names []string) (string, string, bool) {
+	for _, n := range names {
+		if v, ok := lookupEnv(n); ok && strings.TrimSpace(v) != "" {
+			return v, n, true
+		}
 	}
+	return "", "", false
+}
+
+// assignSetting parses raw according to the type of ptr and stores it.
+func assignSetting(ptr any, raw string) error {
+	raw = strings.TrimSpace(raw)
+	switch p := ptr.(type) {
+	case *string:
+		*p = raw
+	case *[]string:
+		*p = splitCSV(raw)
+	case *bool:
+		if raw == "" {
+			*p = false
+			return nil
+		}
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return fmt.Errorf("want true or false")
+		}
+		*p = b
+	case *int:
+		if raw == "" {
+			*p = 0
+			return nil
+		}
+		n, err := strconv.Atoi(raw)
+		if err != nil {
+			return fmt.Errorf("want an integer")
+		}
+		*p = n
+	case *time.Duration:
+		d, err := parseSecondsOrDuration(raw)
+		if err != nil {
+			return err
+		}
+		*p = d
+	case *byteRate:
+		r, err := parseByteRate(raw)
+		if err != nil {
+			return err
+		}
+		*p = r
+	default:
+		return fmt.Errorf("unsupported setting type %T", ptr)
+	}
+	return nil
+}
+
+// parseSecondsOrDuration parses a Go duration ("1h30m") or a bare integer number of seconds.
+func parseSecondsOrDuration(raw string) (time.Duration, error) {
+	if raw == "" {
+		return 0, nil
+	}
+	if n, err := strconv.Atoi(raw); err == nil {
+		return time.Duration(n) * time.Second, nil
+	}
+	d, err := time.ParseDuration(raw)
+	if err != nil {
+		return 0, fmt.Errorf("want a duration like 30s, 15m or 12h")
+	}
+	return d, nil
 }
 
 // ---------------------------------------------------------------------------
 // Config file (--config / URNETWORK_CONFIG)
 // ---------------------------------------------------------------------------
 
-// ConfigFile holds all fields that can be set via a YAML config file.
-// CLI flags take precedence over config file values; the file only supplies
-// defaults for fields that are empty/zero after CLI parsing.
+// configFile is a parsed YAML config file. Every key of configSettings may appear
+// at the top level; list settings accept a YAML sequence or a comma-separated string.
 //
 // Example (~/.urnetwork/config.yaml):
 //
@@ -135,125 +432,395 @@ func parseSOCKSConfig(opts docopt.Opts) SOCKSConfig {
 //	ip_cidr: 10.255.0.2/24
 //	mtu: 1420
 //	default_route: false
+//	kill_switch: false
+//	enable_ipv6: false
 //	dns:
 //	  - "1.1.1.1"
 //	  - "8.8.8.8"
 //	dns_service: "Wi-Fi"
 //	dns_bootstrap: bypass
 //	location_query: "country:Germany"
+//	jwt_renew_interval: 12h
 //	log_level: info
+//	log_file: /var/log/urnet-client.log
 //	stats_interval: 5
-type ConfigFile struct {
-	APIURL            string   `yaml:"api_url"`
-	ConnectURL        string   `yaml:"connect_url"`
-	TunName           string   `yaml:"tun"`
-	IPCIDR            string   `yaml:"ip_cidr"`
-	MTU               int      `yaml:"mtu"`
-	DefaultRoute      bool     `yaml:"default_route"`
-	ExtraRoutes       string   `yaml:"route"`
-	ExcludeRoutes     string   `yaml:"exclude_route"`
-	DNS               []string `yaml:"dns"`
-	DNSService        string   `yaml:"dns_service"`
-	DNSBootstrap      string   `yaml:"dns_bootstrap"`
-	SOCKSListen       string   `yaml:"socks"`
-	AllowDomains      []string `yaml:"domain"`
-	ExcludeDomains    []string `yaml:"exclude_domain"`
-	AllowInboundSrc   string   `yaml:"allow_inbound_src"`
-	AllowInboundLocal bool     `yaml:"allow_inbound_local"`
-	LocationQuery     string   `yaml:"location_query"`
-	LocationID        string   `yaml:"location_id"`
-	LocationGroupID   string   `yaml:"location_group_id"`
-	LogLevel          string   `yaml:"log_level"`
-	StatsInterval     int      `yaml:"stats_interval"`
-	Debug             bool     `yaml:"debug"`
+type configFile struct {
+	Path     string
+	Values   map[string]string
+	Sections map[string]*yaml.Node // structured sections, see configSections
+}
+
+// configSections are the structured (non-scalar) top-level keys of the config file.
+// They are only settable from the file and are decoded by their own parsers.
+var configSections = map[string]bool{
+	"rules":           true,
+	"bandwidth":       true,
+	"listeners":       true,
+	"route_locations": true,
+}
+
+// value returns the value of the first key in keys that is present in the file.
+func (cf configFile) value(keys []string) (string, string, bool) {
+	for _, k := range keys {
+		if v, ok := cf.Values[k]; ok {
+			return v, k, true
+		}
+	}
+	return "", "", false
 }
 
 // loadConfigFile reads and parses a YAML config file from path.
-// Returns an empty ConfigFile (no error) when path is "".
-func loadConfigFile(path string) (ConfigFile, error) {
+// Returns an empty configFile (no error) when path is "". Unknown keys are rejected so
+// typos do not silently fall back to defaults.
+func loadConfigFile(path string) (configFile, error) {
+	cf := configFile{Path: path, Values: map[string]string{}, Sections: map[string]*yaml.Node{}}
 	if strings.TrimSpace(path) == "" {
-		return ConfigFile{}, nil
+		return cf, nil
 	}
 	data, err := os.ReadFile(path)
 	if err != nil {
-		return ConfigFile{}, fmt.Errorf("config file: %w", err)
+		return configFile{}, fmt.Errorf("config file: %w", err)
+	}
+	var nodes map[string]yaml.Node
+	if err := yaml.Unmarshal(data, &nodes); err != nil {
+		return configFile{}, fmt.Errorf("config file parse: %w", err)
 	}
-	var cf ConfigFile
-	if err := yaml.Unmarshal(data, &cf); err != nil {
-		return ConfigFile{}, fmt.Errorf("config file parse: %w", err)
+	known := map[string]bool{}
+	for _, s := range configSettings {
+		known[s.Key] = true
+		for _, k := range s.FileKeys {
+			known[k] = true
+		}
+	}
+	keys := make([]string, 0, len(nodes))
+	for k := range nodes {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		n := nodes[k]
+		if configSections[k] {
+			cf.Sections[k] = &n
+			continue
+		}
+		if !known[k] {
+			return configFile{}, fmt.Errorf("config file %s: unknown key %q", path, k)
+		}
+		switch n.Kind {
+		case yaml.ScalarNode:
+			if n.Tag == "!!null" {
+				cf.Values[k] = ""
+			} else {
+				cf.Values[k] = n.Value
+			}
+		case yaml.SequenceNode:
+			items := make([]string, 0, len(n.Content))
+			for _, c := range n.Content {
+				if c.Kind != yaml.ScalarNode {
+					return configFile{}, fmt.Errorf("config file %s: %s: list items must be scalars (line %d)", path, k, c.Line)
+				}
+				items = append(items, c.Value)
+			}
+			cf.Values[k] = strings.Join(items, ",")
+		default:
+			return configFile{}, fmt.Errorf("config file %s: %s: expected a value or a list (line %d)", path, k, n.Line)
+		}
 	}
 	return cf, nil
 }
 
-// applyConfigFile merges cf into cfg: any cfg field that is zero/empty is
-// filled from cf. CLI-parsed values (non-zero) are never overwritten.
-func applyConfigFile(cfg VPNConfig, cf ConfigFile) VPNConfig {
-	if cfg.APIURL == "" || cfg.APIURL == DefaultAPIURL {
-		if cf.APIURL != "" {
-			cfg.APIURL = cf.APIURL
+// ---------------------------------------------------------------------------
+// Validation (config validate)
+// ---------------------------------------------------------------------------
+
+// validateConfig checks the resolved settings for malformed values and conflicting
+// options. Each problem names the setting and where its value came from.
+func validateConfig(rc *resolvedConfig) []error {
+	errs := append([]error(nil), rc.Problems...)
+	bad := func(key, format string, args ...any) {
+		errs = append(errs, fmt.Errorf("%s (from %s): %s", key, rc.Origins[key], fmt.Sprintf(format, args...)))
+	}
+	v := rc.VPN
+
+	for _, key := range []string{"api_url", "connect_url"} {
+		raw := v.APIURL
+		schemes := []string{"http", "https"}
+		if key == "connect_url" {
+			raw = v.ConnectURL
+			schemes = []string{"ws", "wss"}
 		}
+		u, err := neturl.Parse(raw)
+		if err != nil || u.Host == "" || !containsFold(schemes, u.Scheme) {
+			bad(key, "%q is not a %s URL", raw, strings.Join(schemes, "/"))
+		}
+	}
+
+	if !isTUNDisabled(v.TunName) && strings.TrimSpace(v.TunName) != "" {
+		if ip, _, err := net.ParseCIDR(v.IPCIDR); err != nil || ip.To4() == nil {
+			bad("ip_cidr", "%q is not an IPv4 CIDR like 10.255.0.2/24", v.IPCIDR)
+		}
+		if v.MTU < 576 || v.MTU > 65535 {
+			bad("mtu", "%d is out of range 576-65535", v.MTU)
+		} else if v.EnableIPv6 && v.MTU < 1280 {
+			bad("mtu", "%d is below the IPv6 minimum of 1280 (enable_ipv6 is set)", v.MTU)
+		}
+	}
+	for _, key := range []string{"route", "exclude_route", "allow_inbound_src"} {
+		list := map[string]string{"route": v.ExtraRoutes, "exclude_route": v.ExcludeRoutes, "allow_inbound_src": v.AllowInboundSrcList}[key]
+		for _, r := range splitCSV(list) {
+			if parseCIDRHost(r) == nil {
+				bad(key, "%q is not an IP address or CIDR", r)
+			}
+		}
+	}
+	for _, d := range splitCSV(v.DNSList) {
+		if _, err := parseDNSUpstream(d); err != nil {
+			bad("dns", "%v", err)
+		}
+	}
+	if _, err := parseDNSHosts(v.DNSHosts); err != nil {
+		bad("dns_hosts", "%v", err)
 	}
-	if cfg.ConnectURL == "" || cfg.ConnectURL == DefaultConnectURL {
-		if cf.ConnectURL != "" {
-			cfg.ConnectURL = cf.ConnectURL
+	if _, err := parseDNSSplit(v.DNSSplit); err != nil {
+		bad("dns_split", "%v", err)
+	}
+	for _, src := range v.DNSBlocklist {
+		if isBlocklistURL(src) {
+			if u, err := neturl.Parse(src); err != nil || u.Host == "" {
+				bad("dns_blocklist", "%q is not a valid URL", src)
+			}
+		} else if _, err := os.Stat(src); err != nil {
+			bad("dns_blocklist", "%v", err)
 		}
 	}
-	if cfg.TunName == "" && cf.TunName != "" {
-		cfg.TunName = cf.TunName
+	if v.DNSBlocklistRefresh != 0 && v.DNSBlocklistRefresh < time.Minute {
+		bad("dns_blocklist_refresh", "%s is shorter than 1m (0 disables refresh)", v.DNSBlocklistRefresh)
 	}
-	if cfg.IPCIDR == "10.255.0.2/24" && cf.IPCIDR != "" {
-		cfg.IPCIDR = cf.IPCIDR
+	switch strings.ToLower(v.DNSBlockResponse) {
+	case "nxdomain", "zero":
+	default:
+		bad("dns_block_response", "%q must be one of nxdomain, zero", v.DNSBlockResponse)
 	}
-	if cfg.MTU == 1420 && cf.MTU != 0 {
-		cfg.MTU = cf.MTU
+	switch v.TransparentMode {
+	case transparentRedirect, transparentTProxy:
+	default:
+		bad("transparent_mode", "%q must be one of redirect, tproxy", v.TransparentMode)
 	}
-	if !cfg.DefaultRoute && cf.DefaultRoute {
-		cfg.DefaultRoute = true
+	if v.Transparent != "" && runtime.GOOS != "linux" {
+		bad("transparent", "is only supported on Linux")
 	}
-	if cfg.ExtraRoutes == "" && cf.ExtraRoutes != "" {
-		cfg.ExtraRoutes = cf.ExtraRoutes
+	if v.TransparentNft && v.Transparent == "" {
+		bad("transparent_nft", "has no effect without transparent")
 	}
-	if cfg.ExcludeRoutes == "" && cf.ExcludeRoutes != "" {
-		cfg.ExcludeRoutes = cf.ExcludeRoutes
+	switch v.ShadowsocksMethod {
+	case shadowsocksChaCha20, shadowsocksAES256:
+	default:
+		bad("shadowsocks_method", "%q must be one of %s, %s", v.ShadowsocksMethod, shadowsocksChaCha20, shadowsocksAES256)
 	}
-	if cfg.DNSList == "" && len(cf.DNS) > 0 {
-		cfg.DNSList = strings.Join(cf.DNS, ",")
+	if v.Shadowsocks != "" && v.ShadowsocksPassword == "" {
+		bad("shadowsocks_password", "is required with shadowsocks")
 	}
-	if cfg.DNSService == "" && cf.DNSService != "" {
-		cfg.DNSService = cf.DNSService
+	switch v.DNSBootstrap {
+	case "bypass", "cache", "none":
+	default:
+		bad("dns_bootstrap", "%q must be one of bypass, cache, none", v.DNSBootstrap)
 	}
-	if (cfg.DNSBootstrap == "" || cfg.DNSBootstrap == "bypass") && cf.DNSBootstrap != "" {
-		cfg.DNSBootstrap = cf.DNSBootstrap
+	switch strings.ToLower(v.LogLevel) {
+	case "", "quiet", "silent", "error", "err", "warn", "warning", "info", "debug":
+	default:
+		bad("log_level", "%q must be one of quiet, error, warn, info, debug", v.LogLevel)
 	}
-	if cfg.SOCKSListen == "" && cf.SOCKSListen != "" {
-		cfg.SOCKSListen = cf.SOCKSListen
+	if v.StatsInterval < 0 {
+		bad("stats_interval", "%s must not be negative", v.StatsInterval)
 	}
-	if len(cfg.AllowDomains) == 0 && len(cf.AllowDomains) > 0 {
-		cfg.AllowDomains = cf.AllowDomains
+	if v.SniffTimeout <= 0 || v.SniffTimeout > 5*time.Second {
+		bad("sniff_timeout", "%s is out of range (0, 5s]", v.SniffTimeout)
 	}
-	if len(cfg.ExcludeDomains) == 0 && len(cf.ExcludeDomains) > 0 {
-		cfg.ExcludeDomains = cf.ExcludeDomains
+	if v.SOCKSLimits.MaxConns < 0 {
+		bad("socks_max_conns", "%d must not be negative (0 means no limit)", v.SOCKSLimits.MaxConns)
 	}
-	if cfg.AllowInboundSrcList == "" && cf.AllowInboundSrc != "" {
-		cfg.AllowInboundSrcList = cf.AllowInboundSrc
+	if v.SOCKSLimits.MaxConnsPerIP < 0 {
+		bad("socks_max_conns_per_ip", "%d must not be negative (0 means no limit)", v.SOCKSLimits.MaxConnsPerIP)
 	}
-	if !cfg.AllowInboundLocal && cf.AllowInboundLocal {
-		cfg.AllowInboundLocal = true
+	for _, d := range []struct {
+		key string
+		val time.Duration
+	}{
+		{"socks_idle_timeout", v.SOCKSLimits.IdleTimeout},
+		{"socks_half_close_timeout", v.SOCKSLimits.HalfCloseTimeout},
+		{"socks_drain_timeout", v.SOCKSLimits.DrainTimeout},
+	} {
+		if d.val < 0 {
+			bad(d.key, "%s must not be negative", d.val)
+		}
 	}
-	if cfg.Location.LocationQuery == "" && cf.LocationQuery != "" {
-		cfg.Location.LocationQuery = cf.LocationQuery
+	if l := v.SOCKSLimits; l.MaxConns > 0 && l.MaxConnsPerIP > l.MaxConns {
+		bad("socks_max_conns_per_ip", "%d is above socks_max_conns (%d)", l.MaxConnsPerIP, l.MaxConns)
 	}
-	if cfg.Location.LocationID == "" && cf.LocationID != "" {
-		cfg.Location.LocationID = cf.LocationID
+	users, err := parseSocksAuth(v.SOCKSAuth)
+	if err != nil {
+		bad("socks_auth", "%v", err)
 	}
-	if cfg.Location.LocationGroupID == "" && cf.LocationGroupID != "" {
-		cfg.Location.LocationGroupID = cf.LocationGroupID
+	for user := range users {
+		if id, ok := strings.CutPrefix(user, "loc-"); ok {
+			if _, sel := userLocation(user); !sel {
+				bad("socks_auth", "user %q: %q is not a location id", user, id)
+			}
+		}
 	}
-	if !cfg.Debug && cf.Debug {
-		cfg.Debug = true
+	// With client certificates, users also come from certificate subjects.
+	for _, c := range v.Bandwidth.Classes {
+		if _, ok := users[c.User]; c.User != "" && err == nil && !ok && v.SOCKSTLS.ClientCA == "" {
+			bad("bandwidth", "user %q is not listed in socks_auth", c.User)
+		}
+	}
+	if v.JWTRenewInterval < 0 {
+		bad("jwt_renew_interval", "%s must not be negative", v.JWTRenewInterval)
+	} else if v.JWTRenewInterval > 0 && v.JWTRenewInterval < time.Minute {
+		bad("jwt_renew_interval", "%s is shorter than 1m", v.JWTRenewInterval)
+	}
+	for key, addr := range map[string]string{"socks": v.SOCKSListen, "listen": rc.SOCKS.ListenAddr, "dns_listen": v.DNSListen, "transparent": v.Transparent, "shadowsocks": v.Shadowsocks} {
+		if addr == "" {
+			continue
+		}
+		hostport, useTLS := splitListenAddr(addr)
+		if useTLS && key != "socks" && key != "listen" {
+			bad(key, "%q: %s is for SOCKS listeners", addr, socksTLSScheme)
+		} else if err := checkListenAddr(hostport); err != nil {
+			bad(key, "%q %v", addr, err)
+		}
 	}
-	if cfg.StatsInterval == 5*time.Second && cf.StatsInterval > 0 {
-		cfg.StatsInterval = time.Duration(cf.StatsInterval) * time.Second
+	socksAddr, socksTLS := splitListenAddr(v.SOCKSListen)
+	seen := map[string]bool{socksAddr: socksAddr != ""}
+	for _, l := range v.Listeners {
+		addr, useTLS := splitListenAddr(l.Listen)
+		if seen[addr] {
+			bad("listeners", "%s is used by more than one SOCKS listener", addr)
+		}
+		seen[addr] = true
+		socksTLS = socksTLS || useTLS
+	}
+	if _, useTLS := splitListenAddr(rc.SOCKS.ListenAddr); useTLS {
+		socksTLS = true
+	}
+	switch t := v.SOCKSTLS; {
+	case socksTLS || t.Cert != "" || t.Key != "":
+		if _, err := t.serverConfig(); err != nil {
+			bad("socks_tls_cert", "%v", err)
+		}
+	case t.ClientCA != "":
+		bad("socks_tls_client_ca", "requires socks_tls_cert and socks_tls_key")
+	}
+	if v.Transparent != "" && seen[v.Transparent] {
+		bad("transparent", "%s is also a SOCKS listener", v.Transparent)
+	}
+	if v.Shadowsocks != "" && (seen[v.Shadowsocks] || v.Shadowsocks == v.Transparent) {
+		bad("shadowsocks", "%s is also a SOCKS or transparent listener", v.Shadowsocks)
+	}
+	for key, id := range map[string]string{"location_id": v.Location.LocationID, "location_group_id": v.Location.LocationGroupID} {
+		if id == "" {
+			continue
+		}
+		if _, err := connect.ParseId(id); err != nil {
+			bad(key, "%q is not a valid id (see 'locations')", id)
+		}
+	}
+
+	// Conflicting options.
+	if v.EnableKillSwitch && !v.DefaultRoute {
+		bad("kill_switch", "requires default_route")
+	}
+	if isTUNDisabled(v.TunName) || strings.TrimSpace(v.TunName) == "" {
+		if v.DefaultRoute {
+			bad("default_route", "requires a TUN device (tun is %q)", v.TunName)
+		}
+		if v.ExtraRoutes != "" {
+			bad("route", "requires a TUN device (tun is %q)", v.TunName)
+		}
+		if len(v.RouteLocations) > 0 {
+			bad("route_locations", "requires a TUN device (tun is %q)", v.TunName)
+		}
+		if v.DNSListen != "" {
+			bad("dns_listen", "requires a TUN device (tun is %q)", v.TunName)
+		}
+		if v.Transparent != "" {
+			bad("transparent", "requires a TUN device (tun is %q)", v.TunName)
+		}
+	}
+	if v.DNSListen == "" && len(v.DNSSplit) > 0 {
+		bad("dns_split", "has no effect without dns_listen")
+	}
+	if v.Location.LocationQuery != "" && (v.Location.LocationID != "" || v.Location.LocationGroupID != "") {
+		bad("location_query", "is ignored when location_id or location_group_id is set")
+	}
+
+	sort.SliceStable(errs, func(i, j int) bool { return errs[i].Error() < errs[j].Error() })
+	return errs
+}
+
+// blocklistOptions returns the DNS blocklist settings of c.
+func (c VPNConfig) blocklistOptions() blocklistOptions {
+	return blocklistOptions{Sources: c.DNSBlocklist, Refresh: c.DNSBlocklistRefresh, Response: c.DNSBlockResponse}
+}
+
+// extraRoutes returns the destinations routed through the TUN besides the default
+// route: --route and the CIDRs of route_locations.
+func (c VPNConfig) extraRoutes() []string {
+	routes := splitCSV(c.ExtraRoutes)
+	for _, r := range c.RouteLocations {
+		for _, n := range r.CIDRs {
+			routes = append(routes, n.String())
+		}
+	}
+	return routes
+}
+
+// shadowsocksOptions returns the Shadowsocks server settings, with the rules, DNS,
+// limits, allowlist and VPN binding of socks. PROXY headers are not read: the UDP side
+// could not honour them.
+func (c VPNConfig) shadowsocksOptions(socks socksOptions) shadowsocksOptions {
+	socks.ListenAddr = c.Shadowsocks
+	socks.ProxyFrom = nil
+	return shadowsocksOptions{ListenAddr: c.Shadowsocks, Method: c.ShadowsocksMethod, Password: c.ShadowsocksPassword, Socks: socks}
+}
+
+// egressOptions returns the settings for the exit locations SOCKS users select.
+func (c VPNConfig) egressOptions() egressOptions {
+	return egressOptions{
+		APIURL:     c.APIURL,
+		ConnectURL: c.ConnectURL,
+		JWT:        c.JWT,
+		MTU:        c.MTU,
+		IPCIDR:     c.IPCIDR,
+		EnableIPv6: c.EnableIPv6,
+		DNSServers: splitCSV(c.DNSList),
+		DNSHosts:   c.DNSHosts,
+		Auth:       c.SOCKSAuth,
+		Listeners:  c.Listeners,
+	}
+}
+
+// checkListenAddr reports whether addr is a valid host:port to listen on.
+func checkListenAddr(addr string) error {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return fmt.Errorf("is not host:port")
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < 0 || n > 65535 {
+		return fmt.Errorf("has an invalid port")
+	}
+	if host != "" && net.ParseIP(host) == nil && host != "localhost" {
+		return fmt.Errorf("host must be an IP address or localhost")
+	}
+	return nil
+}
+
+// containsFold reports whether list contains s, ignoring case.
+func containsFold(list []string, s string) bool {
+	for _, v := range list {
+		if strings.EqualFold(v, s) {
+			return true
+		}
 	}
-	return cfg
+	return false
 }
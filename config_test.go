@@ -0,0 +1,316 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docopt/docopt-go"
+)
+
+// writeConfig writes a YAML config file into a temp dir and returns its path.
+func writeConfig(t *testing.T, body string) string {
+	t.Helper()
+	p := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(p, []byte(body), 0o600); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+	return p
+}
+
+// fakeEnv returns a lookupEnv function backed by m.
+func fakeEnv(m map[string]string) func(string) (string, bool) {
+	return func(k string) (string, bool) {
+		v, ok := m[k]
+		return v, ok
+	}
+}
+
+func TestResolveConfig_Defaults(t *testing.T) {
+	rc, err := resolveConfigWith(docopt.Opts{}, fakeEnv(nil))
+	if err != nil {
+		t.Fatalf("resolveConfig: %v", err)
+	}
+	if rc.VPN.MTU != 1420 || rc.VPN.IPCIDR != "10.255.0.2/24" || rc.VPN.DNSBootstrap != "bypass" {
+		t.Fatalf("unexpected defaults: %+v", rc.VPN)
+	}
+	if rc.VPN.StatsInterval != 5*time.Second || rc.VPN.APIURL != DefaultAPIURL {
+		t.Fatalf("unexpected defaults: %+v", rc.VPN)
+	}
+	if rc.Sources["mtu"] != sourceDefault {
+		t.Fatalf("mtu source=%q want default", rc.Sources["mtu"])
+	}
+}
+
+// An explicit flag equal to the built-in default must still beat the config file.
+func TestResolveConfig_ExplicitDefaultFlagBeatsFile(t *testing.T) {
+	path := writeConfig(t, "mtu: 1300\nip_cidr: 10.9.0.2/24\n")
+	opts := docopt.Opts{"--config": path, "--mtu": "1420", "--ip_cidr": nil}
+	rc, err := resolveConfigWith(opts, fakeEnv(nil))
+	if err != nil {
+		t.Fatalf("resolveConfig: %v", err)
+	}
+	if rc.VPN.MTU != 1420 || rc.Sources["mtu"] != sourceFlag {
+		t.Fatalf("mtu=%d source=%q; want 1420 from flag", rc.VPN.MTU, rc.Sources["mtu"])
+	}
+	if rc.VPN.IPCIDR != "10.9.0.2/24" || rc.Sources["ip_cidr"] != sourceFile {
+		t.Fatalf("ip_cidr=%q source=%q; want file value", rc.VPN.IPCIDR, rc.Sources["ip_cidr"])
+	}
+}
+
+func TestResolveConfig_Precedence(t *testing.T) {
+	path := writeConfig(t, "tun: from-file\nlocation_query: \"country:Germany\"\ndns_service: Wi-Fi\n")
+	env := fakeEnv(map[string]string{
+		"URNETWORK_TUN":            "from-env",
+		"URNETWORK_LOCATION_QUERY": "country:Japan",
+	})
+	opts := docopt.Opts{"--config": path, "--tun": "from-flag"}
+	rc, err := resolveConfigWith(opts, env)
+	if err != nil {
+		t.Fatalf("resolveConfig: %v", err)
+	}
+	if rc.VPN.TunName != "from-flag" || rc.Origins["tun"] != "--tun" {
+		t.Fatalf("tun=%q origin=%q", rc.VPN.TunName, rc.Origins["tun"])
+	}
+	if rc.VPN.Location.LocationQuery != "country:Japan" || rc.Sources["location_query"] != sourceEnv {
+		t.Fatalf("location_query=%q source=%q", rc.VPN.Location.LocationQuery, rc.Sources["location_query"])
+	}
+	if rc.VPN.DNSService != "Wi-Fi" || rc.Sources["dns_service"] != sourceFile {
+		t.Fatalf("dns_service=%q source=%q", rc.VPN.DNSService, rc.Sources["dns_service"])
+	}
+}
+
+func TestResolveConfig_FileCoversAllSettings(t *testing.T) {
+	path := writeConfig(t, `
+kill_switch: true
+enable_ipv6: true
+jwt_renew_interval: 12h
+force_jwt: true
+log_file: /tmp/urnet.log
+socks_listen: 127.0.0.1:1080
+dns:
+  - 1.1.1.1
+  - 8.8.8.8
+domain: "a.com,b.com"
+`)
+	rc, err := resolveConfigWith(docopt.Opts{}, fakeEnv(map[string]string{"URNETWORK_CONFIG": path}))
+	if err != nil {
+		t.Fatalf("resolveConfig: %v", err)
+	}
+	v := rc.VPN
+	if !v.EnableKillSwitch || !v.EnableIPv6 || !v.ForceJWT || v.JWTRenewInterval != 12*time.Hour || v.LogFile != "/tmp/urnet.log" {
+		t.Fatalf("file settings not applied: %+v", v)
+	}
+	if v.SOCKSListen != "127.0.0.1:1080" || v.DNSList != "1.1.1.1,8.8.8.8" || len(v.AllowDomains) != 2 {
+		t.Fatalf("list/alias settings not applied: %+v", v)
+	}
+	if rc.ConfigPath != path {
+		t.Fatalf("config path=%q want %q", rc.ConfigPath, path)
+	}
+}
+
+func TestResolveConfig_EnvBoolCanDisableFile(t *testing.T) {
+	path := writeConfig(t, "default_route: true\n")
+	opts := docopt.Opts{"--config": path, "--default_route": false}
+	rc, err := resolveConfigWith(opts, fakeEnv(map[string]string{"URNETWORK_DEFAULT_ROUTE": "false"}))
+	if err != nil {
+		t.Fatalf("resolveConfig: %v", err)
+	}
+	if rc.VPN.DefaultRoute {
+		t.Fatalf("env false should override file true")
+	}
+}
+
+func TestResolveConfig_Errors(t *testing.T) {
+	path := writeConfig(t, "mtuu: 1300\n")
+	if _, err := resolveConfigWith(docopt.Opts{"--config": path}, fakeEnv(nil)); err == nil || !strings.Contains(err.Error(), `unknown key "mtuu"`) {
+		t.Fatalf("want unknown key error, got %v", err)
+	}
+	_, err := resolveConfigWith(docopt.Opts{}, fakeEnv(map[string]string{"URNETWORK_MTU": "big"}))
+	if err == nil || !strings.Contains(err.Error(), "URNETWORK_MTU") {
+		t.Fatalf("want error naming URNETWORK_MTU, got %v", err)
+	}
+}
+
+func TestValidateConfig_DefaultsAreValid(t *testing.T) {
+	rc, err := resolveConfigWith(docopt.Opts{}, fakeEnv(nil))
+	if err != nil {
+		t.Fatalf("resolveConfig: %v", err)
+	}
+	if errs := validateConfig(rc); len(errs) != 0 {
+		t.Fatalf("defaults should validate, got %v", errs)
+	}
+}
+
+func TestValidateConfig_ReportsProblems(t *testing.T) {
+	path := writeConfig(t, `
+tun: utun9
+ip_cidr: 10.0.0.300/24
+mtu: 70000
+route: 10.0.0.0/8,nope
+dns: [1.1.1.1, "9.9.9.9:53", resolver.example]
+socks: 127.0.0.1
+location_id: not-an-id
+location_query: "country:Germany"
+kill_switch: true
+`)
+	opts := docopt.Opts{"--config": path, "--log_level": "loud"}
+	rc, err := resolveConfigWith(opts, fakeEnv(nil))
+	if err != nil {
+		t.Fatalf("resolveConfig: %v", err)
+	}
+	var got []string
+	for _, e := range validateConfig(rc) {
+		got = append(got, e.Error())
+	}
+	joined := strings.Join(got, "\n")
+	for _, want := range []string{
+		"ip_cidr (from " + path + ": ip_cidr)",
+		"mtu (from " + path + ": mtu): 70000 is out of range",
+		`route (from ` + path + `: route): "nope" is not an IP address or CIDR`,
+		`dns (from ` + path + `: dns): DNS server "resolver.example": plain DNS servers must be IP addresses`,
+		`socks (from ` + path + `: socks): "127.0.0.1" is not host:port`,
+		`location_id (from ` + path + `: location_id): "not-an-id" is not a valid id`,
+		"location_query (from " + path + ": location_query): is ignored",
+		"kill_switch (from " + path + ": kill_switch): requires default_route",
+		`log_level (from --log_level): "loud"`,
+	} {
+		if !strings.Contains(joined, want) {
+			t.Errorf("missing %q in:\n%s", want, joined)
+		}
+	}
+	if len(got) != 9 {
+		t.Fatalf("expected 9 problems, got %d:\n%s", len(got), joined)
+	}
+}
+
+func TestValidateConfig_ReportsMalformedValues(t *testing.T) {
+	path := writeConfig(t, "socks_idle_timeout: soon\nrules:\n  - action: teleport\n")
+	opts := docopt.Opts{"--config": path, "--socks_allow_src": "not-an-ip", "--default_route": true}
+	rc, err := resolveConfigWith(opts, fakeEnv(map[string]string{"URNETWORK_MTU": "big"}))
+	if err == nil || rc == nil {
+		t.Fatalf("resolveConfig = %v, %v; want the config and an error", rc, err)
+	}
+	if rc.VPN.MTU != 1420 {
+		t.Errorf("mtu = %d, want the default after a malformed value", rc.VPN.MTU)
+	}
+	var got []string
+	for _, e := range validateConfig(rc) {
+		got = append(got, e.Error())
+	}
+	for _, want := range []string{"mtu (from URNETWORK_MTU)", "socks_idle_timeout (from " + path, "socks_allow_src (from --socks_allow_src)", "config file " + path, "default_route (from --default_route)"} {
+		if !strings.Contains(strings.Join(got, "\n"), want) {
+			t.Errorf("problems %q, want one about %q", got, want)
+		}
+	}
+}
+
+func TestValidateConfig_RoutesNeedTUN(t *testing.T) {
+	opts := docopt.Opts{"--tun": "none", "--default_route": true, "--route": "10.0.0.0/8"}
+	rc, err := resolveConfigWith(opts, fakeEnv(nil))
+	if err != nil {
+		t.Fatalf("resolveConfig: %v", err)
+	}
+	errs := validateConfig(rc)
+	if len(errs) != 2 {
+		t.Fatalf("expected default_route and route conflicts, got %v", errs)
+	}
+}
+
+func TestValidateConfig_DNSListen(t *testing.T) {
+	opts := docopt.Opts{"--tun": "none", "--dns_listen": "127.0.0.1:53", "--dns_split": "corp.example=dns.corp.example"}
+	rc, err := resolveConfigWith(opts, fakeEnv(nil))
+	if err != nil {
+		t.Fatalf("resolveConfig: %v", err)
+	}
+	var keys []string
+	for _, e := range validateConfig(rc) {
+		keys = append(keys, strings.SplitN(e.Error(), " ", 2)[0])
+	}
+	if strings.Join(keys, ",") != "dns_listen,dns_split" {
+		t.Fatalf("expected dns_listen and dns_split problems, got %v", keys)
+	}
+}
+
+func TestValidateConfig_SOCKSLimits(t *testing.T) {
+	opts := docopt.Opts{"--socks_max_conns": "10", "--socks_max_conns_per_ip": "20", "--socks_idle_timeout": "-1s"}
+	rc, err := resolveConfigWith(opts, fakeEnv(nil))
+	if err != nil {
+		t.Fatalf("resolveConfig: %v", err)
+	}
+	if rc.SOCKS.Limits.MaxConns != 10 || rc.SOCKS.Limits.DrainTimeout != DefaultSocksDrainTimeout {
+		t.Fatalf("socks command limits = %+v", rc.SOCKS.Limits)
+	}
+	var keys []string
+	for _, e := range validateConfig(rc) {
+		keys = append(keys, strings.SplitN(e.Error(), " ", 2)[0])
+	}
+	if strings.Join(keys, ",") != "socks_idle_timeout,socks_max_conns_per_ip" {
+		t.Fatalf("expected socks_idle_timeout and socks_max_conns_per_ip problems, got %v", keys)
+	}
+}
+
+func TestResolveConfig_Bandwidth(t *testing.T) {
+	path := writeConfig(t, "socks_auth: [alice:pw]\nsocks_download_limit: 100mbit\nbandwidth:\n  - user: alice\n    upload: 1mbit\n  - user: bob\n    upload: 1mbit\n")
+	rc, err := resolveConfigWith(docopt.Opts{"--config": path}, fakeEnv(nil))
+	if err != nil {
+		t.Fatalf("resolveConfig: %v", err)
+	}
+	bw := rc.SOCKS.Bandwidth
+	if bw.Download != 12.5e6 || len(bw.Classes) != 2 || rc.SOCKS.Auth[0] != "alice:pw" {
+		t.Fatalf("socks bandwidth = %+v auth = %v", bw, rc.SOCKS.Auth)
+	}
+	errs := validateConfig(rc)
+	if len(errs) != 1 || !strings.Contains(errs[0].Error(), `user "bob" is not listed in socks_auth`) {
+		t.Fatalf("expected one problem for bob, got %v", errs)
+	}
+}
+
+func TestBuildConfigShow_RedactsSecretsAndRecordsSources(t *testing.T) {
+	path := writeConfig(t, "password: hunter2\nmtu: 1380\n")
+	opts := docopt.Opts{"--config": path, "--jwt": "a.b.c"}
+	rc, err := resolveConfigWith(opts, fakeEnv(map[string]string{"URNETWORK_DNS": "1.1.1.1"}))
+	if err != nil {
+		t.Fatalf("resolveConfig: %v", err)
+	}
+	out := buildConfigShow(rc)
+	if out.ConfigFile != path || len(out.Settings) != len(configSettings) {
+		t.Fatalf("unexpected output header: %+v", out)
+	}
+	byKey := map[string]configShowEntry{}
+	for _, e := range out.Settings {
+		byKey[e.Key] = e
+	}
+	if e := byKey["password"]; e.Value != "<redacted>" || e.Source != sourceFile {
+		t.Fatalf("password: %+v", e)
+	}
+	if e := byKey["jwt"]; e.Value != "<redacted>" || e.Source != sourceFlag || e.Origin != "--jwt" {
+		t.Fatalf("jwt: %+v", e)
+	}
+	if e := byKey["mtu"]; e.Value != 1380 || e.Source != sourceFile {
+		t.Fatalf("mtu: %+v", e)
+	}
+	if e := byKey["dns"]; e.Value != "1.1.1.1" || e.Source != sourceEnv || e.Origin != "URNETWORK_DNS" {
+		t.Fatalf("dns: %+v", e)
+	}
+	if e := byKey["stats_interval"]; e.Value != "5s" || e.Source != sourceDefault {
+		t.Fatalf("stats_interval: %+v", e)
+	}
+}
+
+func TestValidateConfig_SOCKSLocationUsers(t *testing.T) {
+	opts := docopt.Opts{"--socks_auth": "country:Germany:pw,loc-0193f7a2-5c4e-7d1b-9a3f-2e8b6c1d4f70:pw,loc-frankfurt:pw", "--dns_hosts": "dns.example.test=192.0.2.53"}
+	rc, err := resolveConfigWith(opts, fakeEnv(nil))
+	if err != nil {
+		t.Fatalf("resolveConfig: %v", err)
+	}
+	errs := validateConfig(rc)
+	if len(errs) != 1 || !strings.Contains(errs[0].Error(), `"frankfurt" is not a location id`) {
+		t.Fatalf("expected one problem for loc-frankfurt, got %v", errs)
+	}
+	if eo := rc.VPN.egressOptions(); len(eo.Auth) != 3 || eo.MTU != rc.VPN.MTU || len(eo.DNSHosts) != 1 {
+		t.Fatalf("egress options = %+v", eo)
+	}
+}
@@ -0,0 +1,696 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	neturl "net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// dnsUpstream is one --dns entry. Accepted forms:
+//
+//	1.1.1.1, 1.1.1.1:53, udp://1.1.1.1   plain DNS over UDP (TCP on truncation)
+//	tcp://1.1.1.1[:53]                    plain DNS over TCP
+//	tls://9.9.9.9[:853]                   DNS over TLS
+//	https://1.1.1.1/dns-query             DNS over HTTPS (RFC 8484, POST)
+type dnsUpstream struct {
+	Raw        string
+	Proto      string // "udp", "tcp", "tls" or "https"
+	Addr       string // host:port for udp/tcp/tls
+	URL        string // endpoint for https
+	ServerName string // TLS server name for tls/https
+
+	// health, guarded by dnsClient.mu
+	failures  int
+	downUntil time.Time
+}
+
+// parseDNSUpstream parses one --dns entry.
+func parseDNSUpstream(s string) (*dnsUpstream, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return nil, errors.New("empty DNS server")
+	}
+	scheme, rest, hasScheme := strings.Cut(s, "://")
+	if !hasScheme {
+		scheme, rest = "udp", s
+	}
+	u := &dnsUpstream{Raw: s, Proto: strings.ToLower(scheme)}
+	switch u.Proto {
+	case "udp", "tcp", "tls":
+		host, port := rest, "53"
+		if u.Proto == "tls" {
+			port = "853"
+		}
+		if h, p, err := net.SplitHostPort(rest); err == nil {
+			host, port = h, p
+		}
+		host = strings.Trim(host, "[]")
+		if host == "" || strings.ContainsAny(host, "/?#") {
+			return nil, fmt.Errorf("DNS server %q: invalid host", s)
+		}
+		if u.Proto != "tls" && net.ParseIP(host) == nil {
+			return nil, fmt.Errorf("DNS server %q: plain DNS servers must be IP addresses", s)
+		}
+		u.Addr = net.JoinHostPort(host, port)
+		u.ServerName = host
+	case "https":
+		parsed, err := neturl.Parse(s)
+		if err != nil || parsed.Host == "" {
+			return nil, fmt.Errorf("DNS server %q: invalid URL", s)
+		}
+		if parsed.Path == "" {
+			parsed.Path = "/dns-query"
+		}
+		u.URL = parsed.String()
+		u.ServerName = parsed.Hostname()
+	default:
+		return nil, fmt.Errorf("DNS server %q: unknown scheme %q (use udp, tcp, tls or https)", s, scheme)
+	}
+	return u, nil
+}
+
+// host returns the upstream's host (IP or name) without port.
+func (u *dnsUpstream) host() string {
+	if u.Proto == "https" {
+		return u.ServerName
+	}
+	h, _, _ := net.SplitHostPort(u.Addr)
+	return h
+}
+
+// dnsServerIPs returns the IP addresses of all --dns entries whose host is an IP literal,
+// for installing host routes.
+func dnsServerIPs(list []string) []string {
+	var out []string
+	for _, s := range list {
+		if u, err := parseDNSUpstream(s); err == nil && net.ParseIP(u.host()) != nil {
+			out = append(out, u.host())
+		}
+	}
+	return out
+}
+
+// plainDNSServers returns the IPs of plain DNS entries on port 53, the only kind the
+// operating system resolver can be configured with.
+func plainDNSServers(list []string) []string {
+	var out []string
+	for _, s := range list {
+		u, err := parseDNSUpstream(s)
+		if err != nil || (u.Proto != "udp" && u.Proto != "tcp") {
+			continue
+		}
+		if _, port, _ := net.SplitHostPort(u.Addr); port == "53" {
+			out = append(out, u.host())
+		}
+	}
+	return out
+}
+
+// parseDNSHosts parses static overrides written as name=ip entries. A name may appear
+// several times to give it several addresses.
+func parseDNSHosts(list []string) (map[string][]net.IP, error) {
+	hosts := map[string][]net.IP{}
+	for _, e := range list {
+		name, addr, ok := strings.Cut(e, "=")
+		ip := net.ParseIP(strings.TrimSpace(addr))
+		name = normalizeHost(name)
+		if !ok || name == "" || ip == nil {
+			return nil, fmt.Errorf("host override %q: want name=ip", e)
+		}
+		hosts[name] = append(hosts[name], ip)
+	}
+	return hosts, nil
+}
+
+// dnsClientOptions configures newDNSClient.
+type dnsClientOptions struct {
+	Upstreams []string
+	BindIf    string      // bind upstream sockets to this interface ("" for the default route)
+	Hosts     []string    // static overrides, name=ip
+	TLSConfig *tls.Config // base TLS config for tls:// and https:// (tests inject RootCAs)
+	Timeout   time.Duration
+	// Dial replaces the socket dialer, e.g. to query through a userspace stack. It is
+	// given IP literals only: see bootstrap.
+	Dial func(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+// dnsClient sends queries to its upstreams in order, skipping unhealthy ones, caches
+// answers for their TTL and answers static host overrides locally.
+type dnsClient struct {
+	upstreams []*dnsUpstream
+	hosts     map[string][]net.IP
+	cache     *dnsCache
+	dialer    net.Dialer
+	dial      func(ctx context.Context, network, addr string) (net.Conn, error)
+	// bootstrap are the upstreams given by IP address. With BindIf or Dial they resolve
+	// the names of tls:// and https:// upstreams, so that lookup does not leave
+	// through the system resolver.
+	bootstrap []*dnsUpstream
+	tlsConfig *tls.Config
+	http      *http.Client
+	timeout   time.Duration
+
+	mu sync.Mutex // guards upstream health
+}
+
+// newDNSClient builds a client for opts.Upstreams.
+func newDNSClient(opts dnsClientOptions) (*dnsClient, error) {
+	if len(opts.Upstreams) == 0 {
+		return nil, errors.New("no DNS servers")
+	}
+	c := &dnsClient{cache: newDNSCache(4096), timeout: opts.Timeout}
+	if c.timeout <= 0 {
+		c.timeout = 3 * time.Second
+	}
+	for _, s := range opts.Upstreams {
+		u, err := parseDNSUpstream(s)
+		if err != nil {
+			return nil, err
+		}
+		c.upstreams = append(c.upstreams, u)
+	}
+	hosts, err := parseDNSHosts(opts.Hosts)
+	if err != nil {
+		return nil, err
+	}
+	c.hosts = hosts
+	c.dialer = net.Dialer{Timeout: c.timeout}
+	if opts.BindIf != "" {
+		c.dialer.Control = bindControl(opts.BindIf)
+	}
+	c.dial = c.dialer.DialContext
+	if opts.Dial != nil {
+		c.dial = opts.Dial
+	}
+	if opts.BindIf != "" || opts.Dial != nil {
+		for _, u := range c.upstreams {
+			if net.ParseIP(u.host()) != nil {
+				c.bootstrap = append(c.bootstrap, u)
+			}
+		}
+		for _, u := range c.upstreams {
+			if net.ParseIP(u.host()) == nil && len(c.bootstrap) == 0 && c.hosts[normalizeHost(u.host())] == nil {
+				return nil, fmt.Errorf("DNS server %q: a host name needs a DNS server given by IP address (or a dns_hosts entry) to resolve it", u.Raw)
+			}
+		}
+		dial := c.dial
+		c.dial = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return c.dialBootstrapped(ctx, dial, network, addr)
+		}
+	}
+	c.tlsConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+	if opts.TLSConfig != nil {
+		c.tlsConfig = opts.TLSConfig.Clone()
+	}
+	c.http = &http.Client{
+		Timeout: c.timeout,
+		Transport: &http.Transport{
+			DialContext:       c.dial,
+			TLSClientConfig:   c.tlsConfig.Clone(),
+			ForceAttemptHTTP2: true,
+			IdleConnTimeout:   90 * time.Second,
+		},
+	}
+	return c, nil
+}
+
+// LookupIP resolves host to addresses. network is "ip", "ip4" or "ip6", as for
+// net.Resolver.LookupIP, which this method mirrors so either can serve the SOCKS proxy.
+func (c *dnsClient) LookupIP(ctx context.Context, network, host string) ([]net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+	name := normalizeHost(host)
+	if ips, ok := c.hosts[name]; ok {
+		return filterIPs(ips, network), nil
+	}
+	var types []dnsmessage.Type
+	if network != "ip6" {
+		types = append(types, dnsmessage.TypeA)
+	}
+	if network != "ip4" {
+		types = append(types, dnsmessage.TypeAAAA)
+	}
+	type result struct {
+		ips []net.IP
+		err error
+	}
+	results := make(chan result, len(types))
+	for _, t := range types {
+		go func() {
+			ips, err := c.lookupType(ctx, name, t)
+			results <- result{ips, err}
+		}()
+	}
+	var ips []net.IP
+	var lastErr error
+	for range types {
+		r := <-results
+		ips = append(ips, r.ips...)
+		if r.err != nil {
+			lastErr = r.err
+		}
+	}
+	if len(ips) == 0 {
+		if lastErr == nil {
+			lastErr = &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+		}
+		return nil, lastErr
+	}
+	return ips, nil
+}
+
+func (c *dnsClient) lookupType(ctx context.Context, name string, t dnsmessage.Type) ([]net.IP, error) {
+	q, err := newDNSQuery(name, t)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.Exchange(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+	if resp.RCode == dnsmessage.RCodeNameError {
+		return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+	var ips []net.IP
+	for _, rr := range resp.Answers {
+		switch b := rr.Body.(type) {
+		case *dnsmessage.AResource:
+			ips = append(ips, net.IP(b.A[:]))
+		case *dnsmessage.AAAAResource:
+			ips = append(ips, net.IP(b.AAAA[:]))
+		}
+	}
+	return ips, nil
+}
+
+// Exchange answers q from the host overrides or the cache, or forwards it to the
+// upstreams. The response carries q's ID.
+func (c *dnsClient) Exchange(ctx context.Context, q *dnsmessage.Message) (*dnsmessage.Message, error) {
+	if len(q.Questions) != 1 {
+		return nil, errors.New("dns: exactly one question expected")
+	}
+	question := q.Questions[0]
+	if resp := c.hostsAnswer(q); resp != nil {
+		return resp, nil
+	}
+	if resp := c.cache.get(question, time.Now()); resp != nil {
+		resp.ID = q.ID
+		return resp, nil
+	}
+	resp, err := c.forward(ctx, c.order(time.Now()), q)
+	if err != nil {
+		return nil, err
+	}
+	c.cache.put(question, resp, time.Now())
+	resp.ID = q.ID
+	return resp, nil
+}
+
+// dialBootstrapped dials addr with dial, first resolving a host name through the
+// bootstrap upstreams and the host overrides.
+func (c *dnsClient) dialBootstrapped(ctx context.Context, dial func(ctx context.Context, network, addr string) (net.Conn, error), network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || net.ParseIP(host) != nil {
+		return dial(ctx, network, addr)
+	}
+	name := normalizeHost(host)
+	ips := c.hosts[name]
+	for _, t := range []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA} {
+		if len(ips) > 0 {
+			break
+		}
+		q, err := newDNSQuery(name, t)
+		if err != nil {
+			return nil, err
+		}
+		resp := c.cache.get(q.Questions[0], time.Now())
+		if resp == nil {
+			if resp, err = c.forward(ctx, c.bootstrap, q); err != nil {
+				return nil, err
+			}
+			c.cache.put(q.Questions[0], resp, time.Now())
+		}
+		for _, rr := range resp.Answers {
+			switch b := rr.Body.(type) {
+			case *dnsmessage.AResource:
+				ips = append(ips, net.IP(b.A[:]))
+			case *dnsmessage.AAAAResource:
+				ips = append(ips, net.IP(b.AAAA[:]))
+			}
+		}
+	}
+	if len(ips) == 0 {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	var lastErr error
+	for _, ip := range ips {
+		conn, err := dial(ctx, network, net.JoinHostPort(ip.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+		lastErr = err
+	}
+	return nil, lastErr
+}
+
+// forward sends q to upstreams in order until one answers. SERVFAIL and REFUSED
+// count as failures so the next upstream is tried.
+func (c *dnsClient) forward(ctx context.Context, upstreams []*dnsUpstream, q *dnsmessage.Message) (*dnsmessage.Message, error) {
+	var lastResp *dnsmessage.Message
+	var lastErr error
+	for _, u := range upstreams {
+		resp, err := c.exchangeWith(ctx, u, q)
+		if err == nil && (resp.RCode == dnsmessage.RCodeServerFailure || resp.RCode == dnsmessage.RCodeRefused) {
+			lastResp = resp
+			err = fmt.Errorf("dns %s: %s", u.Raw, resp.RCode)
+		}
+		c.report(u, err)
+		if err == nil {
+			return resp, nil
+		}
+		lastErr = err
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	if lastResp != nil {
+		return lastResp, nil
+	}
+	return nil, lastErr
+}
+
+// order returns the upstreams to try: healthy ones in configured order, then those
+// still backing off, soonest recovery first.
+func (c *dnsClient) order(now time.Time) []*dnsUpstream {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var healthy, down []*dnsUpstream
+	for _, u := range c.upstreams {
+		if now.Before(u.downUntil) {
+			down = append(down, u)
+		} else {
+			healthy = append(healthy, u)
+		}
+	}
+	for i := 1; i < len(down); i++ {
+		for j := i; j > 0 && down[j].downUntil.Before(down[j-1].downUntil); j-- {
+			down[j], down[j-1] = down[j-1], down[j]
+		}
+	}
+	return append(healthy, down...)
+}
+
+// report updates the health of u: each consecutive failure doubles its back-off
+// (1s up to 1m); a success clears it.
+func (c *dnsClient) report(u *dnsUpstream, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err == nil {
+		u.failures = 0
+		u.downUntil = time.Time{}
+		return
+	}
+	u.failures++
+	backoff := time.Second << min(u.failures-1, 6)
+	u.downUntil = time.Now().Add(min(backoff, time.Minute))
+	logDebug("dns upstream %s failed (%d in a row): %v\n", u.Raw, u.failures, err)
+}
+
+func (c *dnsClient) exchangeWith(ctx context.Context, u *dnsUpstream, q *dnsmessage.Message) (*dnsmessage.Message, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+	packed, err := q.Pack()
+	if err != nil {
+		return nil, err
+	}
+	var raw []byte
+	switch u.Proto {
+	case "udp":
+		raw, err = c.exchangeUDP(ctx, u, packed)
+		if err == nil && len(raw) > 2 && raw[2]&0x02 != 0 { // TC: retry over TCP
+			raw, err = c.exchangeStream(ctx, u, packed, false)
+		}
+	case "tcp":
+		raw, err = c.exchangeStream(ctx, u, packed, false)
+	case "tls":
+		raw, err = c.exchangeStream(ctx, u, packed, true)
+	case "https":
+		raw, err = c.exchangeHTTPS(ctx, u, packed)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var resp dnsmessage.Message
+	if err := resp.Unpack(raw); err != nil {
+		return nil, fmt.Errorf("dns %s: bad response: %w", u.Raw, err)
+	}
+	if resp.ID != q.ID || !resp.Response {
+		return nil, fmt.Errorf("dns %s: mismatched response", u.Raw)
+	}
+	return &resp, nil
+}
+
+func (c *dnsClient) exchangeUDP(ctx context.Context, u *dnsUpstream, packed []byte) ([]byte, error) {
+	conn, err := c.dial(ctx, "udp", u.Addr)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = conn.Close() }()
+	if dl, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(dl)
+	}
+	if _, err := conn.Write(packed); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 65535)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		// Ignore stray datagrams that do not carry our ID.
+		if n >= 2 && bytes.Equal(buf[:2], packed[:2]) {
+			return buf[:n], nil
+		}
+	}
+}
+
+func (c *dnsClient) exchangeStream(ctx context.Context, u *dnsUpstream, packed []byte, useTLS bool) ([]byte, error) {
+	conn, err := c.dial(ctx, "tcp", u.Addr)
+	if err != nil {
+		return nil, err
+	}
+	if useTLS {
+		cfg := c.tlsConfig.Clone()
+		if cfg.ServerName == "" {
+			cfg.ServerName = u.ServerName
+		}
+		conn = tls.Client(conn, cfg)
+	}
+	defer func() { _ = conn.Close() }()
+	if dl, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(dl)
+	}
+	msg := make([]byte, 2+len(packed))
+	binary.BigEndian.PutUint16(msg, uint16(len(packed)))
+	copy(msg[2:], packed)
+	if _, err := conn.Write(msg); err != nil {
+		return nil, err
+	}
+	var l [2]byte
+	if _, err := io.ReadFull(conn, l[:]); err != nil {
+		return nil, err
+	}
+	resp := make([]byte, binary.BigEndian.Uint16(l[:]))
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+func (c *dnsClient) exchangeHTTPS(ctx context.Context, u *dnsUpstream, packed []byte) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.URL, bytes.NewReader(packed))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("dns %s: HTTP %s", u.Raw, resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, 65535))
+}
+
+// hostsAnswer builds a response from the static overrides, or returns nil when the
+// question's name is not overridden.
+func (c *dnsClient) hostsAnswer(q *dnsmessage.Message) *dnsmessage.Message {
+	question := q.Questions[0]
+	ips, ok := c.hosts[normalizeHost(question.Name.String())]
+	if !ok {
+		return nil
+	}
+	resp := &dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: q.ID, Response: true, Authoritative: true, RecursionDesired: q.RecursionDesired, RecursionAvailable: true},
+		Questions: q.Questions,
+	}
+	hdr := dnsmessage.ResourceHeader{Name: question.Name, Type: question.Type, Class: dnsmessage.ClassINET, TTL: 60}
+	for _, ip := range ips {
+		switch {
+		case question.Type == dnsmessage.TypeA && ip.To4() != nil:
+			var a [4]byte
+			copy(a[:], ip.To4())
+			resp.Answers = append(resp.Answers, dnsmessage.Resource{Header: hdr, Body: &dnsmessage.AResource{A: a}})
+		case question.Type == dnsmessage.TypeAAAA && ip.To4() == nil:
+			var a [16]byte
+			copy(a[:], ip.To16())
+			resp.Answers = append(resp.Answers, dnsmessage.Resource{Header: hdr, Body: &dnsmessage.AAAAResource{AAAA: a}})
+		}
+	}
+	return resp
+}
+
+// newDNSQuery builds a recursive query for name with a random ID.
+func newDNSQuery(name string, t dnsmessage.Type) (*dnsmessage.Message, error) {
+	n, err := dnsmessage.NewName(strings.TrimSuffix(name, ".") + ".")
+	if err != nil {
+		return nil, err
+	}
+	return &dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: uint16(rand.Uint32()), RecursionDesired: true},
+		Questions: []dnsmessage.Question{{Name: n, Type: t, Class: dnsmessage.ClassINET}},
+	}, nil
+}
+
+func filterIPs(ips []net.IP, network string) []net.IP {
+	var out []net.IP
+	for _, ip := range ips {
+		is4 := ip.To4() != nil
+		if network == "ip" || (network == "ip4" && is4) || (network == "ip6" && !is4) {
+			out = append(out, ip)
+		}
+	}
+	return out
+}
+
+// ---------------------------------------------------------------------------
+// Cache
+// ---------------------------------------------------------------------------
+
+// dnsCache keeps responses until the smallest TTL among their records expires.
+// Negative answers are kept for the SOA minimum, capped at 5 minutes.
+type dnsCache struct {
+	mu      sync.Mutex
+	max     int
+	entries map[dnsCacheKey]dnsCacheEntry
+}
+
+type dnsCacheKey struct {
+	name  string
+	typ   dnsmessage.Type
+	class dnsmessage.Class
+}
+
+type dnsCacheEntry struct {
+	msg     dnsmessage.Message
+	stored  time.Time
+	expires time.Time
+}
+
+func newDNSCache(max int) *dnsCache {
+	return &dnsCache{max: max, entries: map[dnsCacheKey]dnsCacheEntry{}}
+}
+
+func cacheKey(q dnsmessage.Question) dnsCacheKey {
+	return dnsCacheKey{name: strings.ToLower(q.Name.String()), typ: q.Type, class: q.Class}
+}
+
+// get returns a copy of the cached response with TTLs reduced by its age.
+func (c *dnsCache) get(q dnsmessage.Question, now time.Time) *dnsmessage.Message {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[cacheKey(q)]
+	if !ok {
+		return nil
+	}
+	if !now.Before(e.expires) {
+		delete(c.entries, cacheKey(q))
+		return nil
+	}
+	age := uint32(now.Sub(e.stored) / time.Second)
+	msg := e.msg
+	for _, rrs := range []*[]dnsmessage.Resource{&msg.Answers, &msg.Authorities, &msg.Additionals} {
+		aged := make([]dnsmessage.Resource, len(*rrs))
+		for i, rr := range *rrs {
+			if rr.Header.Type != dnsmessage.TypeOPT {
+				rr.Header.TTL -= min(age, rr.Header.TTL)
+			}
+			aged[i] = rr
+		}
+		*rrs = aged
+	}
+	return &msg
+}
+
+func (c *dnsCache) put(q dnsmessage.Question, resp *dnsmessage.Message, now time.Time) {
+	ttl, ok := cacheTTL(resp)
+	if !ok || ttl == 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.entries) >= c.max {
+		// Drop expired entries first, then an arbitrary one.
+		for k, e := range c.entries {
+			if !now.Before(e.expires) {
+				delete(c.entries, k)
+			}
+		}
+		for k := range c.entries {
+			if len(c.entries) < c.max {
+				break
+			}
+			delete(c.entries, k)
+		}
+	}
+	c.entries[cacheKey(q)] = dnsCacheEntry{msg: *resp, stored: now, expires: now.Add(ttl)}
+}
+
+// cacheTTL returns how long resp may be cached. Only NOERROR and NXDOMAIN answers are cached.
+func cacheTTL(resp *dnsmessage.Message) (time.Duration, bool) {
+	if resp.Truncated || (resp.RCode != dnsmessage.RCodeSuccess && resp.RCode != dnsmessage.RCodeNameError) {
+		return 0, false
+	}
+	const maxTTL, maxNegTTL = uint32(3600), uint32(300)
+	if len(resp.Answers) > 0 {
+		ttl := maxTTL
+		for _, rr := range resp.Answers {
+			ttl = min(ttl, rr.Header.TTL)
+		}
+		return time.Duration(ttl) * time.Second, true
+	}
+	for _, rr := range resp.Authorities {
+		if soa, ok := rr.Body.(*dnsmessage.SOAResource); ok {
+			return time.Duration(min(rr.Header.TTL, soa.MinTTL, maxNegTTL)) * time.Second, true
+		}
+	}
+	return 0, false
+}
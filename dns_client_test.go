@@ -0,0 +1,345 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func mustDNSClient(t *testing.T, opts dnsClientOptions) *dnsClient {
+	t.Helper()
+	c, err := newDNSClient(opts)
+	if err != nil {
+		t.Fatalf("newDNSClient: %v", err)
+	}
+	return c
+}
+
+// standInDNS answers A queries with ip (TTL 60) and everything else with an empty
+// NOERROR answer. rcode overrides the response code when non-zero. It counts queries.
+type standInDNS struct {
+	ip      net.IP
+	rcode   dnsmessage.RCode
+	queries atomic.Int32
+}
+
+func (s *standInDNS) answer(raw []byte) []byte {
+	s.queries.Add(1)
+	var q dnsmessage.Message
+	if err := q.Unpack(raw); err != nil || len(q.Questions) != 1 {
+		return nil
+	}
+	resp := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: q.ID, Response: true, RecursionAvailable: true, RCode: s.rcode},
+		Questions: q.Questions,
+	}
+	if s.rcode == 0 && q.Questions[0].Type == dnsmessage.TypeA {
+		var a [4]byte
+		copy(a[:], s.ip.To4())
+		resp.Answers = []dnsmessage.Resource{{
+			Header: dnsmessage.ResourceHeader{Name: q.Questions[0].Name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: 60},
+			Body:   &dnsmessage.AResource{A: a},
+		}}
+	}
+	out, _ := resp.Pack()
+	return out
+}
+
+// serveStream answers length-prefixed queries on ln (plain TCP or TLS).
+func (s *standInDNS) serveStream(ln net.Listener) {
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer func() { _ = c.Close() }()
+			for {
+				var l [2]byte
+				if _, err := io.ReadFull(c, l[:]); err != nil {
+					return
+				}
+				q := make([]byte, binary.BigEndian.Uint16(l[:]))
+				if _, err := io.ReadFull(c, q); err != nil {
+					return
+				}
+				resp := s.answer(q)
+				out := make([]byte, 2+len(resp))
+				binary.BigEndian.PutUint16(out, uint16(len(resp)))
+				copy(out[2:], resp)
+				_, _ = c.Write(out)
+			}
+		}()
+	}
+}
+
+// serveUDP answers queries on a loopback UDP socket and returns its address.
+func (s *standInDNS) serveUDP(t *testing.T) string {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen udp: %v", err)
+	}
+	t.Cleanup(func() { _ = pc.Close() })
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if resp := s.answer(buf[:n]); resp != nil {
+				_, _ = pc.WriteTo(resp, addr)
+			}
+		}
+	}()
+	return pc.LocalAddr().String()
+}
+
+// newDoHServer starts a DNS-over-HTTPS stand-in and returns it with a TLS config
+// trusting its certificate.
+func newDoHServer(t *testing.T, s *standInDNS) (*httptest.Server, *tls.Config) {
+	t.Helper()
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/dns-message" {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		q, _ := io.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "application/dns-message")
+		_, _ = w.Write(s.answer(q))
+	}))
+	t.Cleanup(srv.Close)
+	return srv, srv.Client().Transport.(*http.Transport).TLSClientConfig
+}
+
+func lookupOne(t *testing.T, c *dnsClient, host string) net.IP {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	ips, err := c.LookupIP(ctx, "ip4", host)
+	if err != nil || len(ips) == 0 {
+		t.Fatalf("LookupIP(%s): %v %v", host, ips, err)
+	}
+	return ips[0]
+}
+
+func TestDNSClient_DoHAndCache(t *testing.T) {
+	s := &standInDNS{ip: net.ParseIP("10.1.0.1")}
+	srv, tlsCfg := newDoHServer(t, s)
+	c := mustDNSClient(t, dnsClientOptions{Upstreams: []string{srv.URL + "/dns-query"}, TLSConfig: tlsCfg})
+
+	if ip := lookupOne(t, c, "doh.example.test"); !ip.Equal(s.ip) {
+		t.Fatalf("got %v", ip)
+	}
+	if ip := lookupOne(t, c, "DOH.example.test."); !ip.Equal(s.ip) || s.queries.Load() != 1 {
+		t.Fatalf("second lookup should come from the cache: ip=%v queries=%d", ip, s.queries.Load())
+	}
+}
+
+func TestDNSClient_DoT(t *testing.T) {
+	s := &standInDNS{ip: net.ParseIP("10.1.0.2")}
+	// Borrow httptest's certificate (valid for 127.0.0.1) for the DoT listener.
+	cert := httptest.NewTLSServer(http.NotFoundHandler())
+	defer cert.Close()
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", cert.TLS)
+	if err != nil {
+		t.Fatalf("tls listen: %v", err)
+	}
+	defer func() { _ = ln.Close() }()
+	go s.serveStream(ln)
+
+	roots := cert.Client().Transport.(*http.Transport).TLSClientConfig
+	c := mustDNSClient(t, dnsClientOptions{Upstreams: []string{"tls://" + ln.Addr().String()}, TLSConfig: roots})
+	if ip := lookupOne(t, c, "dot.example.test"); !ip.Equal(s.ip) {
+		t.Fatalf("got %v", ip)
+	}
+}
+
+func TestDNSClient_DoHNameResolvedByBootstrap(t *testing.T) {
+	doh := &standInDNS{ip: net.ParseIP("10.1.0.3")}
+	srv, tlsCfg := newDoHServer(t, doh)
+	bootstrap := &standInDNS{ip: net.ParseIP("127.0.0.1")}
+	_, port, _ := net.SplitHostPort(srv.Listener.Addr().String())
+	// httptest's certificate is valid for example.com.
+	upstreams := []string{"https://example.com:" + port + "/dns-query", bootstrap.serveUDP(t)}
+
+	var mu sync.Mutex
+	var dialed []string
+	dial := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		mu.Lock()
+		dialed = append(dialed, addr)
+		mu.Unlock()
+		return (&net.Dialer{}).DialContext(ctx, network, addr)
+	}
+	c := mustDNSClient(t, dnsClientOptions{Upstreams: upstreams, TLSConfig: tlsCfg, Dial: dial})
+	if ip := lookupOne(t, c, "doh.example.test"); !ip.Equal(doh.ip) {
+		t.Fatalf("got %v", ip)
+	}
+	if bootstrap.queries.Load() == 0 {
+		t.Fatal("the DoH host name was not resolved by the bootstrap upstream")
+	}
+	mu.Lock()
+	for _, addr := range dialed {
+		if host, _, _ := net.SplitHostPort(addr); net.ParseIP(host) == nil {
+			t.Errorf("dialed %s, want IP addresses only", addr)
+		}
+	}
+	mu.Unlock()
+
+	if _, err := newDNSClient(dnsClientOptions{Upstreams: upstreams[:1], Dial: dial}); err == nil {
+		t.Fatal("accepted a DoH host name with nothing to resolve it")
+	}
+	c = mustDNSClient(t, dnsClientOptions{Upstreams: upstreams[:1], Hosts: []string{"example.com=127.0.0.1"}, TLSConfig: tlsCfg, Dial: dial})
+	if ip := lookupOne(t, c, "hosts.example.test"); !ip.Equal(doh.ip) {
+		t.Fatalf("got %v", ip)
+	}
+}
+
+func TestNewSocksServer_DoTNameFromDNSHosts(t *testing.T) {
+	opts := socksOptions{DNSServers: []string{"tls://dns.example.test"}, BindIf: "lo"}
+	if _, err := newSocksServer(opts); err == nil {
+		t.Fatal("accepted a DoT host name with nothing to resolve it")
+	}
+	opts.DNSHosts = []string{"dns.example.test=127.0.0.1"}
+	if _, err := newSocksServer(opts); err != nil {
+		t.Fatalf("newSocksServer with a dns_hosts entry for the upstream: %v", err)
+	}
+}
+
+func TestDNSClient_FailoverAndHealth(t *testing.T) {
+	// A TCP upstream that refuses connections, a SERVFAIL upstream, then a working one.
+	dead, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	deadAddr := dead.Addr().String()
+	_ = dead.Close()
+	failing := &standInDNS{rcode: dnsmessage.RCodeServerFailure}
+	good := &standInDNS{ip: net.ParseIP("10.1.0.3")}
+
+	c := mustDNSClient(t, dnsClientOptions{
+		Upstreams: []string{"tcp://" + deadAddr, failing.serveUDP(t), good.serveUDP(t)},
+		Timeout:   time.Second,
+	})
+	if ip := lookupOne(t, c, "a.example.test"); !ip.Equal(good.ip) {
+		t.Fatalf("got %v", ip)
+	}
+	order := c.order(time.Now())
+	if order[0] != c.upstreams[2] {
+		t.Fatalf("healthy upstream should be tried first, got %s", order[0].Raw)
+	}
+
+	// Once the back-off expires the first upstream is preferred again.
+	if got := c.order(time.Now().Add(2 * time.Second))[0]; got != c.upstreams[0] {
+		t.Fatalf("expected recovery of %s, got %s", c.upstreams[0].Raw, got.Raw)
+	}
+	failed := failing.queries.Load()
+	if ip := lookupOne(t, c, "b.example.test"); !ip.Equal(good.ip) || failing.queries.Load() != failed {
+		t.Fatalf("unhealthy upstream should be skipped: ip=%v servfail queries %d -> %d", ip, failed, failing.queries.Load())
+	}
+}
+
+func TestDNSClient_StaticHosts(t *testing.T) {
+	c := mustDNSClient(t, dnsClientOptions{
+		Upstreams: []string{"127.0.0.1:1"},
+		Hosts:     []string{"nas.lan=192.168.1.10", "nas.lan=fd00::10"},
+	})
+	ctx := context.Background()
+	ips, err := c.LookupIP(ctx, "ip", "NAS.lan")
+	if err != nil || len(ips) != 2 {
+		t.Fatalf("got %v %v", ips, err)
+	}
+	if ips, _ := c.LookupIP(ctx, "ip6", "nas.lan"); len(ips) != 1 || ips[0].To4() != nil {
+		t.Fatalf("ip6 filter: %v", ips)
+	}
+	q, _ := newDNSQuery("nas.lan", dnsmessage.TypeA)
+	resp, err := c.Exchange(ctx, q)
+	if err != nil || len(resp.Answers) != 1 || resp.ID != q.ID {
+		t.Fatalf("Exchange: %+v %v", resp, err)
+	}
+	if _, err := parseDNSHosts([]string{"bad"}); err == nil {
+		t.Fatal("expected error for entry without =")
+	}
+}
+
+func TestDNSCache_TTL(t *testing.T) {
+	c := newDNSCache(2)
+	q, _ := newDNSQuery("ttl.example.test", dnsmessage.TypeA)
+	resp := &dnsmessage.Message{
+		Header:    dnsmessage.Header{Response: true},
+		Questions: q.Questions,
+		Answers: []dnsmessage.Resource{{
+			Header: dnsmessage.ResourceHeader{Name: q.Questions[0].Name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: 30},
+			Body:   &dnsmessage.AResource{A: [4]byte{10, 0, 0, 1}},
+		}},
+	}
+	now := time.Now()
+	c.put(q.Questions[0], resp, now)
+	got := c.get(q.Questions[0], now.Add(10*time.Second))
+	if got == nil || got.Answers[0].Header.TTL != 20 {
+		t.Fatalf("expected aged TTL 20, got %+v", got)
+	}
+	if resp.Answers[0].Header.TTL != 30 {
+		t.Fatal("cache must not modify the stored response")
+	}
+	if c.get(q.Questions[0], now.Add(30*time.Second)) != nil {
+		t.Fatal("entry should expire after its TTL")
+	}
+
+	// SERVFAIL is never cached; NXDOMAIN uses the SOA minimum.
+	c.put(q.Questions[0], &dnsmessage.Message{Header: dnsmessage.Header{RCode: dnsmessage.RCodeServerFailure}}, now)
+	if c.get(q.Questions[0], now) != nil {
+		t.Fatal("SERVFAIL cached")
+	}
+	nx := &dnsmessage.Message{
+		Header: dnsmessage.Header{RCode: dnsmessage.RCodeNameError},
+		Authorities: []dnsmessage.Resource{{
+			Header: dnsmessage.ResourceHeader{Name: q.Questions[0].Name, Type: dnsmessage.TypeSOA, Class: dnsmessage.ClassINET, TTL: 900},
+			Body:   &dnsmessage.SOAResource{NS: q.Questions[0].Name, MBox: q.Questions[0].Name, MinTTL: 120},
+		}},
+	}
+	if ttl, ok := cacheTTL(nx); !ok || ttl != 120*time.Second {
+		t.Fatalf("negative TTL: %v %v", ttl, ok)
+	}
+}
+
+func TestParseDNSUpstream(t *testing.T) {
+	cases := map[string][3]string{ // input -> proto, addr, url
+		"1.1.1.1":                   {"udp", "1.1.1.1:53", ""},
+		"9.9.9.9:5353":              {"udp", "9.9.9.9:5353", ""},
+		"tcp://[2606:4700::1111]":   {"tcp", "[2606:4700::1111]:53", ""},
+		"tls://9.9.9.9":             {"tls", "9.9.9.9:853", ""},
+		"tls://dns.quad9.net:8853":  {"tls", "dns.quad9.net:8853", ""},
+		"https://1.1.1.1/dns-query": {"https", "", "https://1.1.1.1/dns-query"},
+		"https://dns.google":        {"https", "", "https://dns.google/dns-query"},
+	}
+	for in, want := range cases {
+		u, err := parseDNSUpstream(in)
+		if err != nil || u.Proto != want[0] || u.Addr != want[1] || u.URL != want[2] {
+			t.Errorf("%s: got %+v err=%v, want %v", in, u, err, want)
+		}
+	}
+	for _, in := range []string{"dns.example", "quic://1.1.1.1", "https://", ""} {
+		if _, err := parseDNSUpstream(in); err == nil {
+			t.Errorf("%q: expected error", in)
+		}
+	}
+	list := []string{"1.1.1.1", "tls://9.9.9.9", "https://dns.google/dns-query", "8.8.8.8:5353"}
+	if got := dnsServerIPs(list); len(got) != 3 {
+		t.Errorf("dnsServerIPs: %v", got)
+	}
+	if got := plainDNSServers(list); len(got) != 1 || got[0] != "1.1.1.1" {
+		t.Errorf("plainDNSServers: %v", got)
+	}
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// dnsSplitRule sends queries for Domain and its subdomains to its own upstreams.
+type dnsSplitRule struct {
+	Domain    string
+	Upstreams []string
+}
+
+// parseDNSSplit parses domain=upstream entries (e.g. corp.example=10.0.0.53). Repeating
+// a domain adds upstreams to it, tried in order.
+func parseDNSSplit(list []string) ([]dnsSplitRule, error) {
+	var rules []dnsSplitRule
+	index := map[string]int{}
+	for _, e := range list {
+		domain, upstream, ok := strings.Cut(e, "=")
+		domain = normalizeHost(domain)
+		if !ok || domain == "" {
+			return nil, fmt.Errorf("split DNS entry %q: want domain=server", e)
+		}
+		if _, err := parseDNSUpstream(upstream); err != nil {
+			return nil, fmt.Errorf("split DNS entry %q: %w", e, err)
+		}
+		if i, ok := index[domain]; ok {
+			rules[i].Upstreams = append(rules[i].Upstreams, strings.TrimSpace(upstream))
+			continue
+		}
+		index[domain] = len(rules)
+		rules = append(rules, dnsSplitRule{Domain: domain, Upstreams: []string{strings.TrimSpace(upstream)}})
+	}
+	return rules, nil
+}
+
+// dnsServerOptions configures startDNSServer.
+type dnsServerOptions struct {
+	ListenAddr string
+	Upstreams  []string // default upstreams, reached through BindIf
+	Split      []string // domain=server entries, reached through the system routes
+	Hosts      []string // static name=ip overrides
+	BindIf     string
+	EnableIPv6 bool       // when false, AAAA queries get an empty answer
+	Blocklist  *blocklist // nil blocks nothing
+	TLSConfig  *tls.Config
+}
+
+// dnsServer is a caching DNS forwarder listening on UDP and TCP.
+type dnsServer struct {
+	pc         net.PacketConn
+	ln         net.Listener
+	def        *dnsClient
+	split      []dnsSplitClient
+	enableIPv6 bool
+	blocklist  *blocklist
+	wg         sync.WaitGroup
+}
+
+type dnsSplitClient struct {
+	domain string
+	client *dnsClient
+}
+
+// startDNSServer starts the forwarder at opts.ListenAddr. Queries for split domains go
+// to their own upstreams; everything else goes to opts.Upstreams through opts.BindIf,
+// so lookups leave through the VPN.
+func startDNSServer(ctx context.Context, opts dnsServerOptions) (*dnsServer, error) {
+	upstreams := opts.Upstreams
+	if len(upstreams) == 0 {
+		upstreams = DefaultTunnelDNS
+	}
+	def, err := newDNSClient(dnsClientOptions{Upstreams: upstreams, BindIf: opts.BindIf, Hosts: opts.Hosts, TLSConfig: opts.TLSConfig})
+	if err != nil {
+		return nil, err
+	}
+	s := &dnsServer{def: def, enableIPv6: opts.EnableIPv6, blocklist: opts.Blocklist}
+	rules, err := parseDNSSplit(opts.Split)
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range rules {
+		c, err := newDNSClient(dnsClientOptions{Upstreams: r.Upstreams, Hosts: opts.Hosts, TLSConfig: opts.TLSConfig})
+		if err != nil {
+			return nil, err
+		}
+		s.split = append(s.split, dnsSplitClient{domain: r.Domain, client: c})
+	}
+
+	if s.pc, s.ln, err = listenDNS(opts.ListenAddr); err != nil {
+		return nil, err
+	}
+	s.wg.Add(2)
+	go s.serveUDP(ctx)
+	go s.serveTCP(ctx)
+	go func() {
+		<-ctx.Done()
+		_ = s.Close()
+	}()
+	return s, nil
+}
+
+// listenDNS opens the UDP and TCP listeners on one port. With port 0 the port the
+// kernel picks for UDP may already be taken for TCP, so a few ports are tried.
+func listenDNS(addr string) (net.PacketConn, net.Listener, error) {
+	_, port, _ := net.SplitHostPort(addr)
+	for attempt := 1; ; attempt++ {
+		pc, err := net.ListenPacket("udp", addr)
+		if err != nil {
+			return nil, nil, err
+		}
+		ln, err := net.Listen("tcp", pc.LocalAddr().String())
+		if err == nil {
+			return pc, ln, nil
+		}
+		_ = pc.Close()
+		if port != "0" || attempt == 10 {
+			return nil, nil, err
+		}
+	}
+}
+
+// Addr returns the address the server listens on.
+func (s *dnsServer) Addr() string { return s.pc.LocalAddr().String() }
+
+// Close stops both listeners and waits for the accept loops to exit.
+func (s *dnsServer) Close() error {
+	_ = s.pc.Close()
+	_ = s.ln.Close()
+	s.wg.Wait()
+	return nil
+}
+
+func (s *dnsServer) serveUDP(ctx context.Context) {
+	defer s.wg.Done()
+	buf := make([]byte, 65535)
+	for {
+		n, addr, err := s.pc.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		query := append([]byte(nil), buf[:n]...)
+		go func() {
+			if resp := s.handle(ctx, query, true); resp != nil {
+				_, _ = s.pc.WriteTo(resp, addr)
+			}
+		}()
+	}
+}
+
+func (s *dnsServer) serveTCP(ctx context.Context) {
+	defer s.wg.Done()
+	for {
+		c, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer func() { _ = c.Close() }()
+			for {
+				_ = c.SetReadDeadline(time.Now().Add(10 * time.Second))
+				var l [2]byte
+				if _, err := io.ReadFull(c, l[:]); err != nil {
+					return
+				}
+				query := make([]byte, binary.BigEndian.Uint16(l[:]))
+				if _, err := io.ReadFull(c, query); err != nil {
+					return
+				}
+				resp := s.handle(ctx, query, false)
+				if resp == nil {
+					return
+				}
+				out := make([]byte, 2+len(resp))
+				binary.BigEndian.PutUint16(out, uint16(len(resp)))
+				copy(out[2:], resp)
+				if _, err := c.Write(out); err != nil {
+					return
+				}
+			}
+		}()
+	}
+}
+
+// handle answers one wire-format query. It returns nil for input that is not a query.
+func (s *dnsServer) handle(ctx context.Context, raw []byte, overUDP bool) []byte {
+	var q dnsmessage.Message
+	if err := q.Unpack(raw); err != nil || q.Response {
+		return nil
+	}
+	if len(q.Questions) != 1 || q.OpCode != 0 {
+		return packDNS(dnsReply(&q, dnsmessage.RCodeFormatError), 0)
+	}
+	question := q.Questions[0]
+
+	// Static host overrides take precedence over the blocklist.
+	if s.def.hostsAnswer(&q) == nil && s.blocklist.blocks(question.Name.String()) {
+		logDebug("dns %s %s: blocked\n", question.Type, question.Name)
+		return packDNS(s.blocklist.answer(&q), 0)
+	}
+
+	// Without IPv6 answer AAAA with NOERROR and no records, so applications fall back to
+	// IPv4 right away instead of waiting on addresses they cannot reach.
+	if question.Type == dnsmessage.TypeAAAA && !s.enableIPv6 {
+		return packDNS(dnsReply(&q, dnsmessage.RCodeSuccess), 0)
+	}
+
+	client, via := s.clientFor(question.Name.String())
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	resp, err := client.Exchange(ctx, &q)
+	if err != nil {
+		logDebug("dns %s %s via %s: %v\n", question.Type, question.Name, via, err)
+		return packDNS(dnsReply(&q, dnsmessage.RCodeServerFailure), 0)
+	}
+	logDebug("dns %s %s via %s: %s, %d answers\n", question.Type, question.Name, via, resp.RCode, len(resp.Answers))
+	limit := 0
+	if overUDP {
+		limit = udpPayloadLimit(&q)
+	}
+	return packDNS(resp, limit)
+}
+
+// clientFor returns the client for name: the longest matching split domain, or the default.
+func (s *dnsServer) clientFor(name string) (*dnsClient, string) {
+	host := normalizeHost(name)
+	var best *dnsSplitClient
+	for i := range s.split {
+		sc := &s.split[i]
+		if domainMatches(host, []string{sc.domain}) && (best == nil || len(sc.domain) > len(best.domain)) {
+			best = sc
+		}
+	}
+	if best != nil {
+		return best.client, best.domain
+	}
+	return s.def, "default"
+}
+
+// dnsReply builds an empty response to q with rcode.
+func dnsReply(q *dnsmessage.Message, rcode dnsmessage.RCode) *dnsmessage.Message {
+	return &dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: q.ID, Response: true, RecursionDesired: q.RecursionDesired, RecursionAvailable: true, RCode: rcode},
+		Questions: q.Questions,
+	}
+}
+
+// udpPayloadLimit returns the largest UDP response the client accepts: 512 bytes, or
+// the size it advertised in an EDNS0 OPT record.
+func udpPayloadLimit(q *dnsmessage.Message) int {
+	for _, rr := range q.Additionals {
+		if rr.Header.Type == dnsmessage.TypeOPT {
+			return max(512, int(rr.Header.Class))
+		}
+	}
+	return 512
+}
+
+// packDNS packs m. When limit is set and the message does not fit, the records are
+// dropped and TC is set so the client retries over TCP.
+func packDNS(m *dnsmessage.Message, limit int) []byte {
+	out, err := m.Pack()
+	if err != nil {
+		return nil
+	}
+	if limit > 0 && len(out) > limit {
+		t := *m
+		t.Truncated = true
+		t.Answers, t.Authorities, t.Additionals = nil, nil, nil
+		if out, err = t.Pack(); err != nil {
+			return nil
+		}
+	}
+	return out
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func startTestDNSServer(t *testing.T, opts dnsServerOptions) *dnsServer {
+	t.Helper()
+	opts.ListenAddr = "127.0.0.1:0"
+	ctx, cancel := context.WithCancel(context.Background())
+	s, err := startDNSServer(ctx, opts)
+	if err != nil {
+		cancel()
+		t.Fatalf("startDNSServer: %v", err)
+	}
+	t.Cleanup(func() {
+		cancel()
+		_ = s.Close()
+	})
+	return s
+}
+
+// queryDNS sends one query for name to addr over network ("udp" or "tcp").
+func queryDNS(t *testing.T, network, addr, name string, typ dnsmessage.Type) *dnsmessage.Message {
+	t.Helper()
+	m, err := newDNSQuery(name, typ)
+	if err != nil {
+		t.Fatalf("query: %v", err)
+	}
+	q, err := m.Pack()
+	if err != nil {
+		t.Fatalf("pack: %v", err)
+	}
+	c, err := net.DialTimeout(network, addr, 2*time.Second)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer func() { _ = c.Close() }()
+	_ = c.SetDeadline(time.Now().Add(5 * time.Second))
+	var raw []byte
+	if network == "tcp" {
+		out := binary.BigEndian.AppendUint16(nil, uint16(len(q)))
+		if _, err := c.Write(append(out, q...)); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+		var l [2]byte
+		if _, err := io.ReadFull(c, l[:]); err != nil {
+			t.Fatalf("read: %v", err)
+		}
+		raw = make([]byte, binary.BigEndian.Uint16(l[:]))
+		if _, err := io.ReadFull(c, raw); err != nil {
+			t.Fatalf("read: %v", err)
+		}
+	} else {
+		if _, err := c.Write(q); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+		raw = make([]byte, 65535)
+		n, err := c.Read(raw)
+		if err != nil {
+			t.Fatalf("read: %v", err)
+		}
+		raw = raw[:n]
+	}
+	var resp dnsmessage.Message
+	if err := resp.Unpack(raw); err != nil {
+		t.Fatalf("unpack: %v", err)
+	}
+	return &resp
+}
+
+func answerIP(t *testing.T, m *dnsmessage.Message) net.IP {
+	t.Helper()
+	if len(m.Answers) != 1 {
+		t.Fatalf("expected one answer, got %+v", m.Answers)
+	}
+	a, ok := m.Answers[0].Body.(*dnsmessage.AResource)
+	if !ok {
+		t.Fatalf("expected an A record, got %T", m.Answers[0].Body)
+	}
+	return net.IP(a.A[:])
+}
+
+func TestDNSServer_SplitDomainsAndCache(t *testing.T) {
+	public := &standInDNS{ip: net.ParseIP("10.1.0.1")}
+	corp := &standInDNS{ip: net.ParseIP("10.1.0.2")}
+	lab := &standInDNS{ip: net.ParseIP("10.1.0.3")}
+	s := startTestDNSServer(t, dnsServerOptions{
+		Upstreams: []string{public.serveUDP(t)},
+		Split: []string{
+			"corp.example=" + corp.serveUDP(t),
+			"lab.corp.example=" + lab.serveUDP(t),
+		},
+	})
+
+	for _, tc := range []struct {
+		name string
+		want string
+	}{
+		{"www.example.com", "10.1.0.1"},
+		{"corp.example", "10.1.0.2"},
+		{"wiki.corp.example", "10.1.0.2"},
+		{"host.lab.corp.example", "10.1.0.3"},
+		{"notcorp.example", "10.1.0.1"},
+	} {
+		if got := answerIP(t, queryDNS(t, "udp", s.Addr(), tc.name, dnsmessage.TypeA)); got.String() != tc.want {
+			t.Errorf("%s: got %s, want %s", tc.name, got, tc.want)
+		}
+	}
+
+	// A repeated query is answered from the cache, over TCP this time.
+	before := public.queries.Load()
+	if got := answerIP(t, queryDNS(t, "tcp", s.Addr(), "www.example.com", dnsmessage.TypeA)); got.String() != "10.1.0.1" {
+		t.Fatalf("tcp: got %s", got)
+	}
+	if public.queries.Load() != before {
+		t.Fatalf("expected a cached answer, upstream saw %d more queries", public.queries.Load()-before)
+	}
+}
+
+func TestDNSServer_EmptyAAAAWithoutIPv6(t *testing.T) {
+	up := &standInDNS{ip: net.ParseIP("10.1.0.1")}
+	s := startTestDNSServer(t, dnsServerOptions{Upstreams: []string{up.serveUDP(t)}})
+
+	resp := queryDNS(t, "udp", s.Addr(), "www.example.com", dnsmessage.TypeAAAA)
+	if resp.RCode != dnsmessage.RCodeSuccess || len(resp.Answers) != 0 {
+		t.Fatalf("expected empty NOERROR, got %s with %d answers", resp.RCode, len(resp.Answers))
+	}
+	if up.queries.Load() != 0 {
+		t.Fatalf("AAAA query was forwarded upstream")
+	}
+
+	v6 := startTestDNSServer(t, dnsServerOptions{Upstreams: []string{up.serveUDP(t)}, EnableIPv6: true})
+	queryDNS(t, "udp", v6.Addr(), "www.example.com", dnsmessage.TypeAAAA)
+	if up.queries.Load() != 1 {
+		t.Fatalf("expected the AAAA query to be forwarded with IPv6 enabled")
+	}
+}
+
+func TestDNSServer_StaticHostsAndUpstreamFailure(t *testing.T) {
+	down := &standInDNS{rcode: dnsmessage.RCodeServerFailure}
+	s := startTestDNSServer(t, dnsServerOptions{
+		Upstreams: []string{down.serveUDP(t)},
+		Hosts:     []string{"nas.lan=192.168.1.10"},
+	})
+	if got := answerIP(t, queryDNS(t, "udp", s.Addr(), "nas.lan", dnsmessage.TypeA)); got.String() != "192.168.1.10" {
+		t.Fatalf("hosts override: got %s", got)
+	}
+	if resp := queryDNS(t, "udp", s.Addr(), "www.example.com", dnsmessage.TypeA); resp.RCode != dnsmessage.RCodeServerFailure {
+		t.Fatalf("expected SERVFAIL, got %s", resp.RCode)
+	}
+}
+
+func TestParseDNSSplit(t *testing.T) {
+	rules, err := parseDNSSplit([]string{"Corp.Example.=10.0.0.53", "corp.example=tls://10.0.0.54", "lab.example=10.0.1.53:5353"})
+	if err != nil {
+		t.Fatalf("parseDNSSplit: %v", err)
+	}
+	if len(rules) != 2 || rules[0].Domain != "corp.example" || len(rules[0].Upstreams) != 2 || rules[1].Upstreams[0] != "10.0.1.53:5353" {
+		t.Fatalf("unexpected rules: %+v", rules)
+	}
+	for _, bad := range []string{"corp.example", "=10.0.0.53", "corp.example=dns.corp.example"} {
+		if _, err := parseDNSSplit([]string{bad}); err == nil {
+			t.Errorf("%q: expected an error", bad)
+		}
+	}
+}
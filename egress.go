@@ -0,0 +1,281 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/urnetwork/connect"
+	"github.com/urnetwork/connect/protocol"
+)
+
+// egressIdleTimeout is how long a location's provider client is kept after its last
+// SOCKS connection ends.
+const egressIdleTimeout = 10 * time.Minute
+
+// errNoLocation reports that a user name's location matched no provider locations.
+var errNoLocation = errors.New("no provider locations match")
+
+// userLocation returns the exit location a SOCKS user name selects: "loc-<location_id>"
+// for one location, or a location query such as "country:Germany" (keys country,
+// country_code, region, group and name, as for --location_query). Other user names
+// select nothing and use the default path.
+func userLocation(user string) (LocationConfig, bool) {
+	if id, found := strings.CutPrefix(user, "loc-"); found {
+		if _, err := connect.ParseId(id); err != nil {
+			return LocationConfig{}, false
+		}
+		return LocationConfig{LocationID: id}, true
+	}
+	k, v, found := strings.Cut(user, ":")
+	k, v = strings.ToLower(strings.TrimSpace(k)), strings.TrimSpace(v)
+	if !found || v == "" {
+		return LocationConfig{}, false
+	}
+	switch k {
+	case "country", "country_code", "region", "group", "name":
+		return LocationConfig{LocationQuery: k + ":" + v}, true
+	}
+	return LocationConfig{}, false
+}
+
+// locationKey names loc in the egress cache and in logs; "" for the zero location.
+func locationKey(loc LocationConfig) string {
+	var parts []string
+	if loc.LocationID != "" {
+		parts = append(parts, "loc-"+strings.ToLower(loc.LocationID))
+	}
+	if loc.LocationGroupID != "" {
+		parts = append(parts, "group-"+strings.ToLower(loc.LocationGroupID))
+	}
+	if len(parts) == 0 && loc.LocationQuery != "" {
+		parts = append(parts, strings.ToLower(loc.LocationQuery))
+	}
+	return strings.Join(parts, " ")
+}
+
+// egressOptions configures the provider clients of an egressPool.
+type egressOptions struct {
+	APIURL     string
+	ConnectURL string
+	JWT        string
+	MTU        int
+	IPCIDR     string           // address of each userspace stack, as for the TUN
+	EnableIPv6 bool             // give the stacks an IPv6 address and accept IPv6 packets
+	DNSServers []string         // upstreams for names resolved through a location; default DefaultTunnelDNS
+	DNSHosts   []string         // static name=ip overrides, also for the upstreams' own names
+	Auth       []string         // socks_auth entries; see startEgressPool
+	Listeners  []*socksListener // the config file's listeners; see startEgressPool
+}
+
+// locationEgress is one location's provider client with a userspace stack in front of
+// it. Its fields are set before ready is closed and not changed after.
+type locationEgress struct {
+	key   string
+	ready chan struct{}
+	err   error
+
+	dial     func(ctx context.Context, network, addr string) (net.Conn, error)
+	resolver hostResolver
+	close    func()
+
+	// Guarded by egressPool.mu.
+	active   int
+	lastUsed time.Time
+}
+
+// egressPool creates and caches one locationEgress per location selected by SOCKS user
+// names. Provider clients are created on first use and closed after egressIdleTimeout
+// without connections, or when the pool's context ends. A nil *egressPool selects
+// nothing.
+type egressPool struct {
+	ctx  context.Context
+	open func(ctx context.Context, loc LocationConfig, e *locationEgress) error // openEgress; tests replace it
+
+	mu sync.Mutex
+	m  map[string]*locationEgress
+}
+
+// startEgressPool returns a pool for opts whose clients live until ctx ends, or nil when
+// neither a listener nor a user in socks_auth or a listener's auth selects an exit
+// location.
+func startEgressPool(ctx context.Context, opts egressOptions) *egressPool {
+	auth := [][]string{opts.Auth}
+	for _, l := range opts.Listeners {
+		if locationKey(l.Location) != "" {
+			return newEgressPool(ctx, opts)
+		}
+		auth = append(auth, l.Auth)
+	}
+	for _, list := range auth {
+		users, _ := parseSocksAuth(list)
+		for user := range users {
+			if _, ok := userLocation(user); ok {
+				return newEgressPool(ctx, opts)
+			}
+		}
+	}
+	return nil
+}
+
+// newEgressPool returns a pool for opts whose clients live until ctx ends.
+func newEgressPool(ctx context.Context, opts egressOptions) *egressPool {
+	p := &egressPool{
+		ctx: ctx,
+		open: func(ctx context.Context, loc LocationConfig, e *locationEgress) error {
+			return openEgress(ctx, opts, loc, e)
+		},
+		m: map[string]*locationEgress{},
+	}
+	go p.janitor()
+	return p
+}
+
+// acquire returns the egress for loc, creating it on first use, or nil for the zero
+// location. Call release when the connection is done with it.
+func (p *egressPool) acquire(ctx context.Context, loc LocationConfig) (*locationEgress, error) {
+	key := locationKey(loc)
+	if p == nil || key == "" {
+		return nil, nil
+	}
+	p.mu.Lock()
+	e := p.m[key]
+	if e == nil {
+		e = &locationEgress{key: key, ready: make(chan struct{})}
+		p.m[key] = e
+		go p.start(loc, e)
+	}
+	e.active++
+	p.mu.Unlock()
+
+	select {
+	case <-e.ready:
+	case <-ctx.Done():
+		p.release(e)
+		return nil, ctx.Err()
+	}
+	if e.err != nil {
+		p.release(e)
+		return nil, e.err
+	}
+	return e, nil
+}
+
+// release ends a connection's use of e.
+func (p *egressPool) release(e *locationEgress) {
+	if e == nil {
+		return
+	}
+	p.mu.Lock()
+	e.active--
+	e.lastUsed = time.Now()
+	p.mu.Unlock()
+}
+
+// start opens e. A failed egress is forgotten at once so the next connection retries.
+func (p *egressPool) start(loc LocationConfig, e *locationEgress) {
+	start := time.Now()
+	e.err = p.open(p.ctx, loc, e)
+	if e.err != nil {
+		logWarn("SOCKS egress %s: %v\n", e.key, e.err)
+		p.mu.Lock()
+		delete(p.m, e.key)
+		p.mu.Unlock()
+	} else {
+		logInfo("SOCKS egress %s ready after %s\n", e.key, time.Since(start).Round(time.Millisecond))
+	}
+	close(e.ready)
+}
+
+// janitor closes idle egresses, and every egress when the pool's context ends.
+func (p *egressPool) janitor() {
+	t := time.NewTicker(time.Minute)
+	defer t.Stop()
+	for {
+		select {
+		case <-p.ctx.Done():
+			p.closeIdle(-1)
+			return
+		case <-t.C:
+			p.closeIdle(egressIdleTimeout)
+		}
+	}
+}
+
+// closeIdle closes the open egresses without connections for longer than idle; a
+// negative idle closes all of them.
+func (p *egressPool) closeIdle(idle time.Duration) {
+	var closing []*locationEgress
+	p.mu.Lock()
+	for key, e := range p.m {
+		select {
+		case <-e.ready:
+		default:
+			continue // still opening
+		}
+		if idle < 0 || (e.active == 0 && time.Since(e.lastUsed) > idle) {
+			delete(p.m, key)
+			closing = append(closing, e)
+		}
+	}
+	p.mu.Unlock()
+	for _, e := range closing {
+		logInfo("SOCKS egress %s closed\n", e.key)
+		e.close()
+	}
+}
+
+// openEgress builds the provider specs for loc, starts a provider client for them and
+// a userspace stack that carries e's connections and DNS lookups through it.
+func openEgress(ctx context.Context, opts egressOptions, loc LocationConfig, e *locationEgress) error {
+	strat, specs := buildProviderSpecs(ctx, opts.APIURL, opts.JWT, loc)
+	if isBestAvailable(specs) {
+		return errNoLocation
+	}
+	ip, _, err := net.ParseCIDR(opts.IPCIDR)
+	if err != nil {
+		return fmt.Errorf("ip_cidr: %w", err)
+	}
+	addrs := []net.IP{ip}
+	if opts.EnableIPv6 {
+		addrs = append(addrs, net.ParseIP("fd00::2"))
+	}
+	us, err := newUserStack(opts.MTU, addrs)
+	if err != nil {
+		return err
+	}
+	servers := opts.DNSServers
+	if len(servers) == 0 {
+		servers = DefaultTunnelDNS
+	}
+	dc, err := newDNSClient(dnsClientOptions{Upstreams: servers, Hosts: opts.DNSHosts, Dial: us.DialContext})
+	if err != nil {
+		us.Close()
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	appVer := fmt.Sprintf("urnet-client %s", Version)
+	gen := connect.NewApiMultiClientGeneratorWithDefaults(
+		ctx, specs, strat, nil, opts.APIURL, opts.JWT, fmt.Sprintf("%s/", opts.ConnectURL), "", "", appVer, nil,
+	)
+	receive := func(source connect.TransferPath, provideMode protocol.ProvideMode, ipPath *connect.IpPath, packet []byte) {
+		us.receive(packet)
+	}
+	mc := connect.NewRemoteUserNatMultiClientWithDefaults(ctx, gen, receive, protocol.ProvideMode_Network)
+	go us.pump(ctx, func(packet []byte) {
+		mc.SendPacket(connect.TransferPath{}, protocol.ProvideMode_Network, packet, -1)
+	})
+
+	e.dial, e.resolver = us.DialContext, dc
+	e.close = func() {
+		cancel()
+		mc.Close()
+		us.Close()
+	}
+	return nil
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/proxy"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+)
+
+func TestUserLocation(t *testing.T) {
+	for user, want := range map[string]string{
+		"country:Germany":  "country:germany",
+		"Country: Germany": "country:germany",
+		"country_code:DE":  "country_code:de",
+		"region:Europe":    "region:europe",
+		"loc-0193f7a2-5c4e-7d1b-9a3f-2e8b6c1d4f70": "loc-0193f7a2-5c4e-7d1b-9a3f-2e8b6c1d4f70",
+		"alice":                    "",
+		"loc-notanid":              "",
+		"country:":                 "",
+		"planet:Mars":              "",
+		"admin:with:colons":        "",
+		"group:West Europe":        "group:west europe",
+		"name:Frankfurt am Main":   "name:frankfurt am main",
+		"loc-0193F7A25C4E7D1B9A3F": "",
+	} {
+		loc, ok := userLocation(user)
+		if key := locationKey(loc); ok != (want != "") || key != want {
+			t.Errorf("userLocation(%q) = %q, %v; want %q", user, key, ok, want)
+		}
+	}
+	loc, _ := userLocation("country:Germany")
+	if loc.LocationQuery != "country:Germany" {
+		t.Fatalf("query = %q, want the user's spelling", loc.LocationQuery)
+	}
+}
+
+func TestUserStack_DialsThroughPackets(t *testing.T) {
+	client, err := newUserStack(1420, []net.IP{net.ParseIP("10.255.0.2")})
+	if err != nil {
+		t.Fatalf("client stack: %v", err)
+	}
+	t.Cleanup(client.Close)
+	// The peer stands in for the provider and the destination behind it.
+	peer, err := newUserStack(1420, []net.IP{net.ParseIP("10.255.0.1")})
+	if err != nil {
+		t.Fatalf("peer stack: %v", err)
+	}
+	t.Cleanup(peer.Close)
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go client.pump(ctx, peer.receive)
+	go peer.pump(ctx, client.receive)
+
+	peerAddr := tcpip.FullAddress{NIC: userStackNIC, Addr: tcpip.AddrFrom4([4]byte{10, 255, 0, 1}), Port: 7}
+	ln, err := gonet.ListenTCP(peer.s, peerAddr, ipv4.ProtocolNumber)
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { _ = ln.Close() })
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer func() { _ = c.Close() }()
+				_, _ = io.Copy(c, c)
+			}()
+		}
+	}()
+	udp, err := gonet.DialUDP(peer.s, &peerAddr, nil, ipv4.ProtocolNumber)
+	if err != nil {
+		t.Fatalf("udp listen: %v", err)
+	}
+	t.Cleanup(func() { _ = udp.Close() })
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, from, err := udp.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			_, _ = udp.WriteTo(buf[:n], from)
+		}
+	}()
+
+	dctx, dcancel := context.WithTimeout(ctx, 5*time.Second)
+	defer dcancel()
+	c, err := client.DialContext(dctx, "tcp", "10.255.0.1:7")
+	if err != nil {
+		t.Fatalf("tcp dial: %v", err)
+	}
+	t.Cleanup(func() { _ = c.Close() })
+	expectEcho(t, c, "over tcp")
+	if _, ok := c.(interface{ CloseWrite() error }); !ok {
+		t.Fatalf("%T cannot half-close", c)
+	}
+
+	u, err := client.DialContext(dctx, "udp", "10.255.0.1:7")
+	if err != nil {
+		t.Fatalf("udp dial: %v", err)
+	}
+	t.Cleanup(func() { _ = u.Close() })
+	expectEcho(t, u, "over udp")
+
+	if _, err := client.DialContext(dctx, "tcp", "example.com:80"); err == nil {
+		t.Fatal("dialed a name")
+	}
+	if c, err := client.DialContext(dctx, "tcp", "10.255.0.1:8"); err == nil {
+		_ = c.Close()
+		t.Fatal("dialed a closed port")
+	}
+}
+
+// testEgressPool returns a pool whose egresses are opened by open.
+func testEgressPool(t *testing.T, open func(ctx context.Context, loc LocationConfig, e *locationEgress) error) *egressPool {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	return &egressPool{ctx: ctx, open: open, m: map[string]*locationEgress{}}
+}
+
+func TestEgressPool_OpensEachLocationOnce(t *testing.T) {
+	var mu sync.Mutex
+	opened := map[string]int{}
+	var closed atomic.Int32
+	p := testEgressPool(t, func(ctx context.Context, loc LocationConfig, e *locationEgress) error {
+		mu.Lock()
+		opened[loc.LocationQuery+loc.LocationID]++
+		mu.Unlock()
+		if strings.Contains(loc.LocationQuery, "Atlantis") {
+			return errNoLocation
+		}
+		time.Sleep(50 * time.Millisecond)
+		e.close = func() { closed.Add(1) }
+		return nil
+	})
+
+	var wg sync.WaitGroup
+	egs := make([]*locationEgress, 4)
+	for i, user := range []string{"country:Germany", "country:germany", "COUNTRY:Germany", "region:Europe"} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			loc, _ := userLocation(user)
+			e, err := p.acquire(context.Background(), loc)
+			if err != nil || e == nil {
+				t.Errorf("acquire %s: %v, %v", user, e, err)
+			}
+			egs[i] = e
+		}()
+	}
+	wg.Wait()
+	if len(opened) != 2 || egs[0] != egs[1] || egs[0] != egs[2] || egs[0] == egs[3] {
+		t.Fatalf("opened %v", opened)
+	}
+	if e, err := p.acquire(context.Background(), LocationConfig{}); e != nil || err != nil {
+		t.Fatalf("zero location got %v, %v", e, err)
+	}
+
+	// Failures are not cached.
+	for range 2 {
+		if _, err := p.acquire(context.Background(), LocationConfig{LocationQuery: "country:Atlantis"}); !errors.Is(err, errNoLocation) {
+			t.Fatalf("acquire Atlantis: %v", err)
+		}
+	}
+	if opened["country:Atlantis"] != 2 {
+		t.Fatalf("Atlantis opened %d times, want a retry", opened["country:Atlantis"])
+	}
+
+	// Only egresses nobody uses are closed.
+	for _, e := range egs[:3] {
+		p.release(e)
+	}
+	p.closeIdle(0)
+	if closed.Load() != 1 || len(p.m) != 1 {
+		t.Fatalf("closed %d, %d left", closed.Load(), len(p.m))
+	}
+	p.release(egs[3])
+	p.closeIdle(-1)
+	if closed.Load() != 2 || len(p.m) != 0 {
+		t.Fatalf("closed %d, %d left after closing all", closed.Load(), len(p.m))
+	}
+}
+
+func TestSocks5_UserSelectsEgress(t *testing.T) {
+	port := tcpEcho(t)
+	resolver, err := newDNSClient(dnsClientOptions{Upstreams: []string{"127.0.0.1:1"}, Hosts: []string{"exit.test=127.0.0.1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var dialed, dialedUDP atomic.Int32
+	pool := testEgressPool(t, func(ctx context.Context, loc LocationConfig, e *locationEgress) error {
+		if loc.LocationQuery != "country:Germany" {
+			return errNoLocation
+		}
+		e.dial = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			if network == "udp" {
+				dialedUDP.Add(1)
+			} else {
+				dialed.Add(1)
+			}
+			return (&net.Dialer{}).DialContext(ctx, network, addr)
+		}
+		e.resolver = resolver
+		e.close = func() {}
+		return nil
+	})
+	proxyAddr := startTestSocks(t, socksOptions{
+		Auth:   []string{"alice:pw", "country:Germany:pw", "country:Atlantis:pw"},
+		Egress: pool,
+	})
+	dial := func(user, addr string) (net.Conn, error) {
+		d, err := proxy.SOCKS5("tcp", proxyAddr, &proxy.Auth{User: user, Password: "pw"}, &net.Dialer{Timeout: 5 * time.Second})
+		if err != nil {
+			t.Fatalf("proxy.SOCKS5: %v", err)
+		}
+		c, err := d.(proxy.ContextDialer).DialContext(context.Background(), "tcp", addr)
+		if c != nil {
+			t.Cleanup(func() { _ = c.Close() })
+		}
+		return c, err
+	}
+
+	// The name only resolves through the egress's resolver.
+	c, err := dial("country:Germany", net.JoinHostPort("exit.test", strconv.Itoa(port)))
+	if err != nil {
+		t.Fatalf("dial via egress: %v", err)
+	}
+	expectEcho(t, c, "from Germany")
+	if dialed.Load() != 1 {
+		t.Fatalf("egress dialed %d times, want 1", dialed.Load())
+	}
+
+	c, err = dial("alice", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+	if err != nil {
+		t.Fatalf("dial as alice: %v", err)
+	}
+	expectEcho(t, c, "default path")
+	if dialed.Load() != 1 {
+		t.Fatal("a plain user went through the egress")
+	}
+
+	if _, err := dial("country:Atlantis", net.JoinHostPort("127.0.0.1", strconv.Itoa(port))); err == nil || !strings.Contains(err.Error(), "network unreachable") {
+		t.Fatalf("location without providers: %v", err)
+	}
+
+	// UDP ASSOCIATE goes through the location too, names included.
+	echo := udpEcho(t, "127.0.0.1")
+	ctrl := locationUserRequest(t, proxyAddr, "country:Germany", 3)
+	rep, relay := readSocks5Addr(t, ctrl)
+	if rep != 0 {
+		t.Fatalf("UDP ASSOCIATE as a location user: reply=%d", rep)
+	}
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = pc.Close() })
+	dgram := append([]byte{0, 0, 0, 3, byte(len("exit.test"))}, "exit.test"...)
+	dgram = append(binary.BigEndian.AppendUint16(dgram, uint16(echo.Port)), "datagram"...)
+	if _, err := pc.WriteTo(dgram, &net.UDPAddr{IP: relay.IP, Port: relay.Port}); err != nil {
+		t.Fatal(err)
+	}
+	if got := readUDPReply(t, pc, echo, 5*time.Second); got != "datagram" || dialedUDP.Load() != 1 {
+		t.Fatalf("reply %q, egress UDP dials %d", got, dialedUDP.Load())
+	}
+
+	// BIND cannot go through a location's userspace stack.
+	ctrl = locationUserRequest(t, proxyAddr, "country:Germany", 2)
+	if rep, _ := readSocks5Addr(t, ctrl); rep != 7 {
+		t.Fatalf("BIND as a location user: reply=%d, want 7", rep)
+	}
+}
+
+// locationUserRequest authenticates as user (password pw) and sends cmd for
+// 127.0.0.1:0, returning the connection positioned at the reply.
+func locationUserRequest(t *testing.T, proxyAddr, user string, cmd byte) net.Conn {
+	t.Helper()
+	ctrl := dialProxy(t, proxyAddr)
+	req := []byte{5, 1, 2, 1, byte(len(user))}
+	req = append(append(req, user...), 2, 'p', 'w')
+	req = appendSocksAddr(append(req, 5, cmd, 0), net.ParseIP("127.0.0.1"), 0)
+	if _, err := ctrl.Write(req); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	head := make([]byte, 4)
+	if _, err := io.ReadFull(ctrl, head); err != nil || head[1] != 2 || head[3] != 0 {
+		t.Fatalf("greeting and auth %v, %v", head, err)
+	}
+	return ctrl
+}
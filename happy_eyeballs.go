@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"time"
+)
+
+// Happy Eyeballs (RFC 8305) timing for SOCKS CONNECT.
+const (
+	// connectionAttemptDelay is how long an attempt runs before the next address is
+	// tried in parallel (RFC 8305 section 5 recommends 250ms).
+	connectionAttemptDelay = 250 * time.Millisecond
+	// connectAttemptTimeout bounds a single address, so one dead address cannot use up
+	// the whole connect budget.
+	connectAttemptTimeout = 10 * time.Second
+	// connectTimeout bounds the whole connect across all addresses.
+	connectTimeout = 30 * time.Second
+)
+
+// sortDialAddrs orders addrs for connection attempts: IPv6 and IPv4 interleaved, starting
+// with IPv6 (RFC 8305 section 4), duplicates removed. IPv6 addresses are dropped when
+// ipv6 is false.
+func sortDialAddrs(addrs []net.IP, ipv6 bool) []net.IP {
+	var v4, v6 []net.IP
+	seen := map[string]bool{}
+	for _, ip := range addrs {
+		if ip == nil || seen[ip.String()] {
+			continue
+		}
+		seen[ip.String()] = true
+		if ip.To4() != nil {
+			v4 = append(v4, ip)
+		} else if ipv6 {
+			v6 = append(v6, ip)
+		}
+	}
+	out := make([]net.IP, 0, len(v4)+len(v6))
+	for i := 0; i < len(v4) || i < len(v6); i++ {
+		if i < len(v6) {
+			out = append(out, v6[i])
+		}
+		if i < len(v4) {
+			out = append(out, v4[i])
+		}
+	}
+	return out
+}
+
+// dialHappyEyeballs connects to port on the first of addrs that answers. A new attempt
+// starts every connectionAttemptDelay, or as soon as the previous one fails; the first
+// connection wins and the rest are cancelled. addrs must already be in preference order
+// (see sortDialAddrs). On failure the error of the most informative attempt is returned
+// (see mostInformativeDialError). dial is typically a net.Dialer's DialContext.
+func dialHappyEyeballs(ctx context.Context, dial func(ctx context.Context, network, addr string) (net.Conn, error), addrs []net.IP, port int) (net.Conn, error) {
+	if len(addrs) == 0 {
+		return nil, &net.AddrError{Err: "no addresses to dial"}
+	}
+	ctx, cancel := context.WithTimeout(ctx, connectTimeout)
+	defer cancel()
+
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	results := make(chan result, len(addrs))
+	next := 0
+	start := func() {
+		addr := net.JoinHostPort(addrs[next].String(), strconv.Itoa(port))
+		next++
+		go func() {
+			actx, acancel := context.WithTimeout(ctx, connectAttemptTimeout)
+			defer acancel()
+			c, err := dial(actx, "tcp", addr)
+			results <- result{c, err}
+		}()
+	}
+
+	start()
+	timer := time.NewTimer(connectionAttemptDelay)
+	defer timer.Stop()
+	var errs []error
+	for pending := 1; pending > 0; {
+		select {
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				cancel()
+				// Close connections that complete after the winner.
+				go func(n int) {
+					for ; n > 0; n-- {
+						if r := <-results; r.conn != nil {
+							_ = r.conn.Close()
+						}
+					}
+				}(pending)
+				return r.conn, nil
+			}
+			errs = append(errs, r.err)
+			if next < len(addrs) && ctx.Err() == nil {
+				start()
+				pending++
+				timer.Reset(connectionAttemptDelay)
+			}
+		case <-timer.C:
+			if next < len(addrs) {
+				start()
+				pending++
+				timer.Reset(connectionAttemptDelay)
+			}
+		}
+	}
+	return nil, mostInformativeDialError(errs)
+}
+
+// mostInformativeDialError picks the error whose SOCKS reply tells the client the most:
+// a refusal proves the host is up, then host unreachable, network unreachable, and
+// finally a general failure.
+func mostInformativeDialError(errs []error) error {
+	rank := map[byte]int{5: 4, 4: 3, 3: 2, 1: 1}
+	var best error
+	for _, err := range errs {
+		if best == nil || rank[socksErrorReply(err)] > rank[socksErrorReply(best)] {
+			best = err
+		}
+	}
+	return best
+}
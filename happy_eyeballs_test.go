@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func ips(list ...string) []net.IP {
+	out := make([]net.IP, len(list))
+	for i, s := range list {
+		out[i] = net.ParseIP(s)
+	}
+	return out
+}
+
+func TestSortDialAddrs(t *testing.T) {
+	in := ips("10.0.0.1", "10.0.0.2", "2001:db8::1", "10.0.0.1", "10.0.0.3", "2001:db8::2")
+	if got := fmt.Sprint(sortDialAddrs(in, true)); got != "[2001:db8::1 10.0.0.1 2001:db8::2 10.0.0.2 10.0.0.3]" {
+		t.Errorf("ipv6 enabled: %s", got)
+	}
+	if got := fmt.Sprint(sortDialAddrs(in, false)); got != "[10.0.0.1 10.0.0.2 10.0.0.3]" {
+		t.Errorf("ipv6 disabled: %s", got)
+	}
+}
+
+// acceptAndClose listens on network ("tcp" for dual-stack, "tcp4") and closes every
+// connection it accepts. It returns the port.
+func acceptAndClose(t *testing.T, network string) int {
+	t.Helper()
+	ln, err := net.Listen(network, ":0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { _ = ln.Close() })
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			_ = c.Close()
+		}
+	}()
+	return ln.Addr().(*net.TCPAddr).Port
+}
+
+func TestDialHappyEyeballs_FallsBackAfterRefusal(t *testing.T) {
+	port := acceptAndClose(t, "tcp4")
+	// ::1 is refused (or unreachable without IPv6); 127.0.0.1 answers.
+	c, err := dialHappyEyeballs(context.Background(), (&net.Dialer{}).DialContext, ips("::1", "127.0.0.1"), port)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer func() { _ = c.Close() }()
+	if got := c.RemoteAddr().(*net.TCPAddr).IP; !got.Equal(net.ParseIP("127.0.0.1")) {
+		t.Fatalf("connected to %s", got)
+	}
+}
+
+func TestDialHappyEyeballs_StaggersSlowAttempt(t *testing.T) {
+	port := acceptAndClose(t, "tcp")
+	// Stall the first address so the second attempt must start after the attempt delay.
+	d := net.Dialer{Control: func(network, address string, _ syscall.RawConn) error {
+		if address == net.JoinHostPort("::1", fmt.Sprint(port)) {
+			time.Sleep(2 * time.Second)
+		}
+		return nil
+	}}
+	start := time.Now()
+	c, err := dialHappyEyeballs(context.Background(), d.DialContext, ips("::1", "127.0.0.1"), port)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer func() { _ = c.Close() }()
+	if got := c.RemoteAddr().(*net.TCPAddr).IP; !got.Equal(net.ParseIP("127.0.0.1")) {
+		t.Fatalf("connected to %s", got)
+	}
+	if elapsed := time.Since(start); elapsed < connectionAttemptDelay || elapsed > time.Second {
+		t.Fatalf("second attempt connected after %s, want about %s", elapsed, connectionAttemptDelay)
+	}
+}
+
+func TestSocksErrorReply(t *testing.T) {
+	opErr := func(errno syscall.Errno) error {
+		return &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", errno)}
+	}
+	for _, tc := range []struct {
+		err  error
+		want byte
+	}{
+		{opErr(syscall.ECONNREFUSED), 5},
+		{opErr(syscall.ENETUNREACH), 3},
+		{opErr(syscall.EHOSTUNREACH), 4},
+		{opErr(syscall.EACCES), 2},
+		{context.DeadlineExceeded, 4},
+		{context.Canceled, 1},
+		{&net.DNSError{Err: "no such host", Name: "missing.test", IsNotFound: true}, 4},
+		{fmt.Errorf("lookup: %w", errSocksBlocked), 2},
+		{io.EOF, 1},
+	} {
+		if got := socksErrorReply(tc.err); got != tc.want {
+			t.Errorf("socksErrorReply(%v) = %d, want %d", tc.err, got, tc.want)
+		}
+	}
+	errs := []error{opErr(syscall.ENETUNREACH), opErr(syscall.ECONNREFUSED), context.DeadlineExceeded}
+	if got := socksErrorReply(mostInformativeDialError(errs)); got != 5 {
+		t.Errorf("most informative reply = %d, want 5", got)
+	}
+}
+
+func TestSocks5_HappyEyeballsTriesEveryAddress(t *testing.T) {
+	port := acceptAndClose(t, "tcp4")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	proxyAddr := grabFreeAddr(t)
+	stop, err := startSocks(ctx, socksOptions{
+		ListenAddr: proxyAddr,
+		EnableIPv6: true,
+		// The IPv6 address is tried first and refused.
+		DNSHosts: []string{"multi.test=::1", "multi.test=127.0.0.1"},
+	})
+	if err != nil {
+		t.Fatalf("startSocks: %v", err)
+	}
+	defer func() { _ = stop() }()
+
+	conn, err := net.DialTimeout("tcp", proxyAddr, 2*time.Second)
+	if err != nil {
+		t.Fatalf("dial proxy: %v", err)
+	}
+	defer func() { _ = conn.Close() }()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write(buildSocks5Connect("multi.test", uint16(port))); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	resp := make([]byte, 12)
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		t.Fatalf("read reply: %v", err)
+	}
+	if resp[3] != 0 {
+		t.Fatalf("CONNECT reply code=%d, want 0", resp[3])
+	}
+}
+
+func TestRouteAddrs(t *testing.T) {
+	srv, err := newSocksServer(socksOptions{Rules: []*routeRule{
+		{Action: actionBlock, CIDRs: []*net.IPNet{parseCIDRHost("2001:db8::/32")}},
+		{Action: actionDirect, CIDRs: []*net.IPNet{parseCIDRHost("192.0.2.0/24")}},
+		{Action: actionVPN, CIDRs: []*net.IPNet{parseCIDRHost("0.0.0.0/0")}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		addrs, want string
+		action      routeAction
+	}{
+		{"2001:db8::1 198.51.100.1 192.0.2.1 198.51.100.2", "[198.51.100.1 198.51.100.2]", actionVPN},
+		{"2001:db8::1 192.0.2.1 198.51.100.1", "[192.0.2.1]", actionDirect},
+		{"2001:db8::1 2001:db8::2", "[]", actionBlock},
+	} {
+		action, got := srv.routeAddrs("tcp", "mixed.test", ips(strings.Fields(tc.addrs)...), 443)
+		if action != tc.action || fmt.Sprint(got) != tc.want {
+			t.Errorf("%s: %s %v, want %s %s", tc.addrs, action, got, tc.action, tc.want)
+		}
+	}
+}
+
+func TestSocks5_BlockRuleAppliesToEveryAddress(t *testing.T) {
+	ln, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		t.Skipf("no IPv6 loopback: %v", err)
+	}
+	_ = ln.Close()
+	// A dual-stack listener reports which family each connection arrived on.
+	ln, err = net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = ln.Close() })
+	local := make(chan net.IP, 8)
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			local <- c.LocalAddr().(*net.TCPAddr).IP
+			_ = c.Close()
+		}
+	}()
+	port := ln.Addr().(*net.TCPAddr).Port
+
+	for _, tc := range []struct{ block, want string }{
+		{"::1/128", "127.0.0.1"},    // IPv6 is tried first, but blocked
+		{"127.0.0.0/8", "::1"},      // the preferred IPv4 address is blocked
+		{"0.0.0.0/0,::/0", "block"}, // nothing left to dial
+	} {
+		var cidrs []*net.IPNet
+		for _, s := range strings.Split(tc.block, ",") {
+			cidrs = append(cidrs, parseCIDRHost(s))
+		}
+		proxyAddr := startTestSocks(t, socksOptions{
+			EnableIPv6: true,
+			DNSHosts:   []string{"dual.test=::1", "dual.test=127.0.0.1"},
+			Rules:      []*routeRule{{Action: actionBlock, CIDRs: cidrs}},
+		})
+		conn := dialProxy(t, proxyAddr)
+		if _, err := conn.Write(buildSocks5Connect("dual.test", uint16(port))); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+		resp := make([]byte, 4)
+		if _, err := io.ReadFull(conn, resp); err != nil {
+			t.Fatalf("%s: read reply: %v", tc.block, err)
+		}
+		if tc.want == "block" {
+			if resp[3] != 2 {
+				t.Errorf("%s: reply %d, want 2", tc.block, resp[3])
+			}
+			continue
+		}
+		if resp[3] != 0 {
+			t.Fatalf("%s: reply %d, want 0", tc.block, resp[3])
+		}
+		select {
+		case ip := <-local:
+			if !ip.Equal(net.ParseIP(tc.want)) {
+				t.Errorf("%s: connected to %s, want %s", tc.block, ip, tc.want)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("%s: no connection", tc.block)
+		}
+		select {
+		case ip := <-local:
+			t.Errorf("%s: also connected to %s", tc.block, ip)
+		case <-time.After(connectionAttemptDelay + 100*time.Millisecond):
+		}
+	}
+}
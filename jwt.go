@@ -40,17 +40,20 @@ func saveJWT(jwt string) error {
 	return os.WriteFile(path, []byte(strings.TrimSpace(jwt)+"\n"), 0o600)
 }
 
+// removeJWT deletes the stored JWT. A missing file is not an error.
+func removeJWT() error {
+	if err := os.Remove(jwtPath()); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
 // parseClientID extracts the client_id claim from a JWT without verifying its signature.
 // The result is used for informational display and token-type detection only.
 func parseClientID(jwt string) string {
 	claims := gojwt.MapClaims{}
 	_, _, _ = gojwt.NewParser().ParseUnverified(jwt, claims)
-	if v, ok := claims["client_id"]; ok {
-		if s, ok := v.(string); ok {
-			return s
-		}
-	}
-	return ""
+	return claimString(claims, "client_id")
 }
 
 // validateClientJWT performs a lightweight authenticated API call to confirm the JWT is
@@ -63,3 +66,68 @@ func validateClientJWT(ctx context.Context, apiURL, clientJwt string) bool {
 	_, err := api.FindProviders2Sync(&connect.FindProviders2Args{Specs: specs, Count: 1, RankMode: "quality"})
 	return err == nil
 }
+
+// jwtInfo is the decoded, unverified view of a BY JWT used by `token inspect`.
+type jwtInfo struct {
+	TokenType   string         `json:"token_type"`
+	NetworkName string         `json:"network_name,omitempty"`
+	NetworkID   string         `json:"network_id,omitempty"`
+	UserID      string         `json:"user_id,omitempty"`
+	ClientID    string         `json:"client_id,omitempty"`
+	IssuedAt    *time.Time     `json:"issued_at,omitempty"`
+	ExpiresAt   *time.Time     `json:"expires_at,omitempty"`
+	Claims      map[string]any `json:"claims"`
+}
+
+// Remaining returns the time left until expiry relative to now.
+// ok is false when the token carries no exp claim.
+func (i jwtInfo) Remaining(now time.Time) (time.Duration, bool) {
+	if i.ExpiresAt == nil {
+		return 0, false
+	}
+	return i.ExpiresAt.Sub(now), true
+}
+
+// inspectJWT decodes all claims of a JWT without verifying its signature.
+// A token with a client_id claim is reported as "client", otherwise "network".
+func inspectJWT(jwt string) (jwtInfo, error) {
+	claims := gojwt.MapClaims{}
+	if _, _, err := gojwt.NewParser().ParseUnverified(strings.TrimSpace(jwt), claims); err != nil {
+		return jwtInfo{}, fmt.Errorf("decode jwt: %w", err)
+	}
+	info := jwtInfo{
+		NetworkName: claimString(claims, "network_name"),
+		NetworkID:   claimString(claims, "network_id"),
+		UserID:      claimString(claims, "user_id"),
+		ClientID:    claimString(claims, "client_id"),
+		Claims:      claims,
+	}
+	info.TokenType = "network"
+	if info.ClientID != "" {
+		info.TokenType = "client"
+	}
+	if iat, err := claims.GetIssuedAt(); err == nil && iat != nil {
+		t := iat.UTC()
+		info.IssuedAt = &t
+	} else if ct := claimString(claims, "create_time"); ct != "" {
+		if t, err := time.Parse(time.RFC3339Nano, ct); err == nil {
+			t = t.UTC()
+			info.IssuedAt = &t
+		}
+	}
+	if exp, err := claims.GetExpirationTime(); err == nil && exp != nil {
+		t := exp.UTC()
+		info.ExpiresAt = &t
+	}
+	return info, nil
+}
+
+// claimString returns the string value of claim key, or "" when absent or not a string.
+func claimString(claims gojwt.MapClaims, key string) string {
+	if v, ok := claims[key]; ok {
+		if s, ok := v.(string); ok {
+			return s
+		}
+	}
+	return ""
+}
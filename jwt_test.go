@@ -0,0 +1,91 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	gojwt "github.com/golang-jwt/jwt/v5"
+)
+
+func signTestJWT(t *testing.T, claims gojwt.MapClaims) string {
+	t.Helper()
+	s, err := gojwt.NewWithClaims(gojwt.SigningMethodHS256, claims).SignedString([]byte("test"))
+	if err != nil {
+		t.Fatalf("sign: %v", err)
+	}
+	return s
+}
+
+func TestInspectJWT_Client(t *testing.T) {
+	iat := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	exp := iat.Add(24 * time.Hour)
+	tok := signTestJWT(t, gojwt.MapClaims{
+		"network_name": "mynet",
+		"network_id":   "n-1",
+		"client_id":    "c-1",
+		"iat":          iat.Unix(),
+		"exp":          exp.Unix(),
+	})
+	info, err := inspectJWT(tok)
+	if err != nil {
+		t.Fatalf("inspectJWT: %v", err)
+	}
+	if info.TokenType != "client" || info.ClientID != "c-1" || info.NetworkName != "mynet" || info.NetworkID != "n-1" {
+		t.Fatalf("unexpected info: %+v", info)
+	}
+	if info.IssuedAt == nil || !info.IssuedAt.Equal(iat) {
+		t.Fatalf("issued_at=%v want %v", info.IssuedAt, iat)
+	}
+	d, ok := info.Remaining(iat.Add(time.Hour))
+	if !ok || d != 23*time.Hour {
+		t.Fatalf("remaining=%v ok=%v", d, ok)
+	}
+}
+
+func TestInspectJWT_NetworkNoExpiry(t *testing.T) {
+	tok := signTestJWT(t, gojwt.MapClaims{
+		"network_name": "mynet",
+		"create_time":  "2026-01-02T03:04:05Z",
+	})
+	info, err := inspectJWT(tok)
+	if err != nil {
+		t.Fatalf("inspectJWT: %v", err)
+	}
+	if info.TokenType != "network" {
+		t.Fatalf("token_type=%q want network", info.TokenType)
+	}
+	if info.IssuedAt == nil {
+		t.Fatalf("create_time should populate issued_at")
+	}
+	if _, ok := info.Remaining(time.Now()); ok {
+		t.Fatalf("token without exp should report no expiry")
+	}
+	if parseClientID(tok) != "" {
+		t.Fatalf("network token should have no client_id")
+	}
+}
+
+func TestInspectJWT_Invalid(t *testing.T) {
+	if _, err := inspectJWT("not-a-jwt"); err == nil {
+		t.Fatalf("expected error for malformed token")
+	}
+}
+
+func TestSaveAndRemoveJWT(t *testing.T) {
+	t.Setenv("URNETWORK_HOME", t.TempDir())
+	if err := saveJWT("abc"); err != nil {
+		t.Fatalf("saveJWT: %v", err)
+	}
+	if got, err := loadJWT(""); err != nil || got != "abc" {
+		t.Fatalf("loadJWT=%q err=%v", got, err)
+	}
+	if err := removeJWT(); err != nil {
+		t.Fatalf("removeJWT: %v", err)
+	}
+	if _, err := loadJWT(""); err == nil {
+		t.Fatalf("expected no jwt after removeJWT")
+	}
+	if err := removeJWT(); err != nil {
+		t.Fatalf("removeJWT on missing file: %v", err)
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/urnetwork/connect"
+	"gopkg.in/yaml.v3"
+)
+
+// socksListener is one extra SOCKS listener from the config file's `listeners:` section.
+// Settings it leaves out are taken from the top level.
+type socksListener struct {
+	Listen         string
+	Location       LocationConfig // exit location; zero uses the default path
+	AllowDomains   []string
+	ExcludeDomains []string
+	Rules          []*routeRule
+	Auth           []string
+	AllowSrc       []*net.IPNet
+	ProxyFrom      []*net.IPNet // load balancers that send a PROXY protocol header
+
+	// Which of the fields above the entry set; the others are inherited.
+	hasDomains, hasRules, hasAuth, hasAllowSrc, hasProxy bool
+}
+
+// parseListeners decodes the `listeners:` section of the config file.
+//
+//	listeners:
+//	  - listen: 127.0.0.1:1080
+//	    location_query: "country:United States"
+//	  - listen: 127.0.0.1:1081
+//	    location_id: 0193f7a2-5c4e-7d1b-9a3f-2e8b6c1d4f70
+//	    domain: [example.de]
+//	    socks_auth: [scraper:s3cret]
+//	    rules:
+//	      - domain: [corp.example]
+//	        action: direct
+func parseListeners(n *yaml.Node) ([]*socksListener, error) {
+	if n.Kind != yaml.SequenceNode {
+		return nil, fmt.Errorf("listeners: expected a list (line %d)", n.Line)
+	}
+	var out []*socksListener
+	for i, item := range n.Content {
+		if err := checkYAMLKeys(item, "listen", "location_query", "location_id", "location_group_id",
+			"domain", "exclude_domain", "rules", "socks_auth", "socks_allow_src", "socks_allow_local",
+			"socks_proxy_protocol"); err != nil {
+			return nil, fmt.Errorf("listeners[%d]: %w", i, err)
+		}
+		var spec struct {
+			Listen          string      `yaml:"listen"`
+			LocationQuery   string      `yaml:"location_query"`
+			LocationID      string      `yaml:"location_id"`
+			LocationGroupID string      `yaml:"location_group_id"`
+			Domain          *stringList `yaml:"domain"`
+			ExcludeDomain   *stringList `yaml:"exclude_domain"`
+			Rules           yaml.Node   `yaml:"rules"`
+			SocksAuth       *stringList `yaml:"socks_auth"`
+			SocksAllowSrc   *stringList `yaml:"socks_allow_src"`
+			SocksAllowLocal *bool       `yaml:"socks_allow_local"`
+			SocksProxy      *stringList `yaml:"socks_proxy_protocol"`
+		}
+		if err := item.Decode(&spec); err != nil {
+			return nil, fmt.Errorf("listeners[%d]: %w", i, err)
+		}
+		fail := func(format string, args ...any) error {
+			return fmt.Errorf("listeners[%d] (line %d): %s", i, item.Line, fmt.Sprintf(format, args...))
+		}
+		l := &socksListener{
+			Listen: strings.TrimSpace(spec.Listen),
+			Location: LocationConfig{
+				LocationQuery:   strings.TrimSpace(spec.LocationQuery),
+				LocationID:      strings.TrimSpace(spec.LocationID),
+				LocationGroupID: strings.TrimSpace(spec.LocationGroupID),
+			},
+		}
+		if addr, _ := splitListenAddr(l.Listen); addr == "" || checkListenAddr(addr) != nil {
+			return nil, fail("listen %q: want host:port or %shost:port", l.Listen, socksTLSScheme)
+		}
+		for _, id := range []string{l.Location.LocationID, l.Location.LocationGroupID} {
+			if _, err := connect.ParseId(id); id != "" && err != nil {
+				return nil, fail("%q is not a location id", id)
+			}
+		}
+		if spec.Domain != nil || spec.ExcludeDomain != nil {
+			l.hasDomains = true
+			if spec.Domain != nil {
+				l.AllowDomains = *spec.Domain
+			}
+			if spec.ExcludeDomain != nil {
+				l.ExcludeDomains = *spec.ExcludeDomain
+			}
+		}
+		if spec.Rules.Kind != 0 {
+			rules, err := parseRouteRules(&spec.Rules)
+			if err != nil {
+				return nil, fail("%v", err)
+			}
+			l.Rules, l.hasRules = rules, true
+		}
+		if spec.SocksAuth != nil {
+			if _, err := parseSocksAuth(*spec.SocksAuth); err != nil {
+				return nil, fail("%v", err)
+			}
+			l.Auth, l.hasAuth = *spec.SocksAuth, true
+		}
+		if spec.SocksAllowSrc != nil || spec.SocksAllowLocal != nil {
+			var list []string
+			if spec.SocksAllowSrc != nil {
+				list = *spec.SocksAllowSrc
+			}
+			nets, err := parseSourceAllowlist(list, spec.SocksAllowLocal != nil && *spec.SocksAllowLocal)
+			if err != nil {
+				return nil, fail("socks_allow_src: %v", err)
+			}
+			l.AllowSrc, l.hasAllowSrc = nets, true
+		}
+		if spec.SocksProxy != nil {
+			nets, err := parseSourceAllowlist(*spec.SocksProxy, false)
+			if err != nil {
+				return nil, fail("socks_proxy_protocol: %v", err)
+			}
+			l.ProxyFrom, l.hasProxy = nets, true
+		}
+		out = append(out, l)
+	}
+	return out, nil
+}
+
+// options returns base with l's own settings applied.
+func (l *socksListener) options(base socksOptions) socksOptions {
+	opts := base
+	opts.ListenAddr = l.Listen
+	opts.Location = l.Location
+	if l.hasDomains {
+		opts.AllowDomains, opts.ExcludeDomains = l.AllowDomains, l.ExcludeDomains
+	}
+	if l.hasRules {
+		opts.Rules = l.Rules
+	}
+	if l.hasAuth {
+		opts.Auth = l.Auth
+	}
+	if l.hasAllowSrc {
+		opts.AllowSrc = l.AllowSrc
+	}
+	if l.hasProxy {
+		opts.ProxyFrom = l.ProxyFrom
+	}
+	return opts
+}
+
+// String describes l for `config show` and the startup log.
+func (l *socksListener) String() string {
+	parts := []string{l.Listen}
+	if key := locationKey(l.Location); key != "" {
+		parts = append(parts, "location="+key)
+	}
+	if l.hasDomains {
+		parts = append(parts, fmt.Sprintf("domains=%d/%d", len(l.AllowDomains), len(l.ExcludeDomains)))
+	}
+	if l.hasRules {
+		parts = append(parts, fmt.Sprintf("rules=%d", len(l.Rules)))
+	}
+	if l.hasAuth {
+		parts = append(parts, fmt.Sprintf("users=%d", len(l.Auth)))
+	}
+	if l.hasAllowSrc {
+		parts = append(parts, fmt.Sprintf("allow_src=%d", len(l.AllowSrc)))
+	}
+	if l.hasProxy {
+		parts = append(parts, fmt.Sprintf("proxy_protocol=%d", len(l.ProxyFrom)))
+	}
+	return strings.Join(parts, " ")
+}
+
+// startListeners starts every listener in listeners with base's settings overridden by
+// its own, and returns a function that stops them all. When one fails to start, the
+// ones already started are stopped again.
+func startListeners(ctx context.Context, listeners []*socksListener, base socksOptions) (func(), error) {
+	var stops []func() error
+	// Listeners drain in parallel so shutdown takes one drain period, not one each.
+	stopAll := func() {
+		var wg sync.WaitGroup
+		for _, stop := range stops {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				_ = stop()
+			}()
+		}
+		wg.Wait()
+	}
+	for _, l := range listeners {
+		stop, err := startSocks(ctx, l.options(base))
+		if err != nil {
+			stopAll()
+			return nil, fmt.Errorf("listener %s: %w", l.Listen, err)
+		}
+		stops = append(stops, stop)
+		exit := locationKey(l.Location)
+		if exit == "" {
+			exit = "default"
+		}
+		logInfo("SOCKS5 listening at %s (exit %s)\n", l.Listen, exit)
+	}
+	return stopAll, nil
+}
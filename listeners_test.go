@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/docopt/docopt-go"
+	"gopkg.in/yaml.v3"
+)
+
+func TestResolveConfig_Listeners(t *testing.T) {
+	path := writeConfig(t, `
+domain: [example.com]
+socks_auth: [alice:pw]
+rules:
+  - domain: [corp.example]
+    action: direct
+listeners:
+  - listen: 127.0.0.1:1080
+    location_query: "country:United States"
+  - listen: 127.0.0.1:1081
+    location_id: 0193f7a2-5c4e-7d1b-9a3f-2e8b6c1d4f70
+    domain: []
+    socks_auth: [scraper:s3cret]
+    socks_allow_local: true
+    rules:
+      - cidr: 10.0.0.0/8
+        action: block
+`)
+	rc, err := resolveConfigWith(docopt.Opts{"--config": path}, fakeEnv(nil))
+	if err != nil {
+		t.Fatalf("resolveConfig: %v", err)
+	}
+	ls := rc.VPN.Listeners
+	if len(ls) != 2 {
+		t.Fatalf("listeners = %v", ls)
+	}
+	if got := ls[0].String(); got != "127.0.0.1:1080 location=country:united states" {
+		t.Errorf("listener 0 = %q", got)
+	}
+	if got := ls[1].String(); got != "127.0.0.1:1081 location=loc-0193f7a2-5c4e-7d1b-9a3f-2e8b6c1d4f70 domains=0/0 rules=1 users=1 allow_src=9" {
+		t.Errorf("listener 1 = %q", got)
+	}
+
+	base := socksOptions{ListenAddr: "127.0.0.1:9050", AllowDomains: rc.VPN.AllowDomains, Rules: rc.VPN.Rules, Auth: rc.VPN.SOCKSAuth}
+	inherit, own := ls[0].options(base), ls[1].options(base)
+	if inherit.ListenAddr != "127.0.0.1:1080" || inherit.Location.LocationQuery != "country:United States" ||
+		len(inherit.AllowDomains) != 1 || len(inherit.Rules) != 1 || inherit.Auth[0] != "alice:pw" || inherit.AllowSrc != nil {
+		t.Errorf("inherited options = %+v", inherit)
+	}
+	if len(own.AllowDomains) != 0 || own.Rules[0].Action != actionBlock || own.Auth[0] != "scraper:s3cret" || own.AllowSrc == nil {
+		t.Errorf("own options = %+v", own)
+	}
+	if base.ListenAddr != "127.0.0.1:9050" || base.Location != (LocationConfig{}) {
+		t.Errorf("base changed: %+v", base)
+	}
+	if eo := rc.VPN.egressOptions(); len(eo.Listeners) != 2 {
+		t.Errorf("egress options listeners = %d", len(eo.Listeners))
+	}
+	if out := buildConfigShow(rc); len(out.Listeners) != 2 {
+		t.Errorf("config show listeners = %v", out.Listeners)
+	}
+}
+
+func TestParseListeners_Errors(t *testing.T) {
+	for _, bad := range []string{
+		"listen: 127.0.0.1:1080",                               // not a list
+		"- location_query: country:Germany",                    // no listen
+		"- listen: 127.0.0.1:1080\n  locaton_query: x",         // typo
+		"- listen: 127.0.0.1:1080\n  location_id: frankfurt",   // bad id
+		"- listen: 127.0.0.1:1080\n  socks_auth: [alice]",      // no password
+		"- listen: 127.0.0.1:1080\n  socks_allow_src: [10/33]", // bad CIDR
+		"- listen: 127.0.0.1:1080\n  rules:\n    - action: go", // bad rule
+	} {
+		var n yaml.Node
+		if err := yaml.Unmarshal([]byte(bad), &n); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := parseListeners(n.Content[0]); err == nil {
+			t.Errorf("accepted %q", bad)
+		}
+	}
+}
+
+func TestValidateConfig_DuplicateListeners(t *testing.T) {
+	path := writeConfig(t, "socks: 127.0.0.1:1080\nlisteners:\n  - listen: 127.0.0.1:1080\n  - listen: 127.0.0.1:1081\n  - listen: 127.0.0.1:1081\n")
+	rc, err := resolveConfigWith(docopt.Opts{"--config": path}, fakeEnv(nil))
+	if err != nil {
+		t.Fatalf("resolveConfig: %v", err)
+	}
+	errs := validateConfig(rc)
+	if len(errs) != 2 || !strings.Contains(errs[0].Error(), "used by more than one SOCKS listener") {
+		t.Fatalf("expected two duplicate listener problems, got %v", errs)
+	}
+}
+
+func TestStartListeners_ExitPerListener(t *testing.T) {
+	port := tcpEcho(t)
+	var mu sync.Mutex
+	var exits []string
+	pool := testEgressPool(t, func(ctx context.Context, loc LocationConfig, e *locationEgress) error {
+		key := locationKey(loc)
+		e.dial = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			mu.Lock()
+			exits = append(exits, key)
+			mu.Unlock()
+			return (&net.Dialer{}).DialContext(ctx, network, addr)
+		}
+		e.close = func() {}
+		return nil
+	})
+	us, de, plain := grabFreeAddr(t), grabFreeAddr(t), grabFreeAddr(t)
+	stop, err := startListeners(context.Background(), []*socksListener{
+		{Listen: us, Location: LocationConfig{LocationQuery: "country:United States"}},
+		{Listen: de, Location: LocationConfig{LocationQuery: "country:Germany"}},
+		{Listen: plain},
+	}, socksOptions{Egress: pool})
+	if err != nil {
+		t.Fatalf("startListeners: %v", err)
+	}
+	t.Cleanup(stop)
+
+	for _, addr := range []string{de, us, plain, de} {
+		c, err := socksClientDial(t, addr, net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+		if err != nil {
+			t.Fatalf("dial via %s: %v", addr, err)
+		}
+		expectEcho(t, c, "via "+addr)
+	}
+	if got := strings.Join(exits, ","); got != "country:germany,country:united states,country:germany" {
+		t.Fatalf("exits = %s", got)
+	}
+	if len(pool.m) != 2 {
+		t.Fatalf("%d egresses open, want one per location", len(pool.m))
+	}
+
+	// A listener that fails to start stops the ones already started.
+	if _, err := startListeners(context.Background(), []*socksListener{{Listen: grabFreeAddr(t)}, {Listen: us}}, socksOptions{}); err == nil {
+		t.Fatal("started a listener on an address in use")
+	}
+}
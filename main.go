@@ -5,7 +5,6 @@ import (
 	"fmt"
 	"os"
 	"os/signal"
-	"strings"
 	"syscall"
 
 	"github.com/docopt/docopt-go"
@@ -16,37 +15,44 @@ const DefaultConnectURL = "wss://connect.bringyour.com"
 
 const Version = "0.1.0"
 
-func main() {
-	usage := fmt.Sprintf(`urnet-client (experimental)
+// usage is the docopt usage text; every flag must appear once under Options.
+var usage = fmt.Sprintf(`urnet-client (experimental)
 
 Usage:
-    urnet-client login --user_auth=<user_auth> --password=<password> [--api_url=<api_url>]
+    urnet-client login [--user_auth=<user_auth>] [--password=<password>] [--code=<code>] [--api_url=<api_url>]
     urnet-client verify --user_auth=<user_auth> --code=<code> [--api_url=<api_url>]
     urnet-client save-jwt --jwt=<jwt>
-    urnet-client mint-client [--api_url=<api_url>] [--jwt=<jwt>]
-	urnet-client quick-connect [--user_auth=<user_auth> --password=<password> [--code=<code>] | --jwt=<jwt>] [--api_url=<api_url>] [--connect_url=<connect_url>] [--tun=<name>] [--ip_cidr=<cidr>] [--mtu=<mtu>] [--default_route] [--route=<list>] [--exclude_route=<list>] [--domain=<list>] [--exclude_domain=<list>] [--dns=<list>] [--dns_service=<name>] [--dns_bootstrap=<mode>] [--location_query=<q>] [--location_id=<id>] [--location_group_id=<id>] [--socks=<addr>] [--socks_listen=<addr>] [--allow_inbound_src=<list>] [--allow_inbound_local] [--enable_ipv6] [--kill_switch] [--background] [--log_file=<path>] [--log_level=<level>] [--debug] [--stats_interval=<sec>] [--force_jwt] [--jwt_renew_interval=<dur>] [--config=<path>]
-    urnet-client socks --listen=<addr> --extender_ip=<ip> --extender_port=<port> --extender_sni=<sni> [--extender_secret=<secret>] [--domain=<list>] [--exclude_domain=<list>] [--debug]
+    urnet-client mint-client [--api_url=<api_url>] [--jwt=<jwt>] [--description=<desc>] [--device_spec=<spec>]
+    urnet-client logout [--api_url=<api_url>]
+    urnet-client clients list [--api_url=<api_url>] [--jwt=<jwt>] [--json]
+    urnet-client clients remove <client_id> [--api_url=<api_url>] [--jwt=<jwt>]
+    urnet-client token inspect [--jwt=<jwt>] [--api_url=<api_url>] [--json]
+    urnet-client whoami [--jwt=<jwt>] [--api_url=<api_url>] [--json]
+	urnet-client quick-connect [--user_auth=<user_auth>] [--password=<password>] [--code=<code>] [--jwt=<jwt>] [--api_url=<api_url>] [--connect_url=<connect_url>] [--tun=<name>] [--ip_cidr=<cidr>] [--mtu=<mtu>] [--default_route] [--route=<list>] [--exclude_route=<list>] [--domain=<list>] [--exclude_domain=<list>] [--sniff] [--sniff_timeout=<dur>] [--dns=<list>] [--dns_hosts=<list>] [--dns_listen=<addr>] [--dns_split=<list>] [--dns_blocklist=<list>] [--dns_blocklist_refresh=<dur>] [--dns_block_response=<mode>] [--dns_service=<name>] [--dns_bootstrap=<mode>] [--location_query=<q>] [--location_id=<id>] [--location_group_id=<id>] [--socks=<addr>] [--socks_listen=<addr>] [--allow_inbound_src=<list>] [--allow_inbound_local] [--socks_max_conns=<n>] [--socks_max_conns_per_ip=<n>] [--socks_idle_timeout=<dur>] [--socks_half_close_timeout=<dur>] [--socks_drain_timeout=<dur>] [--socks_auth=<list>] [--socks_upload_limit=<rate>] [--socks_download_limit=<rate>] [--socks_allow_src=<list>] [--socks_allow_local] [--socks_proxy_protocol=<list>] [--socks_tls_cert=<path>] [--socks_tls_key=<path>] [--socks_tls_client_ca=<path>] [--transparent=<addr>] [--transparent_mode=<mode>] [--transparent_nft] [--shadowsocks=<addr>] [--shadowsocks_method=<method>] [--shadowsocks_password=<password>] [--enable_ipv6] [--kill_switch] [--background] [--log_file=<path>] [--log_level=<level>] [--debug] [--stats_interval=<sec>] [--force_jwt] [--jwt_renew_interval=<dur>] [--description=<desc>] [--device_spec=<spec>] [--config=<path>]
+    urnet-client socks [--listen=<addr>] [--dns=<list>] [--dns_hosts=<list>] [--dns_blocklist=<list>] [--dns_blocklist_refresh=<dur>] [--dns_block_response=<mode>] [--extender_ip=<ip>] [--extender_port=<port>] [--extender_sni=<sni>] [--extender_secret=<secret>] [--domain=<list>] [--exclude_domain=<list>] [--sniff] [--sniff_timeout=<dur>] [--socks_max_conns=<n>] [--socks_max_conns_per_ip=<n>] [--socks_idle_timeout=<dur>] [--socks_half_close_timeout=<dur>] [--socks_drain_timeout=<dur>] [--socks_auth=<list>] [--socks_upload_limit=<rate>] [--socks_download_limit=<rate>] [--socks_allow_src=<list>] [--socks_allow_local] [--socks_proxy_protocol=<list>] [--socks_tls_cert=<path>] [--socks_tls_key=<path>] [--socks_tls_client_ca=<path>] [--enable_ipv6] [--debug] [--config=<path>]
+    urnet-client config show [--json] [--api_url=<api_url>] [--connect_url=<connect_url>] [--jwt=<jwt>] [--user_auth=<user_auth>] [--password=<password>] [--tun=<name>] [--ip_cidr=<cidr>] [--mtu=<mtu>] [--default_route] [--route=<list>] [--exclude_route=<list>] [--domain=<list>] [--exclude_domain=<list>] [--sniff] [--sniff_timeout=<dur>] [--dns=<list>] [--dns_hosts=<list>] [--dns_listen=<addr>] [--dns_split=<list>] [--dns_blocklist=<list>] [--dns_blocklist_refresh=<dur>] [--dns_block_response=<mode>] [--dns_service=<name>] [--dns_bootstrap=<mode>] [--location_query=<q>] [--location_id=<id>] [--location_group_id=<id>] [--socks=<addr>] [--socks_listen=<addr>] [--allow_inbound_src=<list>] [--allow_inbound_local] [--socks_max_conns=<n>] [--socks_max_conns_per_ip=<n>] [--socks_idle_timeout=<dur>] [--socks_half_close_timeout=<dur>] [--socks_drain_timeout=<dur>] [--socks_auth=<list>] [--socks_upload_limit=<rate>] [--socks_download_limit=<rate>] [--socks_allow_src=<list>] [--socks_allow_local] [--socks_proxy_protocol=<list>] [--socks_tls_cert=<path>] [--socks_tls_key=<path>] [--socks_tls_client_ca=<path>] [--transparent=<addr>] [--transparent_mode=<mode>] [--transparent_nft] [--shadowsocks=<addr>] [--shadowsocks_method=<method>] [--shadowsocks_password=<password>] [--enable_ipv6] [--kill_switch] [--log_file=<path>] [--log_level=<level>] [--debug] [--stats_interval=<sec>] [--force_jwt] [--jwt_renew_interval=<dur>] [--description=<desc>] [--device_spec=<spec>] [--listen=<addr>] [--extender_ip=<ip>] [--extender_port=<port>] [--extender_sni=<sni>] [--extender_secret=<secret>] [--config=<path>]
+    urnet-client config validate [--api_url=<api_url>] [--connect_url=<connect_url>] [--jwt=<jwt>] [--user_auth=<user_auth>] [--password=<password>] [--tun=<name>] [--ip_cidr=<cidr>] [--mtu=<mtu>] [--default_route] [--route=<list>] [--exclude_route=<list>] [--domain=<list>] [--exclude_domain=<list>] [--sniff] [--sniff_timeout=<dur>] [--dns=<list>] [--dns_hosts=<list>] [--dns_listen=<addr>] [--dns_split=<list>] [--dns_blocklist=<list>] [--dns_blocklist_refresh=<dur>] [--dns_block_response=<mode>] [--dns_service=<name>] [--dns_bootstrap=<mode>] [--location_query=<q>] [--location_id=<id>] [--location_group_id=<id>] [--socks=<addr>] [--socks_listen=<addr>] [--allow_inbound_src=<list>] [--allow_inbound_local] [--socks_max_conns=<n>] [--socks_max_conns_per_ip=<n>] [--socks_idle_timeout=<dur>] [--socks_half_close_timeout=<dur>] [--socks_drain_timeout=<dur>] [--socks_auth=<list>] [--socks_upload_limit=<rate>] [--socks_download_limit=<rate>] [--socks_allow_src=<list>] [--socks_allow_local] [--socks_proxy_protocol=<list>] [--socks_tls_cert=<path>] [--socks_tls_key=<path>] [--socks_tls_client_ca=<path>] [--transparent=<addr>] [--transparent_mode=<mode>] [--transparent_nft] [--shadowsocks=<addr>] [--shadowsocks_method=<method>] [--shadowsocks_password=<password>] [--enable_ipv6] [--kill_switch] [--log_file=<path>] [--log_level=<level>] [--debug] [--stats_interval=<sec>] [--force_jwt] [--jwt_renew_interval=<dur>] [--description=<desc>] [--device_spec=<spec>] [--listen=<addr>] [--extender_ip=<ip>] [--extender_port=<port>] [--extender_sni=<sni>] [--extender_secret=<secret>] [--config=<path>]
     urnet-client find-providers [--count=<count>] [--rank_mode=<rank_mode>] [--api_url=<api_url>] [--jwt=<jwt>]
     urnet-client open [--transports=<n>] [--connect_url=<connect_url>] [--api_url=<api_url>] [--jwt=<jwt>]
     urnet-client locations [--query=<q>] [--api_url=<api_url>] [--jwt=<jwt>]
-			urnet-client vpn [--tun=<name>] [--connect_url=<connect_url>] [--api_url=<api_url>] [--jwt=<jwt>] [--ip_cidr=<cidr>] [--mtu=<mtu>] [--default_route] [--route=<list>] [--exclude_route=<list>] [--domain=<list>] [--exclude_domain=<list>] [--dns=<list>] [--dns_service=<name>] [--dns_bootstrap=<mode>] [--location_query=<q>] [--location_id=<id>] [--location_group_id=<id>] [--socks=<addr>] [--socks_listen=<addr>] [--allow_inbound_src=<list>] [--allow_inbound_local] [--enable_ipv6] [--kill_switch] [--background] [--log_file=<path>] [--log_level=<level>] [--debug] [--stats_interval=<sec>] [--config=<path>]
+			urnet-client vpn [--tun=<name>] [--connect_url=<connect_url>] [--api_url=<api_url>] [--jwt=<jwt>] [--ip_cidr=<cidr>] [--mtu=<mtu>] [--default_route] [--route=<list>] [--exclude_route=<list>] [--domain=<list>] [--exclude_domain=<list>] [--sniff] [--sniff_timeout=<dur>] [--dns=<list>] [--dns_hosts=<list>] [--dns_listen=<addr>] [--dns_split=<list>] [--dns_blocklist=<list>] [--dns_blocklist_refresh=<dur>] [--dns_block_response=<mode>] [--dns_service=<name>] [--dns_bootstrap=<mode>] [--location_query=<q>] [--location_id=<id>] [--location_group_id=<id>] [--socks=<addr>] [--socks_listen=<addr>] [--allow_inbound_src=<list>] [--allow_inbound_local] [--socks_max_conns=<n>] [--socks_max_conns_per_ip=<n>] [--socks_idle_timeout=<dur>] [--socks_half_close_timeout=<dur>] [--socks_drain_timeout=<dur>] [--socks_auth=<list>] [--socks_upload_limit=<rate>] [--socks_download_limit=<rate>] [--socks_allow_src=<list>] [--socks_allow_local] [--socks_proxy_protocol=<list>] [--socks_tls_cert=<path>] [--socks_tls_key=<path>] [--socks_tls_client_ca=<path>] [--transparent=<addr>] [--transparent_mode=<mode>] [--transparent_nft] [--shadowsocks=<addr>] [--shadowsocks_method=<method>] [--shadowsocks_password=<password>] [--enable_ipv6] [--kill_switch] [--background] [--log_file=<path>] [--log_level=<level>] [--debug] [--stats_interval=<sec>] [--config=<path>]
 
 Options:
-    --api_url=<api_url>          API base URL [default: %s]
-    --connect_url=<connect_url>  Connect URL (WS) [default: %s]
+    --api_url=<api_url>          API base URL (default: %s)
+    --connect_url=<connect_url>  Connect URL (WS) (default: %s)
     --count=<count>              Number of providers to return [default: 8]
     --rank_mode=<rank_mode>      quality|speed [default: quality]
     --transports=<n>             Number of transports to open [default: 4]
-    --jwt=<jwt>                  BY network JWT (falls back to ~/.urnetwork/jwt)
+    --jwt=<jwt>                  BY JWT (falls back to ~/.urnetwork/jwt)
 	--tun=<name>                 TUN interface name (omit or use 'none' to disable; SOCKS-only)
-        --ip_cidr=<cidr>             Assign CIDR to TUN [default: 10.255.0.2/24]
-    --mtu=<mtu>                  Set MTU on TUN [default: 1420]
+        --ip_cidr=<cidr>             Assign CIDR to TUN (default: 10.255.0.2/24)
+    --mtu=<mtu>                  Set MTU on TUN (default: 1420)
     --default_route              Route all traffic via TUN (disabled by default)
     --route=<list>               Comma-separated extra routes (IP or CIDR) via TUN
         --exclude_route=<list>       Comma-separated routes to keep off the TUN when --default_route is set
-    --dns=<list>                 Comma-separated DNS servers to prefer while VPN is up
+    --dns=<list>                 DNS servers: IP[:port], tcp://IP, tls://host[:853], https://host/dns-query
         --dns_service=<name>         macOS only: Network Service name to modify DNS (e.g., "Wi-Fi"); optional
-    --dns_bootstrap=<mode>       How to keep DNS working during default-route switch: bypass|cache|none [default: bypass]
+    --dns_bootstrap=<mode>       How to keep DNS working during default-route switch: bypass|cache|none (default: bypass)
     --location_query=<q>         Search for locations (e.g., "country:Germany" or "region:Europe") to select providers
     --location_id=<id>           Select providers in a specific location id (use with find-locations)
     --location_group_id=<id>     Select providers in a specific location group id
@@ -67,17 +73,49 @@ Options:
     --log_file=<path>            If set, write logs to this file (default: console)
     --log_level=<level>          quiet|error|warn|info|debug (default: info). --debug implies debug unless a level is set
     --debug                      Verbose per-packet logs for vpn
-    --stats_interval=<sec>       Interval (seconds) to print vpn counters [default: 5]
+    --stats_interval=<sec>       Interval (seconds or duration) to print vpn counters (default: 5)
     --force_jwt                  quick-connect: force mint a fresh client JWT even if one exists
     --jwt_renew_interval=<dur>   quick-connect: periodically renew client JWT while running (e.g., 12h, 30m); 0 disables
-    --user_auth=<user_auth>      Email or phone
-    --password=<password>        Password
-    --code=<code>                Verification code
+    --user_auth=<user_auth>      Email or phone (prompted for on a terminal when omitted)
+    --password=<password>        Password (prompted for without echo on a terminal when omitted)
+    --code=<code>                Verification code (prompted for on a terminal when required)
+    --json                       token inspect/whoami, clients list, config show: print JSON instead of text
+    --description=<desc>         Description for a newly minted client (default: urnet-client@<hostname>)
+    --device_spec=<spec>         Device spec for a newly minted client (default: urnet-client <version> <os>/<arch>)
+    --dns_hosts=<list>           Static name=ip overrides for SOCKS lookups, e.g. nas.lan=192.168.1.10
+    --dns_listen=<addr>          Run a caching DNS forwarder here (e.g. 127.0.0.1:53); queries go over the VPN
+    --dns_split=<list>           Per-domain upstreams for --dns_listen, e.g. corp.example=10.0.0.53
+    --dns_blocklist=<list>       Blocklist files or URLs (hosts or domain-list format) for SOCKS and --dns_listen
+    --dns_blocklist_refresh=<dur>  How often to reload blocklists; 0 disables (default: 24h)
+    --dns_block_response=<mode>  Answer for blocked names: nxdomain or zero (0.0.0.0 / ::) (default: nxdomain)
+    --sniff                      SOCKS: detect the TLS SNI / HTTP Host of IP-address requests for domain rules
+    --sniff_timeout=<dur>        SOCKS: how long to wait for the client's first bytes when sniffing (default: 300ms)
+    --socks_max_conns=<n>        SOCKS: concurrent client connections; 0 means no limit (default: 1024)
+    --socks_max_conns_per_ip=<n>  SOCKS: concurrent client connections per source IP; 0 means no limit (default: 0)
+    --socks_idle_timeout=<dur>   SOCKS: close relays idle in both directions this long; 0 disables (default: 5m)
+    --socks_half_close_timeout=<dur>  SOCKS: idle limit once one side has closed; 0 keeps --socks_idle_timeout (default: 30s)
+    --socks_drain_timeout=<dur>  SOCKS: on shutdown, let open connections finish this long (default: 5s)
+    --socks_auth=<list>          SOCKS: require username/password auth; comma-separated user:password entries
+    --socks_upload_limit=<rate>  SOCKS: total client-to-destination bandwidth, e.g. 20mbit or 2MB; 0 means unlimited (default: 0)
+    --socks_download_limit=<rate>  SOCKS: total destination-to-client bandwidth; 0 means unlimited (default: 0)
+    --socks_allow_src=<list>     SOCKS: only accept clients from these CIDRs or addresses (default: any source)
+    --socks_allow_local          SOCKS: also accept loopback, link-local and private-network clients
+    --socks_proxy_protocol=<list>  SOCKS: load balancer CIDRs whose connections start with a PROXY v1/v2 header
+    --socks_tls_cert=<path>      SOCKS: server certificate (PEM) for socks+tls://host:port listeners
+    --socks_tls_key=<path>       SOCKS: private key (PEM) for --socks_tls_cert
+    --socks_tls_client_ca=<path>  SOCKS: require TLS client certificates from this CA; the subject CN is the user
+    --transparent=<addr>         Linux: accept TCP (and UDP with tproxy) redirected by nftables/iptables and route it like SOCKS
+    --transparent_mode=<mode>    redirect (REDIRECT, TCP only) or tproxy (TPROXY, TCP and UDP) (default: redirect)
+    --transparent_nft            Install the nft rules (and tproxy policy route) for --transparent, removed on exit
+    --shadowsocks=<addr>         Start a Shadowsocks AEAD server (TCP and UDP) routed like SOCKS
+    --shadowsocks_method=<method>  chacha20-ietf-poly1305 or aes-256-gcm (default: chacha20-ietf-poly1305)
+    --shadowsocks_password=<password>  Shadowsocks password (or URNETWORK_SHADOWSOCKS_PASSWORD)
     -h --help                    Show help
     --version                    Show version
-    --config=<path>              Path to YAML config file; CLI flags take precedence
+    --config=<path>              Path to YAML config file (or URNETWORK_CONFIG). Precedence: flags > URNETWORK_* env > file > defaults
 `, DefaultAPIURL, DefaultConnectURL)
 
+func main() {
 	opts, err := docopt.ParseArgs(usage, os.Args[1:], Version)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "error: %v\n", err)
@@ -89,16 +127,28 @@ Options:
 		return
 	}
 
-	// Set up log file and level for commands that support it.
-	if logPath := strings.TrimSpace(getStringOr(opts, "--log_file", "")); logPath != "" {
-		if err := setupLogFile(logPath); err != nil {
+	// Every command resolves its settings through the same layers:
+	// flag > URNETWORK_* env > config file > built-in default.
+	rc, err := resolveConfig(opts)
+	dryRun := mustBool(opts, "config") && (mustBool(opts, "show") || mustBool(opts, "validate"))
+	if err != nil && (rc == nil || !mustBool(opts, "validate")) {
+		if rc != nil {
+			err = reportProblems(rc.Problems)
+		}
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(2)
+	}
+	cfg := rc.VPN
+
+	// Set up log file and level. `config show` and `config validate` leave the log
+	// file alone.
+	if cfg.LogFile != "" && !dryRun {
+		if err := setupLogFile(cfg.LogFile); err != nil {
 			fmt.Fprintf(os.Stderr, "log setup failed: %v\n", err)
 			os.Exit(1)
 		}
 	}
-	lvl := strings.TrimSpace(getStringOr(opts, "--log_level", ""))
-	dbg, _ := opts.Bool("--debug")
-	setLogLevel(lvl, dbg)
+	setLogLevel(cfg.LogLevel, cfg.Debug)
 
 	// Handle --background for commands that support it before creating context.
 	if bg, _ := opts.Bool("--background"); bg {
@@ -119,34 +169,37 @@ Options:
 	var runErr error
 	switch {
 	case mustBool(opts, "login"):
-		runErr = cmdLogin(ctx, opts)
+		runErr = cmdLogin(ctx, opts, cfg)
 	case mustBool(opts, "verify"):
-		runErr = cmdVerify(ctx, opts)
+		runErr = cmdVerify(ctx, opts, cfg)
 	case mustBool(opts, "save-jwt"):
 		runErr = cmdSaveJWT(opts)
 	case mustBool(opts, "mint-client"):
-		runErr = cmdMintClient(ctx, opts)
+		runErr = cmdMintClient(ctx, cfg)
+	case mustBool(opts, "logout"):
+		runErr = cmdLogout(ctx, cfg)
+	case mustBool(opts, "clients") && mustBool(opts, "list"):
+		runErr = cmdClientsList(ctx, opts, cfg)
+	case mustBool(opts, "clients") && mustBool(opts, "remove"):
+		runErr = cmdClientsRemove(ctx, opts, cfg)
+	case mustBool(opts, "token") && mustBool(opts, "inspect"), mustBool(opts, "whoami"):
+		runErr = cmdTokenInspect(ctx, opts, rc)
+	case mustBool(opts, "config") && mustBool(opts, "show"):
+		runErr = cmdConfigShow(opts, rc)
+	case mustBool(opts, "config") && mustBool(opts, "validate"):
+		runErr = cmdConfigValidate(rc)
 	case mustBool(opts, "quick-connect"):
-		runErr = cmdQuickConnect(ctx, opts)
+		runErr = cmdQuickConnect(ctx, opts, cfg)
 	case mustBool(opts, "find-providers"):
-		runErr = cmdFindProviders(ctx, opts)
+		runErr = cmdFindProviders(ctx, opts, cfg)
 	case mustBool(opts, "open"):
-		runErr = cmdOpen(ctx, opts)
+		runErr = cmdOpen(ctx, opts, cfg)
 	case mustBool(opts, "locations"):
-		runErr = cmdLocations(ctx, opts)
+		runErr = cmdLocations(ctx, opts, cfg)
 	case mustBool(opts, "socks"):
-		runErr = cmdSocks(ctx, opts)
+		runErr = cmdSocks(ctx, rc.SOCKS)
 	case mustBool(opts, "vpn"):
-		jwt, _ := loadJWT(getStringOr(opts, "--jwt", ""))
-		cfg := parseVPNConfig(opts, jwt)
-		if cfgPath := strings.TrimSpace(getStringOr(opts, "--config", "")); cfgPath != "" {
-			cf, err := loadConfigFile(cfgPath)
-			if err != nil {
-				fmt.Fprintf(os.Stderr, "error: %v\n", err)
-				os.Exit(1)
-			}
-			cfg = applyConfigFile(cfg, cf)
-		}
+		cfg.JWT, _ = loadJWT(cfg.JWT)
 		runErr = cmdVpn(ctx, cfg)
 	default:
 		fmt.Println(usage)
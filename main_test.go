@@ -1,6 +1,11 @@
 package main
 
-import "testing"
+import (
+	"strings"
+	"testing"
+
+	"github.com/docopt/docopt-go"
+)
 
 func TestParseKV(t *testing.T) {
 	k, v, ok := parseKV("country:Germany")
@@ -24,3 +29,34 @@ func TestMatchValueFold(t *testing.T) {
 		t.Fatalf("* should match non-empty strings")
 	}
 }
+
+func TestUsageParses(t *testing.T) {
+	p := &docopt.Parser{HelpHandler: docopt.NoHelpHandler}
+	for _, argv := range [][]string{
+		{"--version"},
+		{"whoami"},
+		{"vpn", "--dns=1.1.1.1", "--socks=127.0.0.1:1080"},
+		{"quick-connect", "--dns=https://dns.example/dns-query"},
+		{"socks", "--listen=127.0.0.1:1080", "--dns=tls://dns.example"},
+		{"config", "validate", "--dns=1.1.1.1"},
+	} {
+		if _, err := p.ParseArgs(usage, argv, Version); err != nil {
+			t.Errorf("%v: %v", argv, err)
+		}
+	}
+	// docopt rejects an option listed twice only when a flag is matched against
+	// it, so check the Options section directly as well.
+	seen := map[string]bool{}
+	_, opts, _ := strings.Cut(usage, "\nOptions:\n")
+	for _, line := range strings.Split(opts, "\n") {
+		name, _, _ := strings.Cut(strings.TrimSpace(line), "=")
+		name, _, _ = strings.Cut(name, " ")
+		if !strings.HasPrefix(name, "--") {
+			continue
+		}
+		if seen[name] {
+			t.Errorf("%s is listed twice under Options", name)
+		}
+		seen[name] = true
+	}
+}
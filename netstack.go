@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+
+	"gvisor.dev/gvisor/pkg/buffer"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/link/channel"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv6"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/icmp"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/udp"
+)
+
+// userStackNIC is the only interface of a userStack.
+const userStackNIC tcpip.NICID = 1
+
+// userStack is a userspace TCP/IP stack with one interface whose packets are handed to
+// a send function and fed back with receive, instead of going through a TUN device.
+// Connections dialed through it leave with the stack's own addresses.
+type userStack struct {
+	s    *stack.Stack
+	ep   *channel.Endpoint
+	ipv6 bool
+}
+
+// newUserStack creates a stack with addrs (one IPv4 address, plus an IPv6 one when IPv6
+// is enabled) and a default route for each family. Call pump to start sending.
+func newUserStack(mtu int, addrs []net.IP) (*userStack, error) {
+	s := stack.New(stack.Options{
+		NetworkProtocols:   []stack.NetworkProtocolFactory{ipv4.NewProtocol, ipv6.NewProtocol},
+		TransportProtocols: []stack.TransportProtocolFactory{tcp.NewProtocol, udp.NewProtocol, icmp.NewProtocol4, icmp.NewProtocol6},
+		HandleLocal:        true,
+	})
+	sack := tcpip.TCPSACKEnabled(true)
+	_ = s.SetTransportProtocolOption(tcp.ProtocolNumber, &sack)
+	u := &userStack{s: s, ep: channel.New(512, uint32(mtu), "")}
+	if err := s.CreateNIC(userStackNIC, u.ep); err != nil {
+		s.Close()
+		return nil, fmt.Errorf("userspace stack: create NIC: %s", err)
+	}
+	for _, ip := range addrs {
+		proto, subnet := tcpip.NetworkProtocolNumber(ipv4.ProtocolNumber), header.IPv4EmptySubnet
+		if ip.To4() != nil {
+			ip = ip.To4()
+		} else {
+			proto, subnet = ipv6.ProtocolNumber, header.IPv6EmptySubnet
+			u.ipv6 = true
+		}
+		pa := tcpip.ProtocolAddress{Protocol: proto, AddressWithPrefix: tcpip.AddrFromSlice(ip).WithPrefix()}
+		if err := s.AddProtocolAddress(userStackNIC, pa, stack.AddressProperties{}); err != nil {
+			u.Close()
+			return nil, fmt.Errorf("userspace stack: add address %s: %s", ip, err)
+		}
+		s.AddRoute(tcpip.Route{Destination: subnet, NIC: userStackNIC})
+	}
+	return u, nil
+}
+
+// pump hands every packet the stack sends to send until ctx ends.
+func (u *userStack) pump(ctx context.Context, send func(packet []byte)) {
+	for {
+		pkt := u.ep.ReadContext(ctx)
+		if pkt == nil {
+			return
+		}
+		view := pkt.ToView()
+		pkt.DecRef()
+		packet := append([]byte(nil), view.AsSlice()...)
+		view.Release()
+		send(packet)
+	}
+}
+
+// receive delivers an IP packet from the provider to the stack. IPv6 packets are
+// dropped unless the stack has an IPv6 address.
+func (u *userStack) receive(packet []byte) {
+	if len(packet) == 0 {
+		return
+	}
+	var proto tcpip.NetworkProtocolNumber
+	switch packet[0] >> 4 {
+	case 4:
+		proto = ipv4.ProtocolNumber
+	case 6:
+		if !u.ipv6 {
+			return
+		}
+		proto = ipv6.ProtocolNumber
+	default:
+		return
+	}
+	pkb := stack.NewPacketBuffer(stack.PacketBufferOptions{Payload: buffer.MakeWithData(append([]byte(nil), packet...))})
+	u.ep.InjectInbound(proto, pkb)
+	pkb.DecRef()
+}
+
+// DialContext connects to addr, an IP literal and port, over "tcp" or "udp" (optionally
+// with a 4 or 6 suffix). It has the signature of net.Dialer.DialContext.
+func (u *userStack) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	ip := net.ParseIP(host)
+	port, perr := strconv.Atoi(portStr)
+	if ip == nil || perr != nil || port < 0 || port > 65535 {
+		return nil, &net.AddrError{Err: "userspace stack dials IP addresses only", Addr: addr}
+	}
+	proto := tcpip.NetworkProtocolNumber(ipv4.ProtocolNumber)
+	if ip.To4() != nil {
+		ip = ip.To4()
+	} else {
+		proto = ipv6.ProtocolNumber
+	}
+	fa := tcpip.FullAddress{NIC: userStackNIC, Addr: tcpip.AddrFromSlice(ip), Port: uint16(port)}
+	var c net.Conn
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+		c, err = gonet.DialContextTCP(ctx, u.s, fa, proto)
+	case "udp", "udp4", "udp6":
+		c, err = gonet.DialUDP(u.s, nil, &fa, proto)
+	default:
+		return nil, net.UnknownNetworkError(network)
+	}
+	if err != nil {
+		return nil, err // not the typed nil gonet returns
+	}
+	return c, nil
+}
+
+// Close shuts the stack down and aborts its connections.
+func (u *userStack) Close() {
+	u.ep.Close()
+	u.s.Close()
+	u.s.Wait()
+}
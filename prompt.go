@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// stdinReader is shared by all prompts so input buffered by one prompt is not lost to the next.
+var stdinReader = bufio.NewReader(os.Stdin)
+
+// promptOut receives prompt labels; stdout is left for command output.
+var promptOut io.Writer = os.Stderr
+
+// promptInteractive reports whether the user can be prompted (stdin is a terminal).
+// Replace in tests.
+var promptInteractive = func() bool { return isTerminal(int(os.Stdin.Fd())) }
+
+// promptLine prints label and reads one line from stdin. It returns ctx.Err() if ctx is
+// cancelled (e.g. Ctrl-C) before a line is entered.
+func promptLine(ctx context.Context, label string) (string, error) {
+	_, _ = fmt.Fprint(promptOut, label)
+	type outcome struct {
+		line string
+		err  error
+	}
+	ch := make(chan outcome, 1)
+	go func() {
+		line, err := stdinReader.ReadString('\n')
+		if err == io.EOF && line != "" {
+			err = nil
+		}
+		ch <- outcome{line: strings.TrimRight(line, "\r\n"), err: err}
+	}()
+	select {
+	case r := <-ch:
+		return r.line, r.err
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+}
+
+// promptSecret is like promptLine but disables terminal echo while reading.
+func promptSecret(ctx context.Context, label string) (string, error) {
+	fd := int(os.Stdin.Fd())
+	if isTerminal(fd) {
+		restore, err := disableEcho(fd)
+		if err != nil {
+			return "", fmt.Errorf("disable echo: %w", err)
+		}
+		defer func() {
+			restore()
+			_, _ = fmt.Fprintln(promptOut)
+		}()
+	}
+	return promptLine(ctx, label)
+}
+
+// promptCredentials fills in a missing userAuth and/or password by prompting on the terminal.
+// Non-interactive callers get the values back unchanged.
+func promptCredentials(ctx context.Context, userAuth, password string) (string, string, error) {
+	if !promptInteractive() {
+		return userAuth, password, nil
+	}
+	var err error
+	if strings.TrimSpace(userAuth) == "" {
+		if userAuth, err = promptLine(ctx, "Email or phone: "); err != nil {
+			return "", "", err
+		}
+		userAuth = strings.TrimSpace(userAuth)
+	}
+	if password == "" {
+		if password, err = promptSecret(ctx, "Password: "); err != nil {
+			return "", "", err
+		}
+	}
+	if userAuth == "" || password == "" {
+		return "", "", errors.New("user_auth and password are required")
+	}
+	return userAuth, password, nil
+}
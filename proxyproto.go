@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// proxyHeaderTimeout bounds how long a trusted peer has to send its PROXY header.
+const proxyHeaderTimeout = 5 * time.Second
+
+// proxyV2Sig starts every PROXY protocol v2 header.
+var proxyV2Sig = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// errProxyHeader reports a missing or malformed PROXY protocol header.
+var errProxyHeader = errors.New("invalid PROXY protocol header")
+
+// proxyConn is a connection whose client address came from a PROXY protocol header.
+type proxyConn struct {
+	net.Conn
+	r      io.Reader // bytes read past the header, then the connection
+	remote net.Addr
+}
+
+func (c *proxyConn) Read(p []byte) (int, error) { return c.r.Read(p) }
+
+// RemoteAddr returns the client address from the header.
+func (c *proxyConn) RemoteAddr() net.Addr { return c.remote }
+
+// CloseWrite half-closes the underlying connection, as relay expects of TCP.
+func (c *proxyConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
+// readProxyHeader reads the HAProxy PROXY protocol header (v1 text or v2 binary) that
+// must start c, and returns c with the header's source address as its RemoteAddr.
+// LOCAL (v2) and UNKNOWN (v1) headers, which load balancers send for health checks,
+// keep c's own address.
+func readProxyHeader(c net.Conn) (net.Conn, error) {
+	_ = c.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+	br := bufio.NewReader(c)
+	src, err := parseProxyHeader(br)
+	_ = c.SetReadDeadline(time.Time{})
+	if err != nil {
+		return nil, err
+	}
+	rest, _ := br.Peek(br.Buffered())
+	pc := &proxyConn{Conn: c, r: io.MultiReader(bytes.NewReader(rest), c), remote: c.RemoteAddr()}
+	if src != nil {
+		pc.remote = src
+	}
+	return pc, nil
+}
+
+// parseProxyHeader reads one PROXY header from br and returns its source address, or
+// nil when the header carries none.
+func parseProxyHeader(br *bufio.Reader) (*net.TCPAddr, error) {
+	head, err := br.Peek(len(proxyV2Sig))
+	if err == nil && bytes.Equal(head, proxyV2Sig) {
+		return parseProxyV2(br)
+	}
+	if len(head) >= 6 && string(head[:6]) == "PROXY " {
+		return parseProxyV1(br)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return nil, errProxyHeader
+}
+
+// parseProxyV1 parses "PROXY TCP4 <src> <dst> <sport> <dport>\r\n" (or TCP6, or UNKNOWN
+// followed by anything). The line is at most 107 bytes.
+func parseProxyV1(br *bufio.Reader) (*net.TCPAddr, error) {
+	var line []byte
+	for len(line) <= 107 {
+		b, err := br.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	s, ok := strings.CutSuffix(string(line), "\r\n")
+	if !ok {
+		return nil, fmt.Errorf("%w: v1 line not terminated by CRLF within 107 bytes", errProxyHeader)
+	}
+	f := strings.Split(s, " ")
+	if len(f) >= 2 && f[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(f) != 6 || (f[1] != "TCP4" && f[1] != "TCP6") {
+		return nil, fmt.Errorf("%w: %q", errProxyHeader, s)
+	}
+	ip := net.ParseIP(f[2])
+	port, err := strconv.ParseUint(f[4], 10, 16)
+	if ip == nil || err != nil || (ip.To4() != nil) != (f[1] == "TCP4") {
+		return nil, fmt.Errorf("%w: %q", errProxyHeader, s)
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// parseProxyV2 parses a binary header: the signature, version and command, address
+// family and protocol, length, then the addresses and any TLVs, which are skipped.
+func parseProxyV2(br *bufio.Reader) (*net.TCPAddr, error) {
+	var hdr [16]byte
+	if _, err := io.ReadFull(br, hdr[:]); err != nil {
+		return nil, err
+	}
+	if hdr[12]>>4 != 2 {
+		return nil, fmt.Errorf("%w: v2 version %d", errProxyHeader, hdr[12]>>4)
+	}
+	body := make([]byte, binary.BigEndian.Uint16(hdr[14:16]))
+	if _, err := io.ReadFull(br, body); err != nil {
+		return nil, err
+	}
+	switch hdr[12] & 0x0f {
+	case 0: // LOCAL
+		return nil, nil
+	case 1: // PROXY
+	default:
+		return nil, fmt.Errorf("%w: v2 command %d", errProxyHeader, hdr[12]&0x0f)
+	}
+	switch hdr[13] >> 4 {
+	case 1: // AF_INET: src, dst, sport, dport
+		if len(body) < 12 {
+			return nil, fmt.Errorf("%w: short v2 IPv4 addresses", errProxyHeader)
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:4]), Port: int(binary.BigEndian.Uint16(body[8:10]))}, nil
+	case 2: // AF_INET6
+		if len(body) < 36 {
+			return nil, fmt.Errorf("%w: short v2 IPv6 addresses", errProxyHeader)
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:16]), Port: int(binary.BigEndian.Uint16(body[32:34]))}, nil
+	}
+	return nil, nil // AF_UNSPEC or AF_UNIX: no usable address
+}
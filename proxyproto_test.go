@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docopt/docopt-go"
+	"gopkg.in/yaml.v3"
+)
+
+// proxyV2Header builds a v2 PROXY header for a TCP connection from src, followed by a
+// TLV the parser must skip. A nil src builds a LOCAL header.
+func proxyV2Header(src *net.TCPAddr) []byte {
+	h := append([]byte{}, proxyV2Sig...)
+	if src == nil {
+		return append(h, 0x20, 0x00, 0, 0)
+	}
+	var body []byte
+	fam := byte(0x11) // AF_INET, STREAM
+	if ip4 := src.IP.To4(); ip4 != nil {
+		body = append(append(body, ip4...), 127, 0, 0, 1)
+	} else {
+		fam = 0x21
+		body = append(append(body, src.IP.To16()...), net.IPv6loopback...)
+	}
+	body = binary.BigEndian.AppendUint16(body, uint16(src.Port))
+	body = binary.BigEndian.AppendUint16(body, 1080)
+	body = append(body, 0x04, 0, 2, 'h', 'i') // PP2_TYPE_NOOP
+	h = append(h, 0x21, fam)
+	h = binary.BigEndian.AppendUint16(h, uint16(len(body)))
+	return append(h, body...)
+}
+
+func TestParseProxyHeader(t *testing.T) {
+	for _, tc := range []struct {
+		name, header, want string
+	}{
+		{"v1 tcp4", "PROXY TCP4 198.51.100.7 10.0.0.1 40000 1080\r\n", "198.51.100.7:40000"},
+		{"v1 tcp6", "PROXY TCP6 2001:db8::7 2001:db8::1 40000 1080\r\n", "[2001:db8::7]:40000"},
+		{"v1 unknown", "PROXY UNKNOWN\r\n", ""},
+		{"v2 ipv4", string(proxyV2Header(&net.TCPAddr{IP: net.ParseIP("198.51.100.7"), Port: 40000})), "198.51.100.7:40000"},
+		{"v2 ipv6", string(proxyV2Header(&net.TCPAddr{IP: net.ParseIP("2001:db8::7"), Port: 40000})), "[2001:db8::7]:40000"},
+		{"v2 local", string(proxyV2Header(nil)), ""},
+	} {
+		br := bufio.NewReader(strings.NewReader(tc.header + "rest"))
+		src, err := parseProxyHeader(br)
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		if got := ""; src != nil {
+			got = src.String()
+			if got != tc.want {
+				t.Errorf("%s: source %s, want %s", tc.name, got, tc.want)
+			}
+		} else if tc.want != "" {
+			t.Errorf("%s: no source, want %s", tc.name, tc.want)
+		}
+		if rest, _ := io.ReadAll(br); string(rest) != "rest" {
+			t.Errorf("%s: left %q after the header", tc.name, rest)
+		}
+	}
+}
+
+func TestParseProxyHeader_Malformed(t *testing.T) {
+	v2 := proxyV2Header(&net.TCPAddr{IP: net.ParseIP("198.51.100.7"), Port: 40000})
+	badVersion := append([]byte{}, v2...)
+	badVersion[12] = 0x11
+	shortAddrs := append(append([]byte{}, v2[:14]...), 0, 4, 1, 2, 3, 4)
+	for name, header := range map[string]string{
+		"socks greeting":  "\x05\x01\x00\x05\x01\x00\x01\x7f\x00\x00\x01\x04\x38",
+		"v1 no crlf":      "PROXY TCP4 198.51.100.7 10.0.0.1 40000 1080\n",
+		"v1 too long":     "PROXY TCP4 " + strings.Repeat("1", 120) + "\r\n",
+		"v1 bad address":  "PROXY TCP4 example.com 10.0.0.1 40000 1080\r\n",
+		"v1 family":       "PROXY TCP4 2001:db8::7 10.0.0.1 40000 1080\r\n",
+		"v1 bad port":     "PROXY TCP4 198.51.100.7 10.0.0.1 70000 1080\r\n",
+		"v2 version":      string(badVersion),
+		"v2 short":        string(shortAddrs),
+		"v2 truncated":    string(v2[:20]),
+		"empty":           "",
+		"http":            "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n",
+		"v1 missing port": "PROXY TCP4 198.51.100.7 10.0.0.1 40000\r\n",
+	} {
+		if src, err := parseProxyHeader(bufio.NewReader(strings.NewReader(header))); err == nil {
+			t.Errorf("%s: accepted, source %v", name, src)
+		}
+	}
+}
+
+func TestReadProxyHeader_Timeout(t *testing.T) {
+	client, server := net.Pipe()
+	t.Cleanup(func() { _ = client.Close() })
+	go func() { _, _ = client.Write([]byte("PROXY TCP4 ")) }()
+	start := time.Now()
+	_, err := readProxyHeader(server)
+	var ne net.Error
+	if !errors.As(err, &ne) || !ne.Timeout() {
+		t.Fatalf("readProxyHeader = %v, want a timeout", err)
+	}
+	if d := time.Since(start); d > proxyHeaderTimeout+2*time.Second {
+		t.Fatalf("gave up after %s", d)
+	}
+}
+
+// socksConnectVia sends header and a SOCKS5 CONNECT to 127.0.0.1:port in one write, as
+// a load balancer forwarding a pipelining client would.
+func socksConnectVia(t *testing.T, proxyAddr string, header []byte, port int) net.Conn {
+	t.Helper()
+	c := dialProxy(t, proxyAddr)
+	req := []byte{5, 1, 0, 5, 1, 0, 1, 127, 0, 0, 1, 0, 0}
+	binary.BigEndian.PutUint16(req[11:], uint16(port))
+	if _, err := c.Write(append(append([]byte{}, header...), req...)); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	return c
+}
+
+// expectConnected reads the method and CONNECT replies and fails unless both succeed.
+func expectConnected(t *testing.T, c net.Conn) {
+	t.Helper()
+	resp := make([]byte, 12)
+	if _, err := io.ReadFull(c, resp); err != nil || resp[1] != 0 || resp[3] != 0 {
+		t.Fatalf("socks replies %v, %v", resp, err)
+	}
+}
+
+func TestSocks_ProxyProtocolSourceAllowlist(t *testing.T) {
+	port := tcpEcho(t)
+	stats := &socksStats{}
+	proxyAddr := startTestSocks(t, socksOptions{
+		ProxyFrom: []*net.IPNet{parseCIDRHost("127.0.0.0/8")},
+		AllowSrc:  []*net.IPNet{parseCIDRHost("198.51.100.0/24"), parseCIDRHost("2001:db8::/32")},
+		Limits:    socksLimits{MaxConnsPerIP: 1},
+		Stats:     stats,
+	})
+
+	// The carried address, not the load balancer's, is checked and limited per IP.
+	c := socksConnectVia(t, proxyAddr, []byte("PROXY TCP4 198.51.100.7 127.0.0.1 40000 1080\r\n"), port)
+	expectConnected(t, c)
+	expectEcho(t, c, "v1")
+	c = socksConnectVia(t, proxyAddr, proxyV2Header(&net.TCPAddr{IP: net.ParseIP("2001:db8::7"), Port: 40000}), port)
+	expectConnected(t, c)
+	expectEcho(t, c, "v2")
+	expectClosed(t, socksConnectVia(t, proxyAddr, []byte("PROXY TCP4 198.51.100.7 127.0.0.1 40001 1080\r\n"), port), 2*time.Second)
+	if got := stats.refusedLimit.Load(); got != 1 {
+		t.Fatalf("refused limit count = %d, want 1", got)
+	}
+
+	expectClosed(t, socksConnectVia(t, proxyAddr, []byte("PROXY TCP4 203.0.113.9 127.0.0.1 40000 1080\r\n"), port), 2*time.Second)
+	if got := stats.refusedSource.Load(); got != 1 {
+		t.Fatalf("refused source count = %d, want 1", got)
+	}
+	// A health check keeps the load balancer's own address, which is not allowed here.
+	expectClosed(t, socksConnectVia(t, proxyAddr, proxyV2Header(nil), port), 2*time.Second)
+	// A trusted peer must send a header.
+	expectClosed(t, socksConnectVia(t, proxyAddr, nil, port), 2*time.Second)
+}
+
+func TestSocks_ProxyProtocolUntrustedPeer(t *testing.T) {
+	port := tcpEcho(t)
+	proxyAddr := startTestSocks(t, socksOptions{ProxyFrom: []*net.IPNet{parseCIDRHost("192.0.2.0/24")}})
+	// Plain SOCKS still works, and a header from an untrusted peer is not honoured.
+	c := socksConnectVia(t, proxyAddr, nil, port)
+	expectConnected(t, c)
+	expectEcho(t, c, "direct")
+	expectClosed(t, socksConnectVia(t, proxyAddr, []byte("PROXY TCP4 198.51.100.7 127.0.0.1 40000 1080\r\n"), port), 2*time.Second)
+}
+
+func TestResolveConfig_SOCKSProxyProtocol(t *testing.T) {
+	if _, err := resolveConfigWith(docopt.Opts{"--socks_proxy_protocol": "10.0.0.0/8,lb.example"}, fakeEnv(nil)); err == nil {
+		t.Fatal("invalid socks_proxy_protocol was accepted")
+	}
+	rc, err := resolveConfigWith(docopt.Opts{"--socks_proxy_protocol": "10.0.0.0/8,192.0.2.10"}, fakeEnv(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rc.SOCKS.ProxyFrom) != 2 || !cidrsContain(rc.VPN.SOCKSProxyFrom, net.ParseIP("192.0.2.10")) {
+		t.Fatalf("proxy sources = %v", rc.VPN.SOCKSProxyFrom)
+	}
+
+	var n yaml.Node
+	if err := yaml.Unmarshal([]byte("- listen: 127.0.0.1:1081\n  socks_proxy_protocol: [10.0.0.0/8]\n"), &n); err != nil {
+		t.Fatal(err)
+	}
+	ls, err := parseListeners(n.Content[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := ls[0].String(); got != "127.0.0.1:1081 proxy_protocol=1" {
+		t.Errorf("listener = %q", got)
+	}
+	if opts := ls[0].options(socksOptions{ProxyFrom: rc.VPN.SOCKSProxyFrom}); len(opts.ProxyFrom) != 1 {
+		t.Errorf("listener proxy sources = %v", opts.ProxyFrom)
+	}
+}
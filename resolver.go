@@ -0,0 +1,31 @@
+package main
+
+import (
+	"context"
+	"net"
+)
+
+// DefaultTunnelDNS is used for lookups through the VPN interface when --dns is not set.
+// The system's servers are usually on the local network and unreachable through the tunnel.
+var DefaultTunnelDNS = []string{"1.1.1.1", "8.8.8.8"}
+
+// hostResolver looks up the addresses of a destination name. *net.Resolver (the system
+// resolver) and *dnsClient (--dns upstreams) both satisfy it.
+type hostResolver interface {
+	LookupIP(ctx context.Context, network, host string) ([]net.IP, error)
+}
+
+// pickRouteIP returns the first IPv4 address in addrs, or the first address when there
+// is no IPv4 one.
+func pickRouteIP(addrs []net.IP) net.IP {
+	var first net.IP
+	for _, ip := range addrs {
+		if ip.To4() != nil {
+			return ip
+		}
+		if first == nil {
+			first = ip
+		}
+	}
+	return first
+}
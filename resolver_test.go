@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"net"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// TestSocksLookupHost_PicksResolverByRoute verifies that VPN-routed names are resolved
+// with the tunnel resolver, direct names with the system resolver, and blocked names
+// are not resolved at all.
+func TestSocksLookupHost_PicksResolverByRoute(t *testing.T) {
+	if runtime.GOOS == "darwin" {
+		t.Skip("net.Resolver.Dial may be bypassed by the cgo resolver on macOS")
+	}
+	systemDNS, stopSystem := fakeDNSServer(t, net.ParseIP("10.0.0.1"))
+	defer stopSystem()
+	tunnelDNS, stopTunnel := fakeDNSServer(t, net.ParseIP("10.0.0.2"))
+	defer stopTunnel()
+
+	rules := []*routeRule{{Action: actionBlock, Domains: []string{"blocked.test"}}}
+	srv := &socksServer{
+		bindIf:         "tun-test",
+		resolver:       mustDNSClient(t, dnsClientOptions{Upstreams: []string{systemDNS}}),
+		tunnelResolver: mustDNSClient(t, dnsClientOptions{Upstreams: []string{tunnelDNS}}),
+		rules:          newRuleSet(rules, nil, []string{"direct.test"}),
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if ip, blocked := srv.lookupHost(ctx, "tcp", "www.direct.test", 443, nil); blocked || !ip.Equal(net.ParseIP("10.0.0.1")) {
+		t.Errorf("direct name: ip=%v blocked=%v, want system resolver answer 10.0.0.1", ip, blocked)
+	}
+	if ip, blocked := srv.lookupHost(ctx, "tcp", "vpn.test", 443, nil); blocked || !ip.Equal(net.ParseIP("10.0.0.2")) {
+		t.Errorf("VPN name: ip=%v blocked=%v, want tunnel resolver answer 10.0.0.2", ip, blocked)
+	}
+	if ip, blocked := srv.lookupHost(ctx, "udp", "x.blocked.test", 53, nil); !blocked || ip != nil {
+		t.Errorf("blocked name: ip=%v blocked=%v", ip, blocked)
+	}
+
+	// Without a VPN interface there is no tunnel resolver and every name uses the same one.
+	srv.tunnelResolver = nil
+	if ip, _ := srv.lookupHost(ctx, "tcp", "vpn.test", 443, nil); !ip.Equal(net.ParseIP("10.0.0.1")) {
+		t.Errorf("no tunnel: ip=%v, want 10.0.0.1", ip)
+	}
+}
+
+func TestPickRouteIP(t *testing.T) {
+	v6, v4 := net.ParseIP("2001:db8::1"), net.ParseIP("192.0.2.1")
+	if got := pickRouteIP([]net.IP{v6, v4}); !got.Equal(v4) {
+		t.Errorf("got %v, want IPv4", got)
+	}
+	if got := pickRouteIP([]net.IP{v6}); !got.Equal(v6) {
+		t.Errorf("got %v, want IPv6 fallback", got)
+	}
+	if got := pickRouteIP(nil); got != nil {
+		t.Errorf("got %v, want nil", got)
+	}
+}
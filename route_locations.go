@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/urnetwork/connect"
+	"gopkg.in/yaml.v3"
+)
+
+// routeLocation sends TUN packets for its CIDRs through a provider in its own exit
+// location instead of the default one.
+type routeLocation struct {
+	CIDRs    []*net.IPNet
+	Location LocationConfig
+}
+
+// parseRouteLocations decodes the `route_locations:` section of the config file.
+//
+//	route_locations:
+//	  - cidr: [203.0.113.0/24]
+//	    location_query: "country:Japan"
+//	  - cidr: [198.51.100.7, 2001:db8::/32]
+//	    location_id: 0193f7a2-5c4e-7d1b-9a3f-2e8b6c1d4f70
+func parseRouteLocations(n *yaml.Node) ([]*routeLocation, error) {
+	if n.Kind != yaml.SequenceNode {
+		return nil, fmt.Errorf("route_locations: expected a list (line %d)", n.Line)
+	}
+	var out []*routeLocation
+	for i, item := range n.Content {
+		if err := checkYAMLKeys(item, "cidr", "location_query", "location_id", "location_group_id"); err != nil {
+			return nil, fmt.Errorf("route_locations[%d]: %w", i, err)
+		}
+		var spec struct {
+			CIDR            stringList `yaml:"cidr"`
+			LocationQuery   string     `yaml:"location_query"`
+			LocationID      string     `yaml:"location_id"`
+			LocationGroupID string     `yaml:"location_group_id"`
+		}
+		if err := item.Decode(&spec); err != nil {
+			return nil, fmt.Errorf("route_locations[%d]: %w", i, err)
+		}
+		fail := func(format string, args ...any) error {
+			return fmt.Errorf("route_locations[%d] (line %d): %s", i, item.Line, fmt.Sprintf(format, args...))
+		}
+		r := &routeLocation{Location: LocationConfig{
+			LocationQuery:   strings.TrimSpace(spec.LocationQuery),
+			LocationID:      strings.TrimSpace(spec.LocationID),
+			LocationGroupID: strings.TrimSpace(spec.LocationGroupID),
+		}}
+		if len(spec.CIDR) == 0 {
+			return nil, fail("cidr is required")
+		}
+		for _, c := range spec.CIDR {
+			n := parseCIDRHost(c)
+			if n == nil {
+				return nil, fail("cidr %q is not an IP address or CIDR", c)
+			}
+			r.CIDRs = append(r.CIDRs, n)
+		}
+		if locationKey(r.Location) == "" {
+			return nil, fail("location_query, location_id or location_group_id is required")
+		}
+		for _, id := range []string{r.Location.LocationID, r.Location.LocationGroupID} {
+			if _, err := connect.ParseId(id); id != "" && err != nil {
+				return nil, fail("%q is not a location id", id)
+			}
+		}
+		out = append(out, r)
+	}
+	return out, nil
+}
+
+// String describes r for `config show` and the startup log.
+func (r *routeLocation) String() string {
+	cidrs := make([]string, len(r.CIDRs))
+	for i, n := range r.CIDRs {
+		cidrs[i] = n.String()
+	}
+	return fmt.Sprintf("%s via %s", strings.Join(cidrs, ","), locationKey(r.Location))
+}
+
+// sharedRouteLocations returns, for each route, the index of the first route with the
+// same exit location, so routes naming one location can share its provider client.
+func sharedRouteLocations(routes []*routeLocation) []int {
+	first := map[string]int{}
+	share := make([]int, len(routes))
+	for i, r := range routes {
+		key := locationKey(r.Location)
+		j, ok := first[key]
+		if !ok {
+			j = i
+			first[key] = i
+		}
+		share[i] = j
+	}
+	return share
+}
+
+// routeTable picks a route_locations entry for an outgoing packet by the most specific
+// CIDR that contains its destination. A nil *routeTable matches nothing.
+type routeTable struct {
+	entries []routeTableEntry // longest prefix first
+}
+
+type routeTableEntry struct {
+	n     *net.IPNet
+	route int // index into the route_locations entries
+}
+
+// newRouteTable returns the table for routes, or nil when there are none.
+func newRouteTable(routes []*routeLocation) *routeTable {
+	if len(routes) == 0 {
+		return nil
+	}
+	t := &routeTable{}
+	for i, r := range routes {
+		for _, n := range r.CIDRs {
+			t.entries = append(t.entries, routeTableEntry{n: n, route: i})
+		}
+	}
+	// On equal prefixes the earlier entry wins.
+	sort.SliceStable(t.entries, func(i, j int) bool {
+		a, _ := t.entries[i].n.Mask.Size()
+		b, _ := t.entries[j].n.Mask.Size()
+		return a > b
+	})
+	return t
+}
+
+// lookup returns the index of the route for packet, or -1 when packet goes to the
+// default location.
+func (t *routeTable) lookup(packet []byte) int {
+	if t == nil {
+		return -1
+	}
+	dst := packetDst(packet)
+	if dst == nil {
+		return -1
+	}
+	for _, e := range t.entries {
+		if e.n.Contains(dst) {
+			return e.route
+		}
+	}
+	return -1
+}
+
+// packetDst returns the destination address of an IPv4 or IPv6 packet, or nil when the
+// packet is too short.
+func packetDst(packet []byte) net.IP {
+	if len(packet) < 1 {
+		return nil
+	}
+	switch packet[0] >> 4 {
+	case 4:
+		if len(packet) >= 20 {
+			return net.IP(packet[16:20])
+		}
+	case 6:
+		if len(packet) >= 40 {
+			return net.IP(packet[24:40])
+		}
+	}
+	return nil
+}
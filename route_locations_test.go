@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/docopt/docopt-go"
+	"gopkg.in/yaml.v3"
+)
+
+// packetTo returns a minimal IPv4 or IPv6 header addressed to dst.
+func packetTo(dst string) []byte {
+	ip := net.ParseIP(dst)
+	if ip4 := ip.To4(); ip4 != nil {
+		pkt := make([]byte, 20)
+		pkt[0] = 0x45
+		copy(pkt[16:20], ip4)
+		return pkt
+	}
+	pkt := make([]byte, 40)
+	pkt[0] = 0x60
+	copy(pkt[24:40], ip.To16())
+	return pkt
+}
+
+func TestResolveConfig_RouteLocations(t *testing.T) {
+	path := writeConfig(t, `
+route: 192.0.2.0/24
+route_locations:
+  - cidr: [203.0.113.0/24]
+    location_query: "country:Japan"
+  - cidr: [203.0.113.7, "2001:db8::/32"]
+    location_id: 0193f7a2-5c4e-7d1b-9a3f-2e8b6c1d4f70
+`)
+	rc, err := resolveConfigWith(docopt.Opts{"--config": path}, fakeEnv(nil))
+	if err != nil {
+		t.Fatalf("resolveConfig: %v", err)
+	}
+	routes := rc.VPN.RouteLocations
+	if len(routes) != 2 {
+		t.Fatalf("route_locations = %v", routes)
+	}
+	if got := routes[1].String(); got != "203.0.113.7/32,2001:db8::/32 via loc-0193f7a2-5c4e-7d1b-9a3f-2e8b6c1d4f70" {
+		t.Errorf("route 1 = %q", got)
+	}
+	if got := strings.Join(rc.VPN.extraRoutes(), ","); got != "192.0.2.0/24,203.0.113.0/24,203.0.113.7/32,2001:db8::/32" {
+		t.Errorf("extraRoutes = %s", got)
+	}
+	if out := buildConfigShow(rc); len(out.RouteLocations) != 2 || out.RouteLocations[0] != "203.0.113.0/24 via country:japan" {
+		t.Errorf("config show route_locations = %v", out.RouteLocations)
+	}
+
+	rc.VPN.TunName = "none"
+	rc.VPN.ExtraRoutes = ""
+	errs := validateConfig(rc)
+	if len(errs) != 1 || !strings.Contains(errs[0].Error(), "route_locations") {
+		t.Fatalf("route_locations without a TUN: %v", errs)
+	}
+}
+
+func TestParseRouteLocations_Errors(t *testing.T) {
+	for _, bad := range []string{
+		"cidr: [203.0.113.0/24]",                                    // not a list
+		"- location_query: country:Japan",                           // no cidr
+		"- cidr: [203.0.113.0/24]",                                  // no location
+		"- cidr: [203.0.113.0/33]\n  location_query: country:Japan", // bad CIDR
+		"- cidr: [203.0.113.0/24]\n  location_id: tokyo",            // bad id
+		"- cidr: [203.0.113.0/24]\n  location: country:Japan",       // unknown key
+		"- cidr: [203.0.113.0/24]\n  location_group_id: [a, b]",     // not a string
+	} {
+		var n yaml.Node
+		if err := yaml.Unmarshal([]byte(bad), &n); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := parseRouteLocations(n.Content[0]); err == nil {
+			t.Errorf("accepted %q", bad)
+		}
+	}
+}
+
+func TestRouteTable_Lookup(t *testing.T) {
+	var n yaml.Node
+	if err := yaml.Unmarshal([]byte(`
+- cidr: [203.0.113.0/24, "2001:db8::/32"]
+  location_query: "country:Japan"
+- cidr: [203.0.113.128/25]
+  location_query: "country:Germany"
+- cidr: [203.0.113.0/24]
+  location_query: "country:France"
+`), &n); err != nil {
+		t.Fatal(err)
+	}
+	routes, err := parseRouteLocations(n.Content[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	table := newRouteTable(routes)
+	for dst, want := range map[string]int{
+		"203.0.113.1":   0, // the earlier of two equal prefixes
+		"203.0.113.200": 1, // the more specific prefix
+		"2001:db8::1":   0,
+		"198.51.100.1":  -1,
+		"2001:db9::1":   -1,
+	} {
+		if got := table.lookup(packetTo(dst)); got != want {
+			t.Errorf("lookup(%s) = %d, want %d", dst, got, want)
+		}
+	}
+	for _, pkt := range [][]byte{nil, {0x45, 0}, packetTo("2001:db8::1")[:30], {0x10}} {
+		if got := table.lookup(pkt); got != -1 {
+			t.Errorf("lookup(%v) = %d, want -1", pkt, got)
+		}
+	}
+	if got := newRouteTable(nil).lookup(packetTo("203.0.113.1")); got != -1 {
+		t.Errorf("empty table matched route %d", got)
+	}
+}
+
+func TestSharedRouteLocations(t *testing.T) {
+	var n yaml.Node
+	if err := yaml.Unmarshal([]byte(`
+- cidr: [203.0.113.0/24]
+  location_query: "country:Japan"
+- cidr: [198.51.100.0/24]
+  location_query: "country:Germany"
+- cidr: [192.0.2.0/24]
+  location_query: "country:Japan"
+`), &n); err != nil {
+		t.Fatal(err)
+	}
+	routes, err := parseRouteLocations(n.Content[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := fmt.Sprint(sharedRouteLocations(routes)); got != "[0 1 0]" {
+		t.Fatalf("sharedRouteLocations = %s, want [0 1 0]", got)
+	}
+}
@@ -0,0 +1,448 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/idna"
+	"gopkg.in/yaml.v3"
+)
+
+// routeAction is what the SOCKS proxy does with a destination.
+type routeAction string
+
+const (
+	actionVPN    routeAction = "vpn"    // dial through the VPN interface
+	actionDirect routeAction = "direct" // dial through the system default route
+	actionBlock  routeAction = "block"  // refuse the request
+)
+
+// routeRequest describes one CONNECT or UDP ASSOCIATE datagram destination.
+type routeRequest struct {
+	Network string // "tcp" or "udp"
+	Host    string // requested (or sniffed) name; "" for IP-literal requests
+	IP      net.IP // resolved or literal destination address; may be nil
+	Port    int
+}
+
+// portRange is an inclusive destination port range.
+type portRange struct{ lo, hi int }
+
+// routeRule is one entry of the ordered `rules:` section. Every matcher that is set
+// must match (AND); each matcher matches when any of its entries does (OR).
+type routeRule struct {
+	Name      string
+	Action    routeAction
+	Domains   []string         // suffix match on IDNA-normalized names
+	Exact     []string         // exact match on IDNA-normalized names
+	Wildcards []*regexp.Regexp // shell-style patterns (* and ?) on IDNA-normalized names
+	Regexps   []*regexp.Regexp // matched against the ASCII and the Unicode form of the name
+	CIDRs     []*net.IPNet
+	Ports     []portRange
+	Network   string // "", "tcp" or "udp"
+
+	index int    // 1-based position in the rule list
+	desc  string // matcher summary for logs
+}
+
+// matches reports whether req satisfies every matcher of r. req.Host must already be
+// normalized (see normalizeHost). Name matchers never match IP-literal requests.
+func (r *routeRule) matches(req routeRequest) bool {
+	return r.match(req, true)
+}
+
+// match is matches with an option to ignore the cidr matcher.
+func (r *routeRule) match(req routeRequest, checkAddr bool) bool {
+	if r.Network != "" && r.Network != req.Network {
+		return false
+	}
+	if len(r.Ports) > 0 && !portInRanges(req.Port, r.Ports) {
+		return false
+	}
+	if checkAddr && len(r.CIDRs) > 0 {
+		if req.IP == nil || !ipInNets(req.IP, r.CIDRs) {
+			return false
+		}
+	}
+	if len(r.Domains) == 0 && len(r.Exact) == 0 && len(r.Wildcards) == 0 && len(r.Regexps) == 0 {
+		return true
+	}
+	if req.Host == "" {
+		return false
+	}
+	host := req.Host
+	if len(r.Domains) > 0 && !domainMatches(host, r.Domains) {
+		return false
+	}
+	if len(r.Exact) > 0 && !slices.Contains(r.Exact, host) {
+		return false
+	}
+	if len(r.Wildcards) > 0 && !anyRegexpMatches(r.Wildcards, host) {
+		return false
+	}
+	if len(r.Regexps) > 0 {
+		unicode, err := idna.Lookup.ToUnicode(host)
+		if err != nil {
+			unicode = host
+		}
+		if !anyRegexpMatches(r.Regexps, host) && !anyRegexpMatches(r.Regexps, unicode) {
+			return false
+		}
+	}
+	return true
+}
+
+// String identifies the rule in logs, e.g. `rule 2 "corp" (domain=corp.example) -> direct`.
+func (r *routeRule) String() string {
+	if r == nil {
+		return "default"
+	}
+	name := ""
+	if r.Name != "" {
+		name = fmt.Sprintf(" %q", r.Name)
+	}
+	return fmt.Sprintf("rule %d%s (%s) -> %s", r.index, name, r.desc, r.Action)
+}
+
+// ruleSet is the ordered rule list used by the SOCKS proxy. The first matching rule
+// wins; when none matches the request goes through the VPN.
+type ruleSet struct {
+	rules []*routeRule
+}
+
+// newRuleSet combines the config-file rules with the legacy --domain/--exclude_domain
+// lists, which are appended as equivalent rules: excluded names go direct, allowed
+// names use the VPN and, when an allowlist is set, everything else goes direct.
+func newRuleSet(rules []*routeRule, allowDomains, excludeDomains []string) *ruleSet {
+	rs := &ruleSet{rules: append([]*routeRule(nil), rules...)}
+	add := func(r *routeRule) {
+		r.index = len(rs.rules) + 1
+		r.desc = describeRule(r)
+		rs.rules = append(rs.rules, r)
+	}
+	if ex := normalizeDomains(excludeDomains); len(ex) > 0 {
+		add(&routeRule{Name: "exclude_domain", Action: actionDirect, Domains: ex})
+	}
+	if allow := normalizeDomains(allowDomains); len(allow) > 0 {
+		add(&routeRule{Name: "domain", Action: actionVPN, Domains: allow})
+		add(&routeRule{Name: "domain (not listed)", Action: actionDirect})
+	}
+	return rs
+}
+
+// decide returns the action for req and the rule that produced it (nil for the default).
+func (rs *ruleSet) decide(req routeRequest) (routeAction, *routeRule) {
+	req.Host = normalizeHost(req.Host)
+	if rs != nil {
+		for _, r := range rs.rules {
+			if r.matches(req) {
+				return r.Action, r
+			}
+		}
+	}
+	return actionVPN, nil
+}
+
+// decideByName evaluates rs for a name whose address is not known yet. It stops at the
+// first rule that matches on name, port and network alone. known is false when a rule
+// with a cidr matcher would be reached first, since its outcome depends on the address;
+// the returned action is then vpn.
+func (rs *ruleSet) decideByName(req routeRequest) (action routeAction, rule *routeRule, known bool) {
+	req.Host = normalizeHost(req.Host)
+	req.IP = nil
+	if rs != nil {
+		for _, r := range rs.rules {
+			if !r.match(req, false) {
+				continue
+			}
+			if len(r.CIDRs) > 0 {
+				return actionVPN, nil, false
+			}
+			return r.Action, r, true
+		}
+	}
+	return actionVPN, nil, true
+}
+
+// ---------------------------------------------------------------------------
+// Config file `rules:` section
+// ---------------------------------------------------------------------------
+
+// stringList accepts either a YAML scalar or a sequence of scalars. Scalars may hold
+// comma-separated values.
+type stringList []string
+
+func (l *stringList) UnmarshalYAML(n *yaml.Node) error {
+	switch n.Kind {
+	case yaml.ScalarNode:
+		*l = splitCSV(n.Value)
+	case yaml.SequenceNode:
+		var out []string
+		for _, c := range n.Content {
+			if c.Kind != yaml.ScalarNode {
+				return fmt.Errorf("line %d: list items must be scalars", c.Line)
+			}
+			out = append(out, splitCSV(c.Value)...)
+		}
+		*l = out
+	default:
+		return fmt.Errorf("line %d: expected a value or a list", n.Line)
+	}
+	return nil
+}
+
+// ruleSpec is the YAML form of one rule.
+type ruleSpec struct {
+	Name     string     `yaml:"name"`
+	Action   string     `yaml:"action"`
+	Domain   stringList `yaml:"domain"`
+	Exact    stringList `yaml:"exact"`
+	Wildcard stringList `yaml:"wildcard"`
+	Regex    stringList `yaml:"regex"`
+	CIDR     stringList `yaml:"cidr"`
+	Port     stringList `yaml:"port"`
+	Network  string     `yaml:"network"`
+}
+
+// parseRouteRules compiles the `rules:` sequence of the config file.
+//
+//	rules:
+//	  - name: corp
+//	    domain: [corp.example]      # suffix match
+//	    action: direct
+//	  - cidr: 10.0.0.0/8
+//	    port: "22,8000-8100"
+//	    network: tcp
+//	    action: block
+func parseRouteRules(n *yaml.Node) ([]*routeRule, error) {
+	if n.Kind != yaml.SequenceNode {
+		return nil, fmt.Errorf("rules: expected a list (line %d)", n.Line)
+	}
+	rules := make([]*routeRule, 0, len(n.Content))
+	for i, item := range n.Content {
+		if err := checkRuleKeys(item); err != nil {
+			return nil, fmt.Errorf("rules[%d]: %w", i, err)
+		}
+		var spec ruleSpec
+		if err := item.Decode(&spec); err != nil {
+			return nil, fmt.Errorf("rules[%d]: %w", i, err)
+		}
+		r, err := compileRule(spec)
+		if err != nil {
+			return nil, fmt.Errorf("rules[%d] (line %d): %w", i, item.Line, err)
+		}
+		r.index = i + 1
+		r.desc = describeRule(r)
+		rules = append(rules, r)
+	}
+	return rules, nil
+}
+
+// checkRuleKeys rejects unknown keys so a typo does not silently widen a rule.
+func checkRuleKeys(n *yaml.Node) error {
+	if n.Kind != yaml.MappingNode {
+		return fmt.Errorf("expected a mapping (line %d)", n.Line)
+	}
+	known := map[string]bool{"name": true, "action": true, "domain": true, "exact": true, "wildcard": true, "regex": true, "cidr": true, "port": true, "network": true}
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		if k := n.Content[i].Value; !known[k] {
+			return fmt.Errorf("unknown key %q (line %d)", k, n.Content[i].Line)
+		}
+	}
+	return nil
+}
+
+func compileRule(spec ruleSpec) (*routeRule, error) {
+	r := &routeRule{Name: spec.Name}
+	switch a := routeAction(strings.ToLower(strings.TrimSpace(spec.Action))); a {
+	case actionVPN, actionDirect, actionBlock:
+		r.Action = a
+	case "":
+		return nil, fmt.Errorf("action is required (vpn, direct or block)")
+	default:
+		return nil, fmt.Errorf("unknown action %q (use vpn, direct or block)", spec.Action)
+	}
+	r.Domains = normalizeDomains(spec.Domain)
+	r.Exact = normalizeDomains(spec.Exact)
+	for _, w := range spec.Wildcard {
+		re, err := compileWildcard(w)
+		if err != nil {
+			return nil, fmt.Errorf("wildcard %q: %w", w, err)
+		}
+		r.Wildcards = append(r.Wildcards, re)
+	}
+	for _, expr := range spec.Regex {
+		re, err := regexp.Compile("(?i)" + expr)
+		if err != nil {
+			return nil, fmt.Errorf("regex %q: %w", expr, err)
+		}
+		r.Regexps = append(r.Regexps, re)
+	}
+	for _, c := range spec.CIDR {
+		n := parseCIDRHost(c)
+		if n == nil {
+			return nil, fmt.Errorf("cidr %q is not an IP address or CIDR", c)
+		}
+		r.CIDRs = append(r.CIDRs, n)
+	}
+	for _, p := range spec.Port {
+		pr, err := parsePortRange(p)
+		if err != nil {
+			return nil, err
+		}
+		r.Ports = append(r.Ports, pr)
+	}
+	switch nw := strings.ToLower(strings.TrimSpace(spec.Network)); nw {
+	case "", "tcp", "udp":
+		r.Network = nw
+	default:
+		return nil, fmt.Errorf("unknown network %q (use tcp or udp)", spec.Network)
+	}
+	return r, nil
+}
+
+// parsePortRange parses "443" or "8000-8100".
+func parsePortRange(s string) (portRange, error) {
+	s = strings.TrimSpace(s)
+	lo, hi, isRange := strings.Cut(s, "-")
+	a, errA := strconv.Atoi(strings.TrimSpace(lo))
+	b := a
+	var errB error
+	if isRange {
+		b, errB = strconv.Atoi(strings.TrimSpace(hi))
+	}
+	if errA != nil || errB != nil || a < 0 || b > 65535 || a > b {
+		return portRange{}, fmt.Errorf("port %q is not a port or range like 8000-8100", s)
+	}
+	return portRange{lo: a, hi: b}, nil
+}
+
+// compileWildcard turns a shell-style name pattern into an anchored regexp.
+// `*` matches any run of characters (including dots), `?` a single character.
+func compileWildcard(pattern string) (*regexp.Regexp, error) {
+	p := normalizeHost(pattern)
+	if p == "" {
+		return nil, fmt.Errorf("empty pattern")
+	}
+	var b strings.Builder
+	b.WriteString("^")
+	for _, r := range p {
+		switch r {
+		case '*':
+			b.WriteString(".*")
+		case '?':
+			b.WriteString(".")
+		default:
+			b.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	b.WriteString("$")
+	return regexp.Compile(b.String())
+}
+
+// describeRule summarises the matchers of r for logs.
+func describeRule(r *routeRule) string {
+	var parts []string
+	if len(r.Domains) > 0 {
+		parts = append(parts, "domain="+strings.Join(r.Domains, ","))
+	}
+	if len(r.Exact) > 0 {
+		parts = append(parts, "exact="+strings.Join(r.Exact, ","))
+	}
+	if len(r.Wildcards) > 0 {
+		parts = append(parts, fmt.Sprintf("wildcard=%d", len(r.Wildcards)))
+	}
+	if len(r.Regexps) > 0 {
+		parts = append(parts, fmt.Sprintf("regex=%d", len(r.Regexps)))
+	}
+	if len(r.CIDRs) > 0 {
+		cidrs := make([]string, 0, len(r.CIDRs))
+		for _, n := range r.CIDRs {
+			cidrs = append(cidrs, n.String())
+		}
+		parts = append(parts, "cidr="+strings.Join(cidrs, ","))
+	}
+	if len(r.Ports) > 0 {
+		ports := make([]string, 0, len(r.Ports))
+		for _, p := range r.Ports {
+			if p.lo == p.hi {
+				ports = append(ports, strconv.Itoa(p.lo))
+			} else {
+				ports = append(ports, fmt.Sprintf("%d-%d", p.lo, p.hi))
+			}
+		}
+		parts = append(parts, "port="+strings.Join(ports, ","))
+	}
+	if r.Network != "" {
+		parts = append(parts, "network="+r.Network)
+	}
+	if len(parts) == 0 {
+		return "any"
+	}
+	return strings.Join(parts, " ")
+}
+
+// ---------------------------------------------------------------------------
+// Helpers
+// ---------------------------------------------------------------------------
+
+// normalizeHost lower-cases name, drops a trailing dot and converts internationalized
+// labels to their ASCII (punycode) form so "bücher.example" and "xn--bcher-kva.example"
+// compare equal. Labels that cannot be converted (e.g. wildcards) are kept as-is.
+func normalizeHost(name string) string {
+	name = strings.ToLower(strings.TrimSuffix(strings.TrimSpace(name), "."))
+	if name == "" {
+		return ""
+	}
+	if ascii, err := idna.Lookup.ToASCII(name); err == nil {
+		return ascii
+	}
+	labels := strings.Split(name, ".")
+	for i, l := range labels {
+		if ascii, err := idna.Lookup.ToASCII(l); err == nil {
+			labels[i] = ascii
+		}
+	}
+	return strings.Join(labels, ".")
+}
+
+func normalizeDomains(list []string) []string {
+	out := make([]string, 0, len(list))
+	for _, d := range list {
+		if n := normalizeHost(d); n != "" {
+			out = append(out, n)
+		}
+	}
+	return out
+}
+
+func portInRanges(port int, ranges []portRange) bool {
+	for _, r := range ranges {
+		if port >= r.lo && port <= r.hi {
+			return true
+		}
+	}
+	return false
+}
+
+func ipInNets(ip net.IP, nets []*net.IPNet) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func anyRegexpMatches(res []*regexp.Regexp, s string) bool {
+	for _, re := range res {
+		if re.MatchString(s) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/docopt/docopt-go"
+	"gopkg.in/yaml.v3"
+)
+
+// mustParseRules parses the `rules:` section of a YAML document.
+func mustParseRules(t *testing.T, doc string) []*routeRule {
+	t.Helper()
+	var root struct {
+		Rules yaml.Node `yaml:"rules"`
+	}
+	if err := yaml.Unmarshal([]byte(doc), &root); err != nil {
+		t.Fatalf("yaml: %v", err)
+	}
+	rules, err := parseRouteRules(&root.Rules)
+	if err != nil {
+		t.Fatalf("parseRouteRules: %v", err)
+	}
+	return rules
+}
+
+func TestRuleSet_Decide(t *testing.T) {
+	rules := mustParseRules(t, `
+rules:
+  - name: ads
+    regex: '^ads?[0-9]*\.'
+    action: block
+  - exact: login.corp.example
+    action: vpn
+  - domain: corp.example
+    action: direct
+  - wildcard: "*.cdn.*.net"
+    action: direct
+  - domain: bücher.example
+    action: direct
+  - cidr: [10.0.0.0/8, "2001:db8::/32"]
+    port: "22, 8000-8100"
+    network: tcp
+    action: block
+  - network: udp
+    port: 443
+    action: block
+`)
+	rs := newRuleSet(rules, nil, nil)
+	cases := []struct {
+		name string
+		req  routeRequest
+		want routeAction
+		rule int // 1-based index; 0 means default
+	}{
+		{"regex", routeRequest{Network: "tcp", Host: "ads1.tracker.test", Port: 443}, actionBlock, 1},
+		{"exact before suffix", routeRequest{Network: "tcp", Host: "LOGIN.corp.example.", Port: 443}, actionVPN, 2},
+		{"suffix", routeRequest{Network: "tcp", Host: "git.corp.example", Port: 443}, actionDirect, 3},
+		{"wildcard", routeRequest{Network: "tcp", Host: "img.cdn.eu.net", Port: 443}, actionDirect, 4},
+		{"idna unicode", routeRequest{Network: "tcp", Host: "www.bücher.example", Port: 443}, actionDirect, 5},
+		{"idna punycode", routeRequest{Network: "tcp", Host: "www.xn--bcher-kva.example", Port: 443}, actionDirect, 5},
+		{"cidr and port", routeRequest{Network: "tcp", IP: net.ParseIP("10.1.2.3"), Port: 8080}, actionBlock, 6},
+		{"cidr v6", routeRequest{Network: "tcp", IP: net.ParseIP("2001:db8::1"), Port: 22}, actionBlock, 6},
+		{"cidr wrong port", routeRequest{Network: "tcp", IP: net.ParseIP("10.1.2.3"), Port: 443}, actionVPN, 0},
+		{"cidr wrong network", routeRequest{Network: "udp", IP: net.ParseIP("10.1.2.3"), Port: 22}, actionVPN, 0},
+		{"udp quic", routeRequest{Network: "udp", IP: net.ParseIP("1.1.1.1"), Port: 443}, actionBlock, 7},
+		{"ip literal never matches names", routeRequest{Network: "tcp", IP: net.ParseIP("192.0.2.1"), Port: 443}, actionVPN, 0},
+	}
+	for _, tc := range cases {
+		got, rule := rs.decide(tc.req)
+		idx := 0
+		if rule != nil {
+			idx = rule.index
+		}
+		if got != tc.want || idx != tc.rule {
+			t.Errorf("%s: got %s by %v, want %s by rule %d", tc.name, got, rule, tc.want, tc.rule)
+		}
+	}
+}
+
+func TestRuleSet_LegacyDomainLists(t *testing.T) {
+	rs := newRuleSet(nil, []string{"example.com"}, []string{"direct.example.com"})
+	check := func(host string, want routeAction) {
+		t.Helper()
+		if got, rule := rs.decide(routeRequest{Network: "tcp", Host: host, Port: 443}); got != want {
+			t.Errorf("%s: got %s by %v, want %s", host, got, rule, want)
+		}
+	}
+	check("api.example.com", actionVPN)
+	check("x.direct.example.com", actionDirect)
+	check("other.test", actionDirect)
+	if got, _ := rs.decide(routeRequest{Network: "tcp", IP: net.ParseIP("192.0.2.1"), Port: 443}); got != actionDirect {
+		t.Errorf("IP literal with an allowlist should go direct, got %s", got)
+	}
+
+	// Without lists everything uses the VPN.
+	if got, rule := newRuleSet(nil, nil, nil).decide(routeRequest{Network: "tcp", Host: "a.test"}); got != actionVPN || rule != nil {
+		t.Errorf("empty rule set: got %s by %v", got, rule)
+	}
+}
+
+func TestRuleSet_ConfigRulesPrecedeLegacyLists(t *testing.T) {
+	rules := mustParseRules(t, "rules:\n  - domain: example.com\n    action: block\n")
+	rs := newRuleSet(rules, []string{"example.com"}, nil)
+	if got, rule := rs.decide(routeRequest{Network: "tcp", Host: "example.com"}); got != actionBlock || rule.index != 1 {
+		t.Fatalf("got %s by %v", got, rule)
+	}
+	if s := rs.rules[1].String(); s != `rule 2 "domain" (domain=example.com) -> vpn` {
+		t.Fatalf("legacy rule description: %s", s)
+	}
+}
+
+func TestParseRouteRules_Errors(t *testing.T) {
+	for doc, want := range map[string]string{
+		"rules: {}\n":                                      "expected a list",
+		"rules:\n  - domain: a.test\n":                     "action is required",
+		"rules:\n  - domain: a.test\n    action: drop\n":   `unknown action "drop"`,
+		"rules:\n  - domian: a.test\n    action: vpn\n":    `unknown key "domian"`,
+		"rules:\n  - regex: '('\n    action: vpn\n":        "regex",
+		"rules:\n  - cidr: 10.0.0.0/33\n    action: vpn\n": "not an IP address or CIDR",
+		"rules:\n  - port: 90-80\n    action: vpn\n":       "not a port or range",
+		"rules:\n  - network: icmp\n    action: vpn\n":     `unknown network "icmp"`,
+	} {
+		var root struct {
+			Rules yaml.Node `yaml:"rules"`
+		}
+		if err := yaml.Unmarshal([]byte(doc), &root); err != nil {
+			t.Fatalf("yaml: %v", err)
+		}
+		_, err := parseRouteRules(&root.Rules)
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%q: got %v, want error containing %q", doc, err, want)
+		}
+	}
+}
+
+func TestResolveConfig_RulesSection(t *testing.T) {
+	path := writeConfig(t, "mtu: 1380\nrules:\n  - domain: corp.example\n    action: direct\n")
+	rc, err := resolveConfigWith(docopt.Opts{"--config": path}, fakeEnv(nil))
+	if err != nil {
+		t.Fatalf("resolveConfig: %v", err)
+	}
+	if len(rc.VPN.Rules) != 1 || len(rc.SOCKS.Rules) != 1 || rc.VPN.Rules[0].Action != actionDirect {
+		t.Fatalf("rules not loaded: %+v", rc.VPN.Rules)
+	}
+
+	bad := writeConfig(t, "rules:\n  - domain: corp.example\n")
+	if _, err := resolveConfigWith(docopt.Opts{"--config": bad}, fakeEnv(nil)); err == nil || !strings.Contains(err.Error(), "action is required") {
+		t.Fatalf("expected rules error, got %v", err)
+	}
+}
+
+func TestRuleSet_DecideByName(t *testing.T) {
+	rules := mustParseRules(t, `
+rules:
+  - domain: blocked.test
+    action: block
+  - cidr: 10.0.0.0/8
+    domain: mixed.test
+    action: direct
+  - domain: direct.test
+    action: direct
+`)
+	rs := newRuleSet(rules, nil, []string{"excluded.test"})
+	cases := []struct {
+		host  string
+		want  routeAction
+		known bool
+	}{
+		{"www.blocked.test", actionBlock, true},
+		{"mixed.test", actionVPN, false}, // depends on the resolved address
+		{"a.direct.test", actionDirect, true},
+		{"a.excluded.test", actionDirect, true},
+		{"other.test", actionVPN, true},
+	}
+	for _, tc := range cases {
+		got, _, known := rs.decideByName(routeRequest{Network: "tcp", Host: tc.host, Port: 443})
+		if got != tc.want || known != tc.known {
+			t.Errorf("%s: got %s known=%v, want %s known=%v", tc.host, got, known, tc.want, tc.known)
+		}
+	}
+}
@@ -0,0 +1,540 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// Shadowsocks AEAD methods (--shadowsocks_method).
+const (
+	shadowsocksChaCha20 = "chacha20-ietf-poly1305"
+	shadowsocksAES256   = "aes-256-gcm"
+)
+
+const (
+	// shadowsocksMaxPayload is the largest payload of one TCP chunk (SIP004).
+	shadowsocksMaxPayload = 0x3fff
+	// shadowsocksMaxUDPClients bounds the client addresses the UDP relay tracks at once.
+	shadowsocksMaxUDPClients = 1024
+	// saltFilterSize is how many salts each generation of a saltFilter holds.
+	saltFilterSize = 50000
+)
+
+var (
+	// errShadowsocksReplay reports a stream whose salt was seen before.
+	errShadowsocksReplay = errors.New("replayed salt")
+	// errShadowsocksChunk reports a chunk longer than shadowsocksMaxPayload.
+	errShadowsocksChunk = errors.New("chunk too long")
+)
+
+// shadowsocksOptions configures the server started by startShadowsocks.
+type shadowsocksOptions struct {
+	ListenAddr string // TCP and UDP
+	Method     string // shadowsocksChaCha20 or shadowsocksAES256
+	Password   string
+	Socks      socksOptions // rules, DNS, limits, allowlist and VPN binding, as for SOCKS
+}
+
+// shadowsocksCipher holds the master key of one method and password and derives the
+// per-session AEADs from it.
+type shadowsocksCipher struct {
+	key     []byte
+	newAEAD func(key []byte) (cipher.AEAD, error)
+	salts   *saltFilter // salts of TCP streams already seen
+}
+
+func newShadowsocksCipher(method, password string) (*shadowsocksCipher, error) {
+	c := &shadowsocksCipher{salts: &saltFilter{}}
+	switch method {
+	case shadowsocksChaCha20:
+		c.newAEAD = chacha20poly1305.New
+	case shadowsocksAES256:
+		c.newAEAD = func(key []byte) (cipher.AEAD, error) {
+			block, err := aes.NewCipher(key)
+			if err != nil {
+				return nil, err
+			}
+			return cipher.NewGCM(block)
+		}
+	default:
+		return nil, fmt.Errorf("unknown shadowsocks method %q", method)
+	}
+	if password == "" {
+		return nil, fmt.Errorf("shadowsocks needs a password")
+	}
+	c.key = evpBytesToKey(password, 32)
+	return c, nil
+}
+
+// evpBytesToKey derives an n-byte master key from password the way OpenSSL's
+// EVP_BytesToKey does with MD5 and no salt, as every Shadowsocks implementation does.
+func evpBytesToKey(password string, n int) []byte {
+	var key, prev []byte
+	for len(key) < n {
+		h := md5.New()
+		h.Write(prev)
+		h.Write([]byte(password))
+		prev = h.Sum(nil)
+		key = append(key, prev...)
+	}
+	return key[:n]
+}
+
+// saltSize is the length of the salt that starts every stream and datagram.
+func (c *shadowsocksCipher) saltSize() int { return len(c.key) }
+
+// aead returns the AEAD for a session: its subkey is HKDF-SHA1 of the master key with
+// salt and the info "ss-subkey".
+func (c *shadowsocksCipher) aead(salt []byte) (cipher.AEAD, error) {
+	subkey, err := hkdf.Key(sha1.New, c.key, salt, "ss-subkey", len(c.key))
+	if err != nil {
+		return nil, err
+	}
+	return c.newAEAD(subkey)
+}
+
+// openPacket decrypts a UDP datagram: salt, then the sealed address and payload with
+// a zero nonce.
+func (c *shadowsocksCipher) openPacket(p []byte) ([]byte, error) {
+	if len(p) < c.saltSize() {
+		return nil, io.ErrUnexpectedEOF
+	}
+	aead, err := c.aead(p[:c.saltSize()])
+	if err != nil {
+		return nil, err
+	}
+	return aead.Open(nil, make([]byte, aead.NonceSize()), p[c.saltSize():], nil)
+}
+
+// sealPacket encrypts plain as a UDP datagram with a fresh salt.
+func (c *shadowsocksCipher) sealPacket(plain []byte) ([]byte, error) {
+	salt := make([]byte, c.saltSize())
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	aead, err := c.aead(salt)
+	if err != nil {
+		return nil, err
+	}
+	return aead.Seal(salt, make([]byte, aead.NonceSize()), plain, nil), nil
+}
+
+// saltFilter remembers recently seen salts, so a recorded stream cannot be replayed
+// against the server. It keeps two generations of up to saltFilterSize salts.
+type saltFilter struct {
+	mu         sync.Mutex
+	cur, older map[string]struct{}
+}
+
+// add records salt and reports whether it is new.
+func (f *saltFilter) add(salt []byte) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	k := string(salt)
+	if _, ok := f.cur[k]; ok {
+		return false
+	}
+	if _, ok := f.older[k]; ok {
+		return false
+	}
+	if f.cur == nil || len(f.cur) >= saltFilterSize {
+		f.older, f.cur = f.cur, make(map[string]struct{}, saltFilterSize)
+	}
+	f.cur[k] = struct{}{}
+	return true
+}
+
+// shadowsocksConn is the plaintext side of a Shadowsocks TCP stream (SIP004): each
+// direction starts with a salt, followed by chunks of a sealed 2-byte length and a
+// sealed payload, with a little-endian nonce counted up after every seal.
+type shadowsocksConn struct {
+	net.Conn
+	ciph *shadowsocksCipher
+
+	r      cipher.AEAD // nil until the client's salt has been read
+	rNonce []byte
+	rBuf   []byte // decrypted payload not yet returned by Read
+	rRaw   []byte // room for one sealed chunk
+	rSalt  []byte // checked against the salt filter once the first chunk opens
+
+	w      cipher.AEAD // nil until the first Write
+	wNonce []byte
+}
+
+func (c *shadowsocksConn) Read(p []byte) (int, error) {
+	if len(c.rBuf) == 0 {
+		if err := c.readChunk(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, c.rBuf)
+	c.rBuf = c.rBuf[n:]
+	return n, nil
+}
+
+// readChunk decrypts the next chunk into rBuf, reading the salt first on a new stream.
+func (c *shadowsocksConn) readChunk() error {
+	if c.r == nil {
+		salt := make([]byte, c.ciph.saltSize())
+		if _, err := io.ReadFull(c.Conn, salt); err != nil {
+			return err
+		}
+		aead, err := c.ciph.aead(salt)
+		if err != nil {
+			return err
+		}
+		c.r, c.rNonce, c.rSalt = aead, make([]byte, aead.NonceSize()), salt
+	}
+	overhead := c.r.Overhead()
+	if c.rRaw == nil {
+		c.rRaw = make([]byte, shadowsocksMaxPayload+overhead)
+	}
+	buf := c.rRaw[:2+overhead]
+	if _, err := io.ReadFull(c.Conn, buf); err != nil {
+		return err
+	}
+	size, err := c.open(buf)
+	if err != nil {
+		return err
+	}
+	if c.rSalt != nil {
+		if !c.ciph.salts.add(c.rSalt) {
+			return errShadowsocksReplay
+		}
+		c.rSalt = nil
+	}
+	n := int(binary.BigEndian.Uint16(size))
+	if n > shadowsocksMaxPayload {
+		return errShadowsocksChunk
+	}
+	buf = buf[:n+overhead]
+	if _, err := io.ReadFull(c.Conn, buf); err != nil {
+		return err
+	}
+	c.rBuf, err = c.open(buf)
+	return err
+}
+
+func (c *shadowsocksConn) open(sealed []byte) ([]byte, error) {
+	plain, err := c.r.Open(sealed[:0], c.rNonce, sealed, nil)
+	incrementNonce(c.rNonce)
+	return plain, err
+}
+
+func (c *shadowsocksConn) Write(p []byte) (int, error) {
+	var out []byte
+	if c.w == nil {
+		salt := make([]byte, c.ciph.saltSize())
+		if _, err := rand.Read(salt); err != nil {
+			return 0, err
+		}
+		aead, err := c.ciph.aead(salt)
+		if err != nil {
+			return 0, err
+		}
+		// Our own salts go into the filter too, so a client cannot reflect this
+		// stream back at the server (SIP007).
+		c.ciph.salts.add(salt)
+		c.w, c.wNonce, out = aead, make([]byte, aead.NonceSize()), salt
+	}
+	for rest := p; len(rest) > 0; {
+		chunk := rest[:min(len(rest), shadowsocksMaxPayload)]
+		rest = rest[len(chunk):]
+		out = c.w.Seal(out, c.wNonce, binary.BigEndian.AppendUint16(nil, uint16(len(chunk))), nil)
+		incrementNonce(c.wNonce)
+		out = c.w.Seal(out, c.wNonce, chunk, nil)
+		incrementNonce(c.wNonce)
+	}
+	if _, err := c.Conn.Write(out); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// CloseWrite half-closes the underlying connection, as relay expects of TCP.
+func (c *shadowsocksConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
+// incrementNonce counts a little-endian nonce up by one.
+func incrementNonce(nonce []byte) {
+	for i := range nonce {
+		nonce[i]++
+		if nonce[i] != 0 {
+			return
+		}
+	}
+}
+
+// startShadowsocks starts the Shadowsocks server configured by opts and returns a stop
+// function. TCP and UDP share opts.ListenAddr.
+func startShadowsocks(ctx context.Context, opts shadowsocksOptions) (func() error, error) {
+	ciph, err := newShadowsocksCipher(opts.Method, opts.Password)
+	if err != nil {
+		return nil, err
+	}
+	srv, err := newSocksServer(opts.Socks)
+	if err != nil {
+		return nil, err
+	}
+	lc := net.ListenConfig{KeepAlive: socksKeepAlive}
+	ln, err := lc.Listen(ctx, "tcp", opts.ListenAddr)
+	if err != nil {
+		return nil, err
+	}
+	host, _, _ := net.SplitHostPort(opts.ListenAddr)
+	port := strconv.Itoa(ln.Addr().(*net.TCPAddr).Port)
+	pc, err := lc.ListenPacket(ctx, "udp", net.JoinHostPort(host, port))
+	if err != nil {
+		_ = ln.Close()
+		return nil, err
+	}
+	udp := newShadowsocksUDP(ctx, srv, ciph, pc, opts.Socks.AllowSrc, opts.Socks.Stats)
+	stopTCP := srv.serve(ctx, ln, opts.Socks, func(ctx context.Context, c net.Conn, srv *socksServer) {
+		handleShadowsocksConn(ctx, c, srv, ciph)
+	})
+	return func() error {
+		udp.close()
+		return stopTCP()
+	}, nil
+}
+
+// handleShadowsocksConn reads the destination address that starts a Shadowsocks
+// stream and serves it as a SOCKS CONNECT.
+func handleShadowsocksConn(ctx context.Context, c net.Conn, srv *socksServer, ciph *shadowsocksCipher) {
+	defer func() { _ = c.Close() }()
+	_ = c.SetDeadline(time.Now().Add(socksHandshakeTimeout))
+
+	sc := &shadowsocksConn{Conn: c, ciph: ciph}
+	req := &socksRequest{cmd: 1}
+	var atyp [1]byte
+	_, err := io.ReadFull(sc, atyp[:])
+	if err == nil {
+		err = readSocksAddr(sc, atyp[0], req)
+	}
+	if err != nil {
+		if srv.debug {
+			fmt.Printf("[shadowsocks] %s: %v\n", c.RemoteAddr(), err)
+		}
+		// A wrong key or a replayed salt gets no reaction of its own: the connection
+		// stays open until the handshake deadline, as one still sending would.
+		_, _ = io.Copy(io.Discard, c)
+		return
+	}
+	if srv.debug {
+		fmt.Printf("[shadowsocks] %s -> %s\n", c.RemoteAddr(), net.JoinHostPort(req.host, strconv.Itoa(req.port)))
+	}
+	serveRequest(ctx, sc, srv, req)
+}
+
+// shadowsocksUDP relays Shadowsocks UDP datagrams. Each client address gets its own
+// udpAssociation on the shared socket, with its own mappings and queue.
+type shadowsocksUDP struct {
+	srv      *socksServer
+	ciph     *shadowsocksCipher
+	pc       net.PacketConn
+	allowSrc []*net.IPNet
+	stats    *socksStats
+
+	mu      sync.Mutex
+	clients map[string]*shadowsocksUDPClient
+	wg      sync.WaitGroup
+	cancel  context.CancelFunc
+}
+
+type shadowsocksUDPClient struct {
+	a          *udpAssociation
+	queue      chan shadowsocksDatagram
+	lastActive atomic.Int64 // unix nanoseconds
+	cancel     context.CancelFunc
+}
+
+// shadowsocksDatagram is a decrypted client datagram waiting to be forwarded.
+type shadowsocksDatagram struct {
+	ip      net.IP // nil when host is a name
+	host    string
+	port    int
+	payload []byte
+}
+
+func newShadowsocksUDP(ctx context.Context, srv *socksServer, ciph *shadowsocksCipher, pc net.PacketConn, allowSrc []*net.IPNet, stats *socksStats) *shadowsocksUDP {
+	ctx, cancel := context.WithCancel(ctx)
+	u := &shadowsocksUDP{srv: srv, ciph: ciph, pc: pc, allowSrc: allowSrc, stats: stats, clients: map[string]*shadowsocksUDPClient{}, cancel: cancel}
+	u.wg.Add(2)
+	go func() {
+		defer u.wg.Done()
+		u.readLoop(ctx)
+	}()
+	go func() {
+		defer u.wg.Done()
+		u.expireLoop(ctx)
+	}()
+	return u
+}
+
+// close stops the relay and closes every client's mappings.
+func (u *shadowsocksUDP) close() {
+	u.cancel()
+	_ = u.pc.Close()
+	u.wg.Wait()
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	for key, cl := range u.clients {
+		u.removeLocked(key, cl)
+	}
+}
+
+func (u *shadowsocksUDP) readLoop(ctx context.Context) {
+	buf := make([]byte, 65535)
+	for {
+		n, from, err := u.pc.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		src, ok := from.(*net.UDPAddr)
+		if !ok {
+			continue
+		}
+		if u.allowSrc != nil && !cidrsContain(u.allowSrc, src.IP) {
+			u.stats.refused(true)
+			if u.srv.debug {
+				fmt.Printf("[shadowsocks-udp] refused %s: source not allowed\n", src)
+			}
+			continue
+		}
+		plain, err := u.ciph.openPacket(buf[:n])
+		if err != nil {
+			if u.srv.debug {
+				fmt.Printf("[shadowsocks-udp] dropped datagram from %s: %v\n", src, err)
+			}
+			continue
+		}
+		r := bytes.NewReader(plain)
+		var req socksRequest
+		atyp, err := r.ReadByte()
+		if err == nil {
+			err = readSocksAddr(r, atyp, &req)
+		}
+		if err != nil {
+			continue
+		}
+		d := shadowsocksDatagram{host: req.host, port: req.port, payload: plain[len(plain)-r.Len():]}
+		if !req.isDomain {
+			d.ip, d.host = net.ParseIP(req.host), ""
+		}
+		cl := u.client(ctx, src)
+		if cl == nil {
+			continue
+		}
+		select {
+		case cl.queue <- d:
+		default: // the client is sending faster than its destinations take it
+		}
+	}
+}
+
+// client returns the relay state for src, creating it on its first datagram, and marks
+// it active. It returns nil when too many clients are active.
+func (u *shadowsocksUDP) client(ctx context.Context, src *net.UDPAddr) *shadowsocksUDPClient {
+	key := src.String()
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if cl, ok := u.clients[key]; ok {
+		cl.lastActive.Store(time.Now().UnixNano())
+		return cl
+	}
+	if len(u.clients) >= shadowsocksMaxUDPClients {
+		if u.srv.debug {
+			fmt.Printf("[shadowsocks-udp] too many clients, dropping datagram from %s\n", src)
+		}
+		return nil
+	}
+	a := &udpAssociation{
+		srv:      u.srv,
+		shaping:  u.srv.shaper.acquire(src.IP, ""),
+		client:   u.pc,
+		peerIP:   src.IP,
+		mappings: map[string]*udpMapping{},
+	}
+	a.clientAddr.Store(src)
+	a.encode = func(from *net.UDPAddr, payload []byte) []byte {
+		p, _ := u.ciph.sealPacket(append(appendSocksAddr(nil, from.IP, from.Port), payload...))
+		return p
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	cl := &shadowsocksUDPClient{a: a, queue: make(chan shadowsocksDatagram, 64), cancel: cancel}
+	cl.lastActive.Store(time.Now().UnixNano())
+	u.clients[key] = cl
+	go func() {
+		// Also closes a mapping opened while the client was being removed.
+		defer a.closeAll()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case d := <-cl.queue:
+				if !a.forward(ctx, d.ip, d.host, d.port, d.payload) {
+					return
+				}
+			}
+		}
+	}()
+	return cl
+}
+
+// expireLoop closes idle mappings and forgets clients that have none left.
+func (u *shadowsocksUDP) expireLoop(ctx context.Context) {
+	t := time.NewTicker(udpMappingIdleTimeout / 4)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-t.C:
+			u.expireIdle(now, udpMappingIdleTimeout)
+		}
+	}
+}
+
+// expireIdle closes mappings idle since now-idle and removes the clients left without
+// mappings that have sent nothing since then either.
+func (u *shadowsocksUDP) expireIdle(now time.Time, idle time.Duration) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	for key, cl := range u.clients {
+		cl.a.expireIdle(now, idle)
+		cl.a.mu.Lock()
+		empty := len(cl.a.mappings) == 0
+		cl.a.mu.Unlock()
+		if empty && now.Sub(time.Unix(0, cl.lastActive.Load())) > idle {
+			u.removeLocked(key, cl)
+		}
+	}
+}
+
+func (u *shadowsocksUDP) removeLocked(key string, cl *shadowsocksUDPClient) {
+	cl.cancel()
+	cl.a.closeAll()
+	cl.a.shaping.release()
+	delete(u.clients, key)
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docopt/docopt-go"
+)
+
+// startTestShadowsocks starts a Shadowsocks server on a free port and returns its address.
+func startTestShadowsocks(t *testing.T, method string, socks socksOptions) string {
+	t.Helper()
+	addr := grabFreeAddr(t)
+	stop, err := startShadowsocks(context.Background(), shadowsocksOptions{ListenAddr: addr, Method: method, Password: "secret", Socks: socks})
+	if err != nil {
+		t.Fatalf("startShadowsocks: %v", err)
+	}
+	t.Cleanup(func() { _ = stop() })
+	return addr
+}
+
+// recordingConn keeps a copy of everything written to and read from it.
+type recordingConn struct {
+	net.Conn
+	sent, received bytes.Buffer
+}
+
+func (c *recordingConn) Write(p []byte) (int, error) {
+	c.sent.Write(p)
+	return c.Conn.Write(p)
+}
+
+func (c *recordingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.received.Write(p[:n])
+	return n, err
+}
+
+// shadowsocksConnect opens a Shadowsocks stream to 127.0.0.1:port through addr.
+func shadowsocksConnect(t *testing.T, addr string, ciph *shadowsocksCipher, port int) (*shadowsocksConn, *recordingConn) {
+	t.Helper()
+	rc := &recordingConn{Conn: dialProxy(t, addr)}
+	_ = rc.SetDeadline(time.Now().Add(5 * time.Second))
+	sc := &shadowsocksConn{Conn: rc, ciph: ciph}
+	if _, err := sc.Write(appendSocksAddr(nil, net.IPv4(127, 0, 0, 1), port)); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	return sc, rc
+}
+
+// expectSilent fails unless c neither sends anything nor closes within wait.
+func expectSilent(t *testing.T, c net.Conn, wait time.Duration) {
+	t.Helper()
+	_ = c.SetReadDeadline(time.Now().Add(wait))
+	var ne net.Error
+	if _, err := c.Read(make([]byte, 1)); !errors.As(err, &ne) || !ne.Timeout() {
+		t.Fatalf("read = %v, want nothing until the deadline", err)
+	}
+}
+
+func mustShadowsocksCipher(t *testing.T, method, password string) *shadowsocksCipher {
+	t.Helper()
+	ciph, err := newShadowsocksCipher(method, password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ciph
+}
+
+func TestEVPBytesToKey(t *testing.T) {
+	if got := hex.EncodeToString(evpBytesToKey("foobar", 32)); got != "3858f62230ac3c915f300c664312c63f568378529614d22ddb49237d2f60bfdf" {
+		t.Fatalf("key = %s", got)
+	}
+	if _, err := newShadowsocksCipher("rc4-md5", "secret"); err == nil {
+		t.Fatal("accepted a stream cipher")
+	}
+	if _, err := newShadowsocksCipher(shadowsocksChaCha20, ""); err == nil {
+		t.Fatal("accepted an empty password")
+	}
+}
+
+func TestShadowsocks_Connect(t *testing.T) {
+	port := tcpEcho(t)
+	for _, method := range []string{shadowsocksChaCha20, shadowsocksAES256} {
+		addr := startTestShadowsocks(t, method, socksOptions{})
+		sc, _ := shadowsocksConnect(t, addr, mustShadowsocksCipher(t, method, "secret"), port)
+		expectEcho(t, sc, "hello")
+		// Larger than one chunk in both directions.
+		expectEcho(t, sc, strings.Repeat("x", 3*shadowsocksMaxPayload+7))
+	}
+}
+
+func TestShadowsocks_WrongPasswordAndReplay(t *testing.T) {
+	port := tcpEcho(t)
+	addr := startTestShadowsocks(t, shadowsocksChaCha20, socksOptions{})
+
+	sc, _ := shadowsocksConnect(t, addr, mustShadowsocksCipher(t, shadowsocksChaCha20, "guess"), port)
+	if _, err := sc.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	expectSilent(t, sc.Conn, 500*time.Millisecond)
+
+	sc, rec := shadowsocksConnect(t, addr, mustShadowsocksCipher(t, shadowsocksChaCha20, "secret"), port)
+	expectEcho(t, sc, "hello")
+	replay := dialProxy(t, addr)
+	if _, err := replay.Write(rec.sent.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	expectSilent(t, replay, 500*time.Millisecond)
+
+	// The server's own stream, sent back to it, is refused like a replay. The echoed
+	// payload is itself a request, so the reflected stream would otherwise be answered.
+	sc, rec = shadowsocksConnect(t, addr, mustShadowsocksCipher(t, shadowsocksChaCha20, "secret"), port)
+	expectEcho(t, sc, string(appendSocksAddr(nil, net.IPv4(127, 0, 0, 1), port))+"ping")
+	reflect := dialProxy(t, addr)
+	if _, err := reflect.Write(rec.received.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	expectSilent(t, reflect, 500*time.Millisecond)
+}
+
+func TestShadowsocks_BlockRule(t *testing.T) {
+	port := tcpEcho(t)
+	rules := []*routeRule{{Action: actionBlock, CIDRs: []*net.IPNet{parseCIDRHost("127.0.0.0/8")}, Ports: []portRange{{lo: port, hi: port}}}}
+	addr := startTestShadowsocks(t, shadowsocksAES256, socksOptions{Rules: rules})
+	sc, _ := shadowsocksConnect(t, addr, mustShadowsocksCipher(t, shadowsocksAES256, "secret"), port)
+	expectClosed(t, sc, 2*time.Second)
+}
+
+func TestShadowsocks_UDP(t *testing.T) {
+	echo := udpEcho(t, "127.0.0.1")
+	ciph := mustShadowsocksCipher(t, shadowsocksChaCha20, "secret")
+	addr := startTestShadowsocks(t, shadowsocksChaCha20, socksOptions{})
+	server, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = pc.Close() })
+
+	// An undecryptable datagram is dropped without an answer.
+	if _, err := pc.WriteTo([]byte("not shadowsocks"), server); err != nil {
+		t.Fatal(err)
+	}
+	p, err := ciph.sealPacket(append(appendSocksAddr(nil, echo.IP, echo.Port), "ping"...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pc.WriteTo(p, server); err != nil {
+		t.Fatal(err)
+	}
+	_ = pc.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 2048)
+	n, _, err := pc.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("no reply: %v", err)
+	}
+	plain, err := ciph.openPacket(buf[:n])
+	if err != nil {
+		t.Fatalf("openPacket: %v", err)
+	}
+	r := bytes.NewReader(plain)
+	var from socksRequest
+	atyp, _ := r.ReadByte()
+	if err := readSocksAddr(r, atyp, &from); err != nil {
+		t.Fatal(err)
+	}
+	if from.host != "127.0.0.1" || from.port != echo.Port || string(plain[len(plain)-r.Len():]) != "ping" {
+		t.Fatalf("reply from %s:%d: %q", from.host, from.port, plain[len(plain)-r.Len():])
+	}
+}
+
+func TestShadowsocks_UDPRefusedSourceCounted(t *testing.T) {
+	stats := &socksStats{}
+	addr := startTestShadowsocks(t, shadowsocksChaCha20, socksOptions{AllowSrc: []*net.IPNet{parseCIDRHost("192.0.2.0/24")}, Stats: stats})
+	pc, err := net.Dial("udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = pc.Close() })
+	if _, err := pc.Write([]byte("anything")); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for stats.refusedSource.Load() != 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("refused source = %d, want 1", stats.refusedSource.Load())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestValidateConfig_Shadowsocks(t *testing.T) {
+	for body, want := range map[string]string{
+		"tun: none\nshadowsocks: 0.0.0.0:8388\nshadowsocks_password: secret\n":                          "",
+		"tun: none\nshadowsocks: 0.0.0.0:8388\n":                                                        "shadowsocks_password",
+		"tun: none\nshadowsocks: 0.0.0.0:8388\nshadowsocks_password: x\nshadowsocks_method: rc4-md5\n":  "shadowsocks_method",
+		"tun: none\nsocks: 127.0.0.1:1080\nshadowsocks: 127.0.0.1:1080\nshadowsocks_password: secret\n": "is also a SOCKS or transparent listener",
+		"tun: none\nshadowsocks: socks+tls://0.0.0.0:8388\nshadowsocks_password: secret\n":              "is for SOCKS listeners",
+		"tun: none\nshadowsocks: 8388\nshadowsocks_password: secret\n":                                  "shadowsocks",
+	} {
+		rc, err := resolveConfigWith(docopt.Opts{"--config": writeConfig(t, body)}, fakeEnv(nil))
+		if err != nil {
+			t.Fatalf("resolveConfig(%q): %v", body, err)
+		}
+		errs := validateConfig(rc)
+		switch {
+		case want == "" && len(errs) > 0:
+			t.Errorf("%q: unexpected problems %v", body, errs)
+		case want != "" && (len(errs) != 1 || !strings.Contains(errs[0].Error(), want)):
+			t.Errorf("%q: problems %v, want one about %q", body, errs, want)
+		}
+	}
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net"
+	"strings"
+	"time"
+)
+
+// DefaultSniffTimeout bounds how long the SOCKS proxy waits for the first client bytes
+// of an IP-literal CONNECT. Server-speaks-first protocols (SMTP, SSH banners, ...) send
+// nothing, so the wait must stay short.
+const DefaultSniffTimeout = 300 * time.Millisecond
+
+// maxSniffBytes caps how much of the client stream is buffered while looking for a
+// complete ClientHello or HTTP request head.
+const maxSniffBytes = 16 * 1024
+
+// errSniffMore reports that b is a prefix of a recognised protocol and more bytes are needed.
+var errSniffMore = errors.New("sniff: need more data")
+
+// sniffDestination reads the first bytes the client sends after the SOCKS handshake and
+// extracts the TLS SNI or HTTP Host. It returns everything read (which must be forwarded
+// to the destination) and the host name, or "" when none was found before timeout.
+func sniffDestination(c net.Conn, timeout time.Duration) ([]byte, string, string) {
+	if timeout <= 0 {
+		timeout = DefaultSniffTimeout
+	}
+	_ = c.SetReadDeadline(time.Now().Add(timeout))
+	defer func() { _ = c.SetReadDeadline(time.Time{}) }()
+
+	buf := make([]byte, 0, 2048)
+	tmp := make([]byte, 4096)
+	for len(buf) < maxSniffBytes {
+		n, err := c.Read(tmp)
+		buf = append(buf, tmp[:n]...)
+		if host, proto, serr := sniffHost(buf); serr == nil {
+			return buf, host, proto
+		} else if !errors.Is(serr, errSniffMore) {
+			return buf, "", ""
+		}
+		if err != nil {
+			break
+		}
+	}
+	return buf, "", ""
+}
+
+// sniffHost extracts the destination name from the start of a client stream.
+// It returns errSniffMore when b is an incomplete TLS ClientHello or HTTP request head.
+func sniffHost(b []byte) (host, proto string, err error) {
+	if len(b) == 0 {
+		return "", "", errSniffMore
+	}
+	if b[0] == 0x16 {
+		host, err = parseTLSClientHelloSNI(b)
+		return host, "tls", err
+	}
+	host, err = parseHTTPHost(b)
+	return host, "http", err
+}
+
+// parseTLSClientHelloSNI returns the server_name extension of the ClientHello at the
+// start of b. The handshake message may span several TLS records.
+func parseTLSClientHelloSNI(b []byte) (string, error) {
+	// Reassemble the handshake message from consecutive handshake records.
+	var hs []byte
+	msgLen := func() int { return int(hs[1])<<16 | int(hs[2])<<8 | int(hs[3]) }
+	for rest := b; len(hs) < 4 || len(hs) < 4+msgLen(); {
+		if len(hs) >= 4 && msgLen() > maxSniffBytes {
+			return "", errors.New("sniff: ClientHello too large")
+		}
+		if len(rest) < 5 {
+			return "", errSniffMore
+		}
+		if rest[0] != 0x16 || rest[1] != 3 {
+			return "", errors.New("sniff: not a TLS handshake record")
+		}
+		n := int(binary.BigEndian.Uint16(rest[3:5]))
+		if len(rest) < 5+n {
+			hs = append(hs, rest[5:]...)
+			rest = nil
+			continue
+		}
+		hs = append(hs, rest[5:5+n]...)
+		rest = rest[5+n:]
+	}
+	if hs[0] != 1 { // client_hello
+		return "", errors.New("sniff: not a ClientHello")
+	}
+	p := cursor(hs[4 : 4+msgLen()])
+
+	// legacy_version(2) random(32) session_id<1> cipher_suites<2> compression<1>
+	if !p.skip(2+32) || !p.skipVec(1) || !p.skipVec(2) || !p.skipVec(1) {
+		return "", errors.New("sniff: malformed ClientHello")
+	}
+	exts, ok := p.vec(2)
+	if !ok {
+		return "", errors.New("sniff: ClientHello without extensions")
+	}
+	for len(exts) > 0 {
+		typ, ok1 := exts.u16()
+		data, ok2 := exts.vec(2)
+		if !ok1 || !ok2 {
+			return "", errors.New("sniff: malformed extensions")
+		}
+		if typ != 0 { // server_name
+			continue
+		}
+		list, ok := data.vec(2)
+		for ok && len(list) > 0 {
+			nameType, ok1 := list.u8()
+			name, ok2 := list.vec(2)
+			if !ok1 || !ok2 {
+				break
+			}
+			if nameType == 0 {
+				return validSniffedHost(string(name))
+			}
+		}
+		return "", errors.New("sniff: malformed server_name")
+	}
+	return "", errors.New("sniff: no server_name")
+}
+
+// httpMethods are the request methods recognised as the start of an HTTP/1.x request.
+var httpMethods = []string{"GET ", "POST ", "HEAD ", "PUT ", "DELETE ", "OPTIONS ", "PATCH ", "CONNECT ", "TRACE "}
+
+// parseHTTPHost returns the Host header of the HTTP/1.x request head at the start of b.
+func parseHTTPHost(b []byte) (string, error) {
+	isHTTP := false
+	for _, m := range httpMethods {
+		n := min(len(b), len(m))
+		if bytes.Equal(b[:n], []byte(m[:n])) {
+			isHTTP = true
+			if n < len(m) {
+				return "", errSniffMore
+			}
+			break
+		}
+	}
+	if !isHTTP {
+		return "", errors.New("sniff: not an HTTP request")
+	}
+	end := bytes.Index(b, []byte("\r\n\r\n"))
+	if end < 0 {
+		return "", errSniffMore
+	}
+	for _, line := range strings.Split(string(b[:end]), "\r\n")[1:] {
+		k, v, ok := strings.Cut(line, ":")
+		if !ok || !strings.EqualFold(strings.TrimSpace(k), "host") {
+			continue
+		}
+		host := strings.TrimSpace(v)
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		return validSniffedHost(host)
+	}
+	return "", errors.New("sniff: no Host header")
+}
+
+// validSniffedHost accepts only DNS names; IP literals carry no routing information.
+func validSniffedHost(h string) (string, error) {
+	h = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(h)), ".")
+	if h == "" || len(h) > 253 || net.ParseIP(strings.Trim(h, "[]")) != nil || strings.ContainsAny(h, " /\\@") {
+		return "", errors.New("sniff: not a host name")
+	}
+	return h, nil
+}
+
+// cursor is a minimal big-endian reader over a TLS message.
+type cursor []byte
+
+func (c *cursor) skip(n int) bool {
+	if len(*c) < n {
+		return false
+	}
+	*c = (*c)[n:]
+	return true
+}
+
+func (c *cursor) u8() (byte, bool) {
+	if len(*c) < 1 {
+		return 0, false
+	}
+	v := (*c)[0]
+	*c = (*c)[1:]
+	return v, true
+}
+
+func (c *cursor) u16() (uint16, bool) {
+	if len(*c) < 2 {
+		return 0, false
+	}
+	v := binary.BigEndian.Uint16(*c)
+	*c = (*c)[2:]
+	return v, true
+}
+
+// vec reads a vector with a lenBytes-byte length prefix.
+func (c *cursor) vec(lenBytes int) (cursor, bool) {
+	if len(*c) < lenBytes {
+		return nil, false
+	}
+	n := 0
+	for _, b := range (*c)[:lenBytes] {
+		n = n<<8 | int(b)
+	}
+	*c = (*c)[lenBytes:]
+	if len(*c) < n {
+		return nil, false
+	}
+	v := (*c)[:n]
+	*c = (*c)[n:]
+	return v, true
+}
+
+func (c *cursor) skipVec(lenBytes int) bool {
+	_, ok := c.vec(lenBytes)
+	return ok
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// captureClientHello returns the first bytes a crypto/tls client sends for serverName.
+func captureClientHello(t *testing.T, serverName string) []byte {
+	t.Helper()
+	client, server := net.Pipe()
+	defer func() { _ = server.Close() }()
+	go func() {
+		tc := tls.Client(client, &tls.Config{ServerName: serverName, InsecureSkipVerify: true})
+		_ = tc.Handshake()
+		_ = client.Close()
+	}()
+	_ = server.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, 0, 4096)
+	tmp := make([]byte, 4096)
+	for {
+		n, err := server.Read(tmp)
+		buf = append(buf, tmp[:n]...)
+		if _, _, serr := sniffHost(buf); !errors.Is(serr, errSniffMore) || err != nil {
+			return buf
+		}
+	}
+}
+
+func TestSniffHost_TLS(t *testing.T) {
+	hello := captureClientHello(t, "www.example.test")
+	host, proto, err := sniffHost(hello)
+	if err != nil || host != "www.example.test" || proto != "tls" {
+		t.Fatalf("got host=%q proto=%q err=%v", host, proto, err)
+	}
+	// Every strict prefix asks for more data.
+	for _, n := range []int{1, 5, 40, len(hello) - 1} {
+		if _, _, err := sniffHost(hello[:n]); !errors.Is(err, errSniffMore) {
+			t.Fatalf("prefix %d: got %v, want errSniffMore", n, err)
+		}
+	}
+}
+
+func TestSniffHost_TLSSplitAcrossRecords(t *testing.T) {
+	hello := captureClientHello(t, "split.example.test")
+	payload := hello[5:]
+	var split []byte
+	for _, part := range [][]byte{payload[:50], payload[50:]} {
+		hdr := []byte{0x16, 3, 1, 0, 0}
+		binary.BigEndian.PutUint16(hdr[3:], uint16(len(part)))
+		split = append(split, hdr...)
+		split = append(split, part...)
+	}
+	if host, _, err := sniffHost(split); err != nil || host != "split.example.test" {
+		t.Fatalf("got host=%q err=%v", host, err)
+	}
+}
+
+func TestSniffHost_TLSWithoutSNI(t *testing.T) {
+	hello := captureClientHello(t, "")
+	if _, _, err := sniffHost(hello); err == nil || errors.Is(err, errSniffMore) {
+		t.Fatalf("expected a definite failure without SNI, got %v", err)
+	}
+}
+
+func TestSniffHost_HTTP(t *testing.T) {
+	cases := map[string]string{
+		"GET / HTTP/1.1\r\nUser-Agent: x\r\nHost: Web.Example.Test:8080\r\n\r\n":  "web.example.test",
+		"POST /a HTTP/1.1\r\nhost: api.example.test\r\nContent-Length: 0\r\n\r\n": "api.example.test",
+	}
+	for req, want := range cases {
+		host, proto, err := sniffHost([]byte(req))
+		if err != nil || host != want || proto != "http" {
+			t.Errorf("%q: got host=%q proto=%q err=%v", req, host, proto, err)
+		}
+	}
+	if _, _, err := sniffHost([]byte("GE")); !errors.Is(err, errSniffMore) {
+		t.Errorf("partial method: got %v", err)
+	}
+	if _, _, err := sniffHost([]byte("GET / HTTP/1.1\r\nHost: a.test\r\n")); !errors.Is(err, errSniffMore) {
+		t.Errorf("partial head: got %v", err)
+	}
+	if _, _, err := sniffHost([]byte("GET / HTTP/1.1\r\nHost: 10.0.0.1\r\n\r\n")); err == nil {
+		t.Errorf("IP literal Host should not be used")
+	}
+	if _, _, err := sniffHost([]byte("SSH-2.0-OpenSSH\r\n")); err == nil || errors.Is(err, errSniffMore) {
+		t.Errorf("non-HTTP data should fail immediately, got %v", err)
+	}
+}
+
+func TestSocks5_SniffAppliesDomainRules(t *testing.T) {
+	// Echo target: replies with whatever it receives.
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("target listen: %v", err)
+	}
+	defer func() { _ = target.Close() }()
+	go func() {
+		for {
+			c, err := target.Accept()
+			if err != nil {
+				return
+			}
+			go func() { _, _ = io.Copy(c, c); _ = c.Close() }()
+		}
+	}()
+	port := target.Addr().(*net.TCPAddr).Port
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	rules := []*routeRule{{Action: actionBlock, Domains: []string{"blocked.test"}}}
+	proxyAddr := grabFreeAddr(t)
+	stop, err := startSocks(ctx, socksOptions{ListenAddr: proxyAddr, Rules: rules, Sniff: true, SniffTimeout: 200 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("startSocks: %v", err)
+	}
+	defer func() { _ = stop() }()
+
+	// Allowed host: the sniffed request is replayed to the destination.
+	allowed := "GET / HTTP/1.1\r\nHost: allowed.test\r\n\r\n"
+	conn, rep := socksConnectIP(t, proxyAddr, port)
+	if rep != 0 {
+		t.Fatalf("reply=%d", rep)
+	}
+	_, _ = conn.Write([]byte(allowed))
+	echo := make([]byte, len(allowed))
+	if _, err := io.ReadFull(conn, echo); err != nil || string(echo) != allowed {
+		t.Fatalf("echo: %q err=%v", echo, err)
+	}
+	_ = conn.Close()
+
+	// Blocked host: the proxy closes the connection without forwarding.
+	conn, rep = socksConnectIP(t, proxyAddr, port)
+	if rep != 0 {
+		t.Fatalf("reply=%d", rep)
+	}
+	_, _ = conn.Write([]byte("GET / HTTP/1.1\r\nHost: www.blocked.test\r\n\r\n"))
+	if n, err := conn.Read(make([]byte, 64)); err == nil {
+		t.Fatalf("blocked connection returned %d bytes", n)
+	}
+	_ = conn.Close()
+
+	// Server-speaks-first: nothing is sent, the sniff times out and the proxy still connects.
+	conn, rep = socksConnectIP(t, proxyAddr, port)
+	if rep != 0 {
+		t.Fatalf("reply=%d", rep)
+	}
+	time.Sleep(300 * time.Millisecond)
+	_, _ = conn.Write([]byte("late"))
+	late := make([]byte, 4)
+	if _, err := io.ReadFull(conn, late); err != nil || string(late) != "late" {
+		t.Fatalf("late echo: %q err=%v", late, err)
+	}
+	_ = conn.Close()
+}
@@ -1,7 +1,10 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"crypto/subtle"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
@@ -10,7 +13,6 @@ import (
 	"strconv"
 	"strings"
 	"sync"
-	"sync/atomic"
 	"syscall"
 	"time"
 )
@@ -18,8 +20,8 @@ import (
 // StartSocks5 starts a minimal SOCKS5 proxy at listenAddr.
 // If bindIf is non-empty (e.g., "utun10" or "tun0"), outbound connections will be attempted with SO_BINDTODEVICE where supported
 // (Linux) or using a control on macOS to set IP_BOUND_IF via syscall.RawConn.Control.
-// If dnsServers is non-empty, the first entry is used as the DNS resolver for hostname lookups
-// instead of the system default resolver.
+// If dnsServers is non-empty, those servers are used for hostname lookups instead of the
+// system default resolver (see parseDNSUpstream for the accepted forms).
 func StartSocks5(
 	ctx context.Context,
 	listenAddr string,
@@ -29,27 +31,173 @@ func StartSocks5(
 	excludeDomains []string,
 	dnsServers []string,
 ) (func() error, error) {
-	resolver := net.DefaultResolver
-	if len(dnsServers) > 0 {
-		addr := dnsServers[0]
-		if _, _, err := net.SplitHostPort(addr); err != nil {
-			addr = net.JoinHostPort(addr, "53")
-		}
-		resolver = &net.Resolver{
-			PreferGo: true,
-			Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
-				d := net.Dialer{Timeout: 5 * time.Second}
-				return d.DialContext(ctx, "udp", addr)
-			},
-		}
+	return startSocks(ctx, socksOptions{
+		ListenAddr:     listenAddr,
+		BindIf:         bindIf,
+		Debug:          debug,
+		AllowDomains:   allowDomains,
+		ExcludeDomains: excludeDomains,
+		DNSServers:     dnsServers,
+	})
+}
+
+// socksOptions configures a SOCKS5 server started by startSocks.
+type socksOptions struct {
+	ListenAddr     string
+	BindIf         string // VPN interface for VPN-routed destinations; "" uses the system route
+	Debug          bool
+	AllowDomains   []string
+	ExcludeDomains []string
+	DNSServers     []string        // --dns upstreams (udp, tcp://, tls://, https://)
+	DNSHosts       []string        // static name=ip overrides
+	Rules          []*routeRule    // ordered rules evaluated before the domain lists
+	Sniff          bool            // sniff TLS SNI / HTTP Host for IP-literal CONNECTs
+	SniffTimeout   time.Duration   // 0 means DefaultSniffTimeout
+	EnableIPv6     bool            // resolve and dial IPv6 destinations
+	Blocklist      *blocklist      // DNS blocklist applied to requested names; nil blocks nothing
+	Limits         socksLimits     // connection caps, relay timeouts and the drain period
+	Auth           []string        // user:password entries; non-empty requires RFC 1929 auth
+	Shaper         *shaper         // bandwidth shaping; nil shapes nothing
+	AllowSrc       []*net.IPNet    // client sources allowed to connect; nil allows all
+	ProxyFrom      []*net.IPNet    // peers whose connections start with a PROXY protocol header
+	TLS            socksTLSOptions // certificates for a socks+tls:// ListenAddr
+	Stats          *socksStats     // refusal counters; may be nil
+	Egress         *egressPool     // exit locations selected by user name; nil disables them
+	Location       LocationConfig  // exit location for users that select none; zero uses the default path
+}
+
+// socksServer is the shared state of one SOCKS5 listener.
+type socksServer struct {
+	bindIf   string
+	debug    bool
+	resolver hostResolver // direct destinations (all destinations without bindIf)
+	rules    *ruleSet
+
+	tunnelResolver hostResolver        // VPN-routed destinations; nil without bindIf
+	hosts          map[string][]net.IP // static overrides, checked before any lookup
+	blocklist      *blocklist
+	enableIPv6     bool
+	limits         socksLimits
+	users          map[string]string // user -> password; nil allows anonymous clients
+	tls            *tls.Config       // socks+tls:// listeners; nil for plain SOCKS
+	shaper         *shaper
+	egress         *egressPool
+	location       LocationConfig
+
+	sniff        bool
+	sniffTimeout time.Duration
+}
+
+// startSocks starts a SOCKS5 proxy configured by opts and returns a stop function.
+func startSocks(ctx context.Context, opts socksOptions) (func() error, error) {
+	srv, err := newSocksServer(opts)
+	if err != nil {
+		return nil, err
 	}
-	ln, err := net.Listen("tcp", listenAddr)
+	addr, _ := splitListenAddr(opts.ListenAddr)
+	lc := net.ListenConfig{KeepAlive: socksKeepAlive}
+	ln, err := lc.Listen(ctx, "tcp", addr)
 	if err != nil {
 		return nil, err
 	}
+	return srv.serve(ctx, ln, opts, handleSocksConn), nil
+}
+
+// newSocksServer returns the shared state for a listener configured by opts.
+func newSocksServer(opts socksOptions) (*socksServer, error) {
+	srv := &socksServer{
+		bindIf:   opts.BindIf,
+		debug:    opts.Debug,
+		resolver: net.DefaultResolver,
+		rules:    newRuleSet(opts.Rules, opts.AllowDomains, opts.ExcludeDomains),
+
+		blocklist:  opts.Blocklist,
+		enableIPv6: opts.EnableIPv6,
+		limits:     opts.Limits,
+		shaper:     opts.Shaper,
+		egress:     opts.Egress,
+		location:   opts.Location,
+
+		sniff:        opts.Sniff,
+		sniffTimeout: opts.SniffTimeout,
+	}
+	hosts, err := parseDNSHosts(opts.DNSHosts)
+	if err != nil {
+		return nil, err
+	}
+	srv.hosts = hosts
+	if srv.users, err = parseSocksAuth(opts.Auth); err != nil {
+		return nil, err
+	}
+	if _, useTLS := splitListenAddr(opts.ListenAddr); useTLS {
+		if srv.tls, err = opts.TLS.serverConfig(); err != nil {
+			return nil, err
+		}
+	}
+	// Without a VPN interface every lookup uses --dns (or the system resolver). With one,
+	// names routed through the VPN are resolved through it and direct names locally.
+	switch {
+	case opts.BindIf != "":
+		servers := opts.DNSServers
+		if len(servers) == 0 {
+			servers = DefaultTunnelDNS
+		}
+		dc, err := newDNSClient(dnsClientOptions{Upstreams: servers, Hosts: opts.DNSHosts, BindIf: opts.BindIf})
+		if err != nil {
+			return nil, err
+		}
+		srv.tunnelResolver = dc
+	case len(opts.DNSServers) > 0:
+		dc, err := newDNSClient(dnsClientOptions{Upstreams: opts.DNSServers, Hosts: opts.DNSHosts})
+		if err != nil {
+			return nil, err
+		}
+		srv.resolver = dc
+	}
+	return srv, nil
+}
+
+// serve accepts connections on ln and hands each one to handle, after the source
+// allowlist and connection limits of opts. Connections from opts.ProxyFrom must start
+// with a PROXY protocol header, and the client address it carries is the one checked,
+// limited and logged. It returns a function that stops accepting, drains the open
+// connections and closes ln. On a socks+tls:// listener, handle gets the TLS side,
+// which has not done its handshake yet.
+func (srv *socksServer) serve(ctx context.Context, ln net.Listener, opts socksOptions, handle func(ctx context.Context, c net.Conn, srv *socksServer)) func() error {
+	// Handlers outlive ctx so that stop can drain them; kill interrupts whatever is left.
+	hctx, kill := context.WithCancel(context.WithoutCancel(ctx))
+	conns := newConnTracker(opts.Limits)
+	admit := func(conn net.Conn) {
+		if opts.AllowSrc != nil && !cidrsContain(opts.AllowSrc, remoteIP(conn)) {
+			opts.Stats.refused(true)
+			if srv.debug {
+				fmt.Printf("[socks] refused %s: source not allowed\n", conn.RemoteAddr())
+			}
+			_ = conn.Close()
+			return
+		}
+		if ok, reason := conns.add(conn); !ok {
+			opts.Stats.refused(false)
+			if srv.debug {
+				fmt.Printf("[socks] refused %s: %s\n", conn.RemoteAddr(), reason)
+			}
+			_ = conn.Close()
+			return
+		}
+		go func() {
+			defer conns.remove(conn)
+			if srv.tls != nil {
+				handle(hctx, tls.Server(conn, srv.tls), srv)
+				return
+			}
+			handle(hctx, conn, srv)
+		}()
+	}
+	var headers sync.WaitGroup // PROXY headers being read
 	done := make(chan struct{})
 	go func() {
 		defer close(done)
+		defer headers.Wait()
 		for {
 			conn, err := ln.Accept()
 			if err != nil {
@@ -58,48 +206,301 @@ func StartSocks5(
 				}
 				return
 			}
-			go handleSocksConn(ctx, conn, bindIf, debug, allowDomains, excludeDomains, resolver)
+			if opts.ProxyFrom == nil || !cidrsContain(opts.ProxyFrom, remoteIP(conn)) {
+				admit(conn)
+				continue
+			}
+			// Read the header off the accept loop so a slow peer does not hold it up.
+			headers.Add(1)
+			go func() {
+				defer headers.Done()
+				pc, err := readProxyHeader(conn)
+				if err != nil {
+					if srv.debug {
+						fmt.Printf("[socks] refused %s: %v\n", conn.RemoteAddr(), err)
+					}
+					_ = conn.Close()
+					return
+				}
+				if srv.debug {
+					fmt.Printf("[socks] PROXY header from %s: client %s\n", conn.RemoteAddr(), pc.RemoteAddr())
+				}
+				admit(pc)
+			}()
 		}
 	}()
-	stop := func() error { _ = ln.Close(); <-done; return nil }
-	return stop, nil
+	// stop closes the listener, lets open connections finish for the drain period, then
+	// closes the rest.
+	stop := func() error {
+		_ = ln.Close()
+		<-done
+		if n := conns.count(); n > 0 {
+			logInfo("SOCKS %s: draining %d connections for up to %s\n", opts.ListenAddr, n, opts.Limits.DrainTimeout)
+		}
+		if n := conns.drain(opts.Limits.DrainTimeout, kill); n > 0 {
+			logInfo("SOCKS %s: closed %d connections still open after the drain period\n", opts.ListenAddr, n)
+		}
+		kill()
+		return nil
+	}
+	return stop
 }
 
-func handleSocksConn(
-	ctx context.Context,
-	c net.Conn,
-	bindIf string,
-	debug bool,
-	allowDomains []string,
-	excludeDomains []string,
-	resolver *net.Resolver,
-) {
+// errSocksBlocked reports that the routing rules or the DNS blocklist refuse a destination.
+var errSocksBlocked = errors.New("blocked by rule")
+
+// lookupHost resolves a destination name to the single address used for UDP; see
+// lookupAddrs.
+func (srv *socksServer) lookupHost(ctx context.Context, network, host string, port int, eg *locationEgress) (ip net.IP, blocked bool) {
+	addrs, err := srv.lookupAddrs(ctx, network, host, port, eg)
+	return pickRouteIP(addrs), errors.Is(err, errSocksBlocked)
+}
+
+// lookupAddrs resolves a destination name to its addresses in connection-attempt order
+// (see sortDialAddrs). Names the rules send through the VPN are resolved over sockets
+// bound to the VPN interface so the query does not leak onto the local network; direct
+// names use the system resolver. With eg, names routed through the VPN are resolved
+// through that exit location instead. It returns errSocksBlocked, without a lookup, when
+// a rule that does not depend on the address or the DNS blocklist refuses the name.
+func (srv *socksServer) lookupAddrs(ctx context.Context, network, host string, port int, eg *locationEgress) ([]net.IP, error) {
+	action, rule, known := srv.rules.decideByName(routeRequest{Network: network, Host: host, Port: port})
+	if known && action == actionBlock {
+		if srv.debug {
+			fmt.Printf("[socks] %s %s:%d matched %s\n", network, host, port, rule)
+		}
+		return nil, errSocksBlocked
+	}
+	if ips, ok := srv.hosts[normalizeHost(host)]; ok {
+		return usableAddrs(host, sortDialAddrs(ips, srv.enableIPv6), nil)
+	}
+	if srv.blocklist.blocks(host) {
+		if srv.debug {
+			fmt.Printf("[socks] %s %s:%d blocked by DNS blocklist\n", network, host, port)
+		}
+		return nil, errSocksBlocked
+	}
+	resolver, via := srv.resolver, "system"
+	switch {
+	case eg != nil && action != actionDirect:
+		resolver, via = eg.resolver, eg.key
+	case srv.tunnelResolver != nil && action != actionDirect:
+		resolver, via = srv.tunnelResolver, srv.bindIf
+	}
+	family := "ip4"
+	if srv.enableIPv6 {
+		family = "ip"
+	}
+	addrs, err := resolver.LookupIP(ctx, family, host)
+	if srv.debug {
+		fmt.Printf("[socks] resolved %s via %s: %v err=%v\n", host, via, addrs, err)
+	}
+	return usableAddrs(host, sortDialAddrs(addrs, srv.enableIPv6), err)
+}
+
+// usableAddrs returns addrs, or an error when there are none.
+func usableAddrs(host string, addrs []net.IP, err error) ([]net.IP, error) {
+	if len(addrs) > 0 {
+		return addrs, nil
+	}
+	if err == nil {
+		err = &net.DNSError{Err: "no usable address", Name: host, IsNotFound: true}
+	}
+	return nil, err
+}
+
+// route picks the path for req and logs the deciding rule in debug mode.
+func (srv *socksServer) route(req routeRequest) routeAction {
+	action, rule := srv.rules.decide(req)
+	if srv.debug {
+		dst := "-"
+		switch {
+		case req.Host != "":
+			dst = req.Host
+		case req.IP != nil:
+			dst = req.IP.String()
+		}
+		fmt.Printf("[socks] %s %s:%d matched %s\n", req.Network, dst, req.Port, rule)
+	}
+	return action
+}
+
+// routeAddrs decides the path for a connection to host's addrs, given in dial order,
+// and returns the addresses that take it. Each address is checked against the rules on
+// its own, so none that a rule blocks or sends another way is dialed. The preferred
+// address (see pickRouteIP) sets the path, or the first one not blocked when it is.
+func (srv *socksServer) routeAddrs(network, host string, addrs []net.IP, port int) (routeAction, []net.IP) {
+	actions := make([]routeAction, len(addrs))
+	pick := -1
+	preferred := pickRouteIP(addrs)
+	for i, ip := range addrs {
+		actions[i] = srv.route(routeRequest{Network: network, Host: host, IP: ip, Port: port})
+		if ip.Equal(preferred) && actions[i] != actionBlock {
+			pick = i
+		}
+	}
+	for i := 0; pick < 0 && i < len(addrs); i++ {
+		if actions[i] != actionBlock {
+			pick = i
+		}
+	}
+	if pick < 0 {
+		return actionBlock, nil
+	}
+	var same []net.IP
+	for i, ip := range addrs {
+		if actions[i] == actions[pick] {
+			same = append(same, ip)
+		}
+	}
+	return actions[pick], same
+}
+
+// socksHandshakeTimeout bounds the SOCKS handshake phase so clients that connect but
+// never send data do not leak goroutines. Once the tunnel is established the deadline
+// is cleared so long-lived connections work correctly.
+const socksHandshakeTimeout = 10 * time.Second
+
+// socksRequest is a parsed SOCKS5, SOCKS4 or SOCKS4a request, or the destination of a
+// Shadowsocks stream.
+type socksRequest struct {
+	version  byte   // 4 or 5; 0 for Shadowsocks, which has no replies
+	cmd      byte   // 1 CONNECT, 2 BIND, 3 UDP ASSOCIATE
+	host     string // IP literal, or a name when isDomain
+	isDomain bool
+	port     int
+	user     string          // RFC 1929 user name; "" when unauthenticated
+	egress   *locationEgress // exit location selected by user; nil for the default path
+}
+
+// reply sends a reply in the request's protocol version. rep is a SOCKS5 reply code.
+func (r *socksRequest) reply(c net.Conn, rep byte, bindAddr net.Addr) error {
+	switch r.version {
+	case 0:
+		return nil
+	case 4:
+		var ip net.IP
+		port := 0
+		if ta, ok := bindAddr.(*net.TCPAddr); ok {
+			ip, port = ta.IP, ta.Port
+		}
+		return writeSocks4Reply(c, rep, ip, port)
+	}
+	return writeSocksReply(c, rep, bindAddr)
+}
+
+func handleSocksConn(ctx context.Context, c net.Conn, srv *socksServer) {
 	defer func() { _ = c.Close() }()
+	_ = c.SetDeadline(time.Now().Add(socksHandshakeTimeout))
+
+	// A verified client certificate authenticates the client as its subject, in place
+	// of a user name and password.
+	users, certUser := srv.users, ""
+	if tc, ok := c.(*tls.Conn); ok {
+		if err := tc.HandshakeContext(ctx); err != nil {
+			if srv.debug {
+				fmt.Printf("[socks] TLS handshake with %s: %v\n", c.RemoteAddr(), err)
+			}
+			return
+		}
+		if certUser = tlsUser(tc.ConnectionState()); certUser != "" {
+			users = nil
+		}
+	}
+
+	var ver [1]byte
+	if _, err := io.ReadFull(c, ver[:]); err != nil {
+		return
+	}
+	var req *socksRequest
+	switch ver[0] {
+	case 5:
+		req = readSocks5Request(c, users)
+	case 4:
+		req = readSocks4Request(c)
+		if req != nil && users != nil {
+			// SOCKS4 has no passwords; with authentication configured it is refused.
+			_ = req.reply(c, 2, nil)
+			return
+		}
+	}
+	if req == nil {
+		return
+	}
+	if certUser != "" {
+		req.user = certUser
+	}
+	serveRequest(ctx, c, srv, req)
+}
 
-	// Apply a deadline for the SOCKS handshake phase to avoid leaking goroutines
-	// on clients that connect but never send data. Once the tunnel is established
-	// the deadline is cleared so long-lived connections work correctly.
-	const handshakeTimeout = 10 * time.Second
-	_ = c.SetDeadline(time.Now().Add(handshakeTimeout))
+// serveRequest carries out a parsed request on c: CONNECT, BIND or UDP ASSOCIATE.
+func serveRequest(ctx context.Context, c net.Conn, srv *socksServer, req *socksRequest) {
+	// The user name may select an exit location (see userLocation), overriding the
+	// listener's. CONNECT and UDP ASSOCIATE are carried through a location's userspace
+	// stack; BIND, which would need a listener there, is not.
+	loc := srv.location
+	if l, ok := userLocation(req.user); ok {
+		loc = l
+	}
+	eg, err := srv.egress.acquire(ctx, loc)
+	if err != nil {
+		if srv.debug {
+			fmt.Printf("[socks] user %s: %v\n", req.user, err)
+		}
+		_ = req.reply(c, socksErrorReply(err), nil)
+		return
+	}
+	if eg != nil {
+		defer srv.egress.release(eg)
+		if req.cmd == 2 {
+			_ = req.reply(c, 7, nil) // command not supported
+			return
+		}
+		req.egress = eg
+	}
+	switch req.cmd {
+	case 1:
+		serveConnect(ctx, c, srv, req)
+	case 2:
+		serveBind(ctx, c, srv, req)
+	case 3: // DST.ADDR/DST.PORT announce the client's UDP source
+		runUDPAssociate(ctx, c, srv, req)
+	}
+}
 
+// readSocks5Request performs the RFC 1928 method negotiation, authenticates the client
+// against users when there are any, and reads the request that follows; the version
+// byte has been consumed. It answers failed authentication and unsupported requests
+// itself and returns nil for them.
+func readSocks5Request(c net.Conn, users map[string]string) *socksRequest {
 	// RFC 1928 greeting
 	// +----+----------+----------+
 	// |VER | NMETHODS | METHODS  |
 	// +----+----------+----------+
 	buf := make([]byte, 262)
-	if _, err := io.ReadFull(c, buf[:2]); err != nil {
-		return
-	}
-	ver, nMethods := buf[0], int(buf[1])
-	if ver != 5 {
-		return
+	if _, err := io.ReadFull(c, buf[:1]); err != nil {
+		return nil
 	}
+	nMethods := int(buf[0])
 	if _, err := io.ReadFull(c, buf[:nMethods]); err != nil {
-		return
+		return nil
 	}
-	// no auth
-	if _, err := c.Write([]byte{5, 0}); err != nil {
-		return
+	method := byte(0) // no authentication required
+	if users != nil {
+		method = 2 // username/password
+		if !bytes.Contains(buf[:nMethods], []byte{method}) {
+			_, _ = c.Write([]byte{5, 0xff}) // no acceptable methods
+			return nil
+		}
+	}
+	if _, err := c.Write([]byte{5, method}); err != nil {
+		return nil
+	}
+	var user string
+	if method == 2 {
+		var ok bool
+		if user, ok = readSocksUserPass(c, users); !ok {
+			return nil
+		}
 	}
 
 	// Request
@@ -107,163 +508,300 @@ func handleSocksConn(
 	// |VER | CMD |  RSV  | ATYP | DST.ADDR | DST.PORT |
 	// +----+-----+-------+------+----------+----------+
 	if _, err := io.ReadFull(c, buf[:4]); err != nil {
-		return
+		return nil
 	}
 	ver, cmd, atyp := buf[0], buf[1], buf[3]
 	if ver != 5 {
 		_ = writeSocksReply(c, 1, nil)
-		return
-	}
-	if cmd == 3 { // UDP ASSOCIATE
-		runUDPAssociate(ctx, c, bindIf, debug, allowDomains, excludeDomains, resolver)
-		return
+		return nil
 	}
-	if cmd != 1 { // CONNECT only
+	if cmd < 1 || cmd > 3 { // CONNECT, BIND and UDP ASSOCIATE
 		_ = writeSocksReply(c, 7, nil)
-		return
+		return nil
 	}
-	var host string
+	req := &socksRequest{version: 5, cmd: cmd, user: user}
+	if err := readSocksAddr(c, atyp, req); err != nil {
+		if errors.Is(err, errSocksAddrType) {
+			_ = writeSocksReply(c, 8, nil)
+		}
+		return nil
+	}
+	return req
+}
+
+// errSocksAddrType reports an ATYP other than IPv4, domain name and IPv6.
+var errSocksAddrType = errors.New("unsupported address type")
+
+// readSocksAddr reads a DST.ADDR of type atyp and the DST.PORT that follows it into req.
+func readSocksAddr(r io.Reader, atyp byte, req *socksRequest) error {
+	buf := make([]byte, 255)
 	switch atyp {
 	case 1: // IPv4
-		if _, err := io.ReadFull(c, buf[:4]); err != nil {
-			return
+		if _, err := io.ReadFull(r, buf[:4]); err != nil {
+			return err
 		}
-		host = net.IP(buf[:4]).String()
+		req.host = net.IP(buf[:4]).String()
 	case 3: // domain
-		if _, err := io.ReadFull(c, buf[:1]); err != nil {
-			return
+		if _, err := io.ReadFull(r, buf[:1]); err != nil {
+			return err
 		}
 		l := int(buf[0])
-		if _, err := io.ReadFull(c, buf[:l]); err != nil {
-			return
+		if _, err := io.ReadFull(r, buf[:l]); err != nil {
+			return err
 		}
-		host = string(buf[:l])
+		req.host = strings.ToLower(string(buf[:l]))
+		req.isDomain = true
 	case 4: // IPv6
-		if _, err := io.ReadFull(c, buf[:16]); err != nil {
-			return
+		if _, err := io.ReadFull(r, buf[:16]); err != nil {
+			return err
 		}
-		host = net.IP(buf[:16]).String()
+		req.host = net.IP(buf[:16]).String()
 	default:
-		_ = writeSocksReply(c, 8, nil)
-		return
+		return errSocksAddrType
+	}
+	if _, err := io.ReadFull(r, buf[:2]); err != nil {
+		return err
 	}
-	if _, err := io.ReadFull(c, buf[:2]); err != nil {
+	req.port = int(buf[0])<<8 | int(buf[1])
+	return nil
+}
+
+// resolveTarget resolves req's destination to the addresses to try, in order. An IPv6
+// literal is refused, like an IPv6 answer, unless IPv6 is enabled. On failure it sends
+// the reply itself and returns ok=false.
+func resolveTarget(ctx context.Context, c net.Conn, srv *socksServer, req *socksRequest) (addrs []net.IP, ok bool) {
+	var err error
+	if req.isDomain {
+		addrs, err = srv.lookupAddrs(ctx, "tcp", req.host, req.port, req.egress)
+	} else {
+		addrs, err = usableAddrs(req.host, sortDialAddrs([]net.IP{net.ParseIP(req.host)}, srv.enableIPv6), nil)
+	}
+	if err != nil {
+		_ = req.reply(c, socksErrorReply(err), nil)
+		return nil, false
+	}
+	return addrs, true
+}
+
+// serveConnect handles CONNECT.
+func serveConnect(ctx context.Context, c net.Conn, srv *socksServer, req *socksRequest) {
+	port := req.port
+	addr := net.JoinHostPort(req.host, strconv.Itoa(port))
+	dialAddrs, ok := resolveTarget(ctx, c, srv, req)
+	if !ok {
 		return
 	}
-	port := int(buf[0])<<8 | int(buf[1])
-	// Resolve target address to an IP for routing. Prefer IPv4
-	var ipForRoute net.IP
-	var addr string
 	var reqDomain string
-	if atyp == 3 { // domain
-		// Use system resolver
-		reqDomain = strings.ToLower(host)
-		addrs, _ := resolver.LookupIP(ctx, "ip", host)
-		for _, ip := range addrs {
-			if ip.To4() != nil {
-				ipForRoute = ip
-				break
-			}
-			if ipForRoute == nil {
-				ipForRoute = ip
-			}
-		}
-		if ipForRoute == nil {
-			_ = writeSocksReply(c, 4, nil) // host unreachable
+	if req.isDomain {
+		reqDomain = req.host
+	}
+	// IP-literal requests carry no name for the domain rules. When sniffing is enabled,
+	// accept the request first and look for a TLS SNI or HTTP Host in the client's
+	// opening bytes; those bytes are replayed to the destination after dialing.
+	var early []byte
+	replied := false
+	routeHost := reqDomain
+	if reqDomain == "" && srv.sniff {
+		if err := req.reply(c, 0, nil); err != nil {
 			return
 		}
-		addr = net.JoinHostPort(ipForRoute.String(), strconv.Itoa(port))
-	} else {
-		ipForRoute = net.ParseIP(host)
-		addr = net.JoinHostPort(host, strconv.Itoa(port))
-	}
-	useVPN := true
-	if len(allowDomains) > 0 {
-		if reqDomain == "" || !domainMatches(reqDomain, allowDomains) {
-			useVPN = false
+		replied = true
+		var proto string
+		early, routeHost, proto = sniffDestination(c, srv.sniffTimeout)
+		_ = c.SetDeadline(time.Now().Add(socksHandshakeTimeout))
+		if srv.debug {
+			if routeHost != "" {
+				fmt.Printf("[socks] sniffed %s host %s for %s\n", proto, routeHost, addr)
+			} else {
+				fmt.Printf("[socks] no host sniffed for %s (%d bytes)\n", addr, len(early))
+			}
 		}
 	}
-	if reqDomain != "" && domainMatches(reqDomain, excludeDomains) {
-		useVPN = false
+	action, dialAddrs := srv.routeAddrs("tcp", routeHost, dialAddrs, port)
+	if action == actionBlock {
+		if !replied {
+			_ = req.reply(c, 2, nil) // connection not allowed by ruleset
+		}
+		return
 	}
+	useVPN := action == actionVPN
+	bindIf, debug := srv.bindIf, srv.debug
 	if debug {
-		fmt.Printf("[socks] CONNECT %s (ip=%s) bindIf=%s useVPN=%v\n", host+":"+strconv.Itoa(port), ipForRoute, bindIf, useVPN)
+		fmt.Printf("[socks] CONNECT %s (ips=%v) bindIf=%s useVPN=%v\n", addr, dialAddrs, bindIf, useVPN)
 	}
 
-	// Define relay function early so it's available for both initial and fallback connections.
-	relay := func(dst, src net.Conn, wg *sync.WaitGroup) {
-		defer wg.Done()
-		_, _ = io.Copy(dst, src)
-		// Signal EOF to the write side of dst so the peer sees a clean close.
-		if tc, ok := dst.(*net.TCPConn); ok {
-			_ = tc.CloseWrite()
-		}
-	}
-
-	d := net.Dialer{Timeout: 30 * time.Second}
+	d := net.Dialer{KeepAlive: socksKeepAlive}
 	if useVPN && bindIf != "" {
 		// Bind outbound socket to VPN interface
-		d.Control = func(network, address string, rc syscall.RawConn) error {
-			if !strings.Contains(network, "tcp") {
-				return nil
-			}
-			var retErr error
-			ctlErr := rc.Control(func(fd uintptr) {
-				retErr = bindFDToInterface(int(fd), bindIf)
-			})
-			if ctlErr != nil {
-				return ctlErr
-			}
-			return retErr
+		d.Control = bindControl(bindIf)
+	}
+	dial := d.DialContext
+	if useVPN && req.egress != nil {
+		// Leave through the user's exit location instead
+		dial = req.egress.dial
+		if debug {
+			fmt.Printf("[socks] CONNECT %s via egress %s\n", addr, req.egress.key)
 		}
 	}
 
-	rc, err := d.DialContext(ctx, "tcp", addr)
+	rc, err := dialHappyEyeballs(ctx, dial, dialAddrs, port)
 	if err != nil {
-		// Map common errors to SOCKS reply codes
-		rep := byte(1) // general failure by default
-		if ne, ok := err.(net.Error); ok && ne.Timeout() {
-			rep = 4
-		}
-		var se syscall.Errno
-		if errors.As(err, &se) {
-			switch se {
-			case syscall.ECONNREFUSED:
-				rep = 5
-			case syscall.ENETUNREACH:
-				rep = 3
-			case syscall.EHOSTUNREACH:
-				rep = 4
-			case syscall.ETIMEDOUT:
-				rep = 4
-			}
-		}
+		rep := socksErrorReply(err)
 		if debug {
-			fmt.Printf("[socks] dial error to %s: %v (rep=%d)\n", addr, err, rep)
+			fmt.Printf("[socks] dial error to %s %v: %v (rep=%d)\n", addr, dialAddrs, err, rep)
+		}
+		if !replied {
+			_ = req.reply(c, rep, nil)
 		}
-		_ = writeSocksReply(c, rep, nil)
 		return
 	}
 	defer func() { _ = rc.Close() }()
-	if err := writeSocksReply(c, 0, rc.LocalAddr()); err != nil {
-		return
+	if !replied {
+		if err := req.reply(c, 0, rc.LocalAddr()); err != nil {
+			return
+		}
+	}
+	if len(early) > 0 {
+		if _, err := rc.Write(early); err != nil {
+			return
+		}
 	}
 	// Handshake complete — clear deadline so the tunnel can run indefinitely.
 	_ = c.SetDeadline(time.Time{})
-	var wg sync.WaitGroup
-	wg.Add(2)
-	go relay(rc, c, &wg)
-	go relay(c, rc, &wg)
-	wg.Wait()
+	cs := srv.shaper.acquire(remoteIP(c), req.user)
+	defer cs.release()
+	srv.relay(ctx, c, rc, cs)
 }
 
+// readSocksUserPass runs the RFC 1929 username/password subnegotiation and reports
+// whether the client presented one of users' credentials.
+//
+//	+----+------+----------+------+----------+
+//	|VER | ULEN |  UNAME   | PLEN |  PASSWD  |
+//	+----+------+----------+------+----------+
+func readSocksUserPass(c net.Conn, users map[string]string) (string, bool) {
+	field := func() ([]byte, bool) {
+		var l [1]byte
+		if _, err := io.ReadFull(c, l[:]); err != nil {
+			return nil, false
+		}
+		b := make([]byte, l[0])
+		_, err := io.ReadFull(c, b)
+		return b, err == nil
+	}
+	var ver [1]byte
+	if _, err := io.ReadFull(c, ver[:]); err != nil || ver[0] != 1 {
+		return "", false
+	}
+	user, ok := field()
+	if !ok {
+		return "", false
+	}
+	pass, ok := field()
+	if !ok {
+		return "", false
+	}
+	want, known := users[string(user)]
+	ok = subtle.ConstantTimeCompare(pass, []byte(want)) == 1 && known
+	status := byte(1)
+	if ok {
+		status = 0
+	}
+	if _, err := c.Write([]byte{1, status}); err != nil {
+		return "", false
+	}
+	return string(user), ok
+}
+
+// parseSocksAuth parses user:password entries. The password follows the last colon, so
+// user names may contain colons but passwords may not. It returns nil for no entries.
+func parseSocksAuth(list []string) (map[string]string, error) {
+	if len(list) == 0 {
+		return nil, nil
+	}
+	users := map[string]string{}
+	for _, e := range list {
+		i := strings.LastIndexByte(e, ':')
+		if i <= 0 || i == len(e)-1 {
+			return nil, fmt.Errorf("socks auth entry %q: want user:password", e)
+		}
+		user, pass := e[:i], e[i+1:]
+		if len(user) > 255 || len(pass) > 255 {
+			return nil, fmt.Errorf("socks auth entry for %q: user and password are limited to 255 bytes", user)
+		}
+		if _, dup := users[user]; dup {
+			return nil, fmt.Errorf("socks auth: user %q listed twice", user)
+		}
+		users[user] = pass
+	}
+	return users, nil
+}
+
+// writeSocksReply sends a SOCKS5 reply with bindAddr as BND.ADDR/BND.PORT, encoded as
+// IPv4 or IPv6 to match the address. A nil bindAddr is sent as 0.0.0.0:0.
 func writeSocksReply(c net.Conn, rep byte, bindAddr net.Addr) error {
-	// Minimal reply with 0.0.0.0:0
-	resp := []byte{5, rep, 0, 1, 0, 0, 0, 0, 0, 0}
-	_, err := c.Write(resp)
+	ip, port := net.IPv4zero, 0
+	switch a := bindAddr.(type) {
+	case *net.TCPAddr:
+		ip, port = a.IP, a.Port
+	case *net.UDPAddr:
+		ip, port = a.IP, a.Port
+	}
+	_, err := c.Write(appendSocksAddr([]byte{5, rep, 0}, ip, port))
 	return err
 }
 
+// appendSocksAddr appends ATYP, ADDR and PORT for ip:port to b, using ATYP 1 for IPv4
+// (including IPv4-mapped IPv6) and 4 for IPv6.
+func appendSocksAddr(b []byte, ip net.IP, port int) []byte {
+	if v4 := ip.To4(); v4 != nil {
+		b = append(b, 1)
+		b = append(b, v4...)
+	} else if v6 := ip.To16(); v6 != nil {
+		b = append(b, 4)
+		b = append(b, v6...)
+	} else {
+		b = append(b, 1, 0, 0, 0, 0)
+	}
+	return append(b, byte(port>>8), byte(port))
+}
+
+// socksErrorReply maps an error from resolving, routing or dialing a destination to
+// an RFC 1928 reply code.
+func socksErrorReply(err error) byte {
+	var dnsErr *net.DNSError
+	var errno syscall.Errno
+	switch {
+	case err == nil:
+		return 0
+	case errors.Is(err, errSocksBlocked):
+		return 2 // connection not allowed by ruleset
+	case errors.Is(err, errNoLocation):
+		return 3 // the user's exit location has no providers
+	case errors.As(err, &dnsErr):
+		return 4 // NXDOMAIN or failed lookup: host unreachable
+	case errors.As(err, &errno):
+		switch errno {
+		case syscall.ECONNREFUSED:
+			return 5
+		case syscall.ENETUNREACH, syscall.ENETDOWN:
+			return 3
+		case syscall.EHOSTUNREACH, syscall.EHOSTDOWN, syscall.ETIMEDOUT:
+			return 4
+		case syscall.EACCES, syscall.EPERM:
+			return 2 // refused by a local firewall, e.g. the kill switch
+		}
+	}
+	if errors.Is(err, context.Canceled) {
+		return 1 // the proxy is shutting down
+	}
+	var ne net.Error
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &ne) && ne.Timeout()) {
+		return 4
+	}
+	return 1 // general SOCKS server failure
+}
+
 // domainMatches checks if host matches any suffix in patterns (case-insensitive).
 func domainMatches(host string, patterns []string) bool {
 	h := strings.ToLower(strings.TrimSuffix(host, "."))
@@ -279,211 +817,18 @@ func domainMatches(host string, patterns []string) bool {
 	return false
 }
 
-// runUDPAssociate implements SOCKS5 UDP ASSOCIATE for a single TCP control connection.
-func runUDPAssociate(ctx context.Context, ctrl net.Conn, bindIf string, debug bool, allowDomains, excludeDomains []string, resolver *net.Resolver) {
-	// Allocate a UDP listener for the client on loopback (IPv4)
-	pcClient, err := net.ListenPacket("udp", "127.0.0.1:0")
-	if err != nil {
-		_ = writeSocksReply(ctrl, 1, nil)
-		return
-	}
-	defer func() { _ = pcClient.Close() }()
-	la := pcClient.LocalAddr().(*net.UDPAddr)
-	// Reply success with our UDP bind address
-	if debug {
-		fmt.Printf("[socks] UDP ASSOCIATE listening at %s bindIf=%s\n", la.String(), bindIf)
-	}
-	// Build BND.ADDR/PORT reply
-	resp := []byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0}
-	copy(resp[4:8], la.IP.To4())
-	resp[8] = byte(la.Port >> 8)
-	resp[9] = byte(la.Port)
-	if _, err := ctrl.Write(resp); err != nil {
-		return
-	}
-
-	// Prepare outbound UDP packet conns: one bound to VPN interface, one system default
-	var pcVPN, pcSys net.PacketConn
-	// VPN-bound packet conn
-	if bindIf != "" {
-		lc := net.ListenConfig{Control: func(network, address string, rc syscall.RawConn) error {
-			var retErr error
-			ctlErr := rc.Control(func(fd uintptr) {
-				retErr = bindFDToInterface(int(fd), bindIf)
-			})
-			if ctlErr != nil {
-				return ctlErr
-			}
-			return retErr
-		}}
-		pcVPN, _ = lc.ListenPacket(ctx, "udp", ":0")
-	}
-	// System packet conn
-	var errSys error
-	pcSys, errSys = net.ListenPacket("udp", ":0")
-	if pcVPN == nil && errSys != nil {
-		// No viable UDP socket
-		return
-	}
-
-	// Read from remote sockets and forward to client
-	clientAddrCh := make(chan net.Addr, 1)
-	// track last client address observed — written from one goroutine, read from another.
-	var lastClientAddr atomic.Pointer[net.Addr]
-	go func() {
-		b := make([]byte, 65535)
-		for {
-			n, addr, err := pcClient.ReadFrom(b)
-			if err != nil {
-				return
-			}
-			lastClientAddr.Store(&addr)
-			select {
-			case clientAddrCh <- addr:
-			default:
-			}
-			// Parse SOCKS5 UDP request header
-			if n < 10 {
-				continue
-			}
-			p := b[:n]
-			// RSV(2)=0, FRAG(1)=0, ATYP(1)
-			if p[0] != 0 || p[1] != 0 || p[2] != 0 {
-				continue
-			}
-			atyp := p[3]
-			off := 4
-			var dstIP net.IP
-			var dstPort int
-			var reqDomain string
-			switch atyp {
-			case 1: // IPv4
-				if len(p) < off+4+2 {
-					continue
-				}
-				dstIP = net.IP(p[off : off+4])
-				off += 4
-			case 3: // Domain
-				if len(p) < off+1 {
-					continue
-				}
-				l := int(p[off])
-				off++
-				if len(p) < off+l+2 {
-					continue
-				}
-				reqDomain = strings.ToLower(string(p[off : off+l]))
-				off += l
-			case 4: // IPv6
-				if len(p) < off+16+2 {
-					continue
-				}
-				dstIP = net.IP(p[off : off+16])
-				off += 16
-			default:
-				continue
-			}
-			dstPort = int(p[off])<<8 | int(p[off+1])
-			off += 2
-			payload := p[off:]
-
-			// Resolve domain if needed
-			if dstIP == nil && reqDomain != "" {
-				addrs, _ := resolver.LookupIP(ctx, "ip", reqDomain)
-				for _, ip := range addrs {
-					if ip.To4() != nil {
-						dstIP = ip
-						break
-					}
-					if dstIP == nil {
-						dstIP = ip
-					}
-				}
-				if dstIP == nil {
-					continue
-				}
-			}
-
-			// Decide path
-			useVPN := true
-			if len(allowDomains) > 0 {
-				if reqDomain == "" || !domainMatches(reqDomain, allowDomains) {
-					useVPN = false
-				}
-			}
-			if reqDomain != "" && domainMatches(reqDomain, excludeDomains) {
-				useVPN = false
-			}
-			if debug {
-				fmt.Printf("[socks-udp] -> %s:%d via %s\n", dstIP, dstPort, map[bool]string{true: bindIf, false: "system"}[useVPN])
-			}
-
-			// Send out
-			dst := &net.UDPAddr{IP: dstIP, Port: dstPort}
-			var pc net.PacketConn
-			if useVPN && pcVPN != nil {
-				pc = pcVPN
-			} else {
-				pc = pcSys
-			}
-			if pc == nil {
-				continue
-			}
-			_, _ = pc.WriteTo(payload, dst)
-		}
-	}()
-
-	// Forward replies from VPN/system sockets back to client with SOCKS header
-	sendBack := func(pc net.PacketConn) {
-		if pc == nil {
-			return
-		}
-		buf := make([]byte, 65535)
-		for {
-			n, raddr, err := pc.ReadFrom(buf)
-			if err != nil {
-				return
-			}
-			// Build SOCKS UDP response header
-			addrPtr := lastClientAddr.Load()
-			if addrPtr == nil {
-				// Wait for at least one client packet to learn client addr
-				select {
-				case a := <-clientAddrCh:
-					lastClientAddr.Store(&a)
-					addrPtr = &a
-				default:
-				}
-				if addrPtr == nil {
-					continue
-				}
-			}
-			hdr := make([]byte, 0, 10)
-			hdr = append(hdr, 0, 0, 0) // RSV, RSV, FRAG
-			// raddr can be UDPAddr
-			if ua, ok := raddr.(*net.UDPAddr); ok {
-				ip := ua.IP
-				if v4 := ip.To4(); v4 != nil {
-					hdr = append(hdr, 1)
-					hdr = append(hdr, v4...)
-				} else {
-					hdr = append(hdr, 4)
-					hdr = append(hdr, ip.To16()...)
-				}
-				hdr = append(hdr, byte(ua.Port>>8), byte(ua.Port))
-			} else {
-				continue
-			}
-			pkt := append(hdr, buf[:n]...)
-			_, _ = pcClient.WriteTo(pkt, *addrPtr)
+// bindControl returns a dialer/listener Control function that binds sockets to ifName.
+func bindControl(ifName string) func(network, address string, rc syscall.RawConn) error {
+	return func(network, address string, rc syscall.RawConn) error {
+		var retErr error
+		ctlErr := rc.Control(func(fd uintptr) {
+			retErr = bindFDToInterface(int(fd), ifName)
+		})
+		if ctlErr != nil {
+			return ctlErr
 		}
+		return retErr
 	}
-	go sendBack(pcVPN)
-	go sendBack(pcSys)
-
-	// Keep TCP control channel open until client closes
-	tmp := make([]byte, 1)
-	_, _ = ctrl.Read(tmp)
 }
 
 // bindFDToInterface tries to bind a socket file descriptor to an interface by name.
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"io"
+	"net"
+	"strings"
+)
+
+// maxSocks4Field bounds the NUL-terminated USERID and SOCKS4a host name fields.
+const maxSocks4Field = 255
+
+// readSocks4Request reads a SOCKS4 or SOCKS4a request; the version byte has been
+// consumed. USERID is read and ignored. Unsupported commands are answered here and
+// return nil.
+//
+//	+----+----+----+----+----+----+----+----+----+----+....+----+
+//	| VN | CD | DSTPORT |      DSTIP        | USERID       |NULL|
+//	+----+----+----+----+----+----+----+----+----+----+....+----+
+//
+// SOCKS4a sets DSTIP to 0.0.0.x (x != 0) and appends the host name and a NUL.
+func readSocks4Request(c net.Conn) *socksRequest {
+	var buf [7]byte
+	if _, err := io.ReadFull(c, buf[:]); err != nil {
+		return nil
+	}
+	req := &socksRequest{version: 4, cmd: buf[0], port: int(buf[1])<<8 | int(buf[2])}
+	ip := net.IPv4(buf[3], buf[4], buf[5], buf[6])
+	if _, ok := readNULString(c); !ok { // USERID
+		return nil
+	}
+	if buf[3] == 0 && buf[4] == 0 && buf[5] == 0 && buf[6] != 0 { // SOCKS4a
+		host, ok := readNULString(c)
+		if !ok || host == "" {
+			_ = writeSocks4Reply(c, 1, nil, 0)
+			return nil
+		}
+		req.host, req.isDomain = strings.ToLower(host), true
+	} else {
+		req.host = ip.String()
+	}
+	if req.cmd != 1 && req.cmd != 2 { // CONNECT and BIND
+		_ = writeSocks4Reply(c, 7, nil, 0)
+		return nil
+	}
+	return req
+}
+
+// readNULString reads bytes up to a NUL terminator, at most maxSocks4Field of them.
+func readNULString(c net.Conn) (string, bool) {
+	var b [1]byte
+	var out []byte
+	for len(out) <= maxSocks4Field {
+		if _, err := io.ReadFull(c, b[:]); err != nil {
+			return "", false
+		}
+		if b[0] == 0 {
+			return string(out), true
+		}
+		out = append(out, b[0])
+	}
+	return "", false
+}
+
+// writeSocks4Reply sends a SOCKS4 reply. rep is a SOCKS5 reply code: 0 becomes 90
+// (granted) and every failure 91 (rejected or failed). ip:port is only meaningful for
+// BIND and must be IPv4.
+func writeSocks4Reply(c net.Conn, rep byte, ip net.IP, port int) error {
+	resp := []byte{0, 91, byte(port >> 8), byte(port), 0, 0, 0, 0}
+	if rep == 0 {
+		resp[1] = 90
+	}
+	if v4 := ip.To4(); v4 != nil {
+		copy(resp[4:], v4)
+	}
+	_, err := c.Write(resp)
+	return err
+}
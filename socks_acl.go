@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sync/atomic"
+)
+
+// localSourceCIDRs are the ranges the `local` allowlist shortcut admits: loopback,
+// link-local, RFC 1918 and CGNAT.
+var localSourceCIDRs = []string{"127.0.0.0/8", "169.254.0.0/16", "10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "100.64.0.0/10"}
+
+// localSourceCIDRs6 are the IPv6 counterparts: loopback, link-local and unique local.
+var localSourceCIDRs6 = []string{"::1/128", "fe80::/10", "fc00::/7"}
+
+// parseSourceAllowlist builds a SOCKS listener's client allowlist from CIDRs or
+// addresses, plus the local ranges when local is set. It returns nil, meaning every
+// source is allowed, when list is empty and local is false.
+func parseSourceAllowlist(list []string, local bool) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, s := range list {
+		n := parseCIDRHost(s)
+		if n == nil {
+			return nil, fmt.Errorf("%q is not an IP address or CIDR", s)
+		}
+		nets = append(nets, n)
+	}
+	if local {
+		for _, s := range append(localSourceCIDRs, localSourceCIDRs6...) {
+			nets = append(nets, parseCIDRHost(s))
+		}
+	}
+	return nets, nil
+}
+
+// socksStats counts connections a SOCKS listener refused before the greeting. The
+// caller owns it so the counts can go into the periodic stats; a nil *socksStats counts
+// nothing.
+type socksStats struct {
+	refusedSource atomic.Uint64 // source not in the allowlist
+	refusedLimit  atomic.Uint64 // over socks_max_conns or socks_max_conns_per_ip
+}
+
+func (s *socksStats) refused(bySource bool) {
+	switch {
+	case s == nil:
+	case bySource:
+		s.refusedSource.Add(1)
+	default:
+		s.refusedLimit.Add(1)
+	}
+}
+
+// String formats the counts for the [stats] line.
+func (s *socksStats) String() string {
+	return fmt.Sprintf("socks refused source=%d limit=%d", s.refusedSource.Load(), s.refusedLimit.Load())
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/docopt/docopt-go"
+)
+
+func TestParseSourceAllowlist(t *testing.T) {
+	if nets, err := parseSourceAllowlist(nil, false); err != nil || nets != nil {
+		t.Fatalf("empty allowlist = %v, %v; want nil (allow all)", nets, err)
+	}
+	nets, err := parseSourceAllowlist([]string{"203.0.113.0/24", "2001:db8::1"}, true)
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	for ip, want := range map[string]bool{
+		"203.0.113.9": true, "2001:db8::1": true, "2001:db8::2": false,
+		"127.0.0.1": true, "192.168.1.20": true, "::1": true, "fd00::5": true,
+		"198.51.100.1": false, "2a00::1": false,
+	} {
+		if got := cidrsContain(nets, net.ParseIP(ip)); got != want {
+			t.Errorf("%s allowed=%v, want %v", ip, got, want)
+		}
+	}
+	if _, err := parseSourceAllowlist([]string{"10.0.0.0/33"}, false); err == nil {
+		t.Fatal("accepted an invalid CIDR")
+	}
+}
+
+func TestSocks_SourceAllowlist(t *testing.T) {
+	port := tcpEcho(t)
+	stats := &socksStats{}
+	denied, _ := parseSourceAllowlist([]string{"192.0.2.0/24"}, false)
+	proxyAddr := startTestSocks(t, socksOptions{AllowSrc: denied, Stats: stats})
+
+	// Refused before the greeting: the connection closes without a method reply.
+	c := dialProxy(t, proxyAddr)
+	expectClosed(t, c, 2*time.Second)
+	if got := stats.refusedSource.Load(); got != 1 {
+		t.Fatalf("refused source count = %d, want 1", got)
+	}
+
+	local, _ := parseSourceAllowlist(nil, true)
+	proxyAddr = startTestSocks(t, socksOptions{AllowSrc: local, Stats: stats})
+	expectEcho(t, socksConnectTo(t, proxyAddr, port), "allowed")
+	if got := stats.refusedSource.Load(); got != 1 {
+		t.Fatalf("refused source count = %d after an allowed client", got)
+	}
+}
+
+func TestSocks_LimitRefusalsCounted(t *testing.T) {
+	stats := &socksStats{}
+	addr := grabFreeAddr(t)
+	stop, err := startSocks(context.Background(), socksOptions{ListenAddr: addr, Limits: socksLimits{MaxConns: 1}, Stats: stats})
+	if err != nil {
+		t.Fatalf("startSocks: %v", err)
+	}
+	t.Cleanup(func() { _ = stop() })
+	dialProxy(t, addr)
+	expectClosed(t, dialProxy(t, addr), 2*time.Second)
+	if stats.refusedLimit.Load() != 1 || stats.refusedSource.Load() != 0 {
+		t.Fatalf("stats = %s", stats)
+	}
+}
+
+func TestResolveConfig_SOCKSAllowSrcFailsClosed(t *testing.T) {
+	if _, err := resolveConfigWith(docopt.Opts{"--socks_allow_src": "10.0.0.0/8,not-an-ip"}, fakeEnv(nil)); err == nil {
+		t.Fatal("invalid socks_allow_src was accepted")
+	}
+	rc, err := resolveConfigWith(docopt.Opts{"--socks_allow_local": true}, fakeEnv(nil))
+	if err != nil {
+		t.Fatalf("resolveConfig: %v", err)
+	}
+	if len(rc.SOCKS.AllowSrc) == 0 || !cidrsContain(rc.SOCKS.AllowSrc, net.ParseIP("10.1.2.3")) {
+		t.Fatalf("socks allowlist = %v", rc.SOCKS.AllowSrc)
+	}
+}
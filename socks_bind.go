@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"time"
+)
+
+// bindAcceptTimeout bounds how long a BIND waits for the peer to connect.
+// Replace in tests.
+var bindAcceptTimeout = 2 * time.Minute
+
+// serveBind handles BIND (RFC 1928 section 4, SOCKS4 "BIND"): listen for one inbound
+// connection from the request's destination, report the listening address, then the
+// connecting peer, and relay. The listener sits on the path the routing rules choose for
+// the destination, so VPN-routed peers connect back through the VPN interface.
+func serveBind(ctx context.Context, c net.Conn, srv *socksServer, req *socksRequest) {
+	expected, ok := resolveTarget(ctx, c, srv, req)
+	if !ok {
+		return
+	}
+	var host string
+	if req.isDomain {
+		host = req.host
+	}
+	action, expected := srv.routeAddrs("tcp", host, expected, req.port)
+	if action == actionBlock {
+		_ = req.reply(c, 2, nil) // connection not allowed by ruleset
+		return
+	}
+	ipForRoute := pickRouteIP(expected)
+	useVPN := action == actionVPN && srv.bindIf != ""
+
+	localIP, err := bindListenIP(ipForRoute, useVPN, srv.bindIf, c)
+	if err != nil {
+		if srv.debug {
+			fmt.Printf("[socks] BIND %s: no local address: %v\n", req.host, err)
+		}
+		_ = req.reply(c, socksErrorReply(err), nil)
+		return
+	}
+	var lc net.ListenConfig
+	if useVPN {
+		lc.Control = bindControl(srv.bindIf)
+	}
+	ln, err := lc.Listen(ctx, "tcp", net.JoinHostPort(localIP.String(), "0"))
+	if err != nil {
+		_ = req.reply(c, 1, nil)
+		return
+	}
+	defer func() { _ = ln.Close() }()
+	if srv.debug {
+		fmt.Printf("[socks] BIND for %s listening at %s useVPN=%v\n", net.JoinHostPort(req.host, fmt.Sprint(req.port)), ln.Addr(), useVPN)
+	}
+	if err := req.reply(c, 0, ln.Addr()); err != nil {
+		return
+	}
+	_ = c.SetDeadline(time.Time{})
+
+	// Only the requested destination may connect; anything else is turned away. The
+	// timeout covers the wait for the peer only, not the relay that follows.
+	acceptCtx, cancelAccept := context.WithTimeout(ctx, bindAcceptTimeout)
+	defer cancelAccept()
+	go func() {
+		<-acceptCtx.Done()
+		_ = ln.Close()
+	}()
+	var peer net.Conn
+	for peer == nil {
+		conn, err := ln.Accept()
+		if err != nil {
+			rep := byte(1)
+			if errors.Is(acceptCtx.Err(), context.DeadlineExceeded) {
+				rep = 4
+			}
+			_ = req.reply(c, rep, nil)
+			return
+		}
+		pip := conn.RemoteAddr().(*net.TCPAddr).IP
+		if ipForRoute == nil || ipForRoute.IsUnspecified() || slices.ContainsFunc(expected, pip.Equal) {
+			peer = conn
+			continue
+		}
+		if srv.debug {
+			fmt.Printf("[socks] BIND rejected connection from %s (expected %v)\n", conn.RemoteAddr(), expected)
+		}
+		_ = conn.Close()
+	}
+	cancelAccept()
+	_ = ln.Close()
+	defer func() { _ = peer.Close() }()
+	if err := req.reply(c, 0, peer.RemoteAddr()); err != nil {
+		return
+	}
+	cs := srv.shaper.acquire(remoteIP(c), req.user)
+	defer cs.release()
+	srv.relay(ctx, c, peer, cs)
+}
+
+// bindListenIP picks the local address for a BIND listener: the source address this
+// host uses towards dst (through the VPN interface when useVPN), which is where dst can
+// reach us. Without a destination it is the VPN interface's address, or the address the
+// client reached the proxy on.
+func bindListenIP(dst net.IP, useVPN bool, bindIf string, ctrl net.Conn) (net.IP, error) {
+	if dst == nil || dst.IsUnspecified() {
+		if useVPN {
+			return interfaceIP(bindIf)
+		}
+		return ctrl.LocalAddr().(*net.TCPAddr).IP, nil
+	}
+	// Connecting a UDP socket sends nothing but makes the kernel choose the source address.
+	var d net.Dialer
+	if useVPN {
+		d.Control = bindControl(bindIf)
+	}
+	conn, err := d.Dial("udp", net.JoinHostPort(dst.String(), "9"))
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = conn.Close() }()
+	return conn.LocalAddr().(*net.UDPAddr).IP, nil
+}
+
+// interfaceIP returns the first IPv4 address of the named interface, or its first
+// address when it has no IPv4 one.
+func interfaceIP(name string) (net.IP, error) {
+	ifi, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := ifi.Addrs()
+	if err != nil {
+		return nil, err
+	}
+	var ips []net.IP
+	for _, a := range addrs {
+		if ipn, ok := a.(*net.IPNet); ok {
+			ips = append(ips, ipn.IP)
+		}
+	}
+	if ip := pickRouteIP(ips); ip != nil {
+		return ip, nil
+	}
+	return nil, fmt.Errorf("interface %s has no addresses", name)
+}
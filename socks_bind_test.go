@@ -0,0 +1,283 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// tcpEcho starts a loopback TCP echo server and returns its port.
+func tcpEcho(t *testing.T) int {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { _ = ln.Close() })
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer func() { _ = c.Close() }()
+				_, _ = io.Copy(c, c)
+			}()
+		}
+	}()
+	return ln.Addr().(*net.TCPAddr).Port
+}
+
+func startTestSocks(t *testing.T, opts socksOptions) string {
+	t.Helper()
+	opts.ListenAddr = grabFreeAddr(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	stop, err := startSocks(ctx, opts)
+	if err != nil {
+		t.Fatalf("startSocks: %v", err)
+	}
+	t.Cleanup(func() { _ = stop() })
+	return opts.ListenAddr
+}
+
+func dialProxy(t *testing.T, proxyAddr string) net.Conn {
+	t.Helper()
+	conn, err := net.DialTimeout("tcp", proxyAddr, 2*time.Second)
+	if err != nil {
+		t.Fatalf("dial proxy: %v", err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	return conn
+}
+
+// socks4Request builds a SOCKS4 request, or SOCKS4a when host is set.
+func socks4Request(cmd byte, ip net.IP, port int, host string) []byte {
+	req := []byte{4, cmd, 0, 0}
+	binary.BigEndian.PutUint16(req[2:], uint16(port))
+	if host != "" {
+		ip = net.IPv4(0, 0, 0, 1)
+	}
+	req = append(req, ip.To4()...)
+	req = append(req, "user"...)
+	req = append(req, 0)
+	if host != "" {
+		req = append(append(req, host...), 0)
+	}
+	return req
+}
+
+func readSocks4Reply(t *testing.T, c net.Conn) (byte, *net.TCPAddr) {
+	t.Helper()
+	resp := make([]byte, 8)
+	if _, err := io.ReadFull(c, resp); err != nil {
+		t.Fatalf("read socks4 reply: %v", err)
+	}
+	if resp[0] != 0 {
+		t.Fatalf("socks4 reply VN=%d, want 0", resp[0])
+	}
+	return resp[1], &net.TCPAddr{IP: net.IP(resp[4:8]), Port: int(binary.BigEndian.Uint16(resp[2:4]))}
+}
+
+func expectEcho(t *testing.T, c net.Conn, msg string) {
+	t.Helper()
+	if _, err := c.Write([]byte(msg)); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	got := make([]byte, len(msg))
+	if _, err := io.ReadFull(c, got); err != nil || string(got) != msg {
+		t.Fatalf("echo = %q, %v; want %q", got, err, msg)
+	}
+}
+
+func TestSocks4_Connect(t *testing.T) {
+	port := tcpEcho(t)
+	proxyAddr := startTestSocks(t, socksOptions{DNSHosts: []string{"echo.test=127.0.0.1"}})
+
+	for name, req := range map[string][]byte{
+		"socks4":  socks4Request(1, net.ParseIP("127.0.0.1"), port, ""),
+		"socks4a": socks4Request(1, nil, port, "echo.test"),
+	} {
+		conn := dialProxy(t, proxyAddr)
+		if _, err := conn.Write(req); err != nil {
+			t.Fatalf("%s: write: %v", name, err)
+		}
+		if rep, _ := readSocks4Reply(t, conn); rep != 90 {
+			t.Fatalf("%s: reply=%d, want 90", name, rep)
+		}
+		expectEcho(t, conn, "hello "+name)
+	}
+}
+
+func TestSocks4_SharesRoutingRules(t *testing.T) {
+	port := tcpEcho(t)
+	rules := []*routeRule{{Action: actionBlock, Domains: []string{"blocked.test"}}}
+	proxyAddr := startTestSocks(t, socksOptions{Rules: rules, DNSHosts: []string{"blocked.test=127.0.0.1"}})
+
+	conn := dialProxy(t, proxyAddr)
+	if _, err := conn.Write(socks4Request(1, nil, port, "blocked.test")); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if rep, _ := readSocks4Reply(t, conn); rep != 91 {
+		t.Fatalf("reply=%d, want 91 (rejected)", rep)
+	}
+
+	conn = dialProxy(t, proxyAddr)
+	if _, err := conn.Write(socks4Request(3, net.ParseIP("127.0.0.1"), port, "")); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if rep, _ := readSocks4Reply(t, conn); rep != 91 {
+		t.Fatalf("unknown command reply=%d, want 91", rep)
+	}
+}
+
+// readSocks5Addr reads a SOCKS5 reply and returns its code and BND address.
+func readSocks5Addr(t *testing.T, c net.Conn) (byte, *net.TCPAddr) {
+	t.Helper()
+	head := make([]byte, 4)
+	if _, err := io.ReadFull(c, head); err != nil {
+		t.Fatalf("read reply: %v", err)
+	}
+	n := 4
+	if head[3] == 4 {
+		n = 16
+	}
+	rest := make([]byte, n+2)
+	if _, err := io.ReadFull(c, rest); err != nil {
+		t.Fatalf("read reply address: %v", err)
+	}
+	return head[1], &net.TCPAddr{IP: net.IP(rest[:n]), Port: int(binary.BigEndian.Uint16(rest[n:]))}
+}
+
+func TestSocks5_Bind(t *testing.T) {
+	proxyAddr := startTestSocks(t, socksOptions{})
+	ctrl := dialProxy(t, proxyAddr)
+	req := appendSocksAddr([]byte{5, 1, 0, 5, 2, 0}, net.ParseIP("127.0.0.1"), 0)
+	if _, err := ctrl.Write(req); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	greeting := make([]byte, 2)
+	if _, err := io.ReadFull(ctrl, greeting); err != nil {
+		t.Fatalf("read greeting: %v", err)
+	}
+	rep, bound := readSocks5Addr(t, ctrl)
+	if rep != 0 || bound.Port == 0 || !bound.IP.Equal(net.ParseIP("127.0.0.1")) {
+		t.Fatalf("first reply rep=%d addr=%s", rep, bound)
+	}
+
+	peer, err := net.DialTimeout("tcp", bound.String(), 2*time.Second)
+	if err != nil {
+		t.Fatalf("peer dial: %v", err)
+	}
+	defer func() { _ = peer.Close() }()
+	_ = peer.SetDeadline(time.Now().Add(5 * time.Second))
+	rep, from := readSocks5Addr(t, ctrl)
+	if rep != 0 || from.Port != peer.LocalAddr().(*net.TCPAddr).Port {
+		t.Fatalf("second reply rep=%d addr=%s, want the peer %s", rep, from, peer.LocalAddr())
+	}
+
+	if _, err := peer.Write([]byte("from peer")); err != nil {
+		t.Fatalf("peer write: %v", err)
+	}
+	got := make([]byte, 9)
+	if _, err := io.ReadFull(ctrl, got); err != nil || string(got) != "from peer" {
+		t.Fatalf("client read %q, %v", got, err)
+	}
+	if _, err := ctrl.Write([]byte("to peer")); err != nil {
+		t.Fatalf("client write: %v", err)
+	}
+	got = make([]byte, 7)
+	if _, err := io.ReadFull(peer, got); err != nil || string(got) != "to peer" {
+		t.Fatalf("peer read %q, %v", got, err)
+	}
+}
+
+func TestSocks5_BindRelayOutlivesAcceptTimeout(t *testing.T) {
+	old := bindAcceptTimeout
+	bindAcceptTimeout = 200 * time.Millisecond
+	t.Cleanup(func() { bindAcceptTimeout = old })
+
+	proxyAddr := startTestSocks(t, socksOptions{})
+	ctrl := dialProxy(t, proxyAddr)
+	if _, err := ctrl.Write(appendSocksAddr([]byte{5, 1, 0, 5, 2, 0}, net.ParseIP("127.0.0.1"), 0)); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if _, err := io.ReadFull(ctrl, make([]byte, 2)); err != nil {
+		t.Fatalf("read greeting: %v", err)
+	}
+	rep, bound := readSocks5Addr(t, ctrl)
+	if rep != 0 {
+		t.Fatalf("first reply rep=%d", rep)
+	}
+	peer, err := net.DialTimeout("tcp", bound.String(), 2*time.Second)
+	if err != nil {
+		t.Fatalf("peer dial: %v", err)
+	}
+	defer func() { _ = peer.Close() }()
+	_ = peer.SetDeadline(time.Now().Add(5 * time.Second))
+	if rep, _ := readSocks5Addr(t, ctrl); rep != 0 {
+		t.Fatalf("second reply rep=%d", rep)
+	}
+
+	// Data keeps flowing well past the accept timeout.
+	for i := 0; i < 4; i++ {
+		time.Sleep(150 * time.Millisecond)
+		if _, err := ctrl.Write([]byte("x")); err != nil {
+			t.Fatalf("client write %d: %v", i, err)
+		}
+		got := make([]byte, 1)
+		if _, err := io.ReadFull(peer, got); err != nil || got[0] != 'x' {
+			t.Fatalf("peer read %d: %q, %v", i, got, err)
+		}
+	}
+}
+
+func TestSocks4_BindRejectsOtherPeers(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("needs the whole 127.0.0.0/8 on loopback")
+	}
+	proxyAddr := startTestSocks(t, socksOptions{})
+	ctrl := dialProxy(t, proxyAddr)
+	if _, err := ctrl.Write(socks4Request(2, net.ParseIP("127.0.0.2"), 21, "")); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	rep, bound := readSocks4Reply(t, ctrl)
+	if rep != 90 || bound.Port == 0 {
+		t.Fatalf("first reply rep=%d addr=%s", rep, bound)
+	}
+
+	// A connection from 127.0.0.1 is not the expected peer 127.0.0.2 and is closed.
+	stranger, err := net.DialTimeout("tcp", bound.String(), 2*time.Second)
+	if err != nil {
+		t.Fatalf("stranger dial: %v", err)
+	}
+	defer func() { _ = stranger.Close() }()
+	_ = stranger.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := stranger.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("stranger read: %v, want EOF", err)
+	}
+
+	d := net.Dialer{LocalAddr: &net.TCPAddr{IP: net.ParseIP("127.0.0.2")}, Timeout: 2 * time.Second}
+	peer, err := d.Dial("tcp", bound.String())
+	if err != nil {
+		t.Fatalf("peer dial: %v", err)
+	}
+	defer func() { _ = peer.Close() }()
+	if rep, from := readSocks4Reply(t, ctrl); rep != 90 || !from.IP.Equal(net.ParseIP("127.0.0.2")) {
+		t.Fatalf("second reply rep=%d addr=%s", rep, from)
+	}
+	if _, err := ctrl.Write([]byte("x")); err != nil {
+		t.Fatalf("client write: %v", err)
+	}
+	_ = peer.SetReadDeadline(time.Now().Add(2 * time.Second))
+	got := make([]byte, 1)
+	if _, err := io.ReadFull(peer, got); err != nil || got[0] != 'x' {
+		t.Fatalf("peer read %q, %v", got, err)
+	}
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Defaults for the SOCKS connection limits and timeouts (see socksLimits).
+const (
+	DefaultSocksMaxConns         = 1024
+	DefaultSocksIdleTimeout      = 5 * time.Minute
+	DefaultSocksHalfCloseTimeout = 30 * time.Second
+	DefaultSocksDrainTimeout     = 5 * time.Second
+
+	// socksKeepAlive is the TCP keepalive period of client and outbound connections, so
+	// peers that vanish without a FIN (sleeping laptops, dropped NAT state) are noticed.
+	socksKeepAlive = 30 * time.Second
+)
+
+// socksLimits bounds the connections of one SOCKS listener. Zero values mean no limit
+// or no timeout.
+type socksLimits struct {
+	MaxConns      int // concurrent client connections
+	MaxConnsPerIP int // concurrent client connections from one source address
+
+	IdleTimeout      time.Duration // close a relay with no traffic in either direction
+	HalfCloseTimeout time.Duration // idle limit once one direction has finished; 0 keeps IdleTimeout
+	DrainTimeout     time.Duration // how long stop waits for open connections
+}
+
+// connTracker counts a listener's client connections so the limits can be enforced
+// and the survivors closed when draining times out.
+type connTracker struct {
+	limits socksLimits
+	wg     sync.WaitGroup
+
+	mu    sync.Mutex
+	conns map[net.Conn]string // conn -> source IP
+	perIP map[string]int
+}
+
+func newConnTracker(limits socksLimits) *connTracker {
+	return &connTracker{limits: limits, conns: map[net.Conn]string{}, perIP: map[string]int{}}
+}
+
+// add registers c, or reports which limit refuses it.
+func (t *connTracker) add(c net.Conn) (ok bool, reason string) {
+	ip := c.RemoteAddr().String()
+	if rip := remoteIP(c); rip != nil {
+		ip = rip.String()
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.limits.MaxConns > 0 && len(t.conns) >= t.limits.MaxConns {
+		return false, "max connections reached"
+	}
+	if t.limits.MaxConnsPerIP > 0 && t.perIP[ip] >= t.limits.MaxConnsPerIP {
+		return false, "max connections per IP reached"
+	}
+	t.conns[c] = ip
+	t.perIP[ip]++
+	t.wg.Add(1)
+	return true, ""
+}
+
+func (t *connTracker) remove(c net.Conn) {
+	t.mu.Lock()
+	if ip, ok := t.conns[c]; ok {
+		delete(t.conns, c)
+		if t.perIP[ip]--; t.perIP[ip] <= 0 {
+			delete(t.perIP, ip)
+		}
+		t.wg.Done()
+	}
+	t.mu.Unlock()
+}
+
+// count returns the number of open client connections.
+func (t *connTracker) count() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.conns)
+}
+
+// drain waits up to timeout for every connection to finish. Whatever is left is then
+// interrupted with kill and closed, and drain waits for the handlers to return. It
+// returns how many connections had to be closed.
+func (t *connTracker) drain(timeout time.Duration, kill context.CancelFunc) int {
+	done := make(chan struct{})
+	go func() {
+		t.wg.Wait()
+		close(done)
+	}()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-done:
+		return 0
+	case <-timer.C:
+	}
+	kill()
+	t.mu.Lock()
+	n := len(t.conns)
+	for c := range t.conns {
+		_ = c.Close()
+	}
+	t.mu.Unlock()
+	<-done
+	return n
+}
+
+// relay copies between the client and remote connections in both directions until both
+// directions finish, shaped by cs (nil for no shaping). It closes both early when ctx
+// ends, when neither direction has carried data for IdleTimeout, or, once one direction
+// has finished, for HalfCloseTimeout.
+func (srv *socksServer) relay(ctx context.Context, client, remote net.Conn, cs *connShaping) {
+	var lastActive atomic.Int64
+	var halfClosed atomic.Bool
+	touch := func() { lastActive.Store(time.Now().UnixNano()) }
+	touch()
+
+	copyDir := func(dst, src net.Conn, dir int, wg *sync.WaitGroup) {
+		defer wg.Done()
+		_, _ = io.Copy(dst, activityReader{cs.reader(ctx, src, dir), touch})
+		// Signal EOF to the write side of dst so the peer sees a clean close. Both
+		// *net.TCPConn and the userspace stack's connections support half-close.
+		if tc, ok := dst.(interface{ CloseWrite() error }); ok {
+			_ = tc.CloseWrite()
+		}
+		halfClosed.Store(true)
+		touch()
+	}
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go copyDir(remote, client, dirUpload, &wg)
+	go copyDir(client, remote, dirDownload, &wg)
+
+	finished := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(finished)
+	}()
+
+	idle, half := srv.limits.IdleTimeout, srv.limits.HalfCloseTimeout
+	var tick <-chan time.Time
+	if interval := watchdogInterval(idle, half); interval > 0 {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		tick = t.C
+	}
+	for {
+		select {
+		case <-finished:
+			return
+		case <-ctx.Done():
+		case now := <-tick:
+			limit := idle
+			if halfClosed.Load() && half > 0 {
+				limit = half
+			}
+			if limit <= 0 || now.Sub(time.Unix(0, lastActive.Load())) <= limit {
+				continue
+			}
+			if srv.debug {
+				fmt.Printf("[socks] relay %s <-> %s idle for %s, closing\n", client.RemoteAddr(), remote.RemoteAddr(), limit)
+			}
+		}
+		_ = client.Close()
+		_ = remote.Close()
+		<-finished
+		return
+	}
+}
+
+// remoteIP returns the IP address of c's peer, or nil when it has none.
+func remoteIP(c net.Conn) net.IP {
+	switch a := c.RemoteAddr().(type) {
+	case *net.TCPAddr:
+		return a.IP
+	case *net.UDPAddr:
+		return a.IP
+	}
+	return nil
+}
+
+// watchdogInterval is how often relay checks for idleness: a quarter of the shorter
+// timeout, at most a second; 0 when neither timeout is set.
+func watchdogInterval(idle, half time.Duration) time.Duration {
+	d := idle
+	if half > 0 && (d <= 0 || half < d) {
+		d = half
+	}
+	if d <= 0 {
+		return 0
+	}
+	return min(d/4, time.Second)
+}
+
+// activityReader calls touch after every read that returns data.
+type activityReader struct {
+	r     io.Reader
+	touch func()
+}
+
+func (r activityReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if n > 0 {
+		r.touch()
+	}
+	return n, err
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// socksConnectTo runs a SOCKS5 CONNECT to 127.0.0.1:port and fails unless it succeeds.
+func socksConnectTo(t *testing.T, proxyAddr string, port int) net.Conn {
+	t.Helper()
+	conn, rep := socksConnectIP(t, proxyAddr, port)
+	t.Cleanup(func() { _ = conn.Close() })
+	if rep != 0 {
+		t.Fatalf("CONNECT reply=%d", rep)
+	}
+	return conn
+}
+
+// expectClosed fails unless the proxy closes c within within.
+func expectClosed(t *testing.T, c net.Conn, within time.Duration) {
+	t.Helper()
+	_ = c.SetReadDeadline(time.Now().Add(within))
+	if _, err := c.Read(make([]byte, 1)); err == nil {
+		t.Fatal("read data, want the connection closed")
+	} else if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		t.Fatalf("connection still open after %s", within)
+	}
+}
+
+func TestSocks_ConnectionLimits(t *testing.T) {
+	for name, limits := range map[string]socksLimits{
+		"global": {MaxConns: 2},
+		"per IP": {MaxConns: 10, MaxConnsPerIP: 2},
+	} {
+		t.Run(name, func(t *testing.T) {
+			proxyAddr := startTestSocks(t, socksOptions{Limits: limits})
+			// Two connections stalled in the handshake take up the allowance.
+			dialProxy(t, proxyAddr)
+			held := dialProxy(t, proxyAddr)
+			expectClosed(t, dialProxy(t, proxyAddr), 2*time.Second)
+
+			// A slot frees up once a connection goes away.
+			_ = held.Close()
+			time.Sleep(50 * time.Millisecond)
+			c := dialProxy(t, proxyAddr)
+			if _, err := c.Write([]byte{5, 1, 0}); err != nil {
+				t.Fatalf("write greeting: %v", err)
+			}
+			resp := make([]byte, 2)
+			if _, err := io.ReadFull(c, resp); err != nil || resp[1] != 0 {
+				t.Fatalf("greeting reply %v, %v", resp, err)
+			}
+		})
+	}
+}
+
+func TestSocks_RelayIdleTimeout(t *testing.T) {
+	port := tcpEcho(t)
+	proxyAddr := startTestSocks(t, socksOptions{Limits: socksLimits{IdleTimeout: 200 * time.Millisecond}})
+	conn := socksConnectTo(t, proxyAddr, port)
+
+	// Traffic keeps the relay open past the idle timeout.
+	for range 4 {
+		expectEcho(t, conn, "ping")
+		time.Sleep(100 * time.Millisecond)
+	}
+	expectClosed(t, conn, 2*time.Second)
+}
+
+func TestSocks_RelayHalfCloseTimeout(t *testing.T) {
+	// The destination never answers and never closes.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { _ = ln.Close() })
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			t.Cleanup(func() { _ = c.Close() })
+		}
+	}()
+	proxyAddr := startTestSocks(t, socksOptions{Limits: socksLimits{IdleTimeout: time.Hour, HalfCloseTimeout: 200 * time.Millisecond}})
+	conn := socksConnectTo(t, proxyAddr, ln.Addr().(*net.TCPAddr).Port)
+
+	if err := conn.(*net.TCPConn).CloseWrite(); err != nil {
+		t.Fatalf("CloseWrite: %v", err)
+	}
+	expectClosed(t, conn, 2*time.Second)
+}
+
+func TestSocks_StopDrainsThenCloses(t *testing.T) {
+	port := tcpEcho(t)
+	addr := grabFreeAddr(t)
+	stop, err := startSocks(context.Background(), socksOptions{ListenAddr: addr, Limits: socksLimits{DrainTimeout: 500 * time.Millisecond}})
+	if err != nil {
+		t.Fatalf("startSocks: %v", err)
+	}
+	conn := socksConnectTo(t, addr, port)
+
+	start := time.Now()
+	stopped := make(chan struct{})
+	go func() {
+		_ = stop()
+		close(stopped)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	if c, err := net.DialTimeout("tcp", addr, time.Second); err == nil {
+		_ = c.Close()
+		t.Fatal("listener still accepting while draining")
+	}
+	// Established relays keep working during the drain period...
+	expectEcho(t, conn, "still here")
+	// ...and are closed when it ends.
+	expectClosed(t, conn, 2*time.Second)
+	select {
+	case <-stopped:
+	case <-time.After(2 * time.Second):
+		t.Fatal("stop did not return after the drain period")
+	}
+	if d := time.Since(start); d < 400*time.Millisecond {
+		t.Fatalf("stop returned after %s, before the drain period", d)
+	}
+}
+
+func TestSocks_StopReturnsOnceDrained(t *testing.T) {
+	port := tcpEcho(t)
+	addr := grabFreeAddr(t)
+	stop, err := startSocks(context.Background(), socksOptions{ListenAddr: addr, Limits: socksLimits{DrainTimeout: time.Minute}})
+	if err != nil {
+		t.Fatalf("startSocks: %v", err)
+	}
+	conn := socksConnectTo(t, addr, port)
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		_ = conn.Close()
+	}()
+	start := time.Now()
+	_ = stop()
+	if d := time.Since(start); d > 5*time.Second {
+		t.Fatalf("stop took %s although the only connection closed", d)
+	}
+}
+
+// addrConn is a net.Conn that only reports a remote address.
+type addrConn struct {
+	net.Conn
+	remote *net.TCPAddr
+}
+
+func (c addrConn) RemoteAddr() net.Addr { return c.remote }
+
+func TestConnTracker_PerIP(t *testing.T) {
+	tr := newConnTracker(socksLimits{MaxConns: 3, MaxConnsPerIP: 2})
+	from := func(ip string, port int) net.Conn {
+		return addrConn{remote: &net.TCPAddr{IP: net.ParseIP(ip), Port: port}}
+	}
+	a1, a2, a3 := from("192.0.2.1", 1), from("192.0.2.1", 2), from("192.0.2.1", 3)
+	b1, b2 := from("192.0.2.2", 1), from("192.0.2.2", 2)
+	for _, tc := range []struct {
+		c    net.Conn
+		want bool
+	}{{a1, true}, {a2, true}, {a3, false}, {b1, true}, {b2, false}} {
+		if ok, reason := tr.add(tc.c); ok != tc.want {
+			t.Fatalf("add %s = %v (%s), want %v", tc.c.RemoteAddr(), ok, reason, tc.want)
+		}
+	}
+	tr.remove(a1)
+	if ok, _ := tr.add(a3); !ok {
+		t.Fatal("freed per-IP slot not reusable")
+	}
+	if tr.count() != 3 {
+		t.Fatalf("count = %d, want 3", tr.count())
+	}
+}
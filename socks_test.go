@@ -5,8 +5,13 @@ import (
 	"encoding/binary"
 	"io"
 	"net"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+	"golang.org/x/net/proxy"
 )
 
 func TestDomainMatches(t *testing.T) {
@@ -87,8 +92,9 @@ func buildDNSResponse(query []byte, n int, answerIP net.IP) []byte {
 	hdr[3] = 0x80
 	binary.BigEndian.PutUint16(hdr[4:6], 1) // qdcount=1
 
-	question := make([]byte, n-12)
-	copy(question, query[12:n])
+	// Copy only the question; resolvers append an EDNS0 OPT record after it.
+	question := make([]byte, off+4-12)
+	copy(question, query[12:off+4])
 
 	if qtype == 1 && answerIP != nil { // A record
 		ip4 := answerIP.To4()
@@ -149,6 +155,27 @@ func buildSocks5Connect(domain string, port uint16) []byte {
 	return pkt
 }
 
+// socksConnectIP performs a no-auth SOCKS5 CONNECT to 127.0.0.1:port and returns the
+// reply code.
+func socksConnectIP(t *testing.T, proxyAddr string, port int) (net.Conn, byte) {
+	t.Helper()
+	conn, err := net.DialTimeout("tcp", proxyAddr, 2*time.Second)
+	if err != nil {
+		t.Fatalf("dial proxy: %v", err)
+	}
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	req := []byte{5, 1, 0, 5, 1, 0, 1, 127, 0, 0, 1, 0, 0}
+	binary.BigEndian.PutUint16(req[11:], uint16(port))
+	if _, err := conn.Write(req); err != nil {
+		t.Fatalf("write socks5 request: %v", err)
+	}
+	resp := make([]byte, 12)
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		t.Fatalf("read socks5 reply: %v", err)
+	}
+	return conn, resp[3]
+}
+
 // grabFreeAddr returns a local TCP address with an OS-assigned free port.
 // The listener is closed immediately — there is a small TOCTOU window, which is
 // acceptable for unit tests.
@@ -306,3 +333,136 @@ func TestSocks5_DefaultDNS_NXDOMAINFails(t *testing.T) {
 		t.Error("expected CONNECT to fail for testdomain.invalid with default resolver, but got success")
 	}
 }
+
+// TestSocks5_BlockRule verifies that a matching block rule refuses an IP-literal CONNECT
+// with reply 2 (connection not allowed by ruleset) before anything is dialed.
+func TestSocks5_BlockRule(t *testing.T) {
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("target listen: %v", err)
+	}
+	defer func() { _ = target.Close() }()
+	accepted := make(chan struct{}, 1)
+	go func() {
+		if c, err := target.Accept(); err == nil {
+			accepted <- struct{}{}
+			_ = c.Close()
+		}
+	}()
+	port := target.Addr().(*net.TCPAddr).Port
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	rules := []*routeRule{{Action: actionBlock, CIDRs: []*net.IPNet{parseCIDRHost("127.0.0.0/8")}, Ports: []portRange{{lo: port, hi: port}}}}
+	proxyAddr := grabFreeAddr(t)
+	stop, err := startSocks(ctx, socksOptions{ListenAddr: proxyAddr, Rules: rules})
+	if err != nil {
+		t.Fatalf("startSocks: %v", err)
+	}
+	defer func() { _ = stop() }()
+
+	conn, rep := socksConnectIP(t, proxyAddr, port)
+	defer func() { _ = conn.Close() }()
+	if rep != 2 {
+		t.Fatalf("CONNECT reply code=%d, want 2 (not allowed by ruleset)", rep)
+	}
+	select {
+	case <-accepted:
+		t.Fatal("blocked destination was dialed")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+// socksClientDial connects to addr through the SOCKS5 proxy with the x/net client.
+func socksClientDial(t *testing.T, proxyAddr, addr string) (net.Conn, error) {
+	t.Helper()
+	d, err := proxy.SOCKS5("tcp", proxyAddr, nil, &net.Dialer{Timeout: 5 * time.Second})
+	if err != nil {
+		t.Fatalf("proxy.SOCKS5: %v", err)
+	}
+	// DialContext, unlike Dial, returns the client's conn, which carries BND.ADDR.
+	c, err := d.(proxy.ContextDialer).DialContext(context.Background(), "tcp", addr)
+	if c != nil {
+		t.Cleanup(func() { _ = c.Close() })
+	}
+	return c, err
+}
+
+// TestSocks5_ReplyBoundAddr checks BND.ADDR/BND.PORT in CONNECT replies are the
+// proxy's outbound address, encoded as IPv4 or IPv6 to match.
+func TestSocks5_ReplyBoundAddr(t *testing.T) {
+	for _, network := range []string{"tcp4", "tcp6"} {
+		t.Run(network, func(t *testing.T) {
+			host := "127.0.0.1"
+			if network == "tcp6" {
+				host = "::1"
+			}
+			ln, err := net.Listen(network, net.JoinHostPort(host, "0"))
+			if err != nil {
+				t.Skipf("no %s loopback: %v", network, err)
+			}
+			defer func() { _ = ln.Close() }()
+			accepted := make(chan net.Addr, 1)
+			go func() {
+				if c, err := ln.Accept(); err == nil {
+					accepted <- c.RemoteAddr()
+					_ = c.Close()
+				}
+			}()
+			proxyAddr := startTestSocks(t, socksOptions{EnableIPv6: true})
+
+			c, err := socksClientDial(t, proxyAddr, ln.Addr().String())
+			if err != nil {
+				t.Fatalf("dial: %v", err)
+			}
+			bound, ok := c.(interface{ BoundAddr() net.Addr })
+			if !ok {
+				t.Fatalf("%T has no BoundAddr", c)
+			}
+			got, err := net.ResolveTCPAddr("tcp", bound.BoundAddr().String())
+			if err != nil {
+				t.Fatalf("BND %s: %v", bound.BoundAddr(), err)
+			}
+			var want *net.TCPAddr
+			select {
+			case a := <-accepted:
+				want = a.(*net.TCPAddr)
+			case <-time.After(2 * time.Second):
+				t.Fatal("target saw no connection")
+			}
+			if !got.IP.Equal(want.IP) || got.Port != want.Port || (got.IP.To4() == nil) != (network == "tcp6") {
+				t.Fatalf("BND = %s, want %s", got, want)
+			}
+		})
+	}
+}
+
+// TestSocks5_ReplyErrorCodes checks the reply codes clients see for refused ports,
+// unknown names, IPv6 literals with IPv6 disabled and rule blocks.
+func TestSocks5_ReplyErrorCodes(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	refused := ln.Addr().(*net.TCPAddr).Port
+	_ = ln.Close()
+
+	upstream := (&standInDNS{rcode: dnsmessage.RCodeNameError}).serveUDP(t)
+	rules := []*routeRule{{Action: actionBlock, Domains: []string{"blocked.test"}}}
+	proxyAddr := startTestSocks(t, socksOptions{DNSServers: []string{upstream}, Rules: rules})
+
+	for _, tc := range []struct {
+		addr string
+		want string
+	}{
+		{net.JoinHostPort("127.0.0.1", strconv.Itoa(refused)), "connection refused"},
+		{"missing.test:80", "host unreachable"},
+		{"[::1]:80", "host unreachable"},
+		{"blocked.test:80", "connection not allowed by ruleset"},
+	} {
+		_, err := socksClientDial(t, proxyAddr, tc.addr)
+		if err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("dial %s: %v, want %q", tc.addr, err, tc.want)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// socksTLSScheme prefixes a SOCKS listen address whose clients speak SOCKS inside TLS.
+const socksTLSScheme = "socks+tls://"
+
+// socksTLSOptions names the certificate files for socks+tls:// listeners.
+type socksTLSOptions struct {
+	Cert     string // server certificate chain (PEM)
+	Key      string // its private key (PEM)
+	ClientCA string // CA bundle client certificates must chain to; "" asks for none
+}
+
+// splitListenAddr returns addr without its socks+tls:// prefix, and whether it had one.
+func splitListenAddr(addr string) (string, bool) {
+	if rest, ok := strings.CutPrefix(addr, socksTLSScheme); ok {
+		return rest, true
+	}
+	return addr, false
+}
+
+// serverConfig loads the certificate files. With a client CA, every client must
+// present a certificate that chains to it.
+func (o socksTLSOptions) serverConfig() (*tls.Config, error) {
+	if o.Cert == "" || o.Key == "" {
+		return nil, fmt.Errorf("%s listeners need socks_tls_cert and socks_tls_key", socksTLSScheme)
+	}
+	cert, err := tls.LoadX509KeyPair(o.Cert, o.Key)
+	if err != nil {
+		return nil, fmt.Errorf("socks_tls_cert: %w", err)
+	}
+	conf := &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	if o.ClientCA != "" {
+		pem, err := os.ReadFile(o.ClientCA)
+		if err != nil {
+			return nil, fmt.Errorf("socks_tls_client_ca: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("socks_tls_client_ca: %s holds no PEM certificates", o.ClientCA)
+		}
+		conf.ClientCAs = pool
+		conf.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return conf, nil
+}
+
+// tlsUser returns the SOCKS user a verified client certificate stands for: its
+// subject's common name, or the whole subject when that is empty. It returns "" when
+// the client presented no verified certificate.
+func tlsUser(cs tls.ConnectionState) string {
+	if len(cs.VerifiedChains) == 0 || len(cs.PeerCertificates) == 0 {
+		return ""
+	}
+	subject := cs.PeerCertificates[0].Subject
+	if subject.CommonName != "" {
+		return subject.CommonName
+	}
+	return subject.String()
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/docopt/docopt-go"
+)
+
+// testCA issues certificates for the TLS listener tests.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	dir  string
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	ca := &testCA{cert: cert, key: key, dir: t.TempDir()}
+	ca.write(t, "ca.pem", "CERTIFICATE", der)
+	return ca
+}
+
+func (ca *testCA) write(t *testing.T, name, typ string, der []byte) string {
+	t.Helper()
+	path := filepath.Join(ca.dir, name)
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// issue returns a certificate for subject, valid for 127.0.0.1 (server) or as a
+// client certificate, and the paths of its PEM files.
+func (ca *testCA) issue(t *testing.T, name string, subject pkix.Name, server bool) (tls.Certificate, string, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      subject,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	if server {
+		tmpl.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+		tmpl.IPAddresses = []net.IP{net.IPv4(127, 0, 0, 1)}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPath := ca.write(t, name+".pem", "CERTIFICATE", der)
+	keyPath := ca.write(t, name+"-key.pem", "EC PRIVATE KEY", keyDER)
+	pair, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pair, certPath, keyPath
+}
+
+func (ca *testCA) pool() *x509.CertPool {
+	p := x509.NewCertPool()
+	p.AddCert(ca.cert)
+	return p
+}
+
+// tlsSocksConnect sends a no-auth SOCKS5 CONNECT to 127.0.0.1:port over TLS, presenting
+// client when it is not nil.
+func tlsSocksConnect(t *testing.T, proxyAddr string, ca *testCA, client *tls.Certificate, port int) net.Conn {
+	t.Helper()
+	conf := &tls.Config{RootCAs: ca.pool()}
+	if client != nil {
+		conf.Certificates = []tls.Certificate{*client}
+	}
+	c, err := tls.DialWithDialer(&net.Dialer{Timeout: 2 * time.Second}, "tcp", proxyAddr, conf)
+	if err != nil {
+		t.Fatalf("TLS dial: %v", err)
+	}
+	t.Cleanup(func() { _ = c.Close() })
+	_ = c.SetDeadline(time.Now().Add(5 * time.Second))
+	req := []byte{5, 1, 0, 5, 1, 0, 1, 127, 0, 0, 1, 0, 0}
+	binary.BigEndian.PutUint16(req[11:], uint16(port))
+	if _, err := c.Write(req); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	return c
+}
+
+func TestSocksTLS_Connect(t *testing.T) {
+	port := tcpEcho(t)
+	ca := newTestCA(t)
+	_, cert, key := ca.issue(t, "server", pkix.Name{CommonName: "proxy"}, true)
+	files := socksTLSOptions{Cert: cert, Key: key}
+	plainAddr := startTestSocks(t, socksOptions{TLS: files})
+	tlsAddr := grabFreeAddr(t)
+	stop, err := startSocks(context.Background(), socksOptions{ListenAddr: socksTLSScheme + tlsAddr, TLS: files})
+	if err != nil {
+		t.Fatalf("startSocks: %v", err)
+	}
+	t.Cleanup(func() { _ = stop() })
+
+	c := tlsSocksConnect(t, tlsAddr, ca, nil, port)
+	expectConnected(t, c)
+	expectEcho(t, c, "over TLS")
+	// The certificate is only used with the scheme.
+	c = socksConnectVia(t, plainAddr, nil, port)
+	expectConnected(t, c)
+	// A plaintext client gets nothing back from the TLS listener.
+	expectClosed(t, socksConnectVia(t, tlsAddr, nil, port), 2*time.Second)
+
+	if _, err := startSocks(context.Background(), socksOptions{ListenAddr: socksTLSScheme + grabFreeAddr(t)}); err == nil {
+		t.Fatal("started a TLS listener without a certificate")
+	}
+}
+
+func TestSocksTLS_ClientCertificateIsUser(t *testing.T) {
+	port := tcpEcho(t)
+	ca := newTestCA(t)
+	_, cert, key := ca.issue(t, "server", pkix.Name{CommonName: "proxy"}, true)
+	alice, _, _ := ca.issue(t, "alice", pkix.Name{CommonName: "alice"}, false)
+	germany, _, _ := ca.issue(t, "germany", pkix.Name{CommonName: "country:Germany"}, false)
+	other := newTestCA(t)
+	stranger, _, _ := other.issue(t, "stranger", pkix.Name{CommonName: "alice"}, false)
+
+	var mu sync.Mutex
+	var exits []string
+	pool := testEgressPool(t, func(ctx context.Context, loc LocationConfig, e *locationEgress) error {
+		key := locationKey(loc)
+		e.dial = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			mu.Lock()
+			exits = append(exits, key)
+			mu.Unlock()
+			return (&net.Dialer{}).DialContext(ctx, network, addr)
+		}
+		e.close = func() {}
+		return nil
+	})
+	addr := grabFreeAddr(t)
+	stop, err := startSocks(context.Background(), socksOptions{
+		ListenAddr: socksTLSScheme + addr,
+		TLS:        socksTLSOptions{Cert: cert, Key: key, ClientCA: filepath.Join(ca.dir, "ca.pem")},
+		Auth:       []string{"bob:pw"}, // a certificate stands in for the password
+		Egress:     pool,
+	})
+	if err != nil {
+		t.Fatalf("startSocks: %v", err)
+	}
+	t.Cleanup(func() { _ = stop() })
+
+	for _, client := range []*tls.Certificate{&alice, &germany} {
+		c := tlsSocksConnect(t, addr, ca, client, port)
+		expectConnected(t, c)
+		expectEcho(t, c, "with a certificate")
+	}
+	if got := strings.Join(exits, ","); got != "country:germany" {
+		t.Fatalf("exits = %q, want the certificate's location only", got)
+	}
+	expectClosed(t, tlsSocksConnect(t, addr, ca, nil, port), 2*time.Second)
+	expectClosed(t, tlsSocksConnect(t, addr, ca, &stranger, port), 2*time.Second)
+}
+
+func TestTLSUser(t *testing.T) {
+	cert := &x509.Certificate{Subject: pkix.Name{Organization: []string{"Example"}, OrganizationalUnit: []string{"ops"}}}
+	verified := [][]*x509.Certificate{{cert}}
+	if got := tlsUser(tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}, VerifiedChains: verified}); got != "OU=ops,O=Example" {
+		t.Errorf("user without a common name = %q", got)
+	}
+	cert.Subject.CommonName = "alice"
+	if got := tlsUser(tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}, VerifiedChains: verified}); got != "alice" {
+		t.Errorf("user = %q, want alice", got)
+	}
+	if got := tlsUser(tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}); got != "" {
+		t.Errorf("unverified certificate gave user %q", got)
+	}
+}
+
+func TestValidateConfig_SOCKSTLS(t *testing.T) {
+	ca := newTestCA(t)
+	_, cert, key := ca.issue(t, "server", pkix.Name{CommonName: "proxy"}, true)
+	caPath := filepath.Join(ca.dir, "ca.pem")
+	files := "socks_tls_cert: " + cert + "\nsocks_tls_key: " + key + "\n"
+	for body, want := range map[string]string{
+		"socks: socks+tls://127.0.0.1:1080\n" + files:                                                    "",
+		"socks: socks+tls://127.0.0.1:1080\n" + files + "socks_tls_client_ca: " + caPath + "\n":          "",
+		"socks: socks+tls://127.0.0.1:1080\n":                                                            "socks_tls_cert and socks_tls_key",
+		"socks: 127.0.0.1:1080\nsocks_tls_client_ca: " + caPath + "\n":                                   "socks_tls_client_ca",
+		"socks: 127.0.0.1:1080\n" + files + "socks_tls_client_ca: " + cert + "x\n":                       "socks_tls_client_ca",
+		"socks: socks+tls://127.0.0.1:1080\nsocks_tls_cert: " + cert + "\nsocks_tls_key: " + cert + "\n": "socks_tls_cert",
+		"socks: socks+tls://127.0.0.1:1080\nlisteners:\n  - listen: 127.0.0.1:1080\n" + files:            "more than one SOCKS listener",
+		"tun: tun0\ntransparent: socks+tls://0.0.0.0:12345\n":                                            "is for SOCKS listeners",
+		"listeners:\n  - listen: socks+tls://127.0.0.1:1081\n":                                           "socks_tls_cert and socks_tls_key",
+	} {
+		rc, err := resolveConfigWith(docopt.Opts{"--config": writeConfig(t, body)}, fakeEnv(nil))
+		if err != nil {
+			t.Fatalf("resolveConfig(%q): %v", body, err)
+		}
+		errs := validateConfig(rc)
+		switch {
+		case want == "" && len(errs) > 0:
+			t.Errorf("%q: unexpected problems %v", body, errs)
+		case want != "" && (len(errs) != 1 || !strings.Contains(errs[0].Error(), want)):
+			t.Errorf("%q: problems %v, want one about %q", body, errs, want)
+		}
+	}
+}
@@ -0,0 +1,356 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// udpMappingIdleTimeout closes a destination's outbound socket after this long
+	// without traffic in either direction.
+	udpMappingIdleTimeout = 2 * time.Minute
+	// maxUDPMappings bounds the destinations one association may talk to at once.
+	maxUDPMappings = 512
+)
+
+// udpAssociation relays datagrams for one UDP ASSOCIATE control connection, or for one
+// Shadowsocks UDP client. Each destination gets its own connected outbound socket (its
+// NAT mapping), so replies are only accepted from the address the client sent to.
+type udpAssociation struct {
+	srv     *socksServer
+	shaping *connShaping                                   // nil without bandwidth limits
+	client  net.PacketConn                                 // client-facing socket
+	encode  func(from *net.UDPAddr, payload []byte) []byte // frames a reply for the client
+
+	egress     *locationEgress // exit location for datagrams routed through the VPN; nil for bindIf
+	peerIP     net.IP          // the control connection's peer; datagrams must come from it
+	clientPort int             // port the client announced, 0 when unknown
+	clientAddr atomic.Pointer[net.UDPAddr]
+
+	mu       sync.Mutex
+	mappings map[string]*udpMapping
+}
+
+type udpMapping struct {
+	key        string
+	conn       net.Conn
+	lastActive atomic.Int64 // unix nanoseconds
+}
+
+func (m *udpMapping) touch() { m.lastActive.Store(time.Now().UnixNano()) }
+
+// runUDPAssociate implements SOCKS5 UDP ASSOCIATE for a single TCP control connection.
+// The client-facing socket is bound to the address the client reached the proxy on, so
+// LAN and IPv6 clients can use it. The request's DST.ADDR/DST.PORT are the address the
+// client will send from, or zeros when it does not know.
+func runUDPAssociate(ctx context.Context, ctrl net.Conn, srv *socksServer, req *socksRequest) {
+	host, port := req.host, req.port
+	local, _ := ctrl.LocalAddr().(*net.TCPAddr)
+	peer, _ := ctrl.RemoteAddr().(*net.TCPAddr)
+	if local == nil || peer == nil {
+		_ = writeSocksReply(ctrl, 1, nil)
+		return
+	}
+	pc, err := net.ListenPacket("udp", net.JoinHostPort(local.IP.String(), "0"))
+	if err != nil {
+		_ = writeSocksReply(ctrl, 1, nil)
+		return
+	}
+	defer func() { _ = pc.Close() }()
+	la := pc.LocalAddr().(*net.UDPAddr)
+	if srv.debug {
+		fmt.Printf("[socks] UDP ASSOCIATE for %s (announced %s) listening at %s bindIf=%s\n",
+			peer, net.JoinHostPort(host, fmt.Sprint(port)), la, srv.bindIf)
+	}
+	// Reply success with our UDP bind address
+	if err := writeSocksReply(ctrl, 0, la); err != nil {
+		return
+	}
+	// The association lives as long as the control connection.
+	_ = ctrl.SetDeadline(time.Time{})
+
+	cs := srv.shaper.acquire(peer.IP, req.user)
+	defer cs.release()
+	a := &udpAssociation{
+		srv:        srv,
+		shaping:    cs,
+		client:     pc,
+		encode:     socksUDPReply,
+		egress:     req.egress,
+		peerIP:     peer.IP,
+		clientPort: port,
+		mappings:   map[string]*udpMapping{},
+	}
+	if ip := net.ParseIP(host); ip != nil && !ip.IsUnspecified() && !ip.Equal(peer.IP) && srv.debug {
+		// Clients behind NAT announce their private address; the peer address is what counts.
+		fmt.Printf("[socks-udp] client announced %s but connected from %s; using %s\n", ip, peer.IP, peer.IP)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		_, _ = io.Copy(io.Discard, ctrl)
+		cancel()
+	}()
+	go func() {
+		<-ctx.Done()
+		_ = pc.Close()
+	}()
+	go a.expireLoop(ctx)
+	defer a.closeAll()
+
+	a.readClient(ctx)
+}
+
+// readClient relays datagrams from the client until the client socket is closed.
+func (a *udpAssociation) readClient(ctx context.Context) {
+	srv := a.srv
+	b := make([]byte, 65535)
+	for {
+		n, from, err := a.client.ReadFrom(b)
+		if err != nil {
+			return
+		}
+		src, ok := from.(*net.UDPAddr)
+		if !ok || !a.acceptSource(src) {
+			if srv.debug {
+				fmt.Printf("[socks-udp] dropped datagram from unexpected source %s\n", from)
+			}
+			continue
+		}
+		frag, dstIP, reqDomain, dstPort, payload, ok := parseSocksUDPHeader(b[:n])
+		if !ok {
+			continue
+		}
+		if frag != 0 {
+			// Fragment reassembly is optional (RFC 1928 section 7) and not supported;
+			// fragmented datagrams must then be dropped.
+			if srv.debug {
+				fmt.Printf("[socks-udp] dropped fragmented datagram (FRAG=%d) from %s\n", frag, src)
+			}
+			continue
+		}
+		if !a.forward(ctx, dstIP, reqDomain, dstPort, payload) {
+			return
+		}
+	}
+}
+
+// forward sends payload to the destination the client named, an address or a name
+// (dstIP nil), after the DNS blocklist and the routing rules. Datagrams they reject, and
+// those for an IPv6 address while IPv6 is disabled, are dropped. It returns false when
+// the association is shutting down.
+func (a *udpAssociation) forward(ctx context.Context, dstIP net.IP, reqDomain string, dstPort int, payload []byte) bool {
+	srv := a.srv
+	if dstIP != nil && dstIP.To4() == nil && !srv.enableIPv6 {
+		return true
+	}
+	if dstIP == nil {
+		var blocked bool
+		if dstIP, blocked = srv.lookupHost(ctx, "udp", reqDomain, dstPort, a.egress); blocked || dstIP == nil {
+			return true
+		}
+	}
+	action := srv.route(routeRequest{Network: "udp", Host: reqDomain, IP: dstIP, Port: dstPort})
+	if action == actionBlock {
+		return true
+	}
+	m := a.mapping(ctx, &net.UDPAddr{IP: dstIP, Port: dstPort}, action == actionVPN)
+	if m == nil {
+		return true
+	}
+	m.touch()
+	if a.shaping.wait(ctx, dirUpload, len(payload)) != nil {
+		return false
+	}
+	_, _ = m.conn.Write(payload)
+	return true
+}
+
+// acceptSource reports whether a datagram from src belongs to this association: it must
+// come from the control connection's peer, from the announced port if there was one,
+// and from the same address as the first accepted datagram.
+func (a *udpAssociation) acceptSource(src *net.UDPAddr) bool {
+	if !src.IP.Equal(a.peerIP) {
+		return false
+	}
+	if a.clientPort != 0 && src.Port != a.clientPort {
+		return false
+	}
+	if a.clientAddr.CompareAndSwap(nil, src) {
+		return true
+	}
+	cur := a.clientAddr.Load()
+	return cur.IP.Equal(src.IP) && cur.Port == src.Port
+}
+
+// mapping returns the outbound socket for dst, creating it (and its reply reader) on
+// first use. With useVPN the socket leaves through the association's exit location, or
+// else is bound to the VPN interface when there is one. It returns nil when the socket
+// cannot be created or the table is full.
+func (a *udpAssociation) mapping(ctx context.Context, dst *net.UDPAddr, useVPN bool) *udpMapping {
+	via := "system"
+	var d net.Dialer
+	if useVPN && a.egress == nil && a.srv.bindIf != "" {
+		via, d.Control = a.srv.bindIf, bindControl(a.srv.bindIf)
+	}
+	dial := d.DialContext
+	if useVPN && a.egress != nil {
+		via, dial = "egress "+a.egress.key, a.egress.dial
+	}
+	key := dst.String() + " via " + via
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if m, ok := a.mappings[key]; ok {
+		return m
+	}
+	if len(a.mappings) >= maxUDPMappings {
+		if a.srv.debug {
+			fmt.Printf("[socks-udp] too many destinations, dropping datagram to %s\n", dst)
+		}
+		return nil
+	}
+	conn, err := dial(ctx, "udp", dst.String())
+	if err != nil {
+		if a.srv.debug {
+			fmt.Printf("[socks-udp] -> %s via %s: %v\n", dst, via, err)
+		}
+		return nil
+	}
+	if a.srv.debug {
+		fmt.Printf("[socks-udp] -> %s via %s (new mapping %s)\n", dst, via, conn.LocalAddr())
+	}
+	m := &udpMapping{key: key, conn: conn}
+	m.touch()
+	a.mappings[key] = m
+	go a.readReplies(ctx, m)
+	return m
+}
+
+// readReplies forwards datagrams from one destination back to the client, framed by
+// a.encode, until the mapping is closed.
+func (a *udpAssociation) readReplies(ctx context.Context, m *udpMapping) {
+	defer a.remove(m)
+	raddr := m.conn.RemoteAddr().(*net.UDPAddr)
+	buf := make([]byte, 65535)
+	for {
+		n, err := m.conn.Read(buf)
+		if err != nil {
+			return
+		}
+		m.touch()
+		client := a.clientAddr.Load()
+		if client == nil {
+			continue
+		}
+		if a.shaping.wait(ctx, dirDownload, n) != nil {
+			return
+		}
+		_, _ = a.client.WriteTo(a.encode(raddr, buf[:n]), client)
+	}
+}
+
+// socksUDPReply prefixes payload with the SOCKS5 UDP header for a reply from from.
+func socksUDPReply(from *net.UDPAddr, payload []byte) []byte {
+	hdr := appendSocksAddr([]byte{0, 0, 0}, from.IP, from.Port) // RSV, RSV, FRAG
+	return append(hdr, payload...)
+}
+
+func (a *udpAssociation) remove(m *udpMapping) {
+	_ = m.conn.Close()
+	a.mu.Lock()
+	if a.mappings[m.key] == m {
+		delete(a.mappings, m.key)
+	}
+	a.mu.Unlock()
+}
+
+// expireLoop closes mappings idle for longer than udpMappingIdleTimeout.
+func (a *udpAssociation) expireLoop(ctx context.Context) {
+	t := time.NewTicker(udpMappingIdleTimeout / 4)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-t.C:
+			a.expireIdle(now, udpMappingIdleTimeout)
+		}
+	}
+}
+
+// expireIdle closes mappings without traffic since now-idle and returns how many.
+func (a *udpAssociation) expireIdle(now time.Time, idle time.Duration) int {
+	a.mu.Lock()
+	var stale []*udpMapping
+	for _, m := range a.mappings {
+		if now.Sub(time.Unix(0, m.lastActive.Load())) > idle {
+			stale = append(stale, m)
+		}
+	}
+	a.mu.Unlock()
+	for _, m := range stale {
+		if a.srv.debug {
+			fmt.Printf("[socks-udp] mapping %s idle, closing\n", m.key)
+		}
+		a.remove(m)
+	}
+	return len(stale)
+}
+
+func (a *udpAssociation) closeAll() {
+	a.mu.Lock()
+	all := make([]*udpMapping, 0, len(a.mappings))
+	for _, m := range a.mappings {
+		all = append(all, m)
+	}
+	a.mu.Unlock()
+	for _, m := range all {
+		a.remove(m)
+	}
+}
+
+// parseSocksUDPHeader splits a client datagram into its SOCKS5 UDP request header
+// (RSV(2) FRAG(1) ATYP(1) DST.ADDR DST.PORT) and payload. Exactly one of ip and host is set.
+func parseSocksUDPHeader(p []byte) (frag byte, ip net.IP, host string, port int, payload []byte, ok bool) {
+	if len(p) < 4 || p[0] != 0 || p[1] != 0 {
+		return 0, nil, "", 0, nil, false
+	}
+	frag = p[2]
+	off := 4
+	switch p[3] {
+	case 1: // IPv4
+		if len(p) < off+4+2 {
+			return 0, nil, "", 0, nil, false
+		}
+		ip = net.IP(append([]byte(nil), p[off:off+4]...))
+		off += 4
+	case 3: // Domain
+		if len(p) < off+1 {
+			return 0, nil, "", 0, nil, false
+		}
+		l := int(p[off])
+		off++
+		if l == 0 || len(p) < off+l+2 {
+			return 0, nil, "", 0, nil, false
+		}
+		host = strings.ToLower(string(p[off : off+l]))
+		off += l
+	case 4: // IPv6
+		if len(p) < off+16+2 {
+			return 0, nil, "", 0, nil, false
+		}
+		ip = net.IP(append([]byte(nil), p[off:off+16]...))
+		off += 16
+	default:
+		return 0, nil, "", 0, nil, false
+	}
+	port = int(p[off])<<8 | int(p[off+1])
+	return frag, ip, host, port, p[off+2:], true
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// udpEcho starts a UDP echo server on host and returns its address.
+func udpEcho(t *testing.T, host string) *net.UDPAddr {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", net.JoinHostPort(host, "0"))
+	if err != nil {
+		t.Skipf("udp listen on %s: %v", host, err)
+	}
+	t.Cleanup(func() { _ = pc.Close() })
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			_, _ = pc.WriteTo(buf[:n], addr)
+		}
+	}()
+	return pc.LocalAddr().(*net.UDPAddr)
+}
+
+// udpAssociate starts a proxy on host, sends UDP ASSOCIATE announcing announced (nil for
+// zeros) and returns the control connection and the relay address from the reply.
+func udpAssociate(t *testing.T, host string, announced *net.UDPAddr) (net.Conn, *net.UDPAddr) {
+	t.Helper()
+	ln, err := net.Listen("tcp", net.JoinHostPort(host, "0"))
+	if err != nil {
+		t.Skipf("listen on %s: %v", host, err)
+	}
+	proxyAddr := ln.Addr().String()
+	_ = ln.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	// IPv6 is enabled so that ::1 destinations are relayed too.
+	stop, err := startSocks(ctx, socksOptions{ListenAddr: proxyAddr, EnableIPv6: true})
+	if err != nil {
+		t.Fatalf("startSocks: %v", err)
+	}
+	t.Cleanup(func() { _ = stop() })
+
+	ctrl, err := net.DialTimeout("tcp", proxyAddr, 2*time.Second)
+	if err != nil {
+		t.Fatalf("dial proxy: %v", err)
+	}
+	t.Cleanup(func() { _ = ctrl.Close() })
+	_ = ctrl.SetDeadline(time.Now().Add(5 * time.Second))
+	req := []byte{5, 1, 0, 5, 3, 0}
+	if announced == nil {
+		req = appendSocksAddr(req, net.IPv4zero, 0)
+	} else {
+		req = appendSocksAddr(req, announced.IP, announced.Port)
+	}
+	if _, err := ctrl.Write(req); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	head := make([]byte, 6) // greeting reply + VER REP RSV ATYP
+	if _, err := io.ReadFull(ctrl, head); err != nil {
+		t.Fatalf("read reply: %v", err)
+	}
+	if head[3] != 0 {
+		t.Fatalf("UDP ASSOCIATE reply code=%d", head[3])
+	}
+	addrLen := 4
+	if head[5] == 4 {
+		addrLen = 16
+	}
+	rest := make([]byte, addrLen+2)
+	if _, err := io.ReadFull(ctrl, rest); err != nil {
+		t.Fatalf("read bind addr: %v", err)
+	}
+	_ = ctrl.SetDeadline(time.Time{})
+	return ctrl, &net.UDPAddr{IP: net.IP(rest[:addrLen]), Port: int(rest[addrLen])<<8 | int(rest[addrLen+1])}
+}
+
+func socksUDPDatagram(frag byte, dst *net.UDPAddr, payload string) []byte {
+	return append(appendSocksAddr([]byte{0, 0, frag}, dst.IP, dst.Port), payload...)
+}
+
+// readUDPReply returns the payload of the next relayed datagram, or "" after wait.
+func readUDPReply(t *testing.T, pc net.PacketConn, from *net.UDPAddr, wait time.Duration) string {
+	t.Helper()
+	_ = pc.SetReadDeadline(time.Now().Add(wait))
+	buf := make([]byte, 2048)
+	n, _, err := pc.ReadFrom(buf)
+	if err != nil {
+		return ""
+	}
+	frag, ip, _, port, payload, ok := parseSocksUDPHeader(buf[:n])
+	if !ok || frag != 0 || !ip.Equal(from.IP) || port != from.Port {
+		t.Fatalf("bad reply header: % x", buf[:n])
+	}
+	return string(payload)
+}
+
+func TestSocks5_UDPAssociate_Relays(t *testing.T) {
+	for _, host := range []string{"127.0.0.1", "::1"} {
+		t.Run(host, func(t *testing.T) {
+			echo := udpEcho(t, host)
+			_, relay := udpAssociate(t, host, nil)
+			if !relay.IP.Equal(net.ParseIP(host)) {
+				t.Fatalf("relay bound to %s, want the control connection's address %s", relay.IP, host)
+			}
+			client, err := net.ListenPacket("udp", net.JoinHostPort(host, "0"))
+			if err != nil {
+				t.Fatalf("client listen: %v", err)
+			}
+			defer func() { _ = client.Close() }()
+
+			for _, msg := range []string{"one", "two"} {
+				if _, err := client.WriteTo(socksUDPDatagram(0, echo, msg), relay); err != nil {
+					t.Fatalf("write: %v", err)
+				}
+				if got := readUDPReply(t, client, echo, 2*time.Second); got != msg {
+					t.Fatalf("echo = %q, want %q", got, msg)
+				}
+			}
+		})
+	}
+}
+
+func TestSocks5_UDPAssociate_DropsFragmentsAndStrangers(t *testing.T) {
+	echo := udpEcho(t, "127.0.0.1")
+	client, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("client listen: %v", err)
+	}
+	defer func() { _ = client.Close() }()
+	_, relay := udpAssociate(t, "127.0.0.1", client.LocalAddr().(*net.UDPAddr))
+
+	stranger, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("stranger listen: %v", err)
+	}
+	defer func() { _ = stranger.Close() }()
+	_, _ = stranger.WriteTo(socksUDPDatagram(0, echo, "stranger"), relay)
+	if got := readUDPReply(t, stranger, echo, 200*time.Millisecond); got != "" {
+		t.Fatalf("datagram from a port other than the announced one was relayed")
+	}
+
+	_, _ = client.WriteTo(socksUDPDatagram(1, echo, "fragment"), relay)
+	if got := readUDPReply(t, client, echo, 200*time.Millisecond); got != "" {
+		t.Fatalf("fragmented datagram was relayed")
+	}
+
+	_, _ = client.WriteTo(socksUDPDatagram(0, echo, "ok"), relay)
+	if got := readUDPReply(t, client, echo, 2*time.Second); got != "ok" {
+		t.Fatalf("echo = %q, want ok", got)
+	}
+}
+
+func TestSocks5_UDPAssociate_EndsWithControlConnection(t *testing.T) {
+	echo := udpEcho(t, "127.0.0.1")
+	ctrl, relay := udpAssociate(t, "127.0.0.1", nil)
+	client, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("client listen: %v", err)
+	}
+	defer func() { _ = client.Close() }()
+	_ = ctrl.Close()
+	time.Sleep(100 * time.Millisecond)
+	_, _ = client.WriteTo(socksUDPDatagram(0, echo, "late"), relay)
+	if got := readUDPReply(t, client, echo, 200*time.Millisecond); got != "" {
+		t.Fatalf("relay still forwarding after the control connection closed")
+	}
+}
+
+func TestUDPAssociation_ExpireIdle(t *testing.T) {
+	echo := udpEcho(t, "127.0.0.1")
+	a := &udpAssociation{srv: &socksServer{}, mappings: map[string]*udpMapping{}}
+	m := a.mapping(context.Background(), echo, false)
+	if m == nil {
+		t.Fatal("mapping not created")
+	}
+	if again := a.mapping(context.Background(), echo, false); again != m {
+		t.Fatal("same destination got a second mapping")
+	}
+	now := time.Now()
+	if n := a.expireIdle(now, time.Minute); n != 0 {
+		t.Fatalf("expired %d active mappings", n)
+	}
+	if n := a.expireIdle(now.Add(2*time.Minute), time.Minute); n != 1 || len(a.mappings) != 0 {
+		t.Fatalf("expired %d, %d left", n, len(a.mappings))
+	}
+	if _, err := m.conn.Write([]byte("x")); err == nil {
+		t.Fatal("expired mapping socket still open")
+	}
+}
+
+func TestAppendSocksAddr(t *testing.T) {
+	if got := appendSocksAddr(nil, net.ParseIP("10.1.2.3"), 443); !bytes.Equal(got, []byte{1, 10, 1, 2, 3, 1, 187}) {
+		t.Errorf("IPv4: % x", got)
+	}
+	if got := appendSocksAddr(nil, net.ParseIP("2001:db8::1"), 53); len(got) != 19 || got[0] != 4 || got[18] != 53 {
+		t.Errorf("IPv6: % x", got)
+	}
+}
@@ -44,6 +44,12 @@ func buildProviderSpecs(ctx context.Context, apiURL, jwt string, loc LocationCon
 	return strat, specs
 }
 
+// isBestAvailable reports whether specs is the best-available fallback buildProviderSpecs
+// returns when the location matched nothing.
+func isBestAvailable(specs []*connect.ProviderSpec) bool {
+	return len(specs) == 0 || (len(specs) == 1 && specs[0].BestAvailable)
+}
+
 // findSpecsByQueryFallback queries /network/provider-locations and builds ProviderSpecs
 // by client-side filtering for queries like 'country:Germany', 'region:Europe', 'group:West'.
 func findSpecsByQueryFallback(ctx context.Context, apiURL, jwt, q string) []*connect.ProviderSpec {
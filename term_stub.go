@@ -0,0 +1,11 @@
+//go:build !linux && !darwin
+
+package main
+
+import "errors"
+
+func isTerminal(_ int) bool { return false }
+
+func disableEcho(_ int) (func(), error) {
+	return nil, errors.New("hidden input is not supported on this platform")
+}
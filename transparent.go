@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// Transparent proxy modes (--transparent_mode).
+const (
+	transparentRedirect = "redirect" // nft/iptables REDIRECT; TCP only
+	transparentTProxy   = "tproxy"   // TPROXY; TCP and UDP
+)
+
+// transparentNftTable is the nftables table the client installs with --transparent_nft.
+const transparentNftTable = "urnet_transparent"
+
+// transparentMark and transparentRouteTable route TPROXY-marked packets to the local
+// listener with --transparent_nft.
+const (
+	transparentMark       = "0x1"
+	transparentRouteTable = "100"
+)
+
+// transparentOptions configures the transparent proxy started by startTransparent.
+type transparentOptions struct {
+	ListenAddr string
+	Mode       string       // transparentRedirect or transparentTProxy
+	InstallNft bool         // install the redirect rules and remove them on stop
+	TunName    string       // packets arriving on the TUN are never redirected
+	Socks      socksOptions // rules, DNS, limits, allowlist and VPN binding, as for SOCKS
+}
+
+// handleTransparentConn relays a redirected TCP connection to dst, its original
+// destination, with the SOCKS routing rules: the destination is an address, so with
+// sniffing enabled the TLS SNI or HTTP Host in the client's first bytes supplies the
+// name for the domain rules. Blocked and unreachable destinations close the connection.
+func handleTransparentConn(ctx context.Context, c net.Conn, srv *socksServer, dst *net.TCPAddr) {
+	defer func() { _ = c.Close() }()
+	_ = c.SetDeadline(time.Now().Add(socksHandshakeTimeout))
+
+	var early []byte
+	var host string
+	if srv.sniff {
+		var proto string
+		early, host, proto = sniffDestination(c, srv.sniffTimeout)
+		if srv.debug && host != "" {
+			fmt.Printf("[transparent] sniffed %s host %s for %s\n", proto, host, dst)
+		}
+	}
+	action, addrs := srv.routeAddrs("tcp", host, []net.IP{dst.IP}, dst.Port)
+	if action == actionBlock {
+		return
+	}
+	d := net.Dialer{KeepAlive: socksKeepAlive}
+	if action == actionVPN && srv.bindIf != "" {
+		d.Control = bindControl(srv.bindIf)
+	}
+	rc, err := dialHappyEyeballs(ctx, d.DialContext, addrs, dst.Port)
+	if err != nil {
+		if srv.debug {
+			fmt.Printf("[transparent] %s -> %s: %v\n", c.RemoteAddr(), dst, err)
+		}
+		return
+	}
+	defer func() { _ = rc.Close() }()
+	if srv.debug {
+		fmt.Printf("[transparent] %s -> %s action=%s\n", c.RemoteAddr(), dst, action)
+	}
+	if len(early) > 0 {
+		if _, err := rc.Write(early); err != nil {
+			return
+		}
+	}
+	_ = c.SetDeadline(time.Time{})
+	cs := srv.shaper.acquire(remoteIP(c), "")
+	defer cs.release()
+	srv.relay(ctx, c, rc, cs)
+}
+
+// isListenerAddr reports whether dst is the listener at ln itself: a client that
+// connected to the transparent port directly instead of being redirected, which would
+// otherwise make the proxy connect to itself.
+func isListenerAddr(dst *net.TCPAddr, ln net.Addr) bool {
+	la, ok := ln.(*net.TCPAddr)
+	if !ok || dst.Port != la.Port {
+		return false
+	}
+	if !la.IP.IsUnspecified() {
+		return dst.IP.Equal(la.IP)
+	}
+	if dst.IP.IsLoopback() || dst.IP.IsUnspecified() {
+		return true
+	}
+	addrs, _ := net.InterfaceAddrs()
+	for _, a := range addrs {
+		if n, ok := a.(*net.IPNet); ok && n.IP.Equal(dst.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// transparentNftRules returns the nft script that redirects TCP (and, for TPROXY, UDP)
+// arriving from the LAN to port. Traffic for the host itself, broadcast and multicast,
+// and packets arriving on the TUN are left alone. Loading it replaces an earlier copy.
+func transparentNftRules(mode, tunName string, port int) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "table inet %s {}\ndelete table inet %s\n", transparentNftTable, transparentNftTable)
+	fmt.Fprintf(&b, "table inet %s {\n\tchain prerouting {\n", transparentNftTable)
+	if mode == transparentTProxy {
+		b.WriteString("\t\ttype filter hook prerouting priority mangle; policy accept;\n")
+	} else {
+		b.WriteString("\t\ttype nat hook prerouting priority dstnat; policy accept;\n")
+	}
+	if tunName != "" {
+		fmt.Fprintf(&b, "\t\tiifname %q return\n", tunName)
+	}
+	b.WriteString("\t\tfib daddr type { local, broadcast, multicast } return\n")
+	if mode == transparentTProxy {
+		for _, proto := range []string{"tcp", "udp"} {
+			fmt.Fprintf(&b, "\t\tmeta l4proto %s tproxy to :%d meta mark set %s accept\n", proto, port, transparentMark)
+		}
+	} else {
+		fmt.Fprintf(&b, "\t\tmeta l4proto tcp redirect to :%d\n", port)
+	}
+	b.WriteString("\t}\n}\n")
+	return b.String()
+}
@@ -0,0 +1,447 @@
+//go:build linux
+
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os/exec"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// soOriginalDst is SO_ORIGINAL_DST from linux/netfilter_ipv4.h; IP6T_SO_ORIGINAL_DST
+// has the same value.
+const soOriginalDst = 80
+
+// errNotRedirected reports a connection made to the transparent port itself.
+var errNotRedirected = errors.New("not redirected to the transparent port")
+
+// startTransparent starts the transparent proxy configured by opts and returns a stop
+// function. TCP connections are accepted on opts.ListenAddr in both modes; in TPROXY mode
+// UDP datagrams are accepted on the same address and port.
+func startTransparent(ctx context.Context, opts transparentOptions) (func() error, error) {
+	srv, err := newSocksServer(opts.Socks)
+	if err != nil {
+		return nil, err
+	}
+	tproxy := opts.Mode == transparentTProxy
+	lc := net.ListenConfig{KeepAlive: socksKeepAlive}
+	if tproxy {
+		lc.Control = transparentControl(false)
+	}
+	ln, err := lc.Listen(ctx, "tcp", opts.ListenAddr)
+	if err != nil {
+		return nil, err
+	}
+	port := ln.Addr().(*net.TCPAddr).Port
+	var udp *transparentUDP
+	if tproxy {
+		host, _, _ := net.SplitHostPort(opts.ListenAddr)
+		if udp, err = listenTransparentUDP(ctx, srv, opts.Socks, net.JoinHostPort(host, fmt.Sprint(port))); err != nil {
+			_ = ln.Close()
+			return nil, err
+		}
+	}
+	var removeNft func()
+	if opts.InstallNft {
+		if removeNft, err = installTransparentNft(opts.Mode, opts.TunName, port); err != nil {
+			_ = ln.Close()
+			if udp != nil {
+				udp.close()
+			}
+			return nil, err
+		}
+	}
+	stopTCP := srv.serve(ctx, ln, opts.Socks, func(ctx context.Context, c net.Conn, srv *socksServer) {
+		dst, err := originalDst(c, tproxy)
+		if err == nil && isListenerAddr(dst, ln.Addr()) {
+			err = errNotRedirected
+		}
+		if err != nil {
+			if srv.debug {
+				fmt.Printf("[transparent] %s: %v\n", c.RemoteAddr(), err)
+			}
+			_ = c.Close()
+			return
+		}
+		handleTransparentConn(ctx, c, srv, dst)
+	})
+	// The rules go first so that new connections are no longer sent to a closing port.
+	stop := func() error {
+		if removeNft != nil {
+			removeNft()
+		}
+		if udp != nil {
+			udp.close()
+		}
+		return stopTCP()
+	}
+	return stop, nil
+}
+
+// transparentControl returns a Control function that sets IP_TRANSPARENT (and
+// IPV6_TRANSPARENT) so a socket can accept TPROXY traffic or bind to a foreign address;
+// with reuse it also sets SO_REUSEADDR. Both need CAP_NET_ADMIN.
+func transparentControl(reuse bool) func(network, address string, rc syscall.RawConn) error {
+	return func(network, address string, rc syscall.RawConn) error {
+		var serr error
+		err := rc.Control(func(fd uintptr) {
+			e4 := unix.SetsockoptInt(int(fd), unix.SOL_IP, unix.IP_TRANSPARENT, 1)
+			e6 := unix.SetsockoptInt(int(fd), unix.SOL_IPV6, unix.IPV6_TRANSPARENT, 1)
+			if e4 != nil && e6 != nil {
+				serr = fmt.Errorf("set IP_TRANSPARENT: %w (needs CAP_NET_ADMIN)", e4)
+				return
+			}
+			if reuse {
+				serr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEADDR, 1)
+			}
+		})
+		if err != nil {
+			return err
+		}
+		return serr
+	}
+}
+
+// originalDst returns the destination a redirected connection was sent to. TPROXY keeps
+// it as the connection's local address; REDIRECT rewrites it, and conntrack reports the
+// original with SO_ORIGINAL_DST.
+func originalDst(c net.Conn, tproxy bool) (*net.TCPAddr, error) {
+	la, _ := c.LocalAddr().(*net.TCPAddr)
+	tc, ok := c.(*net.TCPConn)
+	if la == nil || !ok {
+		return nil, fmt.Errorf("not a TCP connection")
+	}
+	if tproxy {
+		return la, nil
+	}
+	raw, err := tc.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	var dst *net.TCPAddr
+	var serr error
+	err = raw.Control(func(fd uintptr) {
+		if la.IP.To4() != nil {
+			// struct sockaddr_in: family, port (big endian), address
+			var mreq *unix.IPv6Mreq
+			if mreq, serr = unix.GetsockoptIPv6Mreq(int(fd), unix.SOL_IP, soOriginalDst); serr == nil {
+				a := mreq.Multiaddr
+				dst = &net.TCPAddr{IP: net.IPv4(a[4], a[5], a[6], a[7]), Port: int(a[2])<<8 | int(a[3])}
+			}
+			return
+		}
+		var info *unix.IPv6MTUInfo
+		if info, serr = unix.GetsockoptIPv6MTUInfo(int(fd), unix.SOL_IPV6, soOriginalDst); serr == nil {
+			var port [2]byte
+			binary.NativeEndian.PutUint16(port[:], info.Addr.Port)
+			dst = &net.TCPAddr{IP: append(net.IP(nil), info.Addr.Addr[:]...), Port: int(binary.BigEndian.Uint16(port[:]))}
+		}
+	})
+	if err == nil {
+		err = serr
+	}
+	if err != nil {
+		return nil, fmt.Errorf("SO_ORIGINAL_DST: %w", err)
+	}
+	return dst, nil
+}
+
+// installTransparentNft loads the nft rules for mode and, for TPROXY, the policy route
+// that delivers marked packets locally. It returns a function that removes them.
+func installTransparentNft(mode, tunName string, port int) (func(), error) {
+	cmd := exec.Command("nft", "-f", "-")
+	cmd.Stdin = strings.NewReader(transparentNftRules(mode, tunName, port))
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return nil, fmt.Errorf("nft: %v: %s", err, strings.TrimSpace(string(out)))
+	}
+	var undo [][]string
+	if mode == transparentTProxy {
+		for _, fam := range []struct{ flag, all string }{{"-4", "0.0.0.0/0"}, {"-6", "::/0"}} {
+			rule := []string{fam.flag, "rule", "add", "fwmark", transparentMark, "lookup", transparentRouteTable}
+			route := []string{fam.flag, "route", "replace", "local", fam.all, "dev", "lo", "table", transparentRouteTable}
+			// Drop a rule left behind by an earlier run so it is not installed twice.
+			_, _ = runCapture("ip", fam.flag, "rule", "del", "fwmark", transparentMark, "lookup", transparentRouteTable)
+			if out, err := runCapture("ip", rule...); err != nil {
+				logWarn("transparent: ip %s: %v: %s\n", strings.Join(rule, " "), err, strings.TrimSpace(out))
+				continue
+			}
+			if out, err := runCapture("ip", route...); err != nil {
+				logWarn("transparent: ip %s: %v: %s\n", strings.Join(route, " "), err, strings.TrimSpace(out))
+			}
+			undo = append(undo,
+				[]string{fam.flag, "rule", "del", "fwmark", transparentMark, "lookup", transparentRouteTable},
+				[]string{fam.flag, "route", "del", "local", fam.all, "dev", "lo", "table", transparentRouteTable})
+		}
+	}
+	logInfo("transparent: installed nft table inet %s (%s to port %d)\n", transparentNftTable, mode, port)
+	return func() {
+		if out, err := runCapture("nft", "delete", "table", "inet", transparentNftTable); err != nil {
+			logWarn("transparent: nft delete table: %v: %s\n", err, strings.TrimSpace(out))
+		}
+		for _, args := range undo {
+			_, _ = runCapture("ip", args...)
+		}
+	}, nil
+}
+
+// transparentUDP relays TPROXY'd UDP. Each client and original destination pair gets a
+// mapping with a socket to the destination and a socket bound to the destination's
+// address and connected to the client, which sends the replies and receives the pair's
+// later datagrams.
+type transparentUDP struct {
+	srv      *socksServer
+	allowSrc []*net.IPNet
+	stats    *socksStats
+	pc       *net.UDPConn
+	done     chan struct{}
+	cancel   context.CancelFunc
+
+	mu       sync.Mutex
+	mappings map[string]*transparentUDPMapping
+}
+
+type transparentUDPMapping struct {
+	key        string
+	out        net.Conn     // to the destination
+	local      *net.UDPConn // from the destination's address to the client
+	shaping    *connShaping // nil without bandwidth limits
+	lastActive atomic.Int64 // unix nanoseconds
+}
+
+func (m *transparentUDPMapping) touch() { m.lastActive.Store(time.Now().UnixNano()) }
+
+// listenTransparentUDP starts relaying UDP sent by TPROXY to addr.
+func listenTransparentUDP(ctx context.Context, srv *socksServer, opts socksOptions, addr string) (*transparentUDP, error) {
+	lc := net.ListenConfig{Control: func(network, address string, rc syscall.RawConn) error {
+		if err := transparentControl(false)(network, address, rc); err != nil {
+			return err
+		}
+		return rc.Control(func(fd uintptr) {
+			_ = unix.SetsockoptInt(int(fd), unix.SOL_IP, unix.IP_RECVORIGDSTADDR, 1)
+			_ = unix.SetsockoptInt(int(fd), unix.SOL_IPV6, unix.IPV6_RECVORIGDSTADDR, 1)
+		})
+	}}
+	pc, err := lc.ListenPacket(ctx, "udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	u := &transparentUDP{
+		srv:      srv,
+		allowSrc: opts.AllowSrc,
+		stats:    opts.Stats,
+		pc:       pc.(*net.UDPConn),
+		done:     make(chan struct{}),
+		cancel:   cancel,
+		mappings: map[string]*transparentUDPMapping{},
+	}
+	go u.expireLoop(ctx)
+	go func() {
+		defer close(u.done)
+		u.readLoop(ctx)
+	}()
+	return u, nil
+}
+
+// close stops the relay and closes every mapping.
+func (u *transparentUDP) close() {
+	u.cancel()
+	_ = u.pc.Close()
+	<-u.done
+	u.mu.Lock()
+	all := make([]*transparentUDPMapping, 0, len(u.mappings))
+	for _, m := range u.mappings {
+		all = append(all, m)
+	}
+	u.mu.Unlock()
+	for _, m := range all {
+		u.remove(m)
+	}
+}
+
+// readLoop reads the first datagrams of each pair from the TPROXY socket.
+func (u *transparentUDP) readLoop(ctx context.Context) {
+	buf := make([]byte, 65535)
+	oob := make([]byte, 128)
+	for {
+		n, oobn, _, src, err := u.pc.ReadMsgUDP(buf, oob)
+		if err != nil {
+			return
+		}
+		dst, err := origDstFromCmsg(oob[:oobn])
+		if err != nil {
+			if u.srv.debug {
+				fmt.Printf("[transparent-udp] datagram from %s: %v\n", src, err)
+			}
+			continue
+		}
+		if u.allowSrc != nil && !cidrsContain(u.allowSrc, src.IP) {
+			u.stats.refused(true)
+			continue
+		}
+		m := u.mapping(ctx, src, dst)
+		if m == nil {
+			continue
+		}
+		u.forward(ctx, m, buf[:n])
+	}
+}
+
+// forward sends one datagram from the client to m's destination.
+func (u *transparentUDP) forward(ctx context.Context, m *transparentUDPMapping, payload []byte) {
+	m.touch()
+	if m.shaping.wait(ctx, dirUpload, len(payload)) != nil {
+		return
+	}
+	_, _ = m.out.Write(payload)
+}
+
+// mapping returns the mapping for datagrams from client to dst, creating it on first
+// use. It returns nil when the rules block dst, the sockets cannot be created or the
+// table is full.
+func (u *transparentUDP) mapping(ctx context.Context, client, dst *net.UDPAddr) *transparentUDPMapping {
+	srv := u.srv
+	key := client.String() + " -> " + dst.String()
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if m, ok := u.mappings[key]; ok {
+		return m
+	}
+	if len(u.mappings) >= maxUDPMappings {
+		if srv.debug {
+			fmt.Printf("[transparent-udp] too many mappings, dropping datagram %s\n", key)
+		}
+		return nil
+	}
+	action := srv.route(routeRequest{Network: "udp", IP: dst.IP, Port: dst.Port})
+	if action == actionBlock {
+		return nil
+	}
+	var d net.Dialer
+	if action == actionVPN && srv.bindIf != "" {
+		d.Control = bindControl(srv.bindIf)
+	}
+	out, err := d.DialContext(ctx, "udp", dst.String())
+	if err != nil {
+		if srv.debug {
+			fmt.Printf("[transparent-udp] %s: %v\n", key, err)
+		}
+		return nil
+	}
+	ld := net.Dialer{LocalAddr: dst, Control: transparentControl(true)}
+	lc, err := ld.DialContext(ctx, "udp", client.String())
+	if err != nil {
+		_ = out.Close()
+		if srv.debug {
+			fmt.Printf("[transparent-udp] %s: reply socket: %v\n", key, err)
+		}
+		return nil
+	}
+	if srv.debug {
+		fmt.Printf("[transparent-udp] %s action=%s (new mapping)\n", key, action)
+	}
+	m := &transparentUDPMapping{key: key, out: out, local: lc.(*net.UDPConn), shaping: srv.shaper.acquire(client.IP, "")}
+	m.touch()
+	u.mappings[key] = m
+	go u.readReplies(ctx, m)
+	go u.readLocal(ctx, m)
+	return m
+}
+
+// readReplies forwards datagrams from m's destination to the client until m is closed.
+func (u *transparentUDP) readReplies(ctx context.Context, m *transparentUDPMapping) {
+	defer u.remove(m)
+	buf := make([]byte, 65535)
+	for {
+		n, err := m.out.Read(buf)
+		if err != nil {
+			return
+		}
+		m.touch()
+		if m.shaping.wait(ctx, dirDownload, n) != nil {
+			return
+		}
+		_, _ = m.local.Write(buf[:n])
+	}
+}
+
+// readLocal forwards the client's datagrams that the kernel delivers to m's connected
+// reply socket rather than the TPROXY socket.
+func (u *transparentUDP) readLocal(ctx context.Context, m *transparentUDPMapping) {
+	defer u.remove(m)
+	buf := make([]byte, 65535)
+	for {
+		n, err := m.local.Read(buf)
+		if err != nil {
+			return
+		}
+		u.forward(ctx, m, buf[:n])
+	}
+}
+
+func (u *transparentUDP) remove(m *transparentUDPMapping) {
+	_ = m.out.Close()
+	_ = m.local.Close()
+	u.mu.Lock()
+	if u.mappings[m.key] == m {
+		delete(u.mappings, m.key)
+		m.shaping.release()
+	}
+	u.mu.Unlock()
+}
+
+// expireLoop closes mappings idle for longer than udpMappingIdleTimeout.
+func (u *transparentUDP) expireLoop(ctx context.Context) {
+	t := time.NewTicker(udpMappingIdleTimeout / 4)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-t.C:
+			var stale []*transparentUDPMapping
+			u.mu.Lock()
+			for _, m := range u.mappings {
+				if now.Sub(time.Unix(0, m.lastActive.Load())) > udpMappingIdleTimeout {
+					stale = append(stale, m)
+				}
+			}
+			u.mu.Unlock()
+			for _, m := range stale {
+				u.remove(m)
+			}
+		}
+	}
+}
+
+// origDstFromCmsg returns the original destination from the IP_ORIGDSTADDR or
+// IPV6_ORIGDSTADDR control message of a TPROXY'd datagram.
+func origDstFromCmsg(oob []byte) (*net.UDPAddr, error) {
+	msgs, err := unix.ParseSocketControlMessage(oob)
+	if err != nil {
+		return nil, err
+	}
+	for i := range msgs {
+		sa, err := unix.ParseOrigDstAddr(&msgs[i])
+		if err != nil {
+			continue
+		}
+		switch a := sa.(type) {
+		case *unix.SockaddrInet4:
+			return &net.UDPAddr{IP: net.IP(append([]byte(nil), a.Addr[:]...)), Port: a.Port}, nil
+		case *unix.SockaddrInet6:
+			return &net.UDPAddr{IP: net.IP(append([]byte(nil), a.Addr[:]...)), Port: a.Port}, nil
+		}
+	}
+	return nil, fmt.Errorf("no original destination (is the datagram from TPROXY?)")
+}
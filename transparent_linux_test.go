@@ -0,0 +1,77 @@
+//go:build linux
+
+package main
+
+import (
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// A plain socket with IP_RECVORIGDSTADDR reports its own address, which is what TPROXY
+// replaces with the original destination.
+func TestOrigDstFromCmsg(t *testing.T) {
+	lc := net.ListenConfig{Control: func(network, address string, rc syscall.RawConn) error {
+		return rc.Control(func(fd uintptr) {
+			_ = unix.SetsockoptInt(int(fd), unix.SOL_IP, unix.IP_RECVORIGDSTADDR, 1)
+		})
+	}}
+	pc, err := lc.ListenPacket(t.Context(), "udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = pc.Close() })
+	c, err := net.Dial("udp4", pc.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = c.Close() })
+	if _, err := c.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	_ = pc.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf, oob := make([]byte, 16), make([]byte, 128)
+	_, oobn, _, _, err := pc.(*net.UDPConn).ReadMsgUDP(buf, oob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dst, err := origDstFromCmsg(oob[:oobn])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dst.String() != pc.LocalAddr().String() {
+		t.Fatalf("original destination %s, want %s", dst, pc.LocalAddr())
+	}
+	if _, err := origDstFromCmsg(nil); err == nil {
+		t.Fatal("found a destination without control messages")
+	}
+}
+
+func TestOriginalDst_TProxyUsesLocalAddr(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = ln.Close() })
+	c, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = c.Close() })
+	s, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = s.Close() })
+	dst, err := originalDst(s, true)
+	if err != nil || dst.String() != ln.Addr().String() {
+		t.Fatalf("originalDst = %v, %v; want %s", dst, err, ln.Addr())
+	}
+	// Connecting to the port directly is not a redirect, whatever conntrack reports.
+	if dst, err := originalDst(s, false); err == nil && !isListenerAddr(dst, ln.Addr()) {
+		t.Fatalf("direct connection reported original destination %s", dst)
+	}
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+
+package main
+
+import (
+	"context"
+	"errors"
+)
+
+func startTransparent(_ context.Context, _ transparentOptions) (func() error, error) {
+	return nil, errors.New("the transparent proxy is supported on Linux only")
+}
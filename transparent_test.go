@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/docopt/docopt-go"
+)
+
+func TestTransparentNftRules(t *testing.T) {
+	redirect := transparentNftRules(transparentRedirect, "tun0", 12345)
+	for _, want := range []string{
+		"table inet urnet_transparent {}\ndelete table inet urnet_transparent\n",
+		"type nat hook prerouting priority dstnat;",
+		`iifname "tun0" return`,
+		"fib daddr type { local, broadcast, multicast } return",
+		"meta l4proto tcp redirect to :12345",
+	} {
+		if !strings.Contains(redirect, want) {
+			t.Errorf("redirect rules lack %q:\n%s", want, redirect)
+		}
+	}
+	if strings.Contains(redirect, "udp") {
+		t.Errorf("redirect rules catch UDP:\n%s", redirect)
+	}
+	tproxy := transparentNftRules(transparentTProxy, "", 12345)
+	for _, want := range []string{
+		"type filter hook prerouting priority mangle;",
+		"meta l4proto tcp tproxy to :12345 meta mark set 0x1 accept",
+		"meta l4proto udp tproxy to :12345 meta mark set 0x1 accept",
+	} {
+		if !strings.Contains(tproxy, want) {
+			t.Errorf("tproxy rules lack %q:\n%s", want, tproxy)
+		}
+	}
+	if strings.Contains(tproxy, "iifname") {
+		t.Errorf("tproxy rules name a TUN:\n%s", tproxy)
+	}
+}
+
+func TestIsListenerAddr(t *testing.T) {
+	specific := &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 12345}
+	wildcard := &net.TCPAddr{IP: net.IPv4zero, Port: 12345}
+	for _, tc := range []struct {
+		dst  string
+		ln   *net.TCPAddr
+		want bool
+	}{
+		{"127.0.0.1:12345", specific, true},
+		{"127.0.0.2:12345", specific, false},
+		{"127.0.0.1:443", specific, false},
+		{"127.0.0.1:12345", wildcard, true},
+		{"203.0.113.9:12345", wildcard, false},
+		{"203.0.113.9:443", wildcard, false},
+	} {
+		dst, _ := net.ResolveTCPAddr("tcp", tc.dst)
+		if got := isListenerAddr(dst, tc.ln); got != tc.want {
+			t.Errorf("isListenerAddr(%s, %s) = %v, want %v", tc.dst, tc.ln, got, tc.want)
+		}
+	}
+}
+
+func TestTransparent_RelaysToOriginalDestination(t *testing.T) {
+	echo := tcpEcho(t)
+	blocked := tcpEcho(t)
+	rules := []*routeRule{{Action: actionBlock, CIDRs: []*net.IPNet{parseCIDRHost("127.0.0.0/8")}, Ports: []portRange{{lo: blocked, hi: blocked}}}}
+	opts := socksOptions{Rules: rules}
+	srv, err := newSocksServer(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The original destination stands in for the one conntrack or TPROXY would report.
+	var dst atomic.Pointer[net.TCPAddr]
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	stop := srv.serve(ctx, ln, opts, func(ctx context.Context, c net.Conn, srv *socksServer) {
+		handleTransparentConn(ctx, c, srv, dst.Load())
+	})
+	t.Cleanup(func() { _ = stop() })
+	connect := func(port int) net.Conn {
+		dst.Store(&net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: port})
+		c, err := net.DialTimeout("tcp", ln.Addr().String(), 5*time.Second)
+		if err != nil {
+			t.Fatalf("dial: %v", err)
+		}
+		t.Cleanup(func() { _ = c.Close() })
+		return c
+	}
+
+	expectEcho(t, connect(echo), "redirected")
+	expectClosed(t, connect(blocked), 5*time.Second)
+}
+
+func TestValidateConfig_Transparent(t *testing.T) {
+	for body, want := range map[string]string{
+		"tun: tun0\ntransparent: 0.0.0.0:12345\ntransparent_mode: tproxy\n": "",
+		"tun: tun0\ntransparent: 0.0.0.0:12345\ntransparent_mode: divert\n": "transparent_mode",
+		"tun: tun0\ntransparent_nft: true\n":                                "transparent_nft",
+		"tun: none\nsocks: 127.0.0.1:1080\ntransparent: 0.0.0.0:12345\n":    "requires a TUN device",
+		"tun: tun0\nsocks: 127.0.0.1:1080\ntransparent: 127.0.0.1:1080\n":   "is also a SOCKS listener",
+		"tun: tun0\ntransparent: 12345\n":                                   "transparent",
+	} {
+		rc, err := resolveConfigWith(docopt.Opts{"--config": writeConfig(t, body)}, fakeEnv(nil))
+		if err != nil {
+			t.Fatalf("resolveConfig(%q): %v", body, err)
+		}
+		errs := validateConfig(rc)
+		switch {
+		case want == "" && len(errs) > 0:
+			t.Errorf("%q: unexpected problems %v", body, errs)
+		case want != "" && (len(errs) != 1 || !strings.Contains(errs[0].Error(), want)):
+			t.Errorf("%q: problems %v, want one about %q", body, errs, want)
+		}
+	}
+}
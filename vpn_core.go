@@ -132,18 +132,7 @@ func vpnRunCore(
 		}
 	}
 	if cfg.AllowInboundLocal {
-		appendNet := func(cidr string) {
-			if n := parseCIDRHost(cidr); n != nil {
-				allowInboundCIDRs = append(allowInboundCIDRs, n)
-			}
-		}
-		appendNet("127.0.0.0/8")
-		appendNet("169.254.0.0/16")
-		appendNet("10.0.0.0/8")
-		appendNet("172.16.0.0/12")
-		appendNet("192.168.0.0/16")
-		appendNet("100.64.0.0/10")
-		if cidr := cfg.IPCIDR; cidr != "" {
+		for _, cidr := range append(localSourceCIDRs, cfg.IPCIDR) {
 			if n := parseCIDRHost(cidr); n != nil {
 				allowInboundCIDRs = append(allowInboundCIDRs, n)
 			}
@@ -206,7 +195,32 @@ func vpnRunCore(
 	}
 
 	mc := connect.NewRemoteUserNatMultiClientWithDefaults(ctx, gen, receive, protocol.ProvideMode_Network)
-	_ = mc
+
+	// One more provider client per distinct route_locations location; entries naming the
+	// same location share it. A route whose location matches no providers keeps a nil
+	// client, and its packets are dropped rather than sent through the default location.
+	routes := newRouteTable(cfg.RouteLocations)
+	routeShare := sharedRouteLocations(cfg.RouteLocations)
+	routeMCs := make([]*connect.RemoteUserNatMultiClient, len(cfg.RouteLocations))
+	for i, r := range cfg.RouteLocations {
+		if j := routeShare[i]; j != i {
+			routeMCs[i] = routeMCs[j]
+			if routeMCs[i] != nil {
+				logInfo("route %s\n", r)
+			}
+			continue
+		}
+		strat, specs := buildProviderSpecs(ctx, apiURL, cfg.JWT, r.Location)
+		if isBestAvailable(specs) {
+			logWarn("route %s: no provider locations match; dropping its packets\n", r)
+			continue
+		}
+		gen := connect.NewApiMultiClientGeneratorWithDefaults(
+			ctx, specs, strat, nil, apiURL, cfg.JWT, fmt.Sprintf("%s/", connectURL), "", "", appVer, nil,
+		)
+		routeMCs[i] = connect.NewRemoteUserNatMultiClientWithDefaults(ctx, gen, receive, protocol.ProvideMode_Network)
+		logInfo("route %s\n", r)
+	}
 
 	// TUN -> provider loop
 	go func() {
@@ -221,9 +235,18 @@ func vpnRunCore(
 			}
 			pkt := make([]byte, n)
 			copy(pkt, buf[:n])
-			logDebug("-> provider len=%d\n", len(pkt))
-			// No egress userspace filtering
-			mc.SendPacket(connect.TransferPath{}, protocol.ProvideMode_Network, pkt, -1)
+			// No egress userspace filtering; route_locations pick the provider client.
+			target := mc
+			if i := routes.lookup(pkt); i >= 0 {
+				if target = routeMCs[i]; target == nil {
+					logDebug("dropped packet for %s (route has no providers)\n", packetDst(pkt))
+					continue
+				}
+				logDebug("-> provider len=%d route=%d\n", len(pkt), i+1)
+			} else {
+				logDebug("-> provider len=%d\n", len(pkt))
+			}
+			target.SendPacket(connect.TransferPath{}, protocol.ProvideMode_Network, pkt, -1)
 			if pktsOut != nil {
 				atomic.AddUint64(pktsOut, 1)
 			}
@@ -233,6 +256,16 @@ func vpnRunCore(
 		}
 	}()
 
+	// DNS blocklist shared by the SOCKS proxy and the DNS forwarder; nil without sources
+	bl := startBlocklist(ctx, cfg.blocklistOptions())
+	// SOCKS bandwidth shaping; nil without limits
+	sh := newShaper(cfg.Bandwidth)
+	// SOCKS, transparent and Shadowsocks listener refusals; nil without a listener
+	var refusals *socksStats
+	if cfg.SOCKSListen != "" || len(cfg.Listeners) > 0 || cfg.Transparent != "" || cfg.Shadowsocks != "" {
+		refusals = &socksStats{}
+	}
+
 	// Periodic stats
 	if statsInt > 0 && isInfoEnabled() && pktsIn != nil && bytesIn != nil && pktsOut != nil && bytesOut != nil {
 		go func() {
@@ -247,7 +280,18 @@ func vpnRunCore(
 					inB := atomic.LoadUint64(bytesIn)
 					outP := atomic.LoadUint64(pktsOut)
 					outB := atomic.LoadUint64(bytesOut)
-					logInfo("[stats] in=%d pkts / %d bytes, out=%d pkts / %d bytes\n", inP, inB, outP, outB)
+					line := fmt.Sprintf("[stats] in=%d pkts / %d bytes, out=%d pkts / %d bytes", inP, inB, outP, outB)
+					if bl != nil {
+						line += fmt.Sprintf(", dns blocked=%d", bl.Blocked())
+					}
+					if sh != nil {
+						up, down := sh.rates()
+						line += fmt.Sprintf(", socks up=%s down=%s", up, down)
+					}
+					if refusals != nil {
+						line += ", " + refusals.String()
+					}
+					logInfo("%s\n", line)
 				}
 			}
 		}()
@@ -257,15 +301,92 @@ func vpnRunCore(
 	socksListen := cfg.SOCKSListen
 	allowDomains := cfg.AllowDomains
 	excludeDomains := cfg.ExcludeDomains
+	socksOpts := socksOptions{
+		ListenAddr:     socksListen,
+		BindIf:         tunIfName,
+		Debug:          debugOn || isDebugEnabled(),
+		AllowDomains:   allowDomains,
+		ExcludeDomains: excludeDomains,
+		DNSServers:     splitCSV(cfg.DNSList),
+		DNSHosts:       cfg.DNSHosts,
+		Rules:          cfg.Rules,
+		Sniff:          cfg.Sniff,
+		SniffTimeout:   cfg.SniffTimeout,
+		EnableIPv6:     cfg.EnableIPv6,
+		Limits:         cfg.SOCKSLimits,
+		Auth:           cfg.SOCKSAuth,
+		Shaper:         sh,
+		AllowSrc:       cfg.SOCKSAllowlist,
+		ProxyFrom:      cfg.SOCKSProxyFrom,
+		TLS:            cfg.SOCKSTLS,
+		Stats:          refusals,
+		Egress:         startEgressPool(ctx, cfg.egressOptions()),
+		Blocklist:      bl,
+	}
 	var stopSocks func() error
 	if socksListen != "" {
-		if s, err := StartSocks5(ctx, socksListen, tunIfName, debugOn || isDebugEnabled(), allowDomains, excludeDomains, splitCSV(cfg.DNSList)); err != nil {
+		if s, err := startSocks(ctx, socksOpts); err != nil {
 			logWarn("failed to start socks at %s: %v\n", socksListen, err)
 		} else {
 			stopSocks = s
 			logInfo("SOCKS5 listening at %s (bound to %s)\n", socksListen, tunIfName)
 		}
 	}
+	// Extra listeners from the config file, each with its own exit location
+	stopListeners, err := startListeners(ctx, cfg.Listeners, socksOpts)
+	if err != nil {
+		logWarn("failed to start SOCKS listeners: %v\n", err)
+		stopListeners = func() {}
+	}
+	// Optional transparent proxy for LAN devices whose traffic is redirected to it
+	var stopTransparent func() error
+	if cfg.Transparent != "" {
+		topts := socksOpts
+		topts.ListenAddr = cfg.Transparent
+		topts.ProxyFrom = nil // redirected traffic carries no PROXY header
+		if s, err := startTransparent(ctx, transparentOptions{
+			ListenAddr: cfg.Transparent,
+			Mode:       cfg.TransparentMode,
+			InstallNft: cfg.TransparentNft,
+			TunName:    tunIfName,
+			Socks:      topts,
+		}); err != nil {
+			logWarn("failed to start transparent proxy at %s: %v\n", cfg.Transparent, err)
+		} else {
+			stopTransparent = s
+			logInfo("transparent proxy (%s) listening at %s (bound to %s)\n", cfg.TransparentMode, cfg.Transparent, tunIfName)
+		}
+	}
+
+	// Optional Shadowsocks server for clients that cannot speak SOCKS5
+	var stopShadowsocks func() error
+	if cfg.Shadowsocks != "" {
+		if s, err := startShadowsocks(ctx, cfg.shadowsocksOptions(socksOpts)); err != nil {
+			logWarn("failed to start shadowsocks at %s: %v\n", cfg.Shadowsocks, err)
+		} else {
+			stopShadowsocks = s
+			logInfo("Shadowsocks (%s) listening at %s (bound to %s)\n", cfg.ShadowsocksMethod, cfg.Shadowsocks, tunIfName)
+		}
+	}
+
+	// Optional local DNS forwarder; lookups leave through the VPN interface
+	var dnsSrv *dnsServer
+	if cfg.DNSListen != "" {
+		if s, err := startDNSServer(ctx, dnsServerOptions{
+			ListenAddr: cfg.DNSListen,
+			Upstreams:  splitCSV(cfg.DNSList),
+			Split:      cfg.DNSSplit,
+			Hosts:      cfg.DNSHosts,
+			BindIf:     tunIfName,
+			EnableIPv6: cfg.EnableIPv6,
+			Blocklist:  bl,
+		}); err != nil {
+			logWarn("failed to start DNS forwarder at %s: %v\n", cfg.DNSListen, err)
+		} else {
+			dnsSrv = s
+			logInfo("DNS forwarder listening at %s (bound to %s)\n", s.Addr(), tunIfName)
+		}
+	}
 
 	if isInfoEnabled() {
 		fmt.Println("VPN dataplane running; press Ctrl-C to exit.")
@@ -274,10 +395,26 @@ func vpnRunCore(
 	// Wait for termination via context cancellation
 	<-ctx.Done()
 
-	// Cleanup order: stop socks, then OS-specific cleanup
+	// Cleanup order: stop socks and DNS, close the provider clients, then OS-specific cleanup
 	if stopSocks != nil {
 		_ = stopSocks()
 	}
+	stopListeners()
+	if stopTransparent != nil {
+		_ = stopTransparent()
+	}
+	if stopShadowsocks != nil {
+		_ = stopShadowsocks()
+	}
+	if dnsSrv != nil {
+		_ = dnsSrv.Close()
+	}
+	mc.Close()
+	for i, c := range routeMCs {
+		if c != nil && routeShare[i] == i {
+			c.Close()
+		}
+	}
 	if onBeforeExit != nil {
 		onBeforeExit()
 	}
@@ -331,6 +468,9 @@ func logStartupConfig(cfg VPNConfig) {
 	if strings.TrimSpace(cfg.ExtraRoutes) != "" {
 		configItems = append(configItems, fmt.Sprintf("route=%s", strings.TrimSpace(cfg.ExtraRoutes)))
 	}
+	if len(cfg.RouteLocations) > 0 {
+		configItems = append(configItems, fmt.Sprintf("route_locations=%d", len(cfg.RouteLocations)))
+	}
 	if strings.TrimSpace(cfg.ExcludeRoutes) != "" {
 		configItems = append(configItems, fmt.Sprintf("exclude_route=%s", strings.TrimSpace(cfg.ExcludeRoutes)))
 	}
@@ -346,6 +486,12 @@ func logStartupConfig(cfg VPNConfig) {
 	if cfg.SOCKSListen != "" {
 		configItems = append(configItems, fmt.Sprintf("socks=%s", cfg.SOCKSListen))
 	}
+	if cfg.Transparent != "" {
+		configItems = append(configItems, fmt.Sprintf("transparent=%s (%s)", cfg.Transparent, cfg.TransparentMode))
+	}
+	if cfg.Shadowsocks != "" {
+		configItems = append(configItems, fmt.Sprintf("shadowsocks=%s (%s)", cfg.Shadowsocks, cfg.ShadowsocksMethod))
+	}
 	if len(cfg.AllowDomains) > 0 {
 		configItems = append(configItems, fmt.Sprintf("domain=%s", strings.Join(cfg.AllowDomains, ",")))
 	}
@@ -29,15 +29,49 @@ func cmdVpn(ctx context.Context, cfg VPNConfig) error {
 
 	// If TUN is disabled or not specified (and not a missing-arg case), run SOCKS-only.
 	if isTUNDisabled(tunName) || (rawTun == "" && !tunLikelyMissingArg) {
-		if cfg.SOCKSListen == "" {
-			logError("--tun=none specified but no --socks provided; nothing to do\n")
+		if cfg.SOCKSListen == "" && len(cfg.Listeners) == 0 && cfg.Shadowsocks == "" {
+			logError("--tun=none specified but no --socks, --shadowsocks or listeners provided; nothing to do\n")
 			return nil
 		}
-		stopSocks, err := StartSocks5(ctx, cfg.SOCKSListen, "", cfg.Debug, cfg.AllowDomains, cfg.ExcludeDomains, splitCSV(cfg.DNSList))
+		opts := socksOptions{
+			ListenAddr:     cfg.SOCKSListen,
+			Debug:          cfg.Debug,
+			AllowDomains:   cfg.AllowDomains,
+			ExcludeDomains: cfg.ExcludeDomains,
+			DNSServers:     splitCSV(cfg.DNSList),
+			DNSHosts:       cfg.DNSHosts,
+			Rules:          cfg.Rules,
+			Sniff:          cfg.Sniff,
+			SniffTimeout:   cfg.SniffTimeout,
+			EnableIPv6:     cfg.EnableIPv6,
+			Limits:         cfg.SOCKSLimits,
+			Auth:           cfg.SOCKSAuth,
+			Shaper:         newShaper(cfg.Bandwidth),
+			AllowSrc:       cfg.SOCKSAllowlist,
+			ProxyFrom:      cfg.SOCKSProxyFrom,
+			TLS:            cfg.SOCKSTLS,
+			Egress:         startEgressPool(ctx, cfg.egressOptions()),
+			Blocklist:      startBlocklist(ctx, cfg.blocklistOptions()),
+		}
+		if cfg.SOCKSListen != "" {
+			stopSocks, err := startSocks(ctx, opts)
+			if err != nil {
+				return fmt.Errorf("start socks failed: %w", err)
+			}
+			defer func() { _ = stopSocks() }()
+		}
+		stopListeners, err := startListeners(ctx, cfg.Listeners, opts)
 		if err != nil {
 			return fmt.Errorf("start socks failed: %w", err)
 		}
-		defer func() { _ = stopSocks() }()
+		defer stopListeners()
+		if cfg.Shadowsocks != "" {
+			stopShadowsocks, err := startShadowsocks(ctx, cfg.shadowsocksOptions(opts))
+			if err != nil {
+				return fmt.Errorf("start shadowsocks failed: %w", err)
+			}
+			defer func() { _ = stopShadowsocks() }()
+		}
 		logInfo("SOCKS started without TUN (system routes only). Press Ctrl+C to exit.\n")
 		<-ctx.Done()
 		return nil
@@ -77,7 +111,7 @@ func cmdVpn(ctx context.Context, cfg VPNConfig) error {
 	// Use a ULA (Unique Local Address) prefix with the same /120 subnet as IPv4.
 	_ = runSudo("ifconfig", actualName, "inet6", "fd00::2/120")
 
-	if cfg.SOCKSListen != "" && !cfg.DefaultRoute && cfg.ExtraRoutes == "" && cfg.ExcludeRoutes == "" {
+	if cfg.SOCKSListen != "" && !cfg.DefaultRoute && len(cfg.extraRoutes()) == 0 && cfg.ExcludeRoutes == "" {
 		logInfo("SOCKS mode without route changes: only SOCKS traffic will use the VPN.\n")
 	}
 
@@ -106,28 +140,28 @@ func cmdVpn(ctx context.Context, cfg VPNConfig) error {
 			rm.AddExclude(r)
 		}
 	} else if cfg.SOCKSListen != "" {
-		if cfg.ExtraRoutes == "" && cfg.ExcludeRoutes == "" {
+		if len(cfg.extraRoutes()) == 0 && cfg.ExcludeRoutes == "" {
 			rm.AddScopedDefault()
 		}
 		for _, r := range splitCSV(cfg.ExcludeRoutes) {
 			rm.AddScopedExclude(r)
 		}
 	}
-	for _, r := range splitCSV(cfg.ExtraRoutes) {
+	for _, r := range cfg.extraRoutes() {
 		rm.AddExtraRoute(r)
 	}
 
 	// DNS configuration.
 	if cfg.DNSList != "" {
 		if cfg.DNSService != "" {
-			if err := rm.SetDNS(splitCSV(cfg.DNSList), cfg.DNSService); err != nil {
+			if err := rm.SetDNS(plainDNSServers(splitCSV(cfg.DNSList)), cfg.DNSService); err != nil {
 				logWarn("failed to set DNS via networksetup for %s: %v\n", cfg.DNSService, err)
 			}
 		} else {
 			logWarn("--dns provided without --dns_service; skipping DNS change on macOS\n")
 		}
 		bypass := cfg.DefaultRoute && (cfg.DNSBootstrap == "bypass" || cfg.DNSBootstrap == "cache")
-		rm.AddDNSServerRoutes(splitCSV(cfg.DNSList), bypass)
+		rm.AddDNSServerRoutes(dnsServerIPs(splitCSV(cfg.DNSList)), bypass)
 	} else if cfg.DefaultRoute && defGw != "" && (cfg.DNSBootstrap == "bypass" || cfg.DNSBootstrap == "cache") {
 		// No --dns: bypass current system resolvers so DNS works during default-route switch.
 		if resolvers, err := getSystemDNSResolvers(); err == nil {
@@ -140,7 +174,7 @@ func cmdVpn(ctx context.Context, cfg VPNConfig) error {
 		}
 	}
 	if !cfg.DefaultRoute && cfg.DNSList != "" {
-		rm.AddDNSServerRoutes(splitCSV(cfg.DNSList), false)
+		rm.AddDNSServerRoutes(dnsServerIPs(splitCSV(cfg.DNSList)), false)
 	}
 
 	// DNS cache bootstrap: remove DNS bypass once the tunnel has traffic.
@@ -26,15 +26,49 @@ func cmdVpn(ctx context.Context, cfg VPNConfig) error {
 
 	// TUN-less mode: SOCKS-only when TUN is disabled or not specified.
 	if isTUNDisabled(tunName) || (rawTun == "" && !tunLikelyMissingArg) {
-		if cfg.SOCKSListen == "" {
-			logError("--tun=none specified but no --socks provided; nothing to do\n")
+		if cfg.SOCKSListen == "" && len(cfg.Listeners) == 0 && cfg.Shadowsocks == "" {
+			logError("--tun=none specified but no --socks, --shadowsocks or listeners provided; nothing to do\n")
 			return nil
 		}
-		stopSocks, err := StartSocks5(ctx, cfg.SOCKSListen, "", cfg.Debug, cfg.AllowDomains, cfg.ExcludeDomains, splitCSV(cfg.DNSList))
+		opts := socksOptions{
+			ListenAddr:     cfg.SOCKSListen,
+			Debug:          cfg.Debug,
+			AllowDomains:   cfg.AllowDomains,
+			ExcludeDomains: cfg.ExcludeDomains,
+			DNSServers:     splitCSV(cfg.DNSList),
+			DNSHosts:       cfg.DNSHosts,
+			Rules:          cfg.Rules,
+			Sniff:          cfg.Sniff,
+			SniffTimeout:   cfg.SniffTimeout,
+			EnableIPv6:     cfg.EnableIPv6,
+			Limits:         cfg.SOCKSLimits,
+			Auth:           cfg.SOCKSAuth,
+			Shaper:         newShaper(cfg.Bandwidth),
+			AllowSrc:       cfg.SOCKSAllowlist,
+			ProxyFrom:      cfg.SOCKSProxyFrom,
+			TLS:            cfg.SOCKSTLS,
+			Egress:         startEgressPool(ctx, cfg.egressOptions()),
+			Blocklist:      startBlocklist(ctx, cfg.blocklistOptions()),
+		}
+		if cfg.SOCKSListen != "" {
+			stopSocks, err := startSocks(ctx, opts)
+			if err != nil {
+				return fmt.Errorf("start socks failed: %w", err)
+			}
+			defer func() { _ = stopSocks() }()
+		}
+		stopListeners, err := startListeners(ctx, cfg.Listeners, opts)
 		if err != nil {
 			return fmt.Errorf("start socks failed: %w", err)
 		}
-		defer func() { _ = stopSocks() }()
+		defer stopListeners()
+		if cfg.Shadowsocks != "" {
+			stopShadowsocks, err := startShadowsocks(ctx, cfg.shadowsocksOptions(opts))
+			if err != nil {
+				return fmt.Errorf("start shadowsocks failed: %w", err)
+			}
+			defer func() { _ = stopShadowsocks() }()
+		}
 		logInfo("SOCKS started without TUN (system routes only). Press Ctrl+C to exit.\n")
 		<-ctx.Done()
 		return nil
@@ -95,11 +129,11 @@ func cmdVpn(ctx context.Context, cfg VPNConfig) error {
 			rm.AddExclude(r)
 		}
 	}
-	for _, r := range splitCSV(cfg.ExtraRoutes) {
+	for _, r := range cfg.extraRoutes() {
 		rm.AddExtraRoute(r)
 	}
 	if !cfg.DefaultRoute && cfg.DNSList != "" {
-		rm.AddDNSServerRoutes(splitCSV(cfg.DNSList), false)
+		rm.AddDNSServerRoutes(dnsServerIPs(splitCSV(cfg.DNSList)), false)
 	}
 
 	// Run shared dataplane + SOCKS + stats.